@@ -6,15 +6,20 @@ import (
 	"context"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/LuisEduardoPedra/analiseSped/internal/api/handlers"
 	"github.com/LuisEduardoPedra/analiseSped/internal/api/middleware"
-	"github.com/LuisEduardoPedra/analiseSped/internal/api/responses"
+	"github.com/LuisEduardoPedra/analiseSped/internal/audit"
 	"github.com/LuisEduardoPedra/analiseSped/internal/core/analysis"
 	"github.com/LuisEduardoPedra/analiseSped/internal/core/auth"
 	"github.com/LuisEduardoPedra/analiseSped/internal/core/converter"
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
+	"github.com/LuisEduardoPedra/analiseSped/internal/stats"
+	"github.com/LuisEduardoPedra/analiseSped/internal/workers"
 	"github.com/gin-gonic/gin"
 )
 
@@ -23,23 +28,47 @@ func initFirestoreClient(ctx context.Context) *firestore.Client {
 	databaseID := "analise-sped-db"
 	client, err := firestore.NewClientWithDatabase(ctx, projectID, databaseID)
 	if err != nil {
-		log.Fatalf("Erro ao inicializar cliente Firestore para o banco '%s': %v\n", databaseID, err)
+		logging.Fatalf("Erro ao inicializar cliente Firestore para o banco '%s': %v", databaseID, err)
 	}
-	log.Printf("Conectado com sucesso ao Firestore, banco de dados: %s", databaseID)
+	logging.Infof("Conectado com sucesso ao Firestore, banco de dados: %s", databaseID)
 	return client
 }
 
-func loadEnv() {
-	file, err := os.Open(".env")
+// warmupConverter prepara o conversor antes da primeira requisição. Se CONVERTER_WARMUP_CONTAS
+// apontar para um plano de contas, os índices fuzzy dele já ficam prontos. Falhas só geram aviso.
+func warmupConverter(svc converter.Service) {
+	path := os.Getenv("CONVERTER_WARMUP_CONTAS")
+	if path == "" {
+		if err := svc.Warmup(nil); err != nil {
+			logging.Warnf("Falha no warmup do conversor: %v", err)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
 	if err != nil {
+		logging.Warnf("Não foi possível abrir o plano de contas do warmup (%s): %v", path, err)
+		return
+	}
+	defer f.Close()
 
+	start := time.Now()
+	if err := svc.Warmup(f); err != nil {
+		logging.Warnf("Falha no warmup do conversor: %v", err)
+		return
+	}
+	logging.Infof("Warmup do conversor concluído em %s", time.Since(start))
+}
+
+// loadEnv carrega variáveis do arquivo .env sem sobrescrever as já existentes.
+// Retorna se o arquivo foi carregado, pois o logger só é configurado depois.
+func loadEnv() (bool, error) {
+	file, err := os.Open(".env")
+	if err != nil {
 		if os.IsNotExist(err) {
-			log.Print("Arquivo .env não encontrado, prosseguindo com variáveis de ambiente existentes")
-		} else {
-			log.Printf("Erro ao carregar .env: %v", err)
+			return false, nil
 		}
-
-		return
+		return false, err
 	}
 	defer file.Close()
 
@@ -61,35 +90,71 @@ func loadEnv() {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Printf("Erro ao ler .env: %v", err)
-	} else {
-		log.Print("Variáveis de ambiente carregadas de .env")
+		return false, err
 	}
+	return true, nil
 }
 
 func main() {
-	loadEnv()
+	envLoaded, envErr := loadEnv()
+
+	if err := logging.Init(logging.ConfigFromEnv()); err != nil {
+		log.Fatalf("Configuração de log inválida: %v", err)
+	}
+
+	switch {
+	case envErr != nil:
+		logging.Errorf("Erro ao carregar .env: %v", envErr)
+	case envLoaded:
+		logging.Infof("Variáveis de ambiente carregadas de .env")
+	default:
+		logging.Infof("Arquivo .env não encontrado, prosseguindo com variáveis de ambiente existentes")
+	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
-
-		log.Fatal("FATAL: Variável de ambiente JWT_SECRET não está configurada.")
+		logging.Fatalf("FATAL: Variável de ambiente JWT_SECRET não está configurada.")
 	}
 
-	responses.InitLogger()
 	ctx := context.Background()
 	firestoreClient := initFirestoreClient(ctx)
 	defer firestoreClient.Close()
 
-	analysisService := analysis.NewService()
+	poolSize, err := workers.SizeFromEnv()
+	if err != nil {
+		logging.Fatalf("FATAL: %v", err)
+	}
+	logging.Infof("Pool de workers com %d goroutines", poolSize)
+
+	analysisService := analysis.NewServiceWithWorkers(poolSize)
 
 	authService := auth.NewService(firestoreClient, []byte(jwtSecret))
 
-	converterService := converter.NewService()
+	converterService := converter.NewServiceWithWorkers(poolSize)
+	warmupConverter(converterService)
+	if v, err := strconv.ParseBool(os.Getenv("CONVERTER_FUZZY_PREFILTRO")); err == nil && v {
+		converter.SetPreFiltroFuzzy(true)
+		logging.Infof("Pré-filtro do matcher fuzzy ativado")
+	}
+	if simbolos := strings.TrimSpace(os.Getenv("CONVERTER_SIMBOLOS_MOEDA")); simbolos != "" {
+		converter.SetSimbolosMoeda(strings.Split(simbolos, ","))
+		logging.Infof("Símbolos de moeda removidos dos valores: %s", simbolos)
+	}
+	if v := strings.TrimSpace(os.Getenv("CONVERTER_MAX_LINHAS_SAIDA")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			logging.Fatalf("FATAL: CONVERTER_MAX_LINHAS_SAIDA inválido: %q", v)
+		}
+		converter.SetMaxLinhasSaida(n)
+		logging.Infof("Limite de linhas de saída das conversões Atolini: %d", n)
+	}
 
-	analysisHandler := handlers.NewAnalysisHandler(analysisService)
+	counters := stats.New()
+	analysisHandler := handlers.NewAnalysisHandler(analysisService, counters)
 	authHandler := handlers.NewAuthHandler(authService)
-	converterHandler := handlers.NewConverterHandler(converterService)
+	auditStore := audit.NewFirestoreStore(firestoreClient)
+	converterHandler := handlers.NewConverterHandler(converterService, counters, auditStore)
+	historyHandler := handlers.NewHistoryHandler(auditStore)
 
 	allowedOriginsEnv := os.Getenv("ALLOWED_ORIGINS")
 	if allowedOriginsEnv == "" {
@@ -122,6 +187,7 @@ func main() {
 		c.Writer.Header().Set("Vary", "Origin")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Conversion-Warnings, X-Conversion-Report, X-Conversion-Alerts")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -140,29 +206,46 @@ func main() {
 		{
 			// Rotas de Análise
 			protected.POST("/analyze/icms", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleAnalysisIcms)
+			protected.POST("/analyze/icms/rerun", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleReanalyzeIcms)
+			protected.POST("/analyze/icms/async", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleAnalysisIcmsAsync)
+			protected.POST("/analyze/icms/stream", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleAnalysisIcmsStream)
+			protected.GET("/analyze/jobs/:id", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleAnalysisJob)
+			protected.POST("/analyze/icms/sped-draft", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleSpedDraftIcms)
+			protected.POST("/analyze/icms/sped-chave", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleSpedChave)
 			protected.POST("/analyze/ipi-st", middleware.PermissionMiddleware("analise-ipi-st"), analysisHandler.HandleAnalysisIpiSt)
+			protected.POST("/analyze/validate-xml", middleware.PermissionMiddleware("analise-icms"), analysisHandler.HandleValidateXML)
 
 			// Rotas de Conversão
 			protected.POST("/convert/francesinha", middleware.PermissionMiddleware("converter-francesinha"), converterHandler.HandleSicrediConversion)
+			protected.POST("/convert/cnab240", middleware.PermissionMiddleware("converter-francesinha"), converterHandler.HandleCNAB240Conversion)
 			protected.POST("/convert/receitas-acisa", middleware.PermissionMiddleware("converter-receitas-acisa"), converterHandler.HandleReceitasAcisaConversion)
 			protected.POST("/convert/atolini-pagamentos", middleware.PermissionMiddleware("converter-atolini-pagamentos"), converterHandler.HandleAtoliniPagamentosConversion)
 			protected.POST("/convert/atolini-recebimentos", middleware.PermissionMiddleware("converter-atolini-recebimentos"), converterHandler.HandleAtoliniRecebimentosConversion)
+			protected.POST("/convert/conciliacao-titulos", middleware.PermissionMiddleware("converter-francesinha"), converterHandler.HandleConciliacaoTitulos)
+			protected.POST("/convert/peek", converterHandler.HandlePeek)
+			protected.POST("/convert/explain-match", converterHandler.HandleExplainMatch)
+
+			// Histórico do usuário autenticado
+			protected.GET("/history", historyHandler.HandleHistory)
 		}
 	}
 
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "UP"})
 	})
+	router.GET("/stats", func(c *gin.Context) {
+		c.JSON(200, counters.Snapshot())
+	})
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("🚀 Servidor iniciado e escutando na porta %s", port)
+	logging.Infof("🚀 Servidor iniciado e escutando na porta %s", port)
 
 	if err := router.Run(":" + port); err != nil {
-		log.Fatal("Falha ao iniciar o servidor: ", err)
+		logging.Fatalf("Falha ao iniciar o servidor: %v", err)
 	}
 }
 
@@ -2,24 +2,62 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/LuisEduardoPedra/analiseSped/internal/api/responses"
 	"github.com/LuisEduardoPedra/analiseSped/internal/core/analysis"
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
+	"github.com/LuisEduardoPedra/analiseSped/internal/stats"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	// icmsSessionTTL and maxICMSSessions bound the parsed ICMS analyses kept for re-runs.
+	icmsSessionTTL  = 30 * time.Minute
+	maxICMSSessions = 100
+
+	// avisoNenhumaNotaNoSPED acompanha uma análise em que nenhum XML foi localizado no SPED.
+	avisoNenhumaNotaNoSPED = "Nenhuma das notas foi localizada no SPED — verifique se os arquivos correspondem ao mesmo período/empresa"
+
+	// maxTotalXMLZip limita o total descompactado dos XMLs extraídos do xmlZip.
+	maxTotalXMLZip = 500 << 20
+
+	// icmsJobTTL and maxICMSJobs bound the background analyses kept for polling.
+	icmsJobTTL  = 30 * time.Minute
+	maxICMSJobs = 20
+)
+
 // AnalysisHandler handles analysis-related API requests.
 type AnalysisHandler struct {
-	service analysis.Service
+	service  analysis.Service
+	stats    stats.Counters
+	sessions *analysis.ICMSStore
+	jobs     *analysis.JobStore
 }
 
 // NewAnalysisHandler creates a new analysis handler.
-func NewAnalysisHandler(service analysis.Service) *AnalysisHandler {
+func NewAnalysisHandler(service analysis.Service, counters stats.Counters) *AnalysisHandler {
 	return &AnalysisHandler{
-		service: service,
+		service:  service,
+		stats:    counters,
+		sessions: analysis.NewICMSStore(icmsSessionTTL, maxICMSSessions),
+		jobs:     analysis.NewJobStore(icmsJobTTL, maxICMSJobs),
 	}
 }
 
@@ -37,43 +75,277 @@ func (h *AnalysisHandler) HandleAnalysisIcms(c *gin.Context) {
 	}
 	defer spedFile.Close()
 
-	form, _ := c.MultipartForm()
-	xmlFileHeaders := form.File["xmlFiles"]
-	if len(xmlFileHeaders) == 0 {
-		responses.Error(c, http.StatusBadRequest, "Nenhum arquivo XML foi enviado")
+	fontes, ok := fontesXMLEnviadas(c)
+	if !ok {
+		return
+	}
+	xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
 		return
 	}
+	defer fecharXMLs()
 
-	var xmlReaders []io.Reader
-	for _, header := range xmlFileHeaders {
-		file, err := header.Open()
+	opts, ok := opcoesICMS(c)
+	if !ok {
+		return
+	}
+
+	parsed, err := h.service.ParseICMSFiles(spedFile, xmlReaders)
+	if err != nil {
+		responses.Error(c, analysisErrorStatus(err), "Erro na análise de ICMS", err.Error())
+		return
+	}
+	resultados := h.service.ReanalyzeICMS(parsed, opts)
+	if parsed.NoneInSPED() {
+		responses.Warn(c, avisoNenhumaNotaNoSPED)
+	}
+
+	h.recordAnalysis(resultados)
+	h.checkCNPJ(c, spedFileHeader, fontes)
+	if token, err := h.sessions.Put(parsed); err == nil {
+		responses.AddSummary(c, "analysis_token", token)
+	} else {
+		logging.Warnf("Não foi possível guardar a análise de ICMS para reprocessamento: %v", err)
+	}
+	respondAnalysis(c, resultados, "Análise de ICMS concluída com sucesso")
+}
+
+// HandleReanalyzeIcms re-runs a stored ICMS analysis with a new CFOP ignore list, without
+// uploading or parsing the files again. The token comes from the summary of /analyze/icms.
+func (h *AnalysisHandler) HandleReanalyzeIcms(c *gin.Context) {
+	token := strings.TrimSpace(c.PostForm("token"))
+	if token == "" {
+		responses.Error(c, http.StatusBadRequest, "Token da análise não informado")
+		return
+	}
+	parsed, ok := h.sessions.Get(token)
+	if !ok {
+		responses.Error(c, http.StatusNotFound, "Análise não encontrada ou expirada; envie os arquivos novamente")
+		return
+	}
+
+	opts, ok := opcoesICMS(c)
+	if !ok {
+		return
+	}
+
+	resultados := h.service.ReanalyzeICMS(parsed, opts)
+	if parsed.NoneInSPED() {
+		responses.Warn(c, avisoNenhumaNotaNoSPED)
+	}
+	h.recordAnalysis(resultados)
+	responses.AddSummary(c, "analysis_token", token)
+	respondAnalysis(c, resultados, "Análise de ICMS refeita com sucesso")
+}
+
+// HandleAnalysisIcmsAsync starts an ICMS analysis in the background and answers right away with
+// the job id, to be polled at /analyze/jobs/:id. Meant for uploads with thousands of XMLs, whose
+// analysis would exceed the HTTP timeout; it takes the same fields as /analyze/icms.
+func (h *AnalysisHandler) HandleAnalysisIcmsAsync(c *gin.Context) {
+	spedFileHeader, err := c.FormFile("spedFile")
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Arquivo SPED não encontrado ou inválido")
+		return
+	}
+	fontes, ok := fontesXMLEnviadas(c)
+	if !ok {
+		return
+	}
+	opts, ok := opcoesICMS(c)
+	if !ok {
+		return
+	}
+
+	// os arquivos temporários do upload somem ao fim da requisição: o job usa cópias em memória
+	spedData, err := lerArquivoEnviado(spedFileHeader)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo SPED")
+		return
+	}
+	fontes, err = carregarFontesXML(fontes)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
+		return
+	}
+
+	jobID, err := h.jobs.Submit(func() ([]domain.AnalysisResult, error) {
+		xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
 		if err != nil {
-			responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
-			return
+			return nil, err
 		}
-		defer file.Close()
-		xmlReaders = append(xmlReaders, file)
+		defer fecharXMLs()
+		resultados, err := h.service.AnalyzeICMSFiles(bytes.NewReader(spedData), xmlReaders, opts)
+		if err != nil {
+			return nil, err
+		}
+		h.recordAnalysis(resultados)
+		return resultados, nil
+	})
+	if errors.Is(err, analysis.ErrJobsEsgotados) {
+		responses.Error(c, http.StatusServiceUnavailable, "Muitas análises em andamento; tente novamente em instantes")
+		return
+	}
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível iniciar a análise", err.Error())
+		return
 	}
+	responses.Success(c, gin.H{"job_id": jobID, "status": analysis.JobPendente}, "Análise de ICMS iniciada")
+}
 
-	cfopsStr := c.PostForm("cfopsIgnorados")
-	var cfopsIgnorados []string
-	if cfopsStr != "" {
-		parts := strings.Split(cfopsStr, ",")
-		for _, part := range parts {
-			trimmed := strings.TrimSpace(part)
-			if trimmed != "" {
-				cfopsIgnorados = append(cfopsIgnorados, trimmed)
-			}
-		}
+// HandleAnalysisIcmsStream runs an ICMS analysis streaming its progress as Server-Sent Events:
+// "progresso" events ({"processados": n, "total": m}) every analysis.ProgressInterval XMLs, then
+// one "resultado" event with the results (and the analysis token) or an "erro" event. It takes the
+// same fields as /analyze/icms; invalid input is still answered with a plain JSON error.
+func (h *AnalysisHandler) HandleAnalysisIcmsStream(c *gin.Context) {
+	spedFileHeader, err := c.FormFile("spedFile")
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Arquivo SPED não encontrado ou inválido")
+		return
 	}
+	spedFile, err := spedFileHeader.Open()
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo SPED")
+		return
+	}
+	defer spedFile.Close()
 
-	resultados, err := h.service.AnalyzeICMSFiles(spedFile, xmlReaders, cfopsIgnorados)
+	fontes, ok := fontesXMLEnviadas(c)
+	if !ok {
+		return
+	}
+	xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Erro na análise de ICMS", err.Error())
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
 		return
 	}
+	defer fecharXMLs()
+
+	opts, ok := opcoesICMS(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // proxies como o nginx seguram a resposta sem isso
+	enviar := func(evento string, dados interface{}) {
+		c.SSEvent(evento, dados)
+		c.Writer.Flush()
+	}
 
-	responses.Success(c, resultados, "Análise de ICMS concluída com sucesso")
+	parsed, err := h.service.ParseICMSFilesProgress(spedFile, xmlReaders, func(done, total int) {
+		enviar("progresso", gin.H{"processados": done, "total": total})
+	})
+	if err != nil {
+		enviar("erro", gin.H{"message": "Erro na análise de ICMS", "errors": []string{err.Error()}})
+		return
+	}
+	resultados := h.service.ReanalyzeICMS(parsed, opts)
+	h.recordAnalysis(resultados)
+
+	final := gin.H{"data": resultados}
+	if token, err := h.sessions.Put(parsed); err == nil {
+		final["analysis_token"] = token
+	} else {
+		logging.Warnf("Não foi possível guardar a análise de ICMS para reprocessamento: %v", err)
+	}
+	if parsed.NoneInSPED() {
+		final["warnings"] = []string{avisoNenhumaNotaNoSPED}
+	}
+	enviar("resultado", final)
+}
+
+// HandleAnalysisJob reports the status of a background analysis and, once it is done, its
+// results.
+func (h *AnalysisHandler) HandleAnalysisJob(c *gin.Context) {
+	job, ok := h.jobs.Get(c.Param("id"))
+	if !ok {
+		responses.Error(c, http.StatusNotFound, "Análise não encontrada ou expirada")
+		return
+	}
+	responses.Success(c, job, "Status da análise: "+string(job.Status))
+}
+
+// HandleSpedDraftIcms runs the ICMS analysis and returns draft C100/C190 lines for the
+// discrepancies found, as a text file for manual review.
+func (h *AnalysisHandler) HandleSpedDraftIcms(c *gin.Context) {
+	spedFileHeader, err := c.FormFile("spedFile")
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Arquivo SPED não encontrado ou inválido")
+		return
+	}
+	spedFile, err := spedFileHeader.Open()
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo SPED")
+		return
+	}
+	defer spedFile.Close()
+
+	fontes, ok := fontesXMLEnviadas(c)
+	if !ok {
+		return
+	}
+	xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
+		return
+	}
+	defer fecharXMLs()
+
+	opts, ok := opcoesICMS(c)
+	if !ok {
+		return
+	}
+
+	resultados, err := h.service.AnalyzeICMSFiles(spedFile, xmlReaders, opts)
+	if err != nil {
+		responses.Error(c, analysisErrorStatus(err), "Erro na análise de ICMS", err.Error())
+		return
+	}
+	h.recordAnalysis(resultados)
+
+	draft, err := h.service.ExportSpedDraft(resultados)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Erro ao gerar o rascunho do SPED", err.Error())
+		return
+	}
+
+	fileName := fmt.Sprintf("RascunhoSPED_%s.txt", time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, "text/plain; charset=iso-8859-1", draft)
+}
+
+// HandleSpedChave returns how the SPED books a single note (ICMS, CFOPs, flags), one entry per
+// establishment, for debugging a note without exporting the whole analysis.
+func (h *AnalysisHandler) HandleSpedChave(c *gin.Context) {
+	spedFileHeader, err := c.FormFile("spedFile")
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Arquivo SPED não encontrado ou inválido")
+		return
+	}
+	chave := strings.TrimSpace(c.PostForm("chave"))
+	if chave == "" {
+		responses.Error(c, http.StatusBadRequest, "Informe a chave de acesso da nota")
+		return
+	}
+	spedFile, err := spedFileHeader.Open()
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo SPED")
+		return
+	}
+	defer spedFile.Close()
+
+	notas, err := h.service.SpedInfoForChave(spedFile, chave)
+	if err != nil {
+		responses.Error(c, analysisErrorStatus(err), "Erro ao ler o SPED", err.Error())
+		return
+	}
+	if len(notas) == 0 {
+		responses.Error(c, http.StatusNotFound, "Chave não encontrada no SPED")
+		return
+	}
+	responses.Success(c, notas, "Nota localizada no SPED")
 }
 
 // HandleAnalysisIpiSt handles IPI and ST analysis requests.
@@ -90,12 +362,36 @@ func (h *AnalysisHandler) HandleAnalysisIpiSt(c *gin.Context) {
 	}
 	defer spedFile.Close()
 
-	form, _ := c.MultipartForm()
-	xmlFileHeaders := form.File["xmlFiles"]
-	if len(xmlFileHeaders) == 0 {
+	fontes, ok := fontesXMLEnviadas(c)
+	if !ok {
+		return
+	}
+	xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir um dos arquivos XML")
+		return
+	}
+	defer fecharXMLs()
+
+	resultados, err := h.service.AnalyzeIPISTFiles(spedFile, xmlReaders)
+	if err != nil {
+		responses.Error(c, analysisErrorStatus(err), "Erro na análise de IPI e ST", err.Error())
+		return
+	}
+
+	h.recordAnalysis(resultados)
+	h.checkCNPJ(c, spedFileHeader, fontes)
+	respondAnalysis(c, resultados, "Análise de IPI e ST concluída com sucesso")
+}
+
+// HandleValidateXML runs the structural check on uploaded XMLs, without a SPED.
+func (h *AnalysisHandler) HandleValidateXML(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["xmlFiles"]) == 0 {
 		responses.Error(c, http.StatusBadRequest, "Nenhum arquivo XML foi enviado")
 		return
 	}
+	xmlFileHeaders := form.File["xmlFiles"]
 
 	var xmlReaders []io.Reader
 	var closers []io.Closer
@@ -115,11 +411,507 @@ func (h *AnalysisHandler) HandleAnalysisIpiSt(c *gin.Context) {
 		closers = append(closers, file)
 	}
 
-	resultados, err := h.service.AnalyzeIPISTFiles(spedFile, xmlReaders)
+	resultados := h.service.ValidateXMLFiles(xmlReaders)
+	for i := range resultados {
+		resultados[i].FileName = xmlFileHeaders[i].Filename
+	}
+
+	responses.Success(c, resultados, "Validação dos XMLs concluída")
+}
+
+// getCfopsIgnorados merges the cfopsIgnorados form field (comma-separated) with the optional
+// cfopsIgnoradosFile upload (one CFOP per line). Besides exact CFOPs, wildcards ("5.*") and
+// ranges ("5100-5199") are accepted (see analysis.ParseCFOPPatterns); an invalid one is an
+// error. CFOPs are normalized ("5.102" -> "5102") and de-duplicated; tokens without digits,
+// such as a header line, are skipped.
+func getCfopsIgnorados(c *gin.Context) ([]string, error) {
+	raw := c.PostForm("cfopsIgnorados")
+
+	if fileHeader, err := c.FormFile("cfopsIgnoradosFile"); err == nil {
+		file, err := fileHeader.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		raw += "\n" + string(content)
+	}
+
+	cfops := patternTokens(raw)
+	if _, err := analysis.ParseCFOPPatterns(cfops); err != nil {
+		return nil, err
+	}
+	return cfops, nil
+}
+
+// getEmitentesIgnorados reads the emitentesIgnorados form field: issuer CNPJs whose notes are
+// left out of the ICMS analysis, separated like the CFOPs and with or without punctuation.
+func getEmitentesIgnorados(c *gin.Context) []string {
+	return digitTokens(c.PostForm("emitentesIgnorados"))
+}
+
+// getTolerancia reads the tolerancia form field, the largest ICMS difference (e.g. "0,02") not
+// reported as a discrepancy. An absent field means 0, an exact comparison.
+func getTolerancia(c *gin.Context) (float64, error) {
+	raw := strings.TrimSpace(c.PostForm("tolerancia"))
+	if raw == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(strings.Replace(raw, ",", ".", 1), 64)
+	if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("informe um valor não negativo, como 0,02 (recebido %q)", raw)
+	}
+	return v, nil
+}
+
+// getTipoOperacao reads the tipoOperacao form field ("entrada" or "saida", or the IND_OPER codes
+// 0 and 1) that limits the ICMS analysis to one side. An absent field analyzes both.
+func getTipoOperacao(c *gin.Context) (string, error) {
+	raw := strings.TrimSpace(c.PostForm("tipoOperacao"))
+	switch strings.ToLower(raw) {
+	case "":
+		return "", nil
+	case "entrada", "entradas", analysis.OperacaoEntrada:
+		return analysis.OperacaoEntrada, nil
+	case "saida", "saída", "saidas", "saídas", analysis.OperacaoSaida:
+		return analysis.OperacaoSaida, nil
+	}
+	return "", fmt.Errorf("use entrada ou saida (recebido %q)", raw)
+}
+
+// patternTokens is digitTokens keeping also the '*' and '-' of CFOP wildcards and ranges.
+func patternTokens(raw string) []string {
+	return splitTokens(raw, func(r rune) bool { return (r >= '0' && r <= '9') || r == '*' || r == '-' })
+}
+
+// digitTokens splits raw by commas, semicolons, tabs or line breaks and keeps only the digits
+// of each token, dropping empty and repeated values.
+func digitTokens(raw string) []string {
+	return splitTokens(raw, func(r rune) bool { return r >= '0' && r <= '9' })
+}
+
+// splitTokens splits raw like digitTokens and keeps the runes accepted by keep in each token,
+// dropping tokens without digits and repeated values.
+func splitTokens(raw string, keep func(rune) bool) []string {
+	tokens := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n' || r == '\r' || r == '\t'
+	})
+
+	seen := make(map[string]bool)
+	var values []string
+	for _, token := range tokens {
+		value := strings.Map(func(r rune) rune {
+			if keep(r) {
+				return r
+			}
+			return -1
+		}, token)
+		if !strings.ContainsAny(value, "0123456789") || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	return values
+}
+
+// analysisErrorStatus maps analysis failures caused by the uploaded input itself to 400.
+func analysisErrorStatus(err error) int {
+	if errors.Is(err, analysis.ErrNenhumC100) || errors.Is(err, analysis.ErrChaveInvalida) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// checkCNPJ reopens the uploaded files, adds a response warning when the SPED and the XMLs seem
+// to belong to different companies and puts the inferred company in the summary for the user to
+// confirm. Failures here never block the analysis result.
+func (h *AnalysisHandler) checkCNPJ(c *gin.Context, spedFileHeader *multipart.FileHeader, fontes []fonteXML) {
+	spedFile, err := spedFileHeader.Open()
+	if err != nil {
+		return
+	}
+	defer spedFile.Close()
+
+	xmlReaders, fecharXMLs, err := abrirFontesXML(fontes)
+	if err != nil {
+		return
+	}
+	defer fecharXMLs()
+
+	check, err := h.service.CheckCNPJ(spedFile, xmlReaders)
+	if err != nil {
+		return
+	}
+	if check.Warning != "" {
+		responses.Warn(c, check.Warning)
+	}
+	if check.SpedCNPJ != "" || check.InferredCNPJ != "" {
+		responses.AddSummary(c, "cnpj", check)
+	}
+}
+
+// fonteXML é um XML enviado. abrir pode ser chamada mais de uma vez, já que checkCNPJ relê os
+// arquivos depois da análise; nome identifica o arquivo de origem nos resultados.
+type fonteXML struct {
+	nome  string
+	abrir func() (io.ReadCloser, error)
+}
+
+// opcoesICMS lê do formulário as opções de uma análise de ICMS. Responde com 400 e devolve false
+// quando algum parâmetro é inválido.
+func opcoesICMS(c *gin.Context) (analysis.ICMSOptions, bool) {
+	cfopsIgnorados, err := getCfopsIgnorados(c)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "CFOPs ignorados inválidos ou arquivo ilegível", err.Error())
+		return analysis.ICMSOptions{}, false
+	}
+	tolerancia, err := getTolerancia(c)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Tolerância inválida", err.Error())
+		return analysis.ICMSOptions{}, false
+	}
+	operacao, err := getTipoOperacao(c)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Tipo de operação inválido", err.Error())
+		return analysis.ICMSOptions{}, false
+	}
+	return analysis.ICMSOptions{
+		CfopsToIgnore:    cfopsIgnorados,
+		EmittersToIgnore: getEmitentesIgnorados(c),
+		Tolerance:        tolerancia,
+		CompareST:        getBoolFromForm(c, "compararST"),
+		ComparePISCOFINS: getBoolFromForm(c, "compararPisCofins"),
+		CompareTotal:     getBoolFromForm(c, "compararValorTotal"),
+		CompareCST:       getBoolFromForm(c, "compararCst"),
+		IncludeMatched:   getBoolFromForm(c, "incluirConferidas"),
+		AbsoluteReturns:  getBoolFromForm(c, "devolucaoAbsoluta"),
+		AllowedCfops:     digitTokens(c.PostForm("cfopsPermitidos")),
+		Operation:        operacao,
+		DetectMissingXML: getBoolFromForm(c, "detectarFaltantesXml"),
+		Establishment:    c.PostForm("cnpjEstabelecimento"),
+	}, true
+}
+
+// lerArquivoEnviado lê para a memória um arquivo do formulário.
+func lerArquivoEnviado(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// carregarFontesXML lê cada fonte para a memória, para que possa ser aberta depois do fim da
+// requisição.
+func carregarFontesXML(fontes []fonteXML) ([]fonteXML, error) {
+	carregadas := make([]fonteXML, 0, len(fontes))
+	for _, fonte := range fontes {
+		rc, err := fonte.abrir()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		carregadas = append(carregadas, fonteXML{
+			nome:  fonte.nome,
+			abrir: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil },
+		})
+	}
+	return carregadas, nil
+}
+
+// fontesXMLEnviadas reúne os XMLs enviados em xmlFiles e os extraídos do ZIP enviado em xmlZip.
+// Responde com erro e devolve false quando o ZIP é inválido ou nenhum XML foi enviado.
+func fontesXMLEnviadas(c *gin.Context) ([]fonteXML, bool) {
+	var fontes []fonteXML
+	if form, err := c.MultipartForm(); err == nil {
+		for _, header := range form.File["xmlFiles"] {
+			fontes = append(fontes, fonteXML{nome: header.Filename, abrir: func() (io.ReadCloser, error) { return header.Open() }})
+		}
+	}
+	if zipHeader, err := c.FormFile("xmlZip"); err == nil {
+		xmls, err := extrairXMLsZip(zipHeader)
+		if err != nil {
+			responses.Error(c, http.StatusBadRequest, "Não foi possível ler o ZIP de XMLs", err.Error())
+			return nil, false
+		}
+		for _, x := range xmls {
+			fontes = append(fontes, fonteXML{
+				nome:  zipHeader.Filename + "/" + x.nome,
+				abrir: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(x.data)), nil },
+			})
+		}
+	}
+	if len(fontes) == 0 {
+		responses.Error(c, http.StatusBadRequest, "Nenhum arquivo XML foi enviado")
+		return nil, false
+	}
+	return fontes, true
+}
+
+// abrirFontesXML abre todas as fontes, identificadas pelo nome (analysis.WithSourceName); a
+// função devolvida fecha as que foram abertas.
+func abrirFontesXML(fontes []fonteXML) ([]io.Reader, func(), error) {
+	readers := make([]io.Reader, 0, len(fontes))
+	var closers []io.Closer
+	fechar := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	for _, fonte := range fontes {
+		rc, err := fonte.abrir()
+		if err != nil {
+			fechar()
+			return nil, nil, err
+		}
+		readers = append(readers, analysis.WithSourceName(rc, fonte.nome))
+		closers = append(closers, rc)
+	}
+	return readers, fechar, nil
+}
+
+// xmlZip é um XML extraído do xmlZip, com o caminho dentro do ZIP.
+type xmlZip struct {
+	nome string
+	data []byte
+}
+
+// extrairXMLsZip descompacta em memória os XMLs de NF-e do ZIP, em qualquer pasta. Entradas que
+// não são .xml ou não trazem uma NF-e (eventos de cancelamento, por exemplo) são ignoradas, assim
+// como os arquivos ocultos do macOS. Cada entrada respeita maxEntradaZip e o total descompactado,
+// maxTotalXMLZip, para que um ZIP malicioso não esgote a memória.
+func extrairXMLsZip(header *multipart.FileHeader) ([]xmlZip, error) {
+	file, err := header.Open()
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Erro na análise de IPI e ST", err.Error())
+		return nil, fmt.Errorf("não foi possível abrir o ZIP: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		return nil, fmt.Errorf("não foi possível ler o ZIP: %w", err)
+	}
+
+	var xmls []xmlZip
+	total := 0
+	for _, f := range zr.File {
+		nome := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(nome, "._") || strings.Contains(f.Name, "__MACOSX/") ||
+			!strings.EqualFold(path.Ext(nome), ".xml") {
+			continue
+		}
+		if uint64(total)+f.UncompressedSize64 > maxTotalXMLZip {
+			return nil, fmt.Errorf("o ZIP excede o limite de %d MB descompactado", maxTotalXMLZip>>20)
+		}
+		data, err := lerEntradaZip(f)
+		if err != nil {
+			return nil, err
+		}
+		// o tamanho declarado no ZIP pode ser falso: vale o que foi de fato descompactado
+		if total += len(data); total > maxTotalXMLZip {
+			return nil, fmt.Errorf("o ZIP excede o limite de %d MB descompactado", maxTotalXMLZip>>20)
+		}
+		if !bytes.Contains(data, []byte("<infNFe")) {
+			continue
+		}
+		xmls = append(xmls, xmlZip{nome: f.Name, data: data})
+	}
+	if len(xmls) == 0 {
+		return nil, fmt.Errorf("o ZIP não contém XMLs de NF-e")
+	}
+	return xmls, nil
+}
+
+// recordAnalysis counts a finished analysis and the discrepancies it found.
+func (h *AnalysisHandler) recordAnalysis(resultados []domain.AnalysisResult) {
+	h.stats.IncAnalysis()
+	discrepancias := 0
+	for _, r := range resultados {
+		switch r.StatusCode {
+		case domain.StatusDiscrepanciaICMS, domain.StatusDiscrepanciaICMSST, domain.StatusDiscrepanciaPISCOFINS,
+			domain.StatusDiscrepanciaIPIST, domain.StatusDiscrepanciaValorTotal, domain.StatusDiscrepanciaCST:
+			discrepancias++
+		}
+	}
+	h.stats.AddDiscrepancies(discrepancias)
+}
+
+// getPositiveIntParam reads an integer parameter from the form or the query string.
+// It returns def when the parameter is absent.
+func getPositiveIntParam(c *gin.Context, key string, def int) (int, error) {
+	raw := strings.TrimSpace(c.PostForm(key))
+	if raw == "" {
+		raw = strings.TrimSpace(c.Query(key))
+	}
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("parâmetro %s inválido: %s", key, raw)
+	}
+	return v, nil
+}
+
+// GroupedMeta carries the per-status counts of a grouped analysis response.
+type GroupedMeta struct {
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+}
+
+// respondAnalysis sends the analysis results. With format=csv they come as a CSV file (see
+// analysis.ExportCSV); with format=xlsx as a workbook (see analysis.ExportXLSX), or as a ZIP with
+// one workbook per month when porCompetencia=true; with grouped=true they are keyed by status;
+// otherwise they are paginated when page or pageSize is given.
+func respondAnalysis(c *gin.Context, resultados []domain.AnalysisResult, message string) {
+	canceladas := 0
+	for _, r := range resultados {
+		if r.StatusCode == domain.StatusNotaCancelada {
+			canceladas++
+		}
+	}
+	if canceladas > 0 {
+		responses.AddSummary(c, "notas_canceladas", canceladas)
+	}
+
+	switch formatoAnalise(c) {
+	case "csv":
+		csvData, err := analysis.ExportCSV(resultados)
+		if err != nil {
+			responses.Error(c, http.StatusInternalServerError, "Erro ao gerar o CSV da análise", err.Error())
+			return
+		}
+		fileName := fmt.Sprintf("Analise_%s.csv", time.Now().Format("20060102_150405"))
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", csvData)
+		return
+	case "ajustes":
+		contas := analysis.AjusteContas{
+			Debito:  c.PostForm("contaDebitoAjuste"),
+			Credito: c.PostForm("contaCreditoAjuste"),
+		}
+		csvData, err := analysis.ExportAjustes(resultados, contas)
+		if err != nil {
+			responses.Error(c, http.StatusInternalServerError, "Erro ao gerar o CSV de ajustes", err.Error())
+			return
+		}
+		fileName := fmt.Sprintf("Ajustes_ICMS_%s.csv", time.Now().Format("20060102_150405"))
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Data(http.StatusOK, "text/csv; charset=windows-1252", csvData)
+		return
+	case "xlsx":
+		if getBoolFromForm(c, "porCompetencia") || strings.EqualFold(strings.TrimSpace(c.Query("porCompetencia")), "true") {
+			zipped, err := analysis.ExportXLSXByCompetencia(resultados)
+			if err != nil {
+				responses.Error(c, http.StatusInternalServerError, "Erro ao gerar as planilhas por competência", err.Error())
+				return
+			}
+			fileName := fmt.Sprintf("Analise_%s.zip", time.Now().Format("20060102_150405"))
+			c.Header("Content-Disposition", "attachment; filename="+fileName)
+			c.Data(http.StatusOK, "application/zip", zipped)
+			return
+		}
+		xlsx, err := analysis.ExportXLSX(resultados)
+		if err != nil {
+			responses.Error(c, http.StatusInternalServerError, "Erro ao gerar a planilha da análise", err.Error())
+			return
+		}
+		fileName := fmt.Sprintf("Analise_%s.xlsx", time.Now().Format("20060102_150405"))
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", xlsx)
+		return
+	}
+
+	if getBoolFromForm(c, "grouped") || strings.EqualFold(strings.TrimSpace(c.Query("grouped")), "true") {
+		groups, meta := groupResultsByStatus(resultados)
+		responses.SuccessWithMeta(c, groups, meta, message)
+		return
+	}
+
+	if c.PostForm("page") == "" && c.Query("page") == "" && c.PostForm("pageSize") == "" && c.Query("pageSize") == "" {
+		responses.Success(c, resultados, message)
 		return
 	}
 
-	responses.Success(c, resultados, "Análise de IPI e ST concluída com sucesso")
+	page, err := getPositiveIntParam(c, "page", 1)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageSize, err := getPositiveIntParam(c, "pageSize", defaultPageSize)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	pageItems, meta := paginateResults(resultados, page, pageSize)
+	responses.SuccessWithMeta(c, pageItems, meta, message)
+}
+
+// formatoAnalise reads the file format of the analysis response from format or its alias formato,
+// as a form or query value, in lower case. Empty means the default JSON response.
+func formatoAnalise(c *gin.Context) string {
+	for _, key := range []string{"format", "formato"} {
+		v := strings.TrimSpace(c.PostForm(key))
+		if v == "" {
+			v = strings.TrimSpace(c.Query(key))
+		}
+		if v != "" {
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// paginateResults sorts the results by NFe key (stable, so pages never overlap) and
+// returns the requested page. Pages past the end come back empty.
+func paginateResults(resultados []domain.AnalysisResult, page, pageSize int) ([]domain.AnalysisResult, responses.Pagination) {
+	sorted := make([]domain.AnalysisResult, len(resultados))
+	copy(sorted, resultados)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].NFeKey < sorted[j].NFeKey
+	})
+
+	total := len(sorted)
+	meta := responses.Pagination{
+		Page:       page,
+		PageSize:   pageSize,
+		Total:      total,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}
+
+	start := (page - 1) * pageSize
+	if start >= total {
+		return []domain.AnalysisResult{}, meta
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return sorted[start:end], meta
+}
+
+// groupResultsByStatus groups the results by readable status, keeping their original order
+// inside each group.
+func groupResultsByStatus(resultados []domain.AnalysisResult) (map[string][]domain.AnalysisResult, GroupedMeta) {
+	groups := make(map[string][]domain.AnalysisResult)
+	meta := GroupedMeta{Total: len(resultados), Counts: make(map[string]int)}
+	for _, r := range resultados {
+		key := r.StatusCode.String()
+		groups[key] = append(groups[key], r)
+		meta.Counts[key]++
+	}
+	return groups, meta
 }
@@ -0,0 +1,759 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/core/analysis"
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/LuisEduardoPedra/analiseSped/internal/stats"
+	"github.com/gin-gonic/gin"
+)
+
+// TestPaginateResults verifica os limites das páginas e o total informado.
+func TestPaginateResults(t *testing.T) {
+	var resultados []domain.AnalysisResult
+	for i := 25; i > 0; i-- {
+		resultados = append(resultados, domain.AnalysisResult{NFeKey: fmt.Sprintf("%044d", i)})
+	}
+
+	seen := make(map[string]bool)
+	for page := 1; page <= 3; page++ {
+		items, meta := paginateResults(resultados, page, 10)
+		if meta.Total != 25 || meta.TotalPages != 3 || meta.Page != page {
+			t.Fatalf("Metadados inesperados na página %d: %+v", page, meta)
+		}
+		expected := 10
+		if page == 3 {
+			expected = 5
+		}
+		if len(items) != expected {
+			t.Fatalf("Página %d: esperava %d itens, obteve %d", page, expected, len(items))
+		}
+		for _, it := range items {
+			if seen[it.NFeKey] {
+				t.Errorf("Chave %s repetida entre páginas", it.NFeKey)
+			}
+			seen[it.NFeKey] = true
+		}
+		if page == 1 && items[0].NFeKey != fmt.Sprintf("%044d", 1) {
+			t.Errorf("Primeira página deveria começar pela menor chave, obteve %s", items[0].NFeKey)
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Esperava cobrir 25 resultados, cobriu %d", len(seen))
+	}
+
+	items, meta := paginateResults(resultados, 4, 10)
+	if len(items) != 0 || meta.Total != 25 {
+		t.Errorf("Página além do fim deveria vir vazia com total 25: %d itens, %+v", len(items), meta)
+	}
+}
+
+// TestRespondAnalysisGrouped verifica o formato agrupado por status para um lote misto.
+func TestRespondAnalysisGrouped(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resultados := []domain.AnalysisResult{
+		{NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS},
+		{NFeKey: "2", StatusCode: domain.StatusNaoEncontradaSPED},
+		{NFeKey: "3", StatusCode: domain.StatusDiscrepanciaICMS},
+		{NFeKey: "4", StatusCode: domain.StatusXMLInvalido},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms?grouped=true", nil)
+	respondAnalysis(c, resultados, "ok")
+
+	var body struct {
+		Data map[string][]domain.AnalysisResult `json:"data"`
+		Meta GroupedMeta                        `json:"meta"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Resposta não é JSON válido: %v", err)
+	}
+
+	if len(body.Data) != 3 {
+		t.Fatalf("Esperava 3 grupos, obteve %v", body.Data)
+	}
+	icms := body.Data["discrepancia_icms"]
+	if len(icms) != 2 || icms[0].NFeKey != "1" || icms[1].NFeKey != "3" {
+		t.Errorf("Grupo discrepancia_icms inesperado: %+v", icms)
+	}
+	if len(body.Data["nao_encontrada_sped"]) != 1 || len(body.Data["xml_invalido"]) != 1 {
+		t.Errorf("Grupos inesperados: %+v", body.Data)
+	}
+	if body.Meta.Total != 4 || body.Meta.Counts["discrepancia_icms"] != 2 || body.Meta.Counts["xml_invalido"] != 1 {
+		t.Errorf("Contagens inesperadas: %+v", body.Meta)
+	}
+}
+
+// TestRespondAnalysisNotasCanceladas verifica o contador de notas canceladas no resumo da resposta.
+func TestRespondAnalysisNotasCanceladas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resultados := []domain.AnalysisResult{
+		{NFeKey: "1", StatusCode: domain.StatusNotaCancelada},
+		{NFeKey: "2", StatusCode: domain.StatusDiscrepanciaICMS},
+		{NFeKey: "3", StatusCode: domain.StatusNotaCancelada},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", nil)
+	respondAnalysis(c, resultados, "ok")
+
+	var body struct {
+		Summary map[string]int `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Resposta não é JSON válido: %v", err)
+	}
+	if body.Summary["notas_canceladas"] != 2 {
+		t.Errorf("Esperava 2 notas canceladas no resumo, obteve %v", body.Summary)
+	}
+}
+
+// TestRespondAnalysisStatusDescricao verifica que o JSON traz o código e a descrição do status.
+func TestRespondAnalysisStatusDescricao(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resultados := []domain.AnalysisResult{
+		{NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS},
+		{NFeKey: "2", StatusCode: domain.StatusNaoEncontradaSPED},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", nil)
+	respondAnalysis(c, resultados, "ok")
+
+	var body struct {
+		Data []struct {
+			StatusCode      int    `json:"status_code"`
+			StatusDescricao string `json:"status_descricao"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Resposta não é JSON válido: %v", err)
+	}
+	if len(body.Data) != 2 ||
+		body.Data[0].StatusCode != 1 || body.Data[0].StatusDescricao != "Discrepância de ICMS" ||
+		body.Data[1].StatusCode != 2 || body.Data[1].StatusDescricao != "Não encontrada no SPED" {
+		t.Errorf("Status inesperados: %+v", body.Data)
+	}
+}
+
+// TestRespondAnalysisFormatoCSV verifica o download em CSV pedido com formato=csv.
+func TestRespondAnalysisFormatoCSV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resultados := []domain.AnalysisResult{
+		{NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS, Data: domain.ICMSData{DocNumber: "46", IcmsXML: 18, IcmsSPED: 10}},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms?formato=CSV", nil)
+	respondAnalysis(c, resultados, "ok")
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Esperava CSV, obteve %s: %s", ct, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), ".csv") {
+		t.Errorf("Nome do arquivo inesperado: %s", w.Header().Get("Content-Disposition"))
+	}
+	if !strings.Contains(w.Body.String(), "46;1;18,00;10,00;;Discrepância de ICMS") {
+		t.Errorf("Linha da nota inesperada no CSV: %s", w.Body.String())
+	}
+}
+
+// fakeAnalysisService devolve resultados fixos, sem ler os arquivos.
+type fakeAnalysisService struct {
+	resultados []domain.AnalysisResult
+	xmls       int // XMLs recebidos na última análise de ICMS
+}
+
+func (f *fakeAnalysisService) AnalyzeICMSFiles(io.Reader, []io.Reader, analysis.ICMSOptions) ([]domain.AnalysisResult, error) {
+	return f.resultados, nil
+}
+
+func (f *fakeAnalysisService) ParseICMSFiles(_ io.Reader, xmlFiles []io.Reader) (*analysis.ParsedICMS, error) {
+	f.xmls = len(xmlFiles)
+	return &analysis.ParsedICMS{}, nil
+}
+
+func (f *fakeAnalysisService) ParseICMSFilesProgress(spedFile io.Reader, xmlFiles []io.Reader, _ analysis.ProgressFunc) (*analysis.ParsedICMS, error) {
+	return f.ParseICMSFiles(spedFile, xmlFiles)
+}
+
+func (f *fakeAnalysisService) ReanalyzeICMS(*analysis.ParsedICMS, analysis.ICMSOptions) []domain.AnalysisResult {
+	return f.resultados
+}
+
+func (f *fakeAnalysisService) AnalyzeIPISTFiles(io.Reader, []io.Reader) ([]domain.AnalysisResult, error) {
+	return f.resultados, nil
+}
+
+func (f *fakeAnalysisService) ValidateXMLFiles([]io.Reader) []domain.XMLValidationResult {
+	return nil
+}
+
+func (f *fakeAnalysisService) ExportSpedDraft([]domain.AnalysisResult) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeAnalysisService) CheckCNPJ(io.Reader, []io.Reader) (domain.CNPJCheck, error) {
+	return domain.CNPJCheck{}, nil
+}
+
+func (f *fakeAnalysisService) SpedInfoForChave(io.Reader, string) ([]domain.SpedInfo, error) {
+	return nil, nil
+}
+
+// TestAnalysisIncrementaStats garante que uma análise concluída incrementa o contador de
+// análises e soma as discrepâncias encontradas.
+func TestAnalysisIncrementaStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	counters := stats.New()
+	h := NewAnalysisHandler(&fakeAnalysisService{resultados: []domain.AnalysisResult{
+		{NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS},
+		{NFeKey: "2", StatusCode: domain.StatusOK},
+		{NFeKey: "3", StatusCode: domain.StatusDiscrepanciaICMS},
+	}}, counters)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte("|0000|017|\n"))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota.xml")
+	fw.Write([]byte("<nfeProc/>"))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	h.HandleAnalysisIcms(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Esperava status 200, obteve %d: %s", w.Code, w.Body.String())
+	}
+	snap := counters.Snapshot()
+	if snap.Analyses != 1 || snap.Discrepancies != 2 {
+		t.Errorf("Esperava 1 análise e 2 discrepâncias, obteve %+v", snap)
+	}
+}
+
+// TestAnalysisXMLZip garante que os XMLs de NF-e do xmlZip são somados aos de xmlFiles e que as
+// demais entradas do ZIP são ignoradas.
+func TestAnalysisXMLZip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc := &fakeAnalysisService{}
+	h := NewAnalysisHandler(svc, stats.New())
+
+	nota := "<nfeProc><NFe><infNFe Id=\"NFe1\"></infNFe></NFe></nfeProc>"
+	zipped := zipTeste(t, map[string]string{
+		"notas/nota1.xml":            nota,
+		"notas/NOTA2.XML":            nota,
+		"notas/cancelamento.xml":     "<procEventoNFe><evento/></procEventoNFe>",
+		"notas/leiame.txt":           "não é XML",
+		"__MACOSX/notas/._nota1.xml": nota,
+	})
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte("|0000|017|\n"))
+	fw, _ = mw.CreateFormFile("xmlFiles", "avulsa.xml")
+	fw.Write([]byte(nota))
+	fw, _ = mw.CreateFormFile("xmlZip", "notas.zip")
+	fw.Write(zipped)
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	h.HandleAnalysisIcms(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Esperava status 200, obteve %d: %s", w.Code, w.Body.String())
+	}
+	if svc.xmls != 3 {
+		t.Errorf("Esperava 3 XMLs (1 avulso e 2 do ZIP), obteve %d", svc.xmls)
+	}
+}
+
+// TestAnalysisXMLZipSemNotas garante o erro 400 para um ZIP sem nenhum XML de NF-e.
+func TestAnalysisXMLZipSemNotas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewAnalysisHandler(&fakeAnalysisService{}, stats.New())
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte("|0000|017|\n"))
+	fw, _ = mw.CreateFormFile("xmlZip", "notas.zip")
+	fw.Write(zipTeste(t, map[string]string{"leiame.txt": "vazio"}))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	h.HandleAnalysisIcms(c)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "não contém XMLs de NF-e") {
+		t.Errorf("Esperava 400 para ZIP sem notas, obteve %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestCfopsIgnoradosArquivo garante que os CFOPs enviados em arquivo são somados aos do campo
+// de formulário e tratados como ignorados na análise de ICMS, inclusive curingas e faixas, e
+// que um padrão inválido é recusado com 400.
+func TestCfopsIgnoradosArquivo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe></nfeProc>`
+
+	enviar := func(cfopsCampo, cfopsArquivo string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+		fw.Write([]byte(sped))
+		fw, _ = mw.CreateFormFile("xmlFiles", "nota.xml")
+		fw.Write([]byte(xml))
+		if cfopsCampo != "" {
+			mw.WriteField("cfopsIgnorados", cfopsCampo)
+		}
+		if cfopsArquivo != "" {
+			fw, _ = mw.CreateFormFile("cfopsIgnoradosFile", "cfops.csv")
+			fw.Write([]byte(cfopsArquivo))
+		}
+		mw.Close()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		NewAnalysisHandler(analysis.NewService(), stats.New()).HandleAnalysisIcms(c)
+		return w
+	}
+	analisar := func(cfopsCampo, cfopsArquivo string) []domain.AnalysisResult {
+		w := enviar(cfopsCampo, cfopsArquivo)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Esperava status 200, obteve %d: %s", w.Code, w.Body.String())
+		}
+		var body struct {
+			Data []domain.AnalysisResult `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Resposta não é JSON válido: %v", err)
+		}
+		return body.Data
+	}
+
+	if r := analisar("", ""); len(r) != 1 || r[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Fatalf("Sem CFOPs ignorados esperava 1 discrepância, obteve %+v", r)
+	}
+	if r := analisar("1102", "CFOP\r\n5.102\r\n5102\r\n"); len(r) != 0 {
+		t.Errorf("CFOP 5102 do arquivo deveria ser ignorado, obteve %+v", r)
+	}
+	if r := analisar("1102", "CFOP\r\n5.*\r\n"); len(r) != 0 {
+		t.Errorf("CFOP 5102 deveria ser ignorado pelo curinga 5.*, obteve %+v", r)
+	}
+	if r := analisar("5100-5199", ""); len(r) != 0 {
+		t.Errorf("CFOP 5102 deveria ser ignorado pela faixa, obteve %+v", r)
+	}
+	if w := enviar("5199-5100", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "5199-5100") {
+		t.Errorf("Esperava 400 citando a faixa invertida, obteve %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestAnalysisAvisaCNPJDivergente garante que o aviso de CNPJ divergente entre SPED e XMLs
+// chega em "warnings" na resposta da análise.
+func TestAnalysisAvisaCNPJDivergente(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|14200166000187||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<emit><CNPJ>11111111000111</CNPJ></emit><dest><CNPJ>22222222000122</CNPJ></dest>` +
+		`</infNFe></NFe></nfeProc>`
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte(sped))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota.xml")
+	fw.Write([]byte(xml))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	NewAnalysisHandler(analysis.NewService(), stats.New()).HandleAnalysisIcms(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Esperava status 200, obteve %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Warnings []string `json:"warnings"`
+		Summary  struct {
+			CNPJ domain.CNPJCheck `json:"cnpj"`
+		} `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Resposta não é JSON válido: %v", err)
+	}
+	if len(body.Warnings) != 1 || !strings.Contains(body.Warnings[0], "CNPJ") {
+		t.Errorf("Esperava um aviso de CNPJ divergente, obteve %v", body.Warnings)
+	}
+	if body.Summary.CNPJ.SpedCNPJ != "14200166000187" || body.Summary.CNPJ.InferredCNPJ != "22222222000122" {
+		t.Errorf("Resumo de CNPJ inesperado: %+v", body.Summary.CNPJ)
+	}
+}
+
+// TestReanalyzeIcmsComNovosCfops faz a análise inicial, guarda o token e refaz a análise com um
+// CFOP a mais na lista de ignorados: a nota com esse CFOP sai da lista de problemas.
+func TestReanalyzeIcmsComNovosCfops(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave1 := "35200114200166000187550010000000046271239901"
+	chave2 := "35200114200166000187550010000000047271239900"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave1 + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + chave2 + "|01012024|\n" +
+		"|C190|000|6102|12,00|100,00|100,00|12,00|0|0|0|0||\n"
+	nota := func(chave, nNF string) string {
+		return `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>` + nNF + `</nNF></ide>` +
+			`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>` +
+			`</infNFe></NFe></nfeProc>`
+	}
+
+	h := NewAnalysisHandler(analysis.NewService(), stats.New())
+	type resposta struct {
+		Data    []domain.AnalysisResult `json:"data"`
+		Summary struct {
+			Token string `json:"analysis_token"`
+		} `json:"summary"`
+	}
+	enviar := func(handler gin.HandlerFunc, path string, buf *bytes.Buffer, contentType string) (int, resposta) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, path, buf)
+		c.Request.Header.Set("Content-Type", contentType)
+		handler(c)
+		var body resposta
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Resposta não é JSON válido: %v", err)
+			}
+		}
+		return w.Code, body
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte(sped))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota46.xml")
+	fw.Write([]byte(nota(chave1, "46")))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota47.xml")
+	fw.Write([]byte(nota(chave2, "47")))
+	mw.WriteField("cfopsIgnorados", "5102")
+	mw.Close()
+
+	code, inicial := enviar(h.HandleAnalysisIcms, "/analyze/icms", &buf, mw.FormDataContentType())
+	if code != http.StatusOK || inicial.Summary.Token == "" {
+		t.Fatalf("Análise inicial: status %d, token %q", code, inicial.Summary.Token)
+	}
+	if len(inicial.Data) != 1 || inicial.Data[0].NFeKey != chave2 {
+		t.Fatalf("Esperava só a nota %s com discrepância, obteve %+v", chave2, inicial.Data)
+	}
+
+	reanalisar := func(token, cfops string) (int, resposta) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("token", token)
+		mw.WriteField("cfopsIgnorados", cfops)
+		mw.Close()
+		return enviar(h.HandleReanalyzeIcms, "/analyze/icms/rerun", &buf, mw.FormDataContentType())
+	}
+
+	code, refeita := reanalisar(inicial.Summary.Token, "5102,6102")
+	if code != http.StatusOK {
+		t.Fatalf("Reanálise: esperava 200, obteve %d", code)
+	}
+	if len(refeita.Data) != 0 {
+		t.Errorf("Com 6102 ignorado a nota 47 deveria sair da lista, obteve %+v", refeita.Data)
+	}
+
+	// a lista anterior continua valendo para o mesmo token: nada foi alterado na análise guardada
+	if _, deNovo := reanalisar(inicial.Summary.Token, "5102"); len(deNovo.Data) != 1 {
+		t.Errorf("Reanálise com a lista original deveria repetir o resultado inicial, obteve %+v", deNovo.Data)
+	}
+	if code, _ := reanalisar("token-inexistente", "5102"); code != http.StatusNotFound {
+		t.Errorf("Token desconhecido deveria dar 404, obteve %d", code)
+	}
+}
+
+// TestAnalysisIcmsAsync envia uma análise assíncrona e consulta o job até o resultado ficar pronto.
+func TestAnalysisIcmsAsync(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|12,00|0|0|0|0||\n"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe></nfeProc>`
+
+	h := NewAnalysisHandler(analysis.NewService(), stats.New())
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte(sped))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota46.xml")
+	fw.Write([]byte(xml))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms/async", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	h.HandleAnalysisIcmsAsync(c)
+	var inicio struct {
+		Data struct {
+			JobID  string `json:"job_id"`
+			Status string `json:"status"`
+		} `json:"data"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &inicio) != nil || inicio.Data.JobID == "" {
+		t.Fatalf("Esperava 200 com job_id, obteve %d: %s", w.Code, w.Body.String())
+	}
+
+	consultar := func(id string) (int, analysis.Job) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/analyze/jobs/"+id, nil)
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		h.HandleAnalysisJob(c)
+		var body struct {
+			Data analysis.Job `json:"data"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Resposta não é JSON válido: %v", err)
+			}
+		}
+		return w.Code, body.Data
+	}
+
+	var job analysis.Job
+	for i := 0; i < 500; i++ {
+		var code int
+		if code, job = consultar(inicio.Data.JobID); code != http.StatusOK {
+			t.Fatalf("Consulta do job: esperava 200, obteve %d", code)
+		}
+		if job.Status == analysis.JobConcluido || job.Status == analysis.JobFalhou {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.Status != analysis.JobConcluido || len(job.Results) != 1 || job.Results[0].NFeKey != chave {
+		t.Fatalf("Esperava job concluído com a discrepância da nota 46, obteve %+v", job)
+	}
+	if job.Results[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Errorf("Esperava discrepância de ICMS, obteve %v", job.Results[0].StatusCode)
+	}
+	if code, _ := consultar("job-inexistente"); code != http.StatusNotFound {
+		t.Errorf("Job desconhecido deveria dar 404, obteve %d", code)
+	}
+}
+
+// TestAnalysisAvisaNenhumaNotaNoSPED verifica o aviso quando nenhuma chave dos XMLs está no SPED,
+// e que ele não aparece quando ao menos uma nota é localizada.
+func TestAnalysisAvisaNenhumaNotaNoSPED(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave1 := "35200114200166000187550010000000046271239901"
+	chave2 := "35200114200166000187550010000000471000000470"
+	outra := "35200114200166000187550010000000481000000485"
+	nota := func(chave, nNF string) string {
+		return `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>` + nNF + `</nNF></ide>` +
+			`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+			`</infNFe></NFe></nfeProc>`
+	}
+	analisar := func(chaveSped string) (int, []string, []domain.AnalysisResult) {
+		sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+			"|C100|0|1|P1|55|00|1|46|" + chaveSped + "|01012024|\n" +
+			"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+		fw.Write([]byte(sped))
+		fw, _ = mw.CreateFormFile("xmlFiles", "nota46.xml")
+		fw.Write([]byte(nota(chave1, "46")))
+		fw, _ = mw.CreateFormFile("xmlFiles", "nota47.xml")
+		fw.Write([]byte(nota(chave2, "47")))
+		mw.Close()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms", &buf)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		NewAnalysisHandler(analysis.NewService(), stats.New()).HandleAnalysisIcms(c)
+		var body struct {
+			Data     []domain.AnalysisResult `json:"data"`
+			Warnings []string                `json:"warnings"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Resposta não é JSON válido: %v", err)
+		}
+		return w.Code, body.Warnings, body.Data
+	}
+
+	code, avisos, dados := analisar(outra)
+	if code != http.StatusOK || len(dados) != 2 {
+		t.Fatalf("Esperava 200 com as 2 notas não encontradas, obteve %d com %+v", code, dados)
+	}
+	if len(avisos) != 1 || avisos[0] != avisoNenhumaNotaNoSPED {
+		t.Errorf("Esperava o aviso de nenhuma nota no SPED, obteve %v", avisos)
+	}
+
+	if _, avisos, _ := analisar(chave1); len(avisos) != 0 {
+		t.Errorf("Com uma nota localizada não deveria avisar, obteve %v", avisos)
+	}
+}
+
+// TestAnalysisIcmsStream confere os eventos SSE: o progresso dos XMLs e, por último, o resultado.
+func TestAnalysisIcmsStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|12,00|0|0|0|0||\n"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe></nfeProc>`
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+	fw.Write([]byte(sped))
+	fw, _ = mw.CreateFormFile("xmlFiles", "nota46.xml")
+	fw.Write([]byte(xml))
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms/stream", &buf)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	NewAnalysisHandler(analysis.NewService(), stats.New()).HandleAnalysisIcmsStream(c)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Esperava text/event-stream, obteve %q: %s", ct, w.Body.String())
+	}
+	eventos := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(eventos) != 2 {
+		t.Fatalf("Esperava 2 eventos (progresso e resultado), obteve %q", eventos)
+	}
+	if eventos[0] != "event:progresso\ndata:{\"processados\":1,\"total\":1}" {
+		t.Errorf("Evento de progresso inesperado: %q", eventos[0])
+	}
+	dados, ok := strings.CutPrefix(eventos[1], "event:resultado\ndata:")
+	if !ok {
+		t.Fatalf("Último evento deveria ser o resultado: %q", eventos[1])
+	}
+	var resultado struct {
+		Data  []domain.AnalysisResult `json:"data"`
+		Token string                  `json:"analysis_token"`
+	}
+	if err := json.Unmarshal([]byte(dados), &resultado); err != nil {
+		t.Fatalf("Resultado não é JSON válido: %v", err)
+	}
+	if len(resultado.Data) != 1 || resultado.Data[0].StatusCode != domain.StatusDiscrepanciaICMS || resultado.Token == "" {
+		t.Errorf("Esperava a discrepância da nota 46 e o token, obteve %+v", resultado)
+	}
+}
+
+func TestGetTolerancia(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		raw     string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0,02", 0.02, false},
+		{" 0.5 ", 0.5, false},
+		{"-1", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tc := range cases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"tolerancia": {tc.raw}}.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		got, err := getTolerancia(c)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("getTolerancia(%q) = %v, %v; esperava %v (erro=%v)", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// TestAnalysisSpedChave cobre a consulta de uma única nota: encontrada, ausente, chave inválida
+// e chave não informada.
+func TestAnalysisSpedChave(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+	consultar := func(chaveConsulta string) (int, []domain.SpedInfo) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("spedFile", "sped.txt")
+		fw.Write([]byte(sped))
+		mw.WriteField("chave", chaveConsulta)
+		mw.Close()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/analyze/icms/sped-chave", &buf)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		NewAnalysisHandler(analysis.NewService(), stats.New()).HandleSpedChave(c)
+		var body struct {
+			Data []domain.SpedInfo `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Resposta não é JSON válido: %v", err)
+		}
+		return w.Code, body.Data
+	}
+
+	if code, notas := consultar(chave); code != http.StatusOK || len(notas) != 1 || notas[0].NumDoc != "46" || notas[0].Icms != 18 {
+		t.Errorf("Esperava a nota 46 com ICMS 18, obteve %d %+v", code, notas)
+	}
+	if code, _ := consultar("35200114200166000187550010000000471000000470"); code != http.StatusNotFound {
+		t.Errorf("Chave ausente deveria dar 404, obteve %d", code)
+	}
+	if code, _ := consultar("123"); code != http.StatusBadRequest {
+		t.Errorf("Chave inválida deveria dar 400, obteve %d", code)
+	}
+	if code, _ := consultar(""); code != http.StatusBadRequest {
+		t.Errorf("Chave vazia deveria dar 400, obteve %d", code)
+	}
+}
@@ -1,27 +1,90 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/LuisEduardoPedra/analiseSped/internal/api/responses"
+	"github.com/LuisEduardoPedra/analiseSped/internal/audit"
 	"github.com/LuisEduardoPedra/analiseSped/internal/core/converter"
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
+	"github.com/LuisEduardoPedra/analiseSped/internal/stats"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	defaultPeekRows = 20
+	maxPeekRows     = 500
+
+	// maxEntradaZip limita o tamanho descompactado de cada arquivo extraído do zipFile.
+	maxEntradaZip = 50 << 20
+
+	// maxLinhasRelatorio limita as linhas descartadas listadas em X-Conversion-Report, para o
+	// cabeçalho não estourar o limite dos proxies; X-Conversion-Warnings traz o total.
+	maxLinhasRelatorio = 50
+)
+
 // ConverterHandler lida com as requisições da API relacionadas à conversão de arquivos.
 type ConverterHandler struct {
 	service converter.Service
+	stats   stats.Counters
+	audit   audit.Store
 }
 
-// NewConverterHandler cria um novo handler de conversão.
-func NewConverterHandler(service converter.Service) *ConverterHandler {
+// NewConverterHandler cria um novo handler de conversão. Com store nil as conversões não são
+// registradas no histórico.
+func NewConverterHandler(service converter.Service, counters stats.Counters, store audit.Store) *ConverterHandler {
 	return &ConverterHandler{
 		service: service,
+		stats:   counters,
+		audit:   store,
+	}
+}
+
+// recordConversion contabiliza a conversão e a registra no histórico do usuário. Falhas ao gravar
+// o histórico só são logadas para não perder o arquivo já convertido.
+func (h *ConverterHandler) recordConversion(c *gin.Context, kind string, output []byte, opts converter.Options) {
+	h.stats.IncConversion(kind)
+	if h.audit == nil {
+		return
+	}
+
+	rec := audit.Record{Username: usernameFromClaims(c), Kind: kind, Timestamp: time.Now()}
+	if !opts.RelatorioMatches && !opts.RelatorioNaoEncontradas && opts.FormatoSaida != converter.FormatoSaidaXLSX {
+		rec.Rows, rec.Fallbacks = contarLinhasCSV(output, opts.ContaCoringa())
+	}
+	if err := h.audit.Add(c.Request.Context(), rec); err != nil {
+		logging.Warnf("Erro ao registrar conversão %s no histórico: %v", kind, err)
+	}
+}
+
+// contarLinhasCSV conta as linhas de dados (sem o cabeçalho) de um CSV convertido e quantas delas
+// caíram na conta coringa informada.
+func contarLinhasCSV(output []byte, contaCoringa string) (linhas, coringas int) {
+	for i, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if i == 0 || strings.TrimSpace(line) == "" {
+			continue
+		}
+		linhas++
+		if slices.Contains(strings.Split(line, ";"), contaCoringa) {
+			coringas++
+		}
 	}
+	return linhas, coringas
 }
 
 // getPrefixesFromForm extrai e limpa os prefixos de um campo de formulário.
@@ -41,69 +104,340 @@ func getPrefixesFromForm(c *gin.Context, formKey string) []string {
 	return prefixes
 }
 
-// HandleSicrediConversion lida com a conversão de arquivos do Sicredi (francesinha).
-func (h *ConverterHandler) HandleSicrediConversion(c *gin.Context) {
-	lancamentosFileHeader, err := c.FormFile("lancamentosFile")
+// getBoolFromForm interpreta um campo booleano do formulário ("true", "1", ...).
+// Campos ausentes ou inválidos valem false.
+func getBoolFromForm(c *gin.Context, formKey string) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(c.PostForm(formKey)))
+	return err == nil && v
+}
+
+// getPercentFromForm lê um percentual do formulário aceitando vírgula ou ponto decimal ("0,65").
+// Campos ausentes ou inválidos valem 0, que o conversor rejeita quando o valor é obrigatório.
+func getPercentFromForm(c *gin.Context, formKey string) float64 {
+	raw := strings.TrimSuffix(strings.TrimSpace(c.PostForm(formKey)), "%")
+	v, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(raw), ",", ".", 1), 64)
 	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Lançamentos (.csv, .xls, .xlsx) não encontrado ou inválido")
-		return
+		return 0
 	}
+	return v
+}
 
-	contasFileHeader, err := c.FormFile("contasFile")
+// getEncodingFromForm lê o encoding de saída aceitando as grafias comuns ("UTF-8",
+// "windows-1252"). Valores desconhecidos seguem como vieram para o conversor recusá-los.
+func getEncodingFromForm(c *gin.Context, formKey string) string {
+	raw := strings.ToLower(strings.TrimSpace(c.PostForm(formKey)))
+	switch strings.ReplaceAll(raw, "-", "") {
+	case "utf8":
+		return converter.EncodingUTF8
+	case "cp1252", "windows1252":
+		return converter.EncodingCP1252
+	}
+	return raw
+}
+
+// getFormatoColunasFromForm lê pares coluna=formato separados por vírgula ou ponto e vírgula
+// ("valor_pago=us;juros=br"). Pares sem "=" são ignorados; nomes e formatos são validados pelo
+// conversor.
+func getFormatoColunasFromForm(c *gin.Context, formKey string) map[string]string {
+	raw := strings.TrimSpace(c.PostForm(formKey))
+	if raw == "" {
+		return nil
+	}
+	formatos := make(map[string]string)
+	for _, par := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ';' }) {
+		coluna, formato, ok := strings.Cut(par, "=")
+		if !ok {
+			continue
+		}
+		formatos[strings.ToLower(strings.TrimSpace(coluna))] = strings.ToLower(strings.TrimSpace(formato))
+	}
+	return formatos
+}
+
+// fuzzyDesativado lê o campo fuzzy do formulário, ligado por padrão: só um valor falso
+// explícito ("false", "0") restringe os matchers às correspondências exatas.
+func fuzzyDesativado(c *gin.Context) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(c.PostForm("fuzzy")))
+	return err == nil && !v
+}
+
+// getOptionsFromForm extrai os parâmetros opcionais de conversão do formulário.
+func getOptionsFromForm(c *gin.Context) converter.Options {
+	return converter.Options{
+		IncluirClassificacao:    getBoolFromForm(c, "incluirClassificacao"),
+		Agrupamento:             strings.TrimSpace(c.PostForm("agrupamento")),
+		DebitoPorTitulo:         getBoolFromForm(c, "debitoPorTitulo"),
+		Modo:                    strings.TrimSpace(c.PostForm("modo")),
+		ContaJuros:              strings.TrimSpace(c.PostForm("contaJuros")),
+		ContaDesconto:           strings.TrimSpace(c.PostForm("contaDesconto")),
+		ContaDespBanco:          strings.TrimSpace(c.PostForm("contaDespBanco")),
+		ContaDespCartorio:       strings.TrimSpace(c.PostForm("contaDespCartorio")),
+		ColunaDocumento:         strings.TrimSpace(c.PostForm("colunaDocumento")),
+		MarcarNaoEncontradas:    getBoolFromForm(c, "marcarNaoEncontradas"),
+		IncluirDiagnostico:      getBoolFromForm(c, "incluirDiagnostico"),
+		CreditPrefixes:          getPrefixesFromForm(c, "creditPrefixes"),
+		SufixoSinal:             strings.TrimSpace(c.PostForm("sufixoSinal")),
+		OrdenarPorData:          getBoolFromForm(c, "ordenarPorData"),
+		PisModo:                 strings.TrimSpace(c.PostForm("pisModo")),
+		AliquotaPis:             getPercentFromForm(c, "aliquotaPis"),
+		RelatorioMatches:        getBoolFromForm(c, "relatorioMatches"),
+		RelaxarFiltro:           getBoolFromForm(c, "relaxarFiltro"),
+		Balancete:               getBoolFromForm(c, "balancete"),
+		BOMUTF8:                 getBoolFromForm(c, "bomUtf8"),
+		FormatoColunas:          getFormatoColunasFromForm(c, "formatoColunas"),
+		FormatoData:             strings.TrimSpace(c.PostForm("dateFormat")),
+		NormalizarSaida:         getBoolFromForm(c, "normalizeOutput"),
+		LimiteFallback:          getPercentFromForm(c, "limiteFallback"),
+		LayoutCNAB:              strings.TrimSpace(c.PostForm("layoutCnab")),
+		ContaFallback:           strings.TrimSpace(c.PostForm("contaFallback")),
+		RelatorioNaoEncontradas: getBoolFromForm(c, "relatorioNaoEncontradas"),
+		SimilaridadeMinima:      getPercentFromForm(c, "similaridadeMinima"),
+		FormatoSaida:            strings.ToLower(strings.TrimSpace(c.PostForm("formatoSaida"))),
+		Encoding:                getEncodingFromForm(c, "encoding"),
+		SemFuzzy:                fuzzyDesativado(c),
+	}
+}
+
+// reportarErrosLinhas envia nos cabeçalhos X-Conversion-Warnings (quantidade) e
+// X-Conversion-Report (JSON, percent-encoded) as linhas do arquivo de contas descartadas pela
+// conversão, que continua válida, e em X-Conversion-Alerts (JSON, percent-encoded) os avisos
+// sobre o resultado; devolve nil nesse caso e err inalterado nos demais.
+func reportarErrosLinhas(c *gin.Context, err error) error {
+	var linhas *converter.ErrosLinhas
+	if !errors.As(err, &linhas) {
+		return err
+	}
+	logging.Warnf("Conversão concluída com avisos: %v", linhas)
+
+	if len(linhas.Linhas) > 0 {
+		relatorio := linhas.Linhas
+		if len(relatorio) > maxLinhasRelatorio {
+			relatorio = relatorio[:maxLinhasRelatorio]
+		}
+		if report, jerr := json.Marshal(relatorio); jerr == nil {
+			c.Header("X-Conversion-Report", url.PathEscape(string(report)))
+		}
+		c.Header("X-Conversion-Warnings", strconv.Itoa(len(linhas.Linhas)))
+	}
+	if len(linhas.Avisos) > 0 {
+		if alerts, jerr := json.Marshal(linhas.Avisos); jerr == nil {
+			c.Header("X-Conversion-Alerts", url.PathEscape(string(alerts)))
+		}
+	}
+	return nil
+}
+
+// contentTypeXLSX é o tipo das saídas em planilha (relatório de matches e formatoSaida=xlsx).
+const contentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// sendConversion envia o CSV convertido (ou XLSX, com FormatoSaida) ou, com RelatorioMatches, o
+// relatório XLSX de matches. Com RelatorioNaoEncontradas a saída é o ZIP com o arquivo
+// convertido e a lista de descrições não encontradas. Com Balancete, o arquivo enviado é o
+// balancete por conta.
+func sendConversion(c *gin.Context, output []byte, prefixo string, opts converter.Options) {
+	ext, contentType := "csv", "text/csv; charset=utf-8"
+	if opts.Encoding == converter.EncodingCP1252 {
+		contentType = "text/csv; charset=windows-1252"
+	}
+	if opts.FormatoSaida == converter.FormatoSaidaXLSX {
+		ext, contentType = "xlsx", contentTypeXLSX
+	}
+	switch {
+	case opts.RelatorioMatches:
+		prefixo += "_RelatorioMatches"
+		ext, contentType = "xlsx", contentTypeXLSX
+	case opts.RelatorioNaoEncontradas:
+		ext, contentType = "zip", "application/zip"
+		if opts.Balancete {
+			prefixo += "_Balancete"
+		}
+	case opts.Balancete:
+		prefixo += "_Balancete"
+	}
+	fileName := fmt.Sprintf("%s_%s.%s", prefixo, time.Now().Format("20060102_150405"), ext)
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, contentType, output)
+}
+
+// arquivoEnviado é um arquivo de entrada da conversão, enviado avulso ou extraído do ZIP.
+type arquivoEnviado struct {
+	io.ReadCloser
+	nome string
+}
+
+// abrirArquivosConversao abre o arquivo de lançamentos (campo lancamentosField) e o de contas
+// (campo contasFile). Se o campo zipFile for enviado, os dois vêm dele: lancamentos.* e
+// contas.csv. msgLancamentos é o erro para lançamentos ausentes; em qualquer erro a resposta já
+// foi enviada e ok é false. Os arquivos devolvidos devem ser fechados pelo chamador.
+func abrirArquivosConversao(c *gin.Context, lancamentosField, msgLancamentos string) (lancamentos, contas *arquivoEnviado, ok bool) {
+	if zipHeader, err := c.FormFile("zipFile"); err == nil {
+		lancamentos, contas, err := extrairArquivosZip(zipHeader)
+		if err != nil {
+			responses.Error(c, http.StatusBadRequest, "Arquivo ZIP inválido", err.Error())
+			return nil, nil, false
+		}
+		return lancamentos, contas, true
+	}
+
+	lancamentosHeader, err := c.FormFile(lancamentosField)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, msgLancamentos)
+		return nil, nil, false
+	}
+	contasHeader, err := c.FormFile("contasFile")
 	if err != nil {
 		responses.Error(c, http.StatusBadRequest, "Arquivo de Contas (.csv) não encontrado ou inválido")
+		return nil, nil, false
+	}
+
+	lancamentosFile, err := lancamentosHeader.Open()
+	if err != nil {
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Lançamentos")
+		return nil, nil, false
+	}
+	contasFile, err := contasHeader.Open()
+	if err != nil {
+		lancamentosFile.Close()
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Contas")
+		return nil, nil, false
+	}
+	return &arquivoEnviado{ReadCloser: lancamentosFile, nome: lancamentosHeader.Filename},
+		&arquivoEnviado{ReadCloser: contasFile, nome: contasHeader.Filename}, true
+}
+
+// extrairArquivosZip lê do ZIP o arquivo de lançamentos (lancamentos.*, com ou sem cedilha) e o
+// de contas (contas.csv), em qualquer pasta. Os arquivos ocultos do macOS são ignorados.
+func extrairArquivosZip(header *multipart.FileHeader) (lancamentos, contas *arquivoEnviado, err error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("não foi possível abrir o ZIP: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("não foi possível ler o ZIP: %w", err)
+	}
+
+	for _, f := range zr.File {
+		nome := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(nome, "._") || strings.Contains(f.Name, "__MACOSX/") {
+			continue
+		}
+		base := strings.ToLower(strings.TrimSuffix(nome, path.Ext(nome)))
+		var destino **arquivoEnviado
+		switch {
+		case strings.EqualFold(nome, "contas.csv"):
+			destino = &contas
+		case base == "lancamentos" || base == "lançamentos":
+			destino = &lancamentos
+		default:
+			continue
+		}
+		if *destino != nil {
+			return nil, nil, fmt.Errorf("o ZIP contém mais de um arquivo %s", nome)
+		}
+		data, err := lerEntradaZip(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		*destino = &arquivoEnviado{ReadCloser: io.NopCloser(bytes.NewReader(data)), nome: nome}
+	}
+
+	switch {
+	case lancamentos == nil:
+		return nil, nil, fmt.Errorf("o ZIP não contém o arquivo de lançamentos (lancamentos.csv, .xls ou .xlsx)")
+	case contas == nil:
+		return nil, nil, fmt.Errorf("o ZIP não contém o arquivo de contas (contas.csv)")
+	}
+	return lancamentos, contas, nil
+}
+
+// lerEntradaZip descompacta uma entrada do ZIP em memória, recusando as maiores que
+// maxEntradaZip para que um ZIP malicioso não esgote a memória.
+func lerEntradaZip(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("não foi possível abrir %s no ZIP: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxEntradaZip+1))
+	if err != nil {
+		return nil, fmt.Errorf("não foi possível ler %s no ZIP: %w", f.Name, err)
+	}
+	if len(data) > maxEntradaZip {
+		return nil, fmt.Errorf("%s excede o limite de %d MB descompactado", f.Name, maxEntradaZip>>20)
+	}
+	return data, nil
+}
+
+// HandleSicrediConversion lida com a conversão de arquivos do Sicredi (francesinha).
+func (h *ConverterHandler) HandleSicrediConversion(c *gin.Context) {
+	lancamentosFile, contasFile, ok := abrirArquivosConversao(c, "lancamentosFile", "Arquivo de Lançamentos (.csv, .xls, .xlsx, .ofx) não encontrado ou inválido")
+	if !ok {
 		return
 	}
+	defer lancamentosFile.Close()
+	defer contasFile.Close()
 
-	ext := strings.ToLower(filepath.Ext(lancamentosFileHeader.Filename))
-	if ext != ".csv" && ext != ".xls" && ext != ".xlsx" {
+	ext := strings.ToLower(filepath.Ext(lancamentosFile.nome))
+	if ext != ".csv" && ext != ".xls" && ext != ".xlsx" && ext != ".ofx" {
 		responses.Error(c, http.StatusBadRequest, fmt.Sprintf("Extensão de arquivo de lançamentos não suportada: %s", ext))
 		return
 	}
 
 	classPrefixes := getPrefixesFromForm(c, "classPrefixes")
 
-	lancamentosFile, err := lancamentosFileHeader.Open()
+	opts := getOptionsFromForm(c)
+	outputCSV, err := h.service.ProcessSicrediFiles(lancamentosFile, contasFile, lancamentosFile.nome, classPrefixes, opts)
+	err = reportarErrosLinhas(c, err)
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Lançamentos")
+		logging.Errorf("Erro ao processar arquivos Sicredi: %v", err)
+		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
 		return
 	}
-	defer lancamentosFile.Close()
 
-	contasFile, err := contasFileHeader.Open()
-	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Contas")
+	h.recordConversion(c, "sicredi", outputCSV, opts)
+
+	sendConversion(c, outputCSV, "LancamentosFinal", opts)
+}
+
+// HandleCNAB240Conversion lida com a conversão de retornos/extratos CNAB240 pelo fluxo do Sicredi.
+func (h *ConverterHandler) HandleCNAB240Conversion(c *gin.Context) {
+	cnabFile, contasFile, ok := abrirArquivosConversao(c, "cnabFile", "Arquivo CNAB240 não encontrado ou inválido")
+	if !ok {
 		return
 	}
+	defer cnabFile.Close()
 	defer contasFile.Close()
 
-	outputCSV, err := h.service.ProcessSicrediFiles(lancamentosFile, contasFile, lancamentosFileHeader.Filename, classPrefixes)
+	classPrefixes := getPrefixesFromForm(c, "classPrefixes")
+
+	opts := getOptionsFromForm(c)
+	outputCSV, err := h.service.ProcessCNAB240(cnabFile, contasFile, classPrefixes, opts)
+	err = reportarErrosLinhas(c, err)
 	if err != nil {
-		fmt.Printf("Erro ao processar arquivos Sicredi: %v\n", err)
+		logging.Errorf("Erro ao processar arquivo CNAB240: %v", err)
 		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
 		return
 	}
 
-	fileName := fmt.Sprintf("LancamentosFinal_%s.csv", time.Now().Format("20060102_150405"))
-	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Data(http.StatusOK, "text/csv; charset=utf-8", outputCSV)
+	h.recordConversion(c, "cnab240", outputCSV, opts)
+
+	sendConversion(c, outputCSV, "LancamentosFinal", opts)
 }
 
 // HandleReceitasAcisaConversion lida com a conversão de receitas ACISA.
 func (h *ConverterHandler) HandleReceitasAcisaConversion(c *gin.Context) {
-	excelFileHeader, err := c.FormFile("excelFile")
-	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo Excel (.xls, .xlsx) não encontrado ou inválido")
-		return
-	}
-
-	contasFileHeader, err := c.FormFile("contasFile")
-	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Contas (.csv) não encontrado ou inválido")
+	excelFile, contasFile, ok := abrirArquivosConversao(c, "excelFile", "Arquivo Excel (.xls, .xlsx) não encontrado ou inválido")
+	if !ok {
 		return
 	}
+	defer excelFile.Close()
+	defer contasFile.Close()
 
-	ext := strings.ToLower(filepath.Ext(excelFileHeader.Filename))
+	ext := strings.ToLower(filepath.Ext(excelFile.nome))
 	if ext != ".xls" && ext != ".xlsx" {
 		responses.Error(c, http.StatusBadRequest, fmt.Sprintf("Extensão de arquivo excel não suportada: %s", ext))
 		return
@@ -111,101 +445,173 @@ func (h *ConverterHandler) HandleReceitasAcisaConversion(c *gin.Context) {
 
 	classPrefixes := getPrefixesFromForm(c, "classPrefixes")
 
-	excelFile, err := excelFileHeader.Open()
+	opts := getOptionsFromForm(c)
+	opts.Balancete = false // receitas ACISA não geram partidas débito/crédito
+	outputCSV, err := h.service.ProcessReceitasAcisaFiles(excelFile, contasFile, excelFile.nome, classPrefixes, opts)
+	err = reportarErrosLinhas(c, err)
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo Excel")
+		logging.Errorf("Erro ao processar arquivos para receitas ACISA: %v", err)
+		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
+		return
+	}
+
+	h.recordConversion(c, "receitas_acisa", outputCSV, opts)
+
+	sendConversion(c, outputCSV, "ReceitasAcisa", opts)
+}
+
+// conversionErrorStatus devolve 422 quando a conversão foi abortada por passar do limite de
+// linhas de saída (planilha malformada) e 500 para as demais falhas.
+func conversionErrorStatus(err error) int {
+	if errors.Is(err, converter.ErrLimiteLinhasSaida) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// HandleAtoliniPagamentosConversion lida com a conversão de pagamentos Atolini.
+func (h *ConverterHandler) HandleAtoliniPagamentosConversion(c *gin.Context) {
+	excelFile, contasFile, ok := abrirArquivosConversao(c, "lancamentosFile", "Arquivo de Lançamentos (.xls, .xlsx) não encontrado ou inválido")
+	if !ok {
 		return
 	}
 	defer excelFile.Close()
+	defer contasFile.Close()
 
-	contasFile, err := contasFileHeader.Open()
+	// Lê os parâmetros de filtro de classificação (padronizado com recebimentos)
+	debitPrefixes := getPrefixesFromForm(c, "debitPrefixes")
+	creditPrefixes := getPrefixesFromForm(c, "creditPrefixes")
+
+	opts := getOptionsFromForm(c)
+	// CORREÇÃO: Passa os dois filtros para o serviço
+	outputCSV, err := h.service.ProcessAtoliniPagamentos(excelFile, contasFile, debitPrefixes, creditPrefixes, opts)
+	err = reportarErrosLinhas(c, err)
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Contas")
+		logging.Errorf("Erro ao processar arquivos para Atolini Pagamentos: %v", err)
+		responses.Error(c, conversionErrorStatus(err), "Erro ao processar os arquivos", err.Error())
+		return
+	}
+
+	h.recordConversion(c, "atolini_pagamentos", outputCSV, opts)
+
+	sendConversion(c, outputCSV, "AtoliniPagamentos", opts)
+}
+
+// HandleAtoliniRecebimentosConversion lida com a conversão de recebimentos Atolini.
+func (h *ConverterHandler) HandleAtoliniRecebimentosConversion(c *gin.Context) {
+	excelFile, contasFile, ok := abrirArquivosConversao(c, "lancamentosFile", "Arquivo de Lançamentos (.xls, .xlsx) não encontrado ou inválido")
+	if !ok {
 		return
 	}
+	defer excelFile.Close()
 	defer contasFile.Close()
 
-	outputCSV, err := h.service.ProcessReceitasAcisaFiles(excelFile, contasFile, excelFileHeader.Filename, classPrefixes)
+	debitPrefixes := getPrefixesFromForm(c, "debitPrefixes")
+	creditPrefixes := getPrefixesFromForm(c, "creditPrefixes")
+
+	opts := getOptionsFromForm(c)
+	outputCSV, err := h.service.ProcessAtoliniRecebimentos(excelFile, contasFile, debitPrefixes, creditPrefixes, opts)
+	err = reportarErrosLinhas(c, err)
 	if err != nil {
-		fmt.Printf("Erro ao processar arquivos para receitas ACISA: %v\n", err)
-		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
+		logging.Errorf("Erro ao processar arquivos para Atolini Recebimentos: %v", err)
+		responses.Error(c, conversionErrorStatus(err), "Erro ao processar os arquivos", err.Error())
 		return
 	}
 
-	fileName := fmt.Sprintf("ReceitasAcisa_%s.csv", time.Now().Format("20060102_150405"))
-	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Data(http.StatusOK, "text/csv; charset=utf-8", outputCSV)
+	h.recordConversion(c, "atolini_recebimentos", outputCSV, opts)
+
+	sendConversion(c, outputCSV, "AtoliniRecebimentos", opts)
 }
 
-// HandleAtoliniPagamentosConversion lida com a conversão de pagamentos Atolini.
-func (h *ConverterHandler) HandleAtoliniPagamentosConversion(c *gin.Context) {
-	excelFileHeader, err := c.FormFile("lancamentosFile")
+// HandleConciliacaoTitulos lida com a conciliação dos boletos recebidos contra a lista de títulos.
+func (h *ConverterHandler) HandleConciliacaoTitulos(c *gin.Context) {
+	extratoFileHeader, err := c.FormFile("extratoFile")
 	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Lançamentos (.xls, .xlsx) não encontrado ou inválido")
+		responses.Error(c, http.StatusBadRequest, "Arquivo de Extrato (.csv) não encontrado ou inválido")
 		return
 	}
 
-	contasFileHeader, err := c.FormFile("contasFile")
+	titulosFileHeader, err := c.FormFile("titulosFile")
 	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Contas (.csv) não encontrado ou inválido")
+		responses.Error(c, http.StatusBadRequest, "Arquivo de Títulos (.csv) não encontrado ou inválido")
 		return
 	}
 
-	// Lê os parâmetros de filtro de classificação (padronizado com recebimentos)
-	debitPrefixes := getPrefixesFromForm(c, "debitPrefixes")
-	creditPrefixes := getPrefixesFromForm(c, "creditPrefixes")
-
-	excelFile, err := excelFileHeader.Open()
+	extratoFile, err := extratoFileHeader.Open()
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Lançamentos")
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Extrato")
 		return
 	}
-	defer excelFile.Close()
+	defer extratoFile.Close()
 
-	contasFile, err := contasFileHeader.Open()
+	titulosFile, err := titulosFileHeader.Open()
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Contas")
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Títulos")
 		return
 	}
-	defer contasFile.Close()
+	defer titulosFile.Close()
 
-	// CORREÇÃO: Passa os dois filtros para o serviço
-	outputCSV, err := h.service.ProcessAtoliniPagamentos(excelFile, contasFile, debitPrefixes, creditPrefixes)
+	outputCSV, err := h.service.ProcessConciliacaoTitulos(extratoFile, titulosFile)
 	if err != nil {
-		fmt.Printf("Erro ao processar arquivos para Atolini Pagamentos: %v\n", err)
+		logging.Errorf("Erro ao conciliar títulos: %v", err)
 		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
 		return
 	}
 
-	fileName := fmt.Sprintf("AtoliniPagamentos_%s.csv", time.Now().Format("20060102_150405"))
+	h.recordConversion(c, "conciliacao_titulos", outputCSV, converter.Options{})
+
+	fileName := fmt.Sprintf("ConciliacaoTitulos_%s.csv", time.Now().Format("20060102_150405"))
 	c.Header("Content-Disposition", "attachment; filename="+fileName)
 	c.Data(http.StatusOK, "text/csv; charset=utf-8", outputCSV)
 }
 
-// HandleAtoliniRecebimentosConversion lida com a conversão de recebimentos Atolini.
-func (h *ConverterHandler) HandleAtoliniRecebimentosConversion(c *gin.Context) {
-	excelFileHeader, err := c.FormFile("lancamentosFile")
+// HandlePeek devolve as primeiras linhas de uma planilha enviada, como o servidor a lê,
+// para diagnosticar problemas de coluna ou cabeçalho antes da conversão.
+func (h *ConverterHandler) HandlePeek(c *gin.Context) {
+	excelFileHeader, err := c.FormFile("excelFile")
 	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Lançamentos (.xls, .xlsx) não encontrado ou inválido")
+		responses.Error(c, http.StatusBadRequest, "Arquivo Excel (.xls, .xlsx) não encontrado ou inválido")
 		return
 	}
 
-	contasFileHeader, err := c.FormFile("contasFile")
+	n, err := getPositiveIntParam(c, "n", defaultPeekRows)
 	if err != nil {
-		responses.Error(c, http.StatusBadRequest, "Arquivo de Contas (.csv) não encontrado ou inválido")
+		responses.Error(c, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	debitPrefixes := getPrefixesFromForm(c, "debitPrefixes")
-	creditPrefixes := getPrefixesFromForm(c, "creditPrefixes")
+	if n > maxPeekRows {
+		n = maxPeekRows
+	}
 
 	excelFile, err := excelFileHeader.Open()
 	if err != nil {
-		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Lançamentos")
+		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo Excel")
 		return
 	}
 	defer excelFile.Close()
 
+	preview, err := h.service.PeekPlanilha(excelFile, n)
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Não foi possível ler a planilha", err.Error())
+		return
+	}
+
+	responses.Success(c, preview, "Pré-visualização da planilha")
+}
+
+// HandleExplainMatch mostra como o matcher escolhe a conta de uma única descrição no plano de
+// contas enviado, para responder chamados do tipo "por que X caiu na conta Y?".
+func (h *ConverterHandler) HandleExplainMatch(c *gin.Context) {
+	descricao := strings.TrimSpace(c.PostForm("descricao"))
+	if descricao == "" {
+		responses.Error(c, http.StatusBadRequest, "Informe a descrição a explicar (campo descricao)")
+		return
+	}
+	contasFileHeader, err := c.FormFile("contasFile")
+	if err != nil {
+		responses.Error(c, http.StatusBadRequest, "Arquivo de Contas (.csv) não encontrado ou inválido")
+		return
+	}
 	contasFile, err := contasFileHeader.Open()
 	if err != nil {
 		responses.Error(c, http.StatusInternalServerError, "Não foi possível abrir o arquivo de Contas")
@@ -213,14 +619,11 @@ func (h *ConverterHandler) HandleAtoliniRecebimentosConversion(c *gin.Context) {
 	}
 	defer contasFile.Close()
 
-	outputCSV, err := h.service.ProcessAtoliniRecebimentos(excelFile, contasFile, debitPrefixes, creditPrefixes)
+	explicacao, err := h.service.ExplicarMatch(descricao, contasFile, getPrefixesFromForm(c, "classPrefixes"), getOptionsFromForm(c))
 	if err != nil {
-		fmt.Printf("Erro ao processar arquivos para Atolini Recebimentos: %v\n", err)
-		responses.Error(c, http.StatusInternalServerError, "Erro ao processar os arquivos", err.Error())
+		responses.Error(c, http.StatusBadRequest, "Não foi possível ler o arquivo de contas", err.Error())
 		return
 	}
 
-	fileName := fmt.Sprintf("AtoliniRecebimentos_%s.csv", time.Now().Format("20060102_150405"))
-	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Data(http.StatusOK, "text/csv; charset=utf-8", outputCSV)
+	responses.Success(c, explicacao, "Explicação do match")
 }
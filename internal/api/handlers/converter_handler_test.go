@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/core/converter"
+	"github.com/LuisEduardoPedra/analiseSped/internal/stats"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	contasSicrediHandlerTeste = "101;1.1.2.01.001;CLIENTE ALFA LTDA\n102;1.1.2.01.002;CLIENTE BETA SA\n"
+
+	lancamentosSicrediHandlerTeste = "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;100,00\n" +
+		"SIMPLES;D2;B2;;CLIENTE BETA SA;01/01/2026;05/01/2026;;50,00\n"
+)
+
+// zipTeste monta um ZIP em memória com os arquivos informados (nome -> conteúdo).
+func zipTeste(t *testing.T, arquivos map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for nome, conteudo := range arquivos {
+		w, err := zw.Create(nome)
+		if err != nil {
+			t.Fatalf("Erro ao criar %s no ZIP: %v", nome, err)
+		}
+		w.Write([]byte(conteudo))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Erro ao fechar o ZIP: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// converterSicredi envia os arquivos (campo -> nome e conteúdo) para HandleSicrediConversion.
+func converterSicredi(t *testing.T, arquivos map[string][2]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for campo, arquivo := range arquivos {
+		w, _ := mw.CreateFormFile(campo, arquivo[0])
+		w.Write([]byte(arquivo[1]))
+	}
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/convert/francesinha", &body)
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	NewConverterHandler(converter.NewService(), stats.New(), nil).HandleSicrediConversion(c)
+	return w
+}
+
+// TestConversaoZip garante que lançamentos e contas enviados num único ZIP geram a mesma saída
+// do envio em dois arquivos, e que a falta de um deles é informada.
+func TestConversaoZip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	avulsos := converterSicredi(t, map[string][2]string{
+		"lancamentosFile": {"extrato.csv", lancamentosSicrediHandlerTeste},
+		"contasFile":      {"plano.csv", contasSicrediHandlerTeste},
+	})
+	if avulsos.Code != http.StatusOK {
+		t.Fatalf("Envio avulso: esperava 200, obteve %d: %s", avulsos.Code, avulsos.Body.String())
+	}
+
+	zipado := converterSicredi(t, map[string][2]string{
+		"zipFile": {"arquivos.zip", string(zipTeste(t, map[string]string{
+			"janeiro/lancamentos.csv":       lancamentosSicrediHandlerTeste,
+			"janeiro/contas.csv":            contasSicrediHandlerTeste,
+			"__MACOSX/janeiro/._contas.csv": "lixo",
+		}))},
+	})
+	if zipado.Code != http.StatusOK {
+		t.Fatalf("Envio em ZIP: esperava 200, obteve %d: %s", zipado.Code, zipado.Body.String())
+	}
+	if !bytes.Equal(zipado.Body.Bytes(), avulsos.Body.Bytes()) {
+		t.Errorf("Saída do ZIP difere do envio avulso:\n%s\nx\n%s", zipado.Body.String(), avulsos.Body.String())
+	}
+
+	semContas := converterSicredi(t, map[string][2]string{
+		"zipFile": {"arquivos.zip", string(zipTeste(t, map[string]string{"lancamentos.csv": lancamentosSicrediHandlerTeste}))},
+	})
+	if semContas.Code != http.StatusBadRequest || !strings.Contains(semContas.Body.String(), "contas.csv") {
+		t.Errorf("ZIP sem contas.csv deveria dar 400 citando o arquivo, obteve %d: %s", semContas.Code, semContas.Body.String())
+	}
+}
+
+func TestGetEncodingFromForm(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]string{
+		"":             "",
+		"UTF-8":        converter.EncodingUTF8,
+		" utf8 ":       converter.EncodingUTF8,
+		"cp1252":       converter.EncodingCP1252,
+		"Windows-1252": converter.EncodingCP1252,
+		"latin1":       "latin1",
+	}
+	for raw, want := range cases {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"encoding": {raw}}.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := getEncodingFromForm(c, "encoding"); got != want {
+			t.Errorf("getEncodingFromForm(%q) = %q, esperava %q", raw, got, want)
+		}
+	}
+}
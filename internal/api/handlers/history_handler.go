@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/api/responses"
+	"github.com/LuisEduardoPedra/analiseSped/internal/audit"
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// HistoryHandler lista as conversões recentes do usuário autenticado.
+type HistoryHandler struct {
+	store audit.Store
+}
+
+// NewHistoryHandler cria um novo handler de histórico.
+func NewHistoryHandler(store audit.Store) *HistoryHandler {
+	return &HistoryHandler{store: store}
+}
+
+// usernameFromClaims devolve o usuário dos claims gravados pelo AuthMiddleware, ou "" se ausente.
+func usernameFromClaims(c *gin.Context) string {
+	claims, ok := c.Get("user_claims")
+	if !ok {
+		return ""
+	}
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	username, _ := mapClaims["username"].(string)
+	return username
+}
+
+// HandleHistory devolve os últimos registros de conversão do usuário (GET /history?limit=N).
+func (h *HistoryHandler) HandleHistory(c *gin.Context) {
+	username := usernameFromClaims(c)
+	if username == "" {
+		responses.Error(c, http.StatusUnauthorized, "Usuário não identificado no token")
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			responses.Error(c, http.StatusBadRequest, "Parâmetro limit deve ser um inteiro positivo")
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+
+	records, err := h.store.Recent(c.Request.Context(), username, limit)
+	if err != nil {
+		logging.Errorf("Erro ao consultar histórico de %s: %v", username, err)
+		responses.Error(c, http.StatusInternalServerError, "Erro ao consultar o histórico")
+		return
+	}
+
+	responses.Success(c, records, "Histórico recuperado com sucesso")
+}
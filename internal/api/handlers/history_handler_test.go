@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/audit"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeAuditStore imita a consulta do Firestore: filtra por usuário, ordena do mais recente e
+// respeita o limite, guardando os parâmetros recebidos.
+type fakeAuditStore struct {
+	records   []audit.Record
+	gotUser   string
+	gotLimit  int
+	addedRecs []audit.Record
+}
+
+func (f *fakeAuditStore) Add(_ context.Context, rec audit.Record) error {
+	f.addedRecs = append(f.addedRecs, rec)
+	return nil
+}
+
+func (f *fakeAuditStore) Recent(_ context.Context, username string, limit int) ([]audit.Record, error) {
+	f.gotUser, f.gotLimit = username, limit
+	var out []audit.Record
+	for i := len(f.records) - 1; i >= 0 && len(out) < limit; i-- {
+		if f.records[i].Username == username {
+			out = append(out, f.records[i])
+		}
+	}
+	return out, nil
+}
+
+// TestHistoryFiltraUsuarioELimite verifica que o histórico usa o usuário do token e o limite pedido.
+func TestHistoryFiltraUsuarioELimite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	base := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	store := &fakeAuditStore{}
+	for i, user := range []string{"ana", "bruno", "ana", "ana", "bruno", "ana"} {
+		store.records = append(store.records, audit.Record{
+			Username: user, Kind: "sicredi", Timestamp: base.Add(time.Duration(i) * time.Hour), Rows: i,
+		})
+	}
+	h := NewHistoryHandler(store)
+
+	request := func(query string, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/history"+query, nil)
+		if claims != nil {
+			c.Set("user_claims", claims)
+		}
+		h.HandleHistory(c)
+		return w
+	}
+
+	w := request("?limit=2", jwt.MapClaims{"username": "ana"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Esperava 200, obteve %d: %s", w.Code, w.Body.String())
+	}
+	if store.gotUser != "ana" || store.gotLimit != 2 {
+		t.Errorf("Consulta deveria filtrar por ana com limite 2, obteve %q/%d", store.gotUser, store.gotLimit)
+	}
+	var resp struct {
+		Data []audit.Record `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Resposta inválida: %v", err)
+	}
+	if len(resp.Data) != 2 || resp.Data[0].Rows != 5 || resp.Data[1].Rows != 3 {
+		t.Errorf("Esperava os 2 registros mais recentes de ana (linhas 5 e 3), obteve %+v", resp.Data)
+	}
+	for _, rec := range resp.Data {
+		if rec.Username != "ana" {
+			t.Errorf("Registro de outro usuário no histórico: %+v", rec)
+		}
+	}
+
+	request("?limit=1000", jwt.MapClaims{"username": "bruno"})
+	if store.gotLimit != maxHistoryLimit {
+		t.Errorf("Limite deveria ser truncado em %d, obteve %d", maxHistoryLimit, store.gotLimit)
+	}
+	request("", jwt.MapClaims{"username": "bruno"})
+	if store.gotLimit != defaultHistoryLimit {
+		t.Errorf("Sem limit esperava o padrão %d, obteve %d", defaultHistoryLimit, store.gotLimit)
+	}
+
+	if w := request("?limit=abc", jwt.MapClaims{"username": "ana"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Limit inválido deveria dar 400, obteve %d", w.Code)
+	}
+	if w := request("", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Sem claims deveria dar 401, obteve %d", w.Code)
+	}
+}
+
+// TestContarLinhasCSV verifica a contagem de linhas e de contas coringa registrada no histórico.
+func TestContarLinhasCSV(t *testing.T) {
+	csv := "Data;Debito;Credito;Valor\r\n05/01/2026;1234;999999;10,00\r\n06/01/2026;1234;5678;20,00\r\n"
+	linhas, coringas := contarLinhasCSV([]byte(csv), "999999")
+	if linhas != 2 || coringas != 1 {
+		t.Errorf("Esperava 2 linhas e 1 coringa, obteve %d e %d", linhas, coringas)
+	}
+	if _, coringas := contarLinhasCSV([]byte(csv), "5678"); coringas != 1 {
+		t.Errorf("Esperava 1 linha na conta coringa configurada, obteve %d", coringas)
+	}
+}
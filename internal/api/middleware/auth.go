@@ -11,8 +11,16 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// AuthMiddleware verifica se o token JWT é válido.
+// AuthMiddleware verifica se o token JWT é válido. Com JWT_ISSUER e JWT_AUDIENCE configurados,
+// o token também precisa trazer o mesmo iss e, em aud, a audiência deste serviço.
 func AuthMiddleware(jwtSecret []byte) gin.HandlerFunc {
+	var parserOpts []jwt.ParserOption
+	if issuer := strings.TrimSpace(os.Getenv("JWT_ISSUER")); issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(issuer))
+	}
+	if audience := strings.TrimSpace(os.Getenv("JWT_AUDIENCE")); audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(audience))
+	}
 
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -34,7 +42,7 @@ func AuthMiddleware(jwtSecret []byte) gin.HandlerFunc {
 				return nil, fmt.Errorf("método de assinatura inesperado: %v", token.Header["alg"])
 			}
 			return jwtSecret, nil
-		})
+		}, parserOpts...)
 
 		if err != nil || !token.Valid {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token inválido ou expirado"})
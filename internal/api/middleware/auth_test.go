@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// autenticar envia ao AuthMiddleware um token assinado com os claims informados.
+func autenticar(t *testing.T, claims jwt.MapClaims) int {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("segredo"))
+	if err != nil {
+		t.Fatalf("Erro ao assinar o token: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", AuthMiddleware([]byte("segredo")), func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+// TestAuthMiddlewareIssuerAudience verifica a validação de iss e aud quando configurados.
+func TestAuthMiddlewareIssuerAudience(t *testing.T) {
+	t.Setenv("JWT_SECRET", "segredo")
+	t.Setenv("JWT_ISSUER", "analise-sped")
+	t.Setenv("JWT_AUDIENCE", "conversor")
+
+	cases := []struct {
+		nome   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"iss e aud corretos", jwt.MapClaims{"iss": "analise-sped", "aud": "conversor"}, http.StatusOK},
+		{"aud entre várias", jwt.MapClaims{"iss": "analise-sped", "aud": []string{"relatorios", "conversor"}}, http.StatusOK},
+		{"iss divergente", jwt.MapClaims{"iss": "outro", "aud": "conversor"}, http.StatusUnauthorized},
+		{"aud divergente", jwt.MapClaims{"iss": "analise-sped", "aud": "relatorios"}, http.StatusUnauthorized},
+		{"sem iss e aud", jwt.MapClaims{}, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.nome, func(t *testing.T) {
+			if status := autenticar(t, tc.claims); status != tc.status {
+				t.Errorf("Esperava status %d, obteve %d", tc.status, status)
+			}
+		})
+	}
+}
+
+// TestAuthMiddlewareSemIssuerAudience garante que, sem configuração, iss e aud não são exigidos.
+func TestAuthMiddlewareSemIssuerAudience(t *testing.T) {
+	t.Setenv("JWT_SECRET", "segredo")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+
+	if status := autenticar(t, jwt.MapClaims{"username": "ana"}); status != http.StatusOK {
+		t.Errorf("Esperava status 200 sem iss/aud configurados, obteve %d", status)
+	}
+	if status := autenticar(t, jwt.MapClaims{"iss": "qualquer", "aud": "qualquer"}); status != http.StatusOK {
+		t.Errorf("Esperava status 200 com iss/aud não validados, obteve %d", status)
+	}
+}
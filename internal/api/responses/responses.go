@@ -4,35 +4,90 @@ package responses
 import (
 	"net/http"
 
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-var logger *zap.Logger
-
 // APIResponse defines the standard envelope for API responses.
 type APIResponse struct {
 	Status  string      `json:"status"` // "success" or "error"
 	Data    interface{} `json:"data,omitempty"`
 	Message string      `json:"message,omitempty"`
 	Errors  []string    `json:"errors,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
+	// Warnings carries non-fatal findings about the request, such as files that look mismatched.
+	Warnings []string `json:"warnings,omitempty"`
+	// Summary carries extra facts the user should confirm, such as the company inferred from the files.
+	Summary map[string]interface{} `json:"summary,omitempty"`
+}
+
+// Gin context keys where Warn and AddSummary accumulate data until the response is sent.
+const (
+	warningsKey = "responses.warnings"
+	summaryKey  = "responses.summary"
+)
+
+// Warn records a warning to be sent with the next success response of this request.
+func Warn(c *gin.Context, warning string) {
+	c.Set(warningsKey, append(warnings(c), warning))
+}
+
+// warnings returns the warnings recorded with Warn for this request.
+func warnings(c *gin.Context) []string {
+	if v, ok := c.Get(warningsKey); ok {
+		if w, ok := v.([]string); ok {
+			return w
+		}
+	}
+	return nil
 }
 
-// InitLogger initializes the structured logger for API responses.
-func InitLogger() {
-	logger, _ = zap.NewProduction()
+// Pagination describes the page returned when a result list is paginated.
+type Pagination struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"page_size"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// AddSummary records a summary entry to be sent with the next success response of this request.
+func AddSummary(c *gin.Context, key string, value interface{}) {
+	s := summary(c)
+	if s == nil {
+		s = make(map[string]interface{})
+		c.Set(summaryKey, s)
+	}
+	s[key] = value
+}
+
+// summary returns the entries recorded with AddSummary for this request.
+func summary(c *gin.Context) map[string]interface{} {
+	if v, ok := c.Get(summaryKey); ok {
+		if s, ok := v.(map[string]interface{}); ok {
+			return s
+		}
+	}
+	return nil
 }
 
 // Success sends a successful response with the provided data and message.
 func Success(c *gin.Context, data interface{}, message string) {
-	resp := APIResponse{Status: "success", Data: data, Message: message}
+	resp := APIResponse{Status: "success", Data: data, Message: message, Warnings: warnings(c), Summary: summary(c)}
+	c.JSON(http.StatusOK, resp)
+	logging.L().Info("API success", zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+}
+
+// SuccessWithMeta sends a successful response carrying metadata (e.g. Pagination) alongside the data.
+func SuccessWithMeta(c *gin.Context, data interface{}, meta interface{}, message string) {
+	resp := APIResponse{Status: "success", Data: data, Message: message, Meta: meta, Warnings: warnings(c), Summary: summary(c)}
 	c.JSON(http.StatusOK, resp)
-	logger.Info("API success", zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	logging.L().Info("API success", zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
 }
 
 // Error sends an error response with the provided code, message, and optional errors.
 func Error(c *gin.Context, code int, message string, errs ...string) {
 	resp := APIResponse{Status: "error", Message: message, Errors: errs}
 	c.JSON(code, resp)
-	logger.Error("API error", zap.String("path", c.Request.URL.Path), zap.Int("status", code), zap.Strings("errors", errs))
+	logging.L().Error("API error", zap.String("path", c.Request.URL.Path), zap.Int("status", code), zap.Strings("errors", errs))
 }
@@ -0,0 +1,68 @@
+// internal/audit/audit.go
+package audit
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// Collection is the Firestore collection where audit records are stored.
+const Collection = "audit"
+
+// Record describes one finished conversion, as listed by GET /history.
+type Record struct {
+	Username  string    `firestore:"username" json:"username"`
+	Kind      string    `firestore:"kind" json:"kind"`
+	Timestamp time.Time `firestore:"timestamp" json:"timestamp"`
+	Rows      int       `firestore:"rows" json:"rows"`
+	Fallbacks int       `firestore:"fallbacks" json:"fallbacks"`
+}
+
+// Store persists audit records and lists the most recent ones of a user.
+type Store interface {
+	Add(ctx context.Context, rec Record) error
+	Recent(ctx context.Context, username string, limit int) ([]Record, error)
+}
+
+type firestoreStore struct {
+	db *firestore.Client
+}
+
+// NewFirestoreStore creates a Store backed by the Collection of the given client.
+// Recent needs a composite index on (username, timestamp desc).
+func NewFirestoreStore(db *firestore.Client) Store {
+	return &firestoreStore{db: db}
+}
+
+func (s *firestoreStore) Add(ctx context.Context, rec Record) error {
+	_, _, err := s.db.Collection(Collection).Add(ctx, rec)
+	return err
+}
+
+func (s *firestoreStore) Recent(ctx context.Context, username string, limit int) ([]Record, error) {
+	iter := s.db.Collection(Collection).
+		Where("username", "==", username).
+		OrderBy("timestamp", firestore.Desc).
+		Limit(limit).
+		Documents(ctx)
+	defer iter.Stop()
+
+	records := make([]Record, 0, limit)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec Record
+		if err := doc.DataTo(&rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+}
@@ -0,0 +1,166 @@
+// package analysis/jobs.go
+package analysis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+)
+
+// JobStatus is the stage of an analysis job run in the background.
+type JobStatus string
+
+const (
+	JobPendente    JobStatus = "pendente"
+	JobProcessando JobStatus = "processando"
+	JobConcluido   JobStatus = "concluido"
+	JobFalhou      JobStatus = "falhou"
+)
+
+// ErrJobsEsgotados is returned by JobStore.Submit when the store is full of unfinished jobs.
+var ErrJobsEsgotados = errors.New("limite de análises em andamento atingido")
+
+// Job is a snapshot of an analysis job. Results is only filled once the job is JobConcluido and
+// Error once it is JobFalhou.
+type Job struct {
+	ID         string                  `json:"job_id"`
+	Status     JobStatus               `json:"status"`
+	CreatedAt  time.Time               `json:"created_at"`
+	FinishedAt *time.Time              `json:"finished_at,omitempty"`
+	Results    []domain.AnalysisResult `json:"results,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+// JobStore runs analyses in the background and keeps their state in memory, so clients can poll
+// long analyses instead of holding an HTTP request open. Finished jobs expire after ttl; when the
+// store is full, the oldest finished job is dropped, and a new job is refused if none has finished.
+type JobStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*storedJob
+	now        func() time.Time
+}
+
+type storedJob struct {
+	job       Job
+	expiresAt time.Time // zero while the job runs
+}
+
+// NewJobStore creates a store that keeps up to maxEntries jobs, each for ttl after it finishes.
+func NewJobStore(ttl time.Duration, maxEntries int) *JobStore {
+	return &JobStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*storedJob),
+		now:        time.Now,
+	}
+}
+
+// Submit registers a job and runs it in a new goroutine, returning its id right away. A panic in
+// run fails the job instead of taking the server down.
+func (st *JobStore) Submit(run func() ([]domain.AnalysisResult, error)) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	st.mu.Lock()
+	now := st.now()
+	st.evictExpired(now)
+	if len(st.entries) >= st.maxEntries && !st.evictOldestFinished() {
+		st.mu.Unlock()
+		return "", ErrJobsEsgotados
+	}
+	st.entries[id] = &storedJob{job: Job{ID: id, Status: JobPendente, CreatedAt: now}}
+	st.mu.Unlock()
+
+	go st.run(id, run)
+	return id, nil
+}
+
+func (st *JobStore) run(id string, run func() ([]domain.AnalysisResult, error)) {
+	st.update(id, func(job *Job) { job.Status = JobProcessando })
+
+	var results []domain.AnalysisResult
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("erro inesperado na análise: %v", r)
+			}
+		}()
+		results, err = run()
+	}()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.entries[id]
+	if !ok {
+		return
+	}
+	now := st.now()
+	entry.job.FinishedAt = &now
+	entry.expiresAt = now.Add(st.ttl)
+	if err != nil {
+		entry.job.Status, entry.job.Error = JobFalhou, err.Error()
+		return
+	}
+	entry.job.Status, entry.job.Results = JobConcluido, results
+}
+
+func (st *JobStore) update(id string, fn func(job *Job)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if entry, ok := st.entries[id]; ok {
+		fn(&entry.job)
+	}
+}
+
+// Get returns a snapshot of the job, if it is still stored.
+func (st *JobStore) Get(id string) (Job, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.entries[id]
+	if !ok {
+		return Job{}, false
+	}
+	if !entry.expiresAt.IsZero() && st.now().After(entry.expiresAt) {
+		delete(st.entries, id)
+		return Job{}, false
+	}
+	return entry.job, true
+}
+
+func (st *JobStore) evictExpired(now time.Time) {
+	for id, entry := range st.entries {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(st.entries, id)
+		}
+	}
+}
+
+// evictOldestFinished drops the finished job that expires first and reports whether there was one.
+func (st *JobStore) evictOldestFinished() bool {
+	var oldest string
+	var oldestAt time.Time
+	for id, entry := range st.entries {
+		if entry.expiresAt.IsZero() {
+			continue
+		}
+		if oldest == "" || entry.expiresAt.Before(oldestAt) {
+			oldest, oldestAt = id, entry.expiresAt
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(st.entries, oldest)
+	return true
+}
@@ -0,0 +1,76 @@
+package analysis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+)
+
+// esperarJob aguarda o job sair de pendente/processando.
+func esperarJob(t *testing.T, st *JobStore, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := st.Get(id)
+		if !ok {
+			t.Fatalf("Job %s sumiu antes de terminar", id)
+		}
+		if job.Status == JobConcluido || job.Status == JobFalhou {
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Job %s não terminou a tempo", id)
+	return Job{}
+}
+
+// TestJobStoreCicloDeVida cobre o resultado, a falha, o panic e a expiração após o término.
+func TestJobStoreCicloDeVida(t *testing.T) {
+	st := NewJobStore(10*time.Minute, 10)
+
+	liberar := make(chan struct{})
+	ok, _ := st.Submit(func() ([]domain.AnalysisResult, error) {
+		<-liberar
+		return []domain.AnalysisResult{{NFeKey: "1"}}, nil
+	})
+	if job, _ := st.Get(ok); job.Status != JobPendente && job.Status != JobProcessando {
+		t.Errorf("Job em andamento com status %q", job.Status)
+	}
+	close(liberar)
+	if job := esperarJob(t, st, ok); job.Status != JobConcluido || len(job.Results) != 1 || job.FinishedAt == nil {
+		t.Errorf("Esperava job concluído com 1 resultado, obteve %+v", job)
+	}
+
+	falha, _ := st.Submit(func() ([]domain.AnalysisResult, error) { return nil, errors.New("SPED ilegível") })
+	if job := esperarJob(t, st, falha); job.Status != JobFalhou || job.Error != "SPED ilegível" {
+		t.Errorf("Esperava job com falha, obteve %+v", job)
+	}
+	pane, _ := st.Submit(func() ([]domain.AnalysisResult, error) { panic("boom") })
+	if job := esperarJob(t, st, pane); job.Status != JobFalhou || job.Error == "" {
+		t.Errorf("Panic deveria falhar o job, obteve %+v", job)
+	}
+
+	agora := time.Now().Add(11 * time.Minute)
+	st.mu.Lock()
+	st.now = func() time.Time { return agora }
+	st.mu.Unlock()
+	if _, achou := st.Get(ok); achou {
+		t.Error("Job concluído deveria expirar após o TTL")
+	}
+}
+
+// TestJobStoreLimite verifica que jobs em andamento não são descartados para abrir espaço.
+func TestJobStoreLimite(t *testing.T) {
+	st := NewJobStore(10*time.Minute, 1)
+	liberar := make(chan struct{})
+	defer close(liberar)
+
+	if _, err := st.Submit(func() ([]domain.AnalysisResult, error) { <-liberar; return nil, nil }); err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if _, err := st.Submit(func() ([]domain.AnalysisResult, error) { return nil, nil }); !errors.Is(err, ErrJobsEsgotados) {
+		t.Errorf("Esperava ErrJobsEsgotados com o único job em andamento, obteve %v", err)
+	}
+}
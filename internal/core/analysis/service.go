@@ -2,31 +2,267 @@
 package analysis
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"encoding/csv"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/LuisEduardoPedra/analiseSped/internal/workers"
+	"github.com/xuri/excelize/v2"
 	"golang.org/x/text/encoding/charmap"
 )
 
 const EPSILON = 0.01
 
+// ErrNenhumC100 is returned when a SPED file yields no usable C100 record, which usually means
+// the wrong file, delimiter or layout rather than a period without notes.
+var ErrNenhumC100 = errors.New("nenhum registro C100 encontrado — verifique o layout/delimitador do SPED")
+
+// ErrChaveInvalida is returned by SpedInfoForChave when the key does not have 44 digits.
+var ErrChaveInvalida = errors.New("chave de acesso inválida: são esperados 44 dígitos")
+
 // Service defines the interface for SPED file analysis services.
 type Service interface {
-	AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, cfopsToIgnore []string) ([]domain.AnalysisResult, error)
+	AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, opts ICMSOptions) ([]domain.AnalysisResult, error)
+	ParseICMSFiles(spedFile io.Reader, xmlFiles []io.Reader) (*ParsedICMS, error)
+	ParseICMSFilesProgress(spedFile io.Reader, xmlFiles []io.Reader, progress ProgressFunc) (*ParsedICMS, error)
+	ReanalyzeICMS(parsed *ParsedICMS, opts ICMSOptions) []domain.AnalysisResult
 	AnalyzeIPISTFiles(spedFile io.Reader, xmlFiles []io.Reader) ([]domain.AnalysisResult, error)
+	ValidateXMLFiles(xmlFiles []io.Reader) []domain.XMLValidationResult
+	ExportSpedDraft(results []domain.AnalysisResult) ([]byte, error)
+	CheckCNPJ(spedFile io.Reader, xmlFiles []io.Reader) (domain.CNPJCheck, error)
+	SpedInfoForChave(spedFile io.Reader, chave string) ([]domain.SpedInfo, error)
+}
+
+// ICMSOptions holds the optional parameters of an ICMS analysis. The zero value compares every
+// note exactly.
+type ICMSOptions struct {
+	// CfopsToIgnore marks notes with any of these CFOPs in their C190 records as having no ICMS
+	// to compare. Entries may also be wildcards or ranges (see ParseCFOPPatterns); invalid ones
+	// are skipped, so callers should validate user input with ParseCFOPPatterns first.
+	CfopsToIgnore []string
+	// EmittersToIgnore leaves out of the results the notes issued by these CNPJs.
+	EmittersToIgnore []string
+	// Tolerance is the largest XML x SPED ICMS difference not reported as a discrepancy
+	// (e.g. 0.02 for rounding differences).
+	Tolerance float64
+	// CompareST also compares the ICMS-ST of each note (items' vICMSST x C190 VL_ICMS_ST), in the
+	// same pass and with the same tolerance and ignore lists. A note whose own ICMS matches but
+	// whose ICMS-ST does not is reported as domain.StatusDiscrepanciaICMSST.
+	CompareST bool
+	// ComparePISCOFINS also compares PIS and COFINS (items' vPIS/vCOFINS x C100, or the C170 sum
+	// when the C100 is zero). Notes that only differ here get domain.StatusDiscrepanciaPISCOFINS.
+	ComparePISCOFINS bool
+	// CompareTotal also compares the note total (ICMSTot/vNF x C100 VL_DOC), catching typos in the
+	// bookkeeping that do not touch the ICMS. Notes that only differ here get
+	// domain.StatusDiscrepanciaValorTotal.
+	CompareTotal bool
+	// CompareCST also compares the tax situation of each note: the distinct origin + CST/CSOSN of
+	// the XML items against the distinct C190 CST_ICMS. A note booked under another CST (e.g. 000
+	// in the XML and 020 in the SPED) is wrong even when the ICMS matches; notes that only differ
+	// here get domain.StatusDiscrepanciaCST.
+	CompareCST bool
+	// IncludeMatched also returns the notes whose XML and SPED agree, with domain.StatusOK, so the
+	// results cover every analyzed note (notes of ignored emitters are still left out).
+	IncludeMatched bool
+	// AbsoluteReturns compares the ICMS of devolução notes (see IsCFOPDevolucao) by absolute value,
+	// since the SPED may carry them negative while the XML always reports positive values.
+	AbsoluteReturns bool
+	// AllowedCfops, when not empty, is the only set of CFOPs expected in the C190 records: a note
+	// with any other CFOP gets domain.StatusCFOPNaoPermitido, whatever its ICMS comparison.
+	AllowedCfops []string
+	// Operation limits the analysis to the notes whose C100 IND_OPER matches (OperacaoEntrada or
+	// OperacaoSaida); empty analyzes both. Notes not found in the SPED have no known operation and
+	// are always reported.
+	Operation string
+	// Establishment limits the analysis to the notes booked under this CNPJ in a SPED with several
+	// establishments (see parseSpedFileForICMS); empty analyzes all of them.
+	Establishment string
+	// DetectMissingXML also reports the SPED C100 keys for which no XML was sent, with
+	// domain.StatusSemXML, the note number and the SPED ICMS. Operation applies to them too.
+	DetectMissingXML bool
+}
+
+// Values of the C100 IND_OPER field, accepted in ICMSOptions.Operation.
+const (
+	OperacaoEntrada = "0"
+	OperacaoSaida   = "1"
+)
+
+// cfopsDevolucao are the last three digits of the devolução CFOPs, valid for every first digit
+// (entradas 1/2/3, saídas 5/6/7).
+var cfopsDevolucao = map[string]bool{
+	"201": true, "202": true, "203": true, "204": true, "205": true, "206": true, "207": true,
+	"208": true, "209": true, "210": true, "410": true, "411": true, "412": true, "413": true,
+	"503": true, "504": true, "553": true, "555": true, "556": true, "660": true, "661": true,
+	"662": true, "918": true, "919": true,
 }
 
-type service struct{}
+// IsCFOPDevolucao reports whether the CFOP is a devolução (return of goods).
+func IsCFOPDevolucao(cfop string) bool {
+	cfop = strings.TrimSpace(cfop)
+	return len(cfop) == 4 && cfopsDevolucao[cfop[1:]]
+}
+
+// cfopRange is an inclusive range of CFOPs with the same number of digits; an exact CFOP has
+// lo == hi.
+type cfopRange struct{ lo, hi string }
+
+// CFOPSet is a parsed list of CFOP patterns (see ParseCFOPPatterns).
+type CFOPSet []cfopRange
+
+// Contains reports whether cfop matches any pattern of the set.
+func (s CFOPSet) Contains(cfop string) bool {
+	cfop = strings.TrimSpace(cfop)
+	for _, r := range s {
+		if len(cfop) == len(r.lo) && r.lo <= cfop && cfop <= r.hi {
+			return true
+		}
+	}
+	return false
+}
 
-// NewService creates a new analysis service.
+// ParseCFOPPatterns parses a CFOP list where each entry is an exact CFOP ("5102"), a wildcard
+// over the trailing digits ("5*", "51*", also written "5.*") or an inclusive range
+// ("5100-5199"). Dots and spaces are ignored, as in "5.102". The returned set holds every valid
+// entry; the error reports the first invalid one.
+func ParseCFOPPatterns(patterns []string) (CFOPSet, error) {
+	const cfopLen = 4
+	var set CFOPSet
+	var firstErr error
+	fail := func(p string, reason string) {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("padrão de CFOP inválido %q: %s", p, reason)
+		}
+	}
+	for _, p := range patterns {
+		clean := strings.NewReplacer(".", "", " ", "").Replace(strings.TrimSpace(p))
+		if clean == "" {
+			continue
+		}
+		if lo, hi, ok := strings.Cut(clean, "-"); ok {
+			switch {
+			case len(lo) != cfopLen || len(hi) != cfopLen || !allDigits(lo) || !allDigits(hi):
+				fail(p, "use uma faixa de dois CFOPs de 4 dígitos, como 5100-5199")
+			case lo > hi:
+				fail(p, "o início da faixa é maior que o fim")
+			default:
+				set = append(set, cfopRange{lo, hi})
+			}
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(clean, "*"); ok {
+			if len(prefix) >= cfopLen || !allDigits(prefix) {
+				fail(p, "o curinga * só pode vir depois dos primeiros dígitos, como 5* ou 51*")
+				continue
+			}
+			pad := cfopLen - len(prefix)
+			set = append(set, cfopRange{prefix + strings.Repeat("0", pad), prefix + strings.Repeat("9", pad)})
+			continue
+		}
+		if !allDigits(clean) {
+			fail(p, "use só dígitos, curinga (5*) ou faixa (5100-5199)")
+			continue
+		}
+		set = append(set, cfopRange{clean, clean})
+	}
+	return set, firstErr
+}
+
+// allDigits reports whether s only has ASCII digits (an empty s included).
+func allDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+// service keeps no state between calls: every parse builds its own maps, so one instance
+// can serve concurrent requests. workers bounds the goroutines used inside a single analysis.
+type service struct {
+	workers int
+}
+
+// runPool runs the per-XML work of an analysis; tests replace it to observe the pool size.
+var runPool = workers.Each
+
+// NewService creates a new analysis service using the default worker pool size.
 func NewService() Service {
-	return &service{}
+	return NewServiceWithWorkers(workers.DefaultSize())
+}
+
+// NewServiceWithWorkers creates a new analysis service that parses XMLs with up to n workers.
+func NewServiceWithWorkers(n int) Service {
+	if n < 1 {
+		n = 1
+	}
+	return &service{workers: n}
+}
+
+// Positions (after splitting the line by "|") of the SPED fields used in the analysis. The EFD
+// ICMS/IPI layouts published so far (COD_VER 002 onwards) never moved these fields.
+const (
+	campoR0000CNPJ   = 7
+	campoR0140CNPJ   = 4
+	campoC010CNPJ    = 2
+	campoC100IndOper = 2
+	campoC100NumDoc  = 8
+	campoC100Chave   = 9
+	campoC100VlDoc   = 12
+	campoC100VlICMS  = 22
+	campoC100VlST    = 24
+	campoC100VlIPI   = 25
+	campoC100VlPIS   = 26
+	campoC100VlCOF   = 27
+	campoC170VlST    = 18
+	campoC170VlIPI   = 24
+	campoC170VlPIS   = 30
+	campoC170VlCOF   = 36
+	campoC190CST     = 2
+	campoC190CFOP    = 3
+	campoC190VlICMS  = 7
+	campoC190VlST    = 9
+)
+
+// splitSpedLine splits a SPED line so that parts[1] is always the REG field. The spec wraps
+// every line in pipes; lines missing the leading pipe are realigned, and a pipe escaped as
+// "\|" inside a field is kept as content instead of starting a new field.
+func splitSpedLine(line string) []string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if !strings.HasPrefix(line, "|") {
+		line = "|" + line
+	}
+	if !strings.Contains(line, `\|`) {
+		return strings.Split(line, "|")
+	}
+
+	var parts []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			field.WriteByte('|')
+			i++
+		case line[i] == '|':
+			parts = append(parts, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(parts, field.String())
 }
 
 // AnalyzeIPISTFiles analyzes IPI and ST from SPED and XML files.
@@ -72,36 +308,174 @@ func (s *service) AnalyzeIPISTFiles(spedFile io.Reader, xmlFiles []io.Reader) ([
 				StatusCode: statusCode,
 				Alerts:     alerts,
 				Data:       data,
+				SourceFile: xmlData.SourceFile,
 			}
 			finalResults = append(finalResults, result)
 		}
 	}
 
+	// o mapa não tem ordem: ordena por chave para que o resultado seja sempre o mesmo
+	sort.Slice(finalResults, func(i, j int) bool { return finalResults[i].NFeKey < finalResults[j].NFeKey })
 	return finalResults, nil
 }
 
-// parseXMLsForIPIST parses XML files for IPI and ST data.
-func (s *service) parseXMLsForIPIST(xmlFiles []io.Reader) (map[string]domain.XMLTaxData, error) {
-	xmlDataMap := make(map[string]domain.XMLTaxData)
+// CheckCNPJ compares the CNPJ of the SPED record 0000 with the issuer and recipient CNPJs of
+// the XMLs. Warning is set when none or less than half of the XMLs carrying a CNPJ involve the
+// SPED company, which usually means files from different companies were mixed up.
+//
+// It also infers the company from the XMLs alone (see inferCompanyCNPJ) and counts the notes
+// it received (entradas) and issued (saídas), so the side of each note needs no user input.
+func (s *service) CheckCNPJ(spedFile io.Reader, xmlFiles []io.Reader) (domain.CNPJCheck, error) {
+	var check domain.CNPJCheck
+	spedCNPJ, err := readSpedCNPJ(spedFile)
+	if err != nil {
+		return check, fmt.Errorf("falha ao processar arquivo SPED: %w", err)
+	}
+	check.SpedCNPJ = spedCNPJ
 
-	for _, xmlFile := range xmlFiles {
-		bytes, err := io.ReadAll(xmlFile)
+	var parties []nfeParties
+	for _, xmlFile := range expandXMLFiles(xmlFiles) {
+		data, err := io.ReadAll(xmlFile)
+		if err != nil {
+			continue
+		}
+		nfeProc, _, err := unmarshalNFeProc(data)
 		if err != nil {
 			continue
 		}
+		infNFe := nfeProc.NFe.InfNFe
+		p := nfeParties{emit: onlyDigits(infNFe.Emit.CNPJ), dest: onlyDigits(infNFe.Dest.CNPJ)}
+		if p.emit != "" || p.dest != "" {
+			parties = append(parties, p)
+		}
+	}
+
+	check.InferredCNPJ = inferCompanyCNPJ(parties)
+	var matched int
+	for _, p := range parties {
+		switch check.InferredCNPJ {
+		case "":
+		case p.dest:
+			check.Incoming++
+		case p.emit:
+			check.Outgoing++
+		}
+		if spedCNPJ != "" && (p.emit == spedCNPJ || p.dest == spedCNPJ) {
+			matched++
+		}
+	}
+
+	total := len(parties)
+	switch {
+	case spedCNPJ == "" || total == 0:
+	case matched == 0:
+		check.Warning = fmt.Sprintf("Nenhum dos %d XMLs tem o CNPJ %s do SPED como emitente ou destinatário; verifique se os arquivos são da mesma empresa", total, spedCNPJ)
+	case matched*2 < total:
+		check.Warning = fmt.Sprintf("Apenas %d de %d XMLs têm o CNPJ %s do SPED como emitente ou destinatário; verifique se os arquivos são da mesma empresa", matched, total, spedCNPJ)
+	}
+	return check, nil
+}
+
+// nfeParties holds the issuer and recipient CNPJs (digits only) of one NFe.
+type nfeParties struct {
+	emit string
+	dest string
+}
+
+// inferCompanyCNPJ guesses the company that owns a batch of XMLs: the recipient of the majority
+// of the notes (a batch of purchases). Without such a majority, e.g. a batch of sales to many
+// customers, it falls back to the CNPJ present in most notes on either side. Ties go to the
+// smallest CNPJ so the answer does not depend on file order.
+func inferCompanyCNPJ(parties []nfeParties) string {
+	destCount := make(map[string]int)
+	anyCount := make(map[string]int)
+	for _, p := range parties {
+		if p.dest != "" {
+			destCount[p.dest]++
+			anyCount[p.dest]++
+		}
+		if p.emit != "" && p.emit != p.dest {
+			anyCount[p.emit]++
+		}
+	}
+
+	if cnpj, n := mostFrequent(destCount); n*2 > len(parties) {
+		return cnpj
+	}
+	cnpj, _ := mostFrequent(anyCount)
+	return cnpj
+}
+
+// mostFrequent returns the key with the highest count, the smallest key winning ties.
+func mostFrequent(counts map[string]int) (string, int) {
+	var best string
+	var bestCount int
+	for k, n := range counts {
+		if n > bestCount || (n == bestCount && k < best) {
+			best, bestCount = k, n
+		}
+	}
+	return best, bestCount
+}
 
-		var nfeProc domain.NFeProc
-		if err := xml.Unmarshal(bytes, &nfeProc); err != nil {
+// readSpedCNPJ returns the CNPJ (digits only) of the SPED record 0000, stopping at that record.
+func readSpedCNPJ(spedFile io.Reader) (string, error) {
+	scanner := bufio.NewScanner(charmap.ISO8859_1.NewDecoder().Reader(spedFile))
+	for scanner.Scan() {
+		parts := splitSpedLine(scanner.Text())
+		if len(parts) < 2 || parts[1] != "0000" {
 			continue
 		}
+		if len(parts) > campoR0000CNPJ {
+			return onlyDigits(parts[campoR0000CNPJ]), nil
+		}
+		return "", nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("erro ao ler arquivo SPED: %w", err)
+	}
+	return "", nil
+}
+
+// onlyDigits drops everything but digits, so formatted CNPJs ("14.200.166/0001-87") compare equal.
+func onlyDigits(raw string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, raw)
+}
 
+// parseXMLsForIPIST parses XML files for IPI and ST data.
+func (s *service) parseXMLsForIPIST(xmlFiles []io.Reader) (map[string]domain.XMLTaxData, error) {
+	// o parse roda no pool; o mapa é montado depois, na ordem dos arquivos, para que uma chave
+	// repetida fique sempre com o último XML enviado
+	docs := expandXMLFiles(xmlFiles)
+	keys := make([]string, len(docs))
+	values := make([]domain.XMLTaxData, len(docs))
+	runPool(s.workers, len(docs), func(i int) {
+		bytes, err := io.ReadAll(docs[i])
+		if err != nil {
+			return
+		}
+		nfeProc, _, err := unmarshalNFeProc(bytes)
+		if err != nil {
+			return
+		}
 		infNFe := nfeProc.NFe.InfNFe
-		nfeKey := strings.TrimPrefix(infNFe.ID, "NFe")
+		keys[i], _ = normalizeChave(infNFe.ID)
+		values[i] = domain.XMLTaxData{
+			STValue:    infNFe.Total.ICMSTot.VST,
+			IPIValue:   infNFe.Total.ICMSTot.VIPI,
+			SourceFile: sourceName(docs[i]),
+		}
+	})
+
+	xmlDataMap := make(map[string]domain.XMLTaxData, len(docs))
+	for i, nfeKey := range keys {
 		if nfeKey != "" {
-			xmlDataMap[nfeKey] = domain.XMLTaxData{
-				STValue:  infNFe.Total.ICMSTot.VST,
-				IPIValue: infNFe.Total.ICMSTot.VIPI,
-			}
+			xmlDataMap[nfeKey] = values[i]
 		}
 	}
 	return xmlDataMap, nil
@@ -115,6 +489,7 @@ type SpedIPISTResult struct {
 }
 
 // parseSpedForIPIST parses SPED file for IPI and ST data.
+// The returned map is freshly allocated and owned by the caller.
 func (s *service) parseSpedForIPIST(spedFile io.Reader) (map[string]SpedIPISTResult, error) {
 	contexts := make(map[string]*domain.SpedTaxContext)
 	var currentC100Key string
@@ -123,31 +498,30 @@ func (s *service) parseSpedForIPIST(spedFile io.Reader) (map[string]SpedIPISTRes
 	scanner := bufio.NewScanner(decoder.Reader(spedFile))
 
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, "|")
+		parts := splitSpedLine(scanner.Text())
 		if len(parts) < 2 {
 			continue
 		}
 		recordType := parts[1]
 		switch recordType {
 		case "C100":
-			if len(parts) > 25 {
-				nfeKey := parts[9]
+			if len(parts) > campoC100VlIPI && len(parts) > campoC100VlST {
+				nfeKey, _ := normalizeChave(parts[campoC100Chave])
 				currentC100Key = nfeKey
 				if _, ok := contexts[nfeKey]; !ok {
 					contexts[nfeKey] = &domain.SpedTaxContext{}
 				}
-				contexts[nfeKey].C100IPIValue = parseNumberSped(parts[25])
-				contexts[nfeKey].C100STValue = parseNumberSped(parts[24])
+				contexts[nfeKey].C100IPIValue = parseNumberSped(parts[campoC100VlIPI])
+				contexts[nfeKey].C100STValue = parseNumberSped(parts[campoC100VlST])
 			}
 		case "C170":
-			if ctx, ok := contexts[currentC100Key]; ok && len(parts) > 24 {
-				ctx.C170SumST += parseNumberSped(parts[18])
-				ctx.C170SumIPI += parseNumberSped(parts[24])
+			if ctx, ok := contexts[currentC100Key]; ok && len(parts) > campoC170VlIPI && len(parts) > campoC170VlST {
+				ctx.C170SumST += parseNumberSped(parts[campoC170VlST])
+				ctx.C170SumIPI += parseNumberSped(parts[campoC170VlIPI])
 			}
 		case "C190":
-			if ctx, ok := contexts[currentC100Key]; ok && len(parts) > 9 {
-				ctx.C190SumST += parseNumberSped(parts[9])
+			if ctx, ok := contexts[currentC100Key]; ok && len(parts) > campoC190VlST {
+				ctx.C190SumST += parseNumberSped(parts[campoC190VlST])
 			}
 		}
 	}
@@ -155,6 +529,9 @@ func (s *service) parseSpedForIPIST(spedFile io.Reader) (map[string]SpedIPISTRes
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("erro ao ler arquivo SPED: %w", err)
 	}
+	if len(contexts) == 0 {
+		return nil, ErrNenhumC100
+	}
 
 	finalizedResults := make(map[string]SpedIPISTResult)
 	for key, ctx := range contexts {
@@ -192,25 +569,116 @@ func (s *service) parseSpedForIPIST(spedFile io.Reader) (map[string]SpedIPISTRes
 }
 
 // AnalyzeICMSFiles analyzes ICMS from SPED and XML files.
-func (s *service) AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, cfopsToIgnore []string) ([]domain.AnalysisResult, error) {
-	cfopsMap := make(map[string]bool)
-	for _, cfop := range cfopsToIgnore {
-		cfopsMap[cfop] = true
+func (s *service) AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, opts ICMSOptions) ([]domain.AnalysisResult, error) {
+	parsed, err := s.ParseICMSFiles(spedFile, xmlFiles)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReanalyzeICMS(parsed, opts), nil
+}
+
+// ParsedICMS holds the parsed SPED and XMLs of an ICMS analysis. It is read-only once built, so
+// it can be kept and re-analyzed with other CFOP ignore lists (see ReanalyzeICMS) concurrently.
+type ParsedICMS struct {
+	sped    map[string][]domain.SpedInfo
+	xmls    []XMLICMSResult
+	xmlErrs []error
+}
+
+// NoneInSPED reports whether none of the readable XMLs has its key in the SPED. When every note
+// is missing, the files are most likely from different periods or companies rather than the
+// notes being unbooked; XMLs that failed to parse or have an invalid key are not counted.
+func (p *ParsedICMS) NoneInSPED() bool {
+	lidos := 0
+	for i, x := range p.xmls {
+		if p.xmlErrs[i] != nil || !ValidChaveNFe(x.NFeKey) {
+			continue
+		}
+		if len(p.sped[x.NFeKey]) > 0 {
+			return false
+		}
+		lidos++
 	}
+	return lidos > 0
+}
+
+// ProgressFunc receives how many of the total XMLs of an analysis have been parsed so far.
+type ProgressFunc func(done, total int)
+
+// ProgressInterval is how many XMLs are parsed between two ProgressFunc calls; the last XML
+// always reports, so the final call has done == total.
+const ProgressInterval = 50
+
+// ParseICMSFiles reads the SPED and the XMLs of an ICMS analysis without applying any CFOP
+// ignore list, which only matters when the results are computed.
+func (s *service) ParseICMSFiles(spedFile io.Reader, xmlFiles []io.Reader) (*ParsedICMS, error) {
+	return s.ParseICMSFilesProgress(spedFile, xmlFiles, nil)
+}
 
-	spedData, err := s.parseSpedFileForICMS(spedFile, cfopsMap)
+// ParseICMSFilesProgress is ParseICMSFiles reporting the XMLs parsed every ProgressInterval notes
+// (the XMLs of a ZIP count one by one). The calls come from the worker goroutines but never
+// overlap, and done only grows; a nil progress is not called.
+func (s *service) ParseICMSFilesProgress(spedFile io.Reader, xmlFiles []io.Reader, progress ProgressFunc) (*ParsedICMS, error) {
+	spedData, err := s.parseSpedFileForICMS(spedFile, nil)
 	if err != nil {
 		return nil, fmt.Errorf("falha ao processar arquivo SPED: %w", err)
 	}
 
+	// os XMLs são independentes entre si: o parse roda no pool e a conciliação, em ordem
+	docs := expandXMLFiles(xmlFiles)
+	parsed := &ParsedICMS{
+		sped:    spedData,
+		xmls:    make([]XMLICMSResult, len(docs)),
+		xmlErrs: make([]error, len(docs)),
+	}
+	var mu sync.Mutex
+	done := 0
+	runPool(s.workers, len(docs), func(i int) {
+		parsed.xmls[i], parsed.xmlErrs[i] = s.parseXMLForICMS(docs[i])
+		parsed.xmls[i].SourceFile = sourceName(docs[i])
+		if progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if done++; done%ProgressInterval == 0 || done == len(docs) {
+			progress(done, len(docs))
+		}
+	})
+	return parsed, nil
+}
+
+// ReanalyzeICMS reconciles already parsed files with the given options (see ICMSOptions).
+// XMLs that could not be parsed are always reported, whatever their issuer.
+func (s *service) ReanalyzeICMS(parsed *ParsedICMS, opts ICMSOptions) []domain.AnalysisResult {
+	// entradas inválidas são descartadas; o handler já as recusou
+	cfopsIgnored, _ := ParseCFOPPatterns(opts.CfopsToIgnore)
+	allowedMap := make(map[string]bool)
+	for _, cfop := range opts.AllowedCfops {
+		allowedMap[cfop] = true
+	}
+	emittersMap := make(map[string]bool)
+	for _, cnpj := range opts.EmittersToIgnore {
+		if cnpj = onlyDigits(cnpj); cnpj != "" {
+			emittersMap[cnpj] = true
+		}
+	}
+
+	establishment := onlyDigits(opts.Establishment)
+
 	var problematicResults []domain.AnalysisResult
 
-	for _, xmlFile := range xmlFiles {
-		xmlResult, err := s.parseXMLForICMS(xmlFile)
-		if err != nil {
+	for i, xmlResult := range parsed.xmls {
+		report := func(r domain.AnalysisResult) {
+			r.SourceFile = xmlResult.SourceFile
+			problematicResults = append(problematicResults, r)
+		}
+		if err := parsed.xmlErrs[i]; err != nil {
 			data := domain.ICMSData{
-				DocNumber: xmlResult.DocNumber,
-				IcmsXML:   xmlResult.IcmsXML,
+				DocNumber:  xmlResult.DocNumber,
+				IssueDate:  xmlResult.IssueDate,
+				IcmsXML:    xmlResult.IcmsXML,
+				ItemGroups: xmlResult.ItemGroups,
 			}
 			result := domain.AnalysisResult{
 				Type:       domain.TypeICMS,
@@ -219,27 +687,157 @@ func (s *service) AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, cfo
 				Alerts:     []string{err.Error()},
 				Data:       data,
 			}
-			problematicResults = append(problematicResults, result)
+			report(result)
+			continue
+		}
+		// uma chave com dígito verificador errado indica XML corrompido ou adulterado: não cruza com o SPED
+		if !ValidChaveNFe(xmlResult.NFeKey) {
+			report(domain.AnalysisResult{
+				Type:       domain.TypeICMS,
+				NFeKey:     xmlResult.NFeKey,
+				StatusCode: domain.StatusChaveInvalida,
+				Alerts:     append([]string{"Chave de acesso com dígito verificador inválido"}, xmlResult.Alerts...),
+				Data: domain.ICMSData{
+					DocNumber:  xmlResult.DocNumber,
+					IssueDate:  xmlResult.IssueDate,
+					IcmsXML:    xmlResult.IcmsXML,
+					ItemGroups: xmlResult.ItemGroups,
+				},
+			})
+			continue
+		}
+		if emittersMap[xmlResult.EmitCNPJ] {
+			continue
+		}
+		if xmlResult.Cancelada {
+			report(domain.AnalysisResult{
+				Type:       domain.TypeICMS,
+				NFeKey:     xmlResult.NFeKey,
+				StatusCode: domain.StatusNotaCancelada,
+				Alerts:     append([]string{fmt.Sprintf("Nota cancelada (cStat %s: %s); não conferida com o SPED", xmlResult.CStat, xmlResult.XMotivo)}, xmlResult.Alerts...),
+				Data: domain.ICMSData{
+					DocNumber:  xmlResult.DocNumber,
+					IssueDate:  xmlResult.IssueDate,
+					IcmsXML:    xmlResult.IcmsXML,
+					ItemGroups: xmlResult.ItemGroups,
+				},
+			})
 			continue
 		}
 
 		var statusCode domain.StatusCode = domain.StatusOK
-		var alerts []string
+		// cópia: parsed pode ser reanalisado várias vezes e não deve ser alterado
+		alerts := append([]string(nil), xmlResult.Alerts...)
 
-		if spedInfo, ok := spedData[xmlResult.NFeKey]; ok {
+		bookings := parsed.sped[xmlResult.NFeKey]
+		spedInfo, ok, found := spedNoteFor(bookings, establishment)
+		if found && !ok {
+			// escriturada só em outros estabelecimentos
+			continue
+		}
+		if ok {
+			if opts.Operation != "" && spedInfo.IndOper != opts.Operation {
+				continue
+			}
+			if len(bookings) > 1 && establishment == "" {
+				cnpjs := make([]string, len(bookings))
+				for i, b := range bookings {
+					cnpjs[i] = b.CNPJ
+				}
+				alerts = append(alerts, fmt.Sprintf("Nota escriturada em %d estabelecimentos (%s); conferida com a do CNPJ %s", len(bookings), strings.Join(cnpjs, ", "), spedInfo.CNPJ))
+			}
+			spedInfo.TemCfopIgnorado = false
+			for _, cfop := range spedInfo.Cfops {
+				if cfopsIgnored.Contains(cfop) {
+					spedInfo.TemCfopIgnorado = true
+					break
+				}
+			}
+			icmsXML, icmsSPED := xmlResult.IcmsXML, spedInfo.Icms
+			if opts.AbsoluteReturns && temCfopDevolucao(spedInfo.Cfops) {
+				icmsXML, icmsSPED = math.Abs(icmsXML), math.Abs(icmsSPED)
+			}
 			data := domain.ICMSData{
-				DocNumber: xmlResult.DocNumber,
-				IcmsXML:   xmlResult.IcmsXML,
-				IcmsSPED:  spedInfo.Icms,
-				CfopsSPED: spedInfo.Cfops,
+				DocNumber:         xmlResult.DocNumber,
+				IssueDate:         xmlResult.IssueDate,
+				IcmsXML:           xmlResult.IcmsXML,
+				IcmsSPED:          spedInfo.Icms,
+				IcmsDifference:    round(math.Abs(icmsXML-icmsSPED), 2),
+				CfopsSPED:         spedInfo.Cfops,
+				IcmsByCfop:        spedInfo.IcmsPorCfop,
+				ItemGroups:        xmlResult.ItemGroups,
+				EstablishmentCNPJ: spedInfo.CNPJ,
 			}
 
-			if !spedInfo.TemCfopIgnorado && xmlResult.IcmsXML != spedInfo.Icms {
+			if !spedInfo.TemCfopIgnorado && data.IcmsDifference > opts.Tolerance {
 				statusCode = domain.StatusDiscrepanciaICMS
 				alerts = append(alerts, fmt.Sprintf("Discrepância detectada: ICMS XML=%.2f, SPED=%.2f", xmlResult.IcmsXML, spedInfo.Icms))
 			}
+			if opts.CompareST {
+				stXML, stSPED := xmlResult.IcmsStXML, spedInfo.IcmsST
+				data.IcmsStXML, data.IcmsStSPED = &stXML, &stSPED
+				if !spedInfo.TemCfopIgnorado && round(math.Abs(stXML-stSPED), 2) > opts.Tolerance {
+					if statusCode == domain.StatusOK {
+						statusCode = domain.StatusDiscrepanciaICMSST
+					}
+					alerts = append(alerts, fmt.Sprintf("Discrepância detectada: ICMS-ST XML=%.2f, SPED=%.2f", stXML, stSPED))
+				}
+			}
+			if opts.ComparePISCOFINS {
+				pisXML, pisSPED := xmlResult.PisXML, spedInfo.Pis
+				cofinsXML, cofinsSPED := xmlResult.CofinsXML, spedInfo.Cofins
+				data.PisXML, data.PisSPED = &pisXML, &pisSPED
+				data.CofinsXML, data.CofinsSPED = &cofinsXML, &cofinsSPED
+				for _, t := range []struct {
+					nome      string
+					xml, sped float64
+				}{{"PIS", pisXML, pisSPED}, {"COFINS", cofinsXML, cofinsSPED}} {
+					if round(math.Abs(t.xml-t.sped), 2) <= opts.Tolerance {
+						continue
+					}
+					if statusCode == domain.StatusOK {
+						statusCode = domain.StatusDiscrepanciaPISCOFINS
+					}
+					alerts = append(alerts, fmt.Sprintf("Discrepância detectada: %s XML=%.2f, SPED=%.2f", t.nome, t.xml, t.sped))
+				}
+			}
+			if opts.CompareTotal {
+				totalXML, totalSPED := xmlResult.TotalXML, spedInfo.ValorTotal
+				data.TotalXML, data.TotalSPED = &totalXML, &totalSPED
+				if round(math.Abs(totalXML-totalSPED), 2) > opts.Tolerance {
+					if statusCode == domain.StatusOK {
+						statusCode = domain.StatusDiscrepanciaValorTotal
+					}
+					alerts = append(alerts, fmt.Sprintf("Discrepância detectada: valor total XML=%.2f, SPED=%.2f", totalXML, totalSPED))
+				}
+			}
+			if opts.CompareCST {
+				data.CstXML, data.CstSPED = slices.Sorted(slices.Values(xmlResult.Csts)), slices.Sorted(slices.Values(spedInfo.Csts))
+				// sem CST de um dos lados não há o que comparar
+				if !spedInfo.TemCfopIgnorado && len(data.CstXML) > 0 && len(data.CstSPED) > 0 &&
+					!slices.Equal(data.CstXML, data.CstSPED) {
+					if statusCode == domain.StatusOK {
+						statusCode = domain.StatusDiscrepanciaCST
+					}
+					alerts = append(alerts, fmt.Sprintf("Discrepância detectada: CST XML=%s, SPED=%s", strings.Join(data.CstXML, ", "), strings.Join(data.CstSPED, ", ")))
+				}
+			}
+
+			if len(allowedMap) > 0 {
+				var naoPermitidos []string
+				for _, cfop := range spedInfo.Cfops {
+					if !allowedMap[cfop] {
+						naoPermitidos = append(naoPermitidos, cfop)
+					}
+				}
+				if len(naoPermitidos) > 0 {
+					statusCode = domain.StatusCFOPNaoPermitido
+					alerts = append([]string{fmt.Sprintf("CFOP fora da lista permitida: %s", strings.Join(naoPermitidos, ", "))}, alerts...)
+				}
+			}
 
-			if statusCode != domain.StatusOK {
+			// Notas sem discrepância também são reportadas quando o XML gerou alertas.
+			if statusCode != domain.StatusOK || len(alerts) > 0 || opts.IncludeMatched {
 				result := domain.AnalysisResult{
 					Type:       domain.TypeICMS,
 					NFeKey:     xmlResult.NFeKey,
@@ -247,44 +845,419 @@ func (s *service) AnalyzeICMSFiles(spedFile io.Reader, xmlFiles []io.Reader, cfo
 					Alerts:     alerts,
 					Data:       data,
 				}
-				problematicResults = append(problematicResults, result)
+				report(result)
 			}
 		} else {
 			data := domain.ICMSData{
-				DocNumber: xmlResult.DocNumber,
-				IcmsXML:   xmlResult.IcmsXML,
+				DocNumber:  xmlResult.DocNumber,
+				IssueDate:  xmlResult.IssueDate,
+				IcmsXML:    xmlResult.IcmsXML,
+				ItemGroups: xmlResult.ItemGroups,
 			}
 			result := domain.AnalysisResult{
 				Type:       domain.TypeICMS,
 				NFeKey:     xmlResult.NFeKey,
 				StatusCode: domain.StatusNaoEncontradaSPED,
-				Alerts:     []string{"NFe não encontrada no SPED"},
+				Alerts:     append([]string{"NFe não encontrada no SPED"}, alerts...),
 				Data:       data,
 			}
-			problematicResults = append(problematicResults, result)
+			report(result)
+		}
+	}
+	if opts.DetectMissingXML {
+		problematicResults = append(problematicResults, missingXMLResults(parsed, opts)...)
+	}
+	return problematicResults
+}
+
+// missingXMLResults lists, in key order, the SPED notes whose key matches none of the sent XMLs.
+// Any XML with a readable key counts as sent, even if it was reported invalid or cancelled.
+func missingXMLResults(parsed *ParsedICMS, opts ICMSOptions) []domain.AnalysisResult {
+	sent := make(map[string]bool, len(parsed.xmls))
+	for _, x := range parsed.xmls {
+		sent[x.NFeKey] = true
+	}
+	keys := make([]string, 0, len(parsed.sped))
+	for key := range parsed.sped {
+		if key != "" && !sent[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	establishment := onlyDigits(opts.Establishment)
+	var results []domain.AnalysisResult
+	for _, key := range keys {
+		// cada estabelecimento que escriturou a nota cobra o XML
+		for _, info := range parsed.sped[key] {
+			if (establishment != "" && info.CNPJ != establishment) || (opts.Operation != "" && info.IndOper != opts.Operation) {
+				continue
+			}
+			results = append(results, domain.AnalysisResult{
+				Type:       domain.TypeICMS,
+				NFeKey:     key,
+				StatusCode: domain.StatusSemXML,
+				Alerts:     []string{"Nota escriturada no SPED sem XML correspondente"},
+				Data: domain.ICMSData{
+					DocNumber:         info.NumDoc,
+					IcmsSPED:          info.Icms,
+					CfopsSPED:         info.Cfops,
+					IcmsByCfop:        info.IcmsPorCfop,
+					EstablishmentCNPJ: info.CNPJ,
+				},
+			})
+		}
+	}
+	return results
+}
+
+// temCfopDevolucao reports whether any of the note's C190 CFOPs is a devolução.
+func temCfopDevolucao(cfops []string) bool {
+	for _, cfop := range cfops {
+		if IsCFOPDevolucao(cfop) {
+			return true
+		}
+	}
+	return false
+}
+
+// XMLICMSResult holds the ICMS data extracted from a single NFe XML.
+type XMLICMSResult struct {
+	SourceFile string
+	DocNumber  string
+	IssueDate  string
+	NFeKey     string
+	EmitCNPJ   string
+	IcmsXML    float64
+	IcmsStXML  float64
+	PisXML     float64
+	CofinsXML  float64
+	TotalXML   float64
+	// Csts are the distinct origin + CST/CSOSN of the items, in item order.
+	Csts       []string
+	ItemGroups []domain.ICMSItemGroup
+	Alerts     []string
+	// CStat and XMotivo come from the authorization protocol (infProt); Cancelada is set when
+	// CStat is one of the cancellation codes.
+	CStat     string
+	XMotivo   string
+	Cancelada bool
+}
+
+// issueDate returns the emission date of the NFe as YYYY-MM-DD, taken from dhEmi or, in the
+// older layout, dEmi. It is empty when neither carries a valid date.
+func issueDate(ide domain.IdeXML) string {
+	v := strings.TrimSpace(firstNonBlank(ide.DhEmi, ide.DEmi))
+	if len(v) < 10 {
+		return ""
+	}
+	if _, err := time.Parse("2006-01-02", v[:10]); err != nil {
+		return ""
+	}
+	return v[:10]
+}
+
+// cStatCancelamento lists the protocol status codes that mean the NFe was cancelled.
+var cStatCancelamento = map[string]bool{
+	"101": true, // cancelamento homologado
+	"135": true, // evento de cancelamento registrado
+	"151": true, // cancelamento homologado fora de prazo
+	"155": true, // cancelamento homologado fora de prazo (evento)
+}
+
+// icmsGroupValue is the value reported by one ICMS group of an item.
+type icmsGroupValue struct {
+	Group string
+	Value string
+}
+
+// icmsGroupValues lists, in order of preference, the ICMS groups of an item that carry a value.
+// The first entry is the one used in the total; more than one entry means the XML is inconsistent.
+func icmsGroupValues(icms domain.ICMSXML) []icmsGroupValue {
+	sn900 := firstNonBlank(icms.ICMSSN900.VICMS, icms.ICMSSN900.VCreditICMSSN)
+	candidates := []icmsGroupValue{
+		{Group: "ICMS00", Value: icms.ICMS00.VICMS},
+		{Group: "ICMS10", Value: icms.ICMS10.VICMS},
+		{Group: "ICMS20", Value: icms.ICMS20.VICMS},
+		{Group: "ICMS70", Value: icms.ICMS70.VICMS},
+		{Group: "ICMS90", Value: icms.ICMS90.VICMS},
+		{Group: "ICMSSN101", Value: icms.ICMSSN101.VCreditICMSSN},
+		{Group: "ICMSSN900", Value: sn900},
+		{Group: "ICMSPart", Value: icms.ICMSPart.VICMS},
+	}
+	// ICMSST only repasses ST retained upstream: the item is accounted for, with zero own ICMS,
+	// so it still counts when checking for conflicting groups. The same goes for the Simples
+	// Nacional groups without own ICMS (CSOSN 102 and 500, whose vICMSSTRet is not a credit)
+	// and for a CSOSN 900 item with no value informed.
+	zeroGroups := []icmsGroupValue{
+		{Group: "ICMSST", Value: icms.ICMSST.CST},
+		{Group: "ICMSSN102", Value: icms.ICMSSN102.CSOSN},
+		{Group: "ICMSSN500", Value: icms.ICMSSN500.CSOSN},
+	}
+	if strings.TrimSpace(sn900) == "" {
+		zeroGroups = append(zeroGroups, icmsGroupValue{Group: "ICMSSN900", Value: icms.ICMSSN900.CSOSN})
+	}
+	for _, z := range zeroGroups {
+		if strings.TrimSpace(z.Value) != "" {
+			candidates = append(candidates, icmsGroupValue{Group: z.Group, Value: "0"})
+		}
+	}
+
+	var present []icmsGroupValue
+	for _, c := range candidates {
+		if strings.TrimSpace(c.Value) != "" {
+			present = append(present, c)
+		}
+	}
+	return present
+}
+
+// icmsCST returns the origin + CST (or CSOSN) of an item, as the SPED books it in CST_ICMS
+// (e.g. "020", "0102"), from the first ICMS group that informs one; empty when none does.
+func icmsCST(icms domain.ICMSXML) string {
+	for _, g := range []domain.ICMSCSTXML{
+		icms.ICMS00.ICMSCSTXML, icms.ICMS10.ICMSCSTXML, icms.ICMS20.ICMSCSTXML, icms.ICMS30.ICMSCSTXML,
+		icms.ICMS40.ICMSCSTXML, icms.ICMS51.ICMSCSTXML, icms.ICMS60.ICMSCSTXML, icms.ICMS70.ICMSCSTXML,
+		icms.ICMS90.ICMSCSTXML, icms.ICMSPart.ICMSCSTXML, icms.ICMSST.ICMSCSTXML,
+		icms.ICMSSN101.ICMSCSTXML, icms.ICMSSN102.ICMSCSTXML, icms.ICMSSN201.ICMSCSTXML,
+		icms.ICMSSN202.ICMSCSTXML, icms.ICMSSN500.ICMSCSTXML, icms.ICMSSN900.ICMSCSTXML,
+	} {
+		if code := strings.TrimSpace(firstNonBlank(g.CST, g.CSOSN)); code != "" {
+			return strings.TrimSpace(g.Orig) + code
+		}
+	}
+	return ""
+}
+
+// icmsSTValue returns the vICMSST of an item, from whichever ICMS group informs it.
+func icmsSTValue(icms domain.ICMSXML) float64 {
+	return parseXMLValue(icms.ICMS10.VICMSST, icms.ICMS30.VICMSST, icms.ICMS70.VICMSST, icms.ICMS90.VICMSST,
+		icms.ICMSSN201.VICMSST, icms.ICMSSN202.VICMSST, icms.ICMSSN900.VICMSST)
+}
+
+// parseXMLValue parses the first non-blank of values, or returns 0.
+func parseXMLValue(values ...string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(firstNonBlank(values...)), 64)
+	return v
+}
+
+// firstNonBlank returns the first of values that is not blank, or "".
+func firstNonBlank(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ValidateXMLFiles checks that each XML is a parseable NFe, without requiring a SPED.
+// The returned slice follows the order of xmlFiles.
+func (s *service) ValidateXMLFiles(xmlFiles []io.Reader) []domain.XMLValidationResult {
+	results := make([]domain.XMLValidationResult, 0, len(xmlFiles))
+	for _, xmlFile := range xmlFiles {
+		xmlResult, err := s.parseXMLForICMS(xmlFile)
+		if err != nil {
+			results = append(results, domain.XMLValidationResult{Valid: false, Reason: err.Error()})
+			continue
+		}
+
+		result := domain.XMLValidationResult{
+			Valid:     true,
+			NFeKey:    xmlResult.NFeKey,
+			DocNumber: xmlResult.DocNumber,
+			Alerts:    xmlResult.Alerts,
+		}
+		if strings.TrimSpace(xmlResult.NFeKey) == "" {
+			result.Valid = false
+			result.Reason = "chave de acesso (chNFe) não encontrada no protocolo"
+		} else if _, ok := normalizeChave(xmlResult.NFeKey); !ok {
+			result.Valid = false
+			result.Reason = fmt.Sprintf("chave de acesso inválida: %s (esperados %d dígitos)", xmlResult.NFeKey, chaveNFeLen)
+		} else if !ValidChaveNFe(xmlResult.NFeKey) {
+			result.Valid = false
+			result.Reason = fmt.Sprintf("chave de acesso inválida: %s (dígito verificador não confere)", xmlResult.NFeKey)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// expandXMLFiles splits files that carry several NFes (concatenated nfeProc documents, or an
+// ERP envelope around them) into one reader per document. Files with a single NFe, or that are
+// not well-formed enough to be split, are passed through untouched.
+func expandXMLFiles(xmlFiles []io.Reader) []io.Reader {
+	expanded := make([]io.Reader, 0, len(xmlFiles))
+	for _, xmlFile := range xmlFiles {
+		name := sourceName(xmlFile)
+		data, err := io.ReadAll(xmlFile)
+		if err != nil {
+			expanded = append(expanded, WithSourceName(&failingReader{err: err}, name))
+			continue
+		}
+		docs := splitXMLDocuments(data)
+		if len(docs) < 2 {
+			expanded = append(expanded, WithSourceName(bytes.NewReader(data), name))
+			continue
+		}
+		for _, doc := range docs {
+			expanded = append(expanded, WithSourceName(bytes.NewReader(doc), name))
+		}
+	}
+	return expanded
+}
+
+// splitXMLDocuments returns the raw bytes of every outermost nfeProc (or bare NFe) element in
+// data, wherever it sits: at the root, side by side, or inside a wrapper element.
+func splitXMLDocuments(data []byte) [][]byte {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var docs [][]byte
+	var start int64
+	depth := 0 // nesting inside the document being captured; 0 = outside any
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				depth++
+			} else if t.Name.Local == "nfeProc" || t.Name.Local == "NFe" {
+				start = offset
+				depth = 1
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+				if depth == 0 {
+					docs = append(docs, data[start:dec.InputOffset()])
+				}
+			}
 		}
 	}
-	return problematicResults, nil
+	return docs
+}
+
+// WithSourceName tags an XML input with the name of its source file, which is then reported in
+// AnalysisResult.SourceFile (also for every NFe of a file with several concatenated ones).
+func WithSourceName(r io.Reader, name string) io.Reader {
+	return &namedReader{Reader: r, name: name}
+}
+
+// namedReader is an io.Reader tagged by WithSourceName.
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+// sourceName returns the name given by WithSourceName, or "" for untagged readers.
+func sourceName(r io.Reader) string {
+	if n, ok := r.(*namedReader); ok {
+		return n.name
+	}
+	return ""
+}
+
+// failingReader keeps a read error so it surfaces when the XML is parsed.
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read([]byte) (int, error) {
+	return 0, f.err
+}
+
+// chaveNFeLen is the number of digits of an NFe access key.
+const chaveNFeLen = 44
+
+// normalizeChave keeps only the digits of an access key read from SPED or XML (dropping
+// spaces and the "NFe" prefix of the Id attribute) and reports whether it has 44 digits.
+func normalizeChave(raw string) (string, bool) {
+	var b strings.Builder
+	for _, r := range raw {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	chave := b.String()
+	return chave, len(chave) == chaveNFeLen
+}
+
+// ValidChaveNFe reports whether chave has 44 digits and its last digit is the modulo 11 check
+// digit of the first 43 (weights 2 to 9 from right to left; remainders 0 and 1 give 0).
+func ValidChaveNFe(chave string) bool {
+	if len(chave) != chaveNFeLen {
+		return false
+	}
+	sum, weight := 0, 2
+	for i := chaveNFeLen - 2; i >= 0; i-- {
+		d := chave[i]
+		if d < '0' || d > '9' {
+			return false
+		}
+		sum += int(d-'0') * weight
+		if weight++; weight > 9 {
+			weight = 2
+		}
+	}
+	dv := 11 - sum%11
+	if dv >= 10 {
+		dv = 0
+	}
+	return chave[chaveNFeLen-1] == byte('0'+dv)
+}
+
+// unmarshalNFeProc decodes an nfeProc document. When the document as a whole does not parse, it
+// retries with just its <NFe> element, so a note whose protNFe is broken (truncated protocol,
+// stray bytes added by an ERP) can still be reconciled by the infNFe Id; partial reports that
+// fallback. Documents whose root is not nfeProc keep failing with the original error.
+func unmarshalNFeProc(data []byte) (domain.NFeProc, bool, error) {
+	var nfeProc domain.NFeProc
+	err := xml.Unmarshal(data, &nfeProc)
+	if err == nil {
+		return nfeProc, false, nil
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	root := ""
+	for {
+		tok, tokErr := dec.Token()
+		if tokErr != nil {
+			return domain.NFeProc{}, false, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if root == "" {
+			if root = start.Name.Local; root != "nfeProc" {
+				return domain.NFeProc{}, false, err
+			}
+			continue
+		}
+		if start.Name.Local != "NFe" {
+			return domain.NFeProc{}, false, err
+		}
+		var nfe domain.NFeXML
+		if dec.DecodeElement(&nfe, &start) != nil || nfe.InfNFe.ID == "" {
+			return domain.NFeProc{}, false, err
+		}
+		return domain.NFeProc{NFe: nfe}, true, nil
+	}
 }
 
 // parseXMLForICMS parses an XML file for ICMS data.
-func (s *service) parseXMLForICMS(xmlFile io.Reader) (struct {
-	DocNumber string
-	NFeKey    string
-	IcmsXML   float64
-}, error) {
-	result := struct {
-		DocNumber string
-		NFeKey    string
-		IcmsXML   float64
-	}{DocNumber: "ERRO", NFeKey: "ERRO"}
+func (s *service) parseXMLForICMS(xmlFile io.Reader) (XMLICMSResult, error) {
+	result := XMLICMSResult{DocNumber: "ERRO", NFeKey: "ERRO"}
 	xmlData, err := io.ReadAll(xmlFile)
 	if err != nil {
 		return result, fmt.Errorf("erro ao ler dados do XML: %w", err)
 	}
 
-	var nfeProc domain.NFeProc
-	if err := xml.Unmarshal(xmlData, &nfeProc); err != nil {
+	nfeProc, partial, err := unmarshalNFeProc(xmlData)
+	if err != nil {
 		return result, fmt.Errorf("falha ao fazer parse do XML: %w", err)
 	}
 
@@ -292,89 +1265,269 @@ func (s *service) parseXMLForICMS(xmlFile io.Reader) (struct {
 	if infNFe.Ide.NNF == "" {
 		return result, fmt.Errorf("XML inválido ou não é uma NF-e")
 	}
+	if partial {
+		result.Alerts = append(result.Alerts, "Protocolo (protNFe) malformado; chave obtida do atributo Id do infNFe")
+	}
 
 	result.DocNumber = infNFe.Ide.NNF
-	result.NFeKey = nfeProc.ProtNFe.InfProt.ChNFe
+	result.IssueDate = issueDate(infNFe.Ide)
+	result.EmitCNPJ = onlyDigits(infNFe.Emit.CNPJ)
+	result.NFeKey, _ = normalizeChave(nfeProc.ProtNFe.InfProt.ChNFe)
+	if result.NFeKey == "" {
+		result.NFeKey, _ = normalizeChave(infNFe.ID)
+	}
+	result.CStat = strings.TrimSpace(nfeProc.ProtNFe.InfProt.CStat)
+	result.XMotivo = strings.TrimSpace(nfeProc.ProtNFe.InfProt.XMotivo)
+	result.Cancelada = cStatCancelamento[result.CStat]
 
-	var totalICMS float64
-	for _, det := range infNFe.Det {
-		icms := det.Imposto.ICMS
-		var vICMSStr string
-		switch {
-		case icms.ICMS00.VICMS != "":
-			vICMSStr = icms.ICMS00.VICMS
-		case icms.ICMS10.VICMS != "":
-			vICMSStr = icms.ICMS10.VICMS
-		case icms.ICMS20.VICMS != "":
-			vICMSStr = icms.ICMS20.VICMS
-		case icms.ICMS70.VICMS != "":
-			vICMSStr = icms.ICMS70.VICMS
-		case icms.ICMS90.VICMS != "":
-			vICMSStr = icms.ICMS90.VICMS
-		case icms.ICMSSN101.VCreditICMSSN != "":
-			vICMSStr = icms.ICMSSN101.VCreditICMSSN
-		}
-		if vICMS, err := strconv.ParseFloat(vICMSStr, 64); err == nil {
+	var totalICMS, totalST, totalPIS, totalCOFINS float64
+	for i, det := range infNFe.Det {
+		totalST += icmsSTValue(det.Imposto.ICMS)
+		pis, cofins := det.Imposto.PIS, det.Imposto.COFINS
+		totalPIS += parseXMLValue(pis.PISAliq.VPIS, pis.PISQtde.VPIS, pis.PISOutr.VPIS)
+		totalCOFINS += parseXMLValue(cofins.COFINSAliq.VCOFINS, cofins.COFINSQtde.VCOFINS, cofins.COFINSOutr.VCOFINS)
+		if cst := icmsCST(det.Imposto.ICMS); cst != "" && !slices.Contains(result.Csts, cst) {
+			result.Csts = append(result.Csts, cst)
+		}
+		groups := icmsGroupValues(det.Imposto.ICMS)
+		if len(groups) == 0 {
+			continue
+		}
+		result.ItemGroups = append(result.ItemGroups, domain.ICMSItemGroup{Item: i + 1, Group: groups[0].Group})
+		if len(groups) > 1 {
+			names := make([]string, len(groups))
+			for j, g := range groups {
+				names[j] = g.Group
+			}
+			result.Alerts = append(result.Alerts, fmt.Sprintf("Item %d possui mais de um grupo de ICMS informado (%s); considerado %s", i+1, strings.Join(names, ", "), groups[0].Group))
+		}
+		if vICMS, err := strconv.ParseFloat(strings.TrimSpace(groups[0].Value), 64); err == nil {
 			totalICMS += vICMS
 		}
 	}
 	result.IcmsXML = round(totalICMS, 2)
+	result.IcmsStXML = round(totalST, 2)
+	result.PisXML = round(totalPIS, 2)
+	result.CofinsXML = round(totalCOFINS, 2)
+	result.TotalXML = round(infNFe.Total.ICMSTot.VNF, 2)
 	return result, nil
 }
 
-// parseSpedFileForICMS parses SPED file for ICMS data.
-func (s *service) parseSpedFileForICMS(spedFile io.Reader, cfopsSemCredito map[string]bool) (map[string]domain.SpedInfo, error) {
-	spedData := make(map[string]domain.SpedInfo)
+// spedNota identifies a note of the SPED: the same key may be booked under more than one
+// establishment (e.g. a transfer between branches) and each booking is kept apart.
+type spedNota struct {
+	chave string
+	cnpj  string
+}
+
+// spedICMSState is the state shared by the record handlers while parseSpedFileForICMS reads a
+// SPED: the notes found so far and the context (establishment, current C100) the next
+// record belongs to.
+type spedICMSState struct {
+	establishment   string
+	current         spedNota
+	notes           map[spedNota]domain.SpedInfo
+	order           []spedNota
+	pisCofins       map[spedNota]*spedPisCofins
+	cfopsSemCredito map[string]bool
+	chave           string // when set, only the C100 of this key are read
+	temC100         bool
+}
+
+// spedPisCofins keeps both sources of a note's PIS/COFINS: the C100 or, when it is zero, the sum
+// of the C170 items.
+type spedPisCofins struct{ c100Pis, c100Cofins, c170Pis, c170Cofins float64 }
+
+// spedRecordHandler reads one SPED record (parts[1] is the REG) into the parse state.
+type spedRecordHandler func(st *spedICMSState, parts []string)
+
+// spedICMSHandlers maps each REG read by parseSpedFileForICMS to its handler; records not listed
+// are skipped. A new record type only needs an entry here.
+var spedICMSHandlers = map[string]spedRecordHandler{
+	"0000": handleSped0000,
+	"0140": handleSped0140,
+	"C010": handleSpedC010,
+	"C100": handleSpedC100,
+	"C170": handleSpedC170,
+	"C190": handleSpedC190,
+}
+
+// handleSped0000 reads the CNPJ of the company.
+func handleSped0000(st *spedICMSState, parts []string) {
+	if len(parts) > campoR0000CNPJ {
+		st.establishment = onlyDigits(parts[campoR0000CNPJ])
+	}
+}
+
+// handleSped0140 switches to the establishment of a 0140 record.
+func handleSped0140(st *spedICMSState, parts []string) {
+	if len(parts) > campoR0140CNPJ {
+		st.establishment = onlyDigits(parts[campoR0140CNPJ])
+	}
+}
+
+// handleSpedC010 switches to the establishment whose block C follows.
+func handleSpedC010(st *spedICMSState, parts []string) {
+	if len(parts) > campoC010CNPJ {
+		st.establishment = onlyDigits(parts[campoC010CNPJ])
+	}
+}
+
+// handleSpedC100 starts (or, for a repeated key of the same establishment, resumes) a note.
+func handleSpedC100(st *spedICMSState, parts []string) {
+	if len(parts) <= campoC100Chave {
+		return
+	}
+	st.temC100 = true
+	chave, _ := normalizeChave(parts[campoC100Chave])
+	if st.chave != "" && chave != st.chave {
+		// C170/C190 seguintes pertencem a uma nota fora do filtro
+		st.current = spedNota{}
+		return
+	}
+	st.current = spedNota{chave: chave, cnpj: st.establishment}
+	if _, ok := st.notes[st.current]; !ok {
+		st.order = append(st.order, st.current)
+		st.notes[st.current] = domain.SpedInfo{
+			CNPJ:        st.establishment,
+			IndOper:     strings.TrimSpace(parts[campoC100IndOper]),
+			NumDoc:      strings.TrimSpace(parts[campoC100NumDoc]),
+			Cfops:       []string{},
+			IcmsPorCfop: map[string]float64{},
+		}
+		st.pisCofins[st.current] = &spedPisCofins{}
+	}
+	if len(parts) > campoC100VlDoc {
+		info := st.notes[st.current]
+		info.ValorTotal = parseNumberSped(parts[campoC100VlDoc])
+		st.notes[st.current] = info
+	}
+	if len(parts) > campoC100VlCOF {
+		st.pisCofins[st.current].c100Pis = parseNumberSped(parts[campoC100VlPIS])
+		st.pisCofins[st.current].c100Cofins = parseNumberSped(parts[campoC100VlCOF])
+	}
+}
+
+// handleSpedC170 adds the item's PIS/COFINS to the current note.
+func handleSpedC170(st *spedICMSState, parts []string) {
+	if pc, ok := st.pisCofins[st.current]; ok && len(parts) > campoC170VlCOF {
+		pc.c170Pis += parseNumberSped(parts[campoC170VlPIS])
+		pc.c170Cofins += parseNumberSped(parts[campoC170VlCOF])
+	}
+}
+
+// handleSpedC190 adds the CFOP, CST, ICMS and ICMS-ST of an analytical record to the current note.
+func handleSpedC190(st *spedICMSState, parts []string) {
+	info, ok := st.notes[st.current]
+	if !ok || len(parts) <= campoC190VlICMS || len(parts) <= campoC190CFOP {
+		return
+	}
+	cfop := parts[campoC190CFOP]
+	if !slices.Contains(info.Cfops, cfop) {
+		info.Cfops = append(info.Cfops, cfop)
+	}
+	if cst := strings.TrimSpace(parts[campoC190CST]); cst != "" && !slices.Contains(info.Csts, cst) {
+		info.Csts = append(info.Csts, cst)
+	}
+
+	if st.cfopsSemCredito[cfop] {
+		info.TemCfopIgnorado = true
+	}
+	icmsVal := parseNumberSped(parts[campoC190VlICMS])
+	info.Icms += icmsVal
+	info.IcmsPorCfop[cfop] += icmsVal
+	if len(parts) > campoC190VlST {
+		info.IcmsST += parseNumberSped(parts[campoC190VlST])
+	}
+	st.notes[st.current] = info
+}
+
+// parseSpedFileForICMS parses SPED file for ICMS data, returning the notes of each key in file
+// order, one per establishment. The establishment is the CNPJ of the last 0000, 0140 or C010
+// record read before the C100. Each record is read by its handler in spedICMSHandlers.
+// The returned map is freshly allocated and owned by the caller; it is never shared
+// with other calls, so concurrent analyses do not touch the same map.
+func (s *service) parseSpedFileForICMS(spedFile io.Reader, cfopsSemCredito map[string]bool) (map[string][]domain.SpedInfo, error) {
+	return s.parseSpedFileForICMSChave(spedFile, cfopsSemCredito, "")
+}
+
+// parseSpedFileForICMSChave is parseSpedFileForICMS keeping only the notes of chave (all of them
+// when empty). A SPED with C100 records but none of chave yields an empty map, not ErrNenhumC100.
+func (s *service) parseSpedFileForICMSChave(spedFile io.Reader, cfopsSemCredito map[string]bool, chave string) (map[string][]domain.SpedInfo, error) {
+	st := &spedICMSState{
+		notes:           make(map[spedNota]domain.SpedInfo),
+		pisCofins:       make(map[spedNota]*spedPisCofins),
+		cfopsSemCredito: cfopsSemCredito,
+		chave:           chave,
+	}
 	decoder := charmap.ISO8859_1.NewDecoder()
 	scanner := bufio.NewScanner(decoder.Reader(spedFile))
-
-	var currentC100Key string
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		parts := strings.Split(line, "|")
+		parts := splitSpedLine(scanner.Text())
 		if len(parts) < 2 {
 			continue
 		}
+		if handle, ok := spedICMSHandlers[parts[1]]; ok {
+			handle(st, parts)
+		}
+	}
 
-		recordType := parts[1]
-		switch recordType {
-		case "C100":
-			if len(parts) > 9 {
-				currentC100Key = parts[9]
-				if _, ok := spedData[currentC100Key]; !ok {
-					spedData[currentC100Key] = domain.SpedInfo{Cfops: []string{}}
-				}
-			}
-		case "C190":
-			if info, ok := spedData[currentC100Key]; ok && len(parts) > 7 {
-				cfop := parts[3]
-				found := false
-				for _, existingCfop := range info.Cfops {
-					if existingCfop == cfop {
-						found = true
-						break
-					}
-				}
-				if !found {
-					info.Cfops = append(info.Cfops, cfop)
-				}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !st.temC100 {
+		return nil, ErrNenhumC100
+	}
 
-				if cfopsSemCredito[cfop] {
-					info.TemCfopIgnorado = true
-				}
-				icmsVal := parseNumberSped(parts[7])
-				info.Icms += icmsVal
-				spedData[currentC100Key] = info
+	notes := make(map[string][]domain.SpedInfo)
+	for _, key := range st.order {
+		info := st.notes[key]
+		info.Icms = round(info.Icms, 2)
+		info.IcmsST = round(info.IcmsST, 2)
+		for cfop, v := range info.IcmsPorCfop {
+			info.IcmsPorCfop[cfop] = round(v, 2)
+		}
+		if pc := st.pisCofins[key]; pc != nil {
+			info.Pis, info.Cofins = pc.c100Pis, pc.c100Cofins
+			if info.Pis <= EPSILON {
+				info.Pis = pc.c170Pis
+			}
+			if info.Cofins <= EPSILON {
+				info.Cofins = pc.c170Cofins
 			}
+			info.Pis, info.Cofins = round(info.Pis, 2), round(info.Cofins, 2)
 		}
+		notes[key.chave] = append(notes[key.chave], info)
 	}
 
-	for key, info := range spedData {
-		info.Icms = round(info.Icms, 2)
-		spedData[key] = info
+	return notes, nil
+}
+
+// SpedInfoForChave parses only the C100 of chave in the SPED and returns its bookings, one per
+// establishment, as the ICMS analysis sees them. It is meant for debugging a single note without
+// dumping the whole file; a key not booked in the SPED yields an empty slice.
+func (s *service) SpedInfoForChave(spedFile io.Reader, chave string) ([]domain.SpedInfo, error) {
+	chave, ok := normalizeChave(chave)
+	if !ok {
+		return nil, ErrChaveInvalida
+	}
+	notes, err := s.parseSpedFileForICMSChave(spedFile, nil, chave)
+	if err != nil {
+		return nil, err
 	}
+	return notes[chave], nil
+}
 
-	return spedData, scanner.Err()
+// spedNoteFor picks, among the bookings of a key, the one of the requested establishment, or the
+// first one when no establishment is requested. found reports whether the key is in the SPED at
+// all, so a note booked only under other establishments can be told apart from a missing one.
+func spedNoteFor(notes []domain.SpedInfo, establishment string) (info domain.SpedInfo, ok, found bool) {
+	for _, n := range notes {
+		if establishment == "" || n.CNPJ == establishment {
+			return n, true, true
+		}
+	}
+	return domain.SpedInfo{}, false, len(notes) > 0
 }
 
 // parseNumberSped parses a number from SPED format.
@@ -395,3 +1548,331 @@ func round(val float64, places int) float64 {
 	pow := math.Pow(10, float64(places))
 	return math.Round(val*pow) / pow
 }
+
+// Sheets of the workbook built by ExportXLSX.
+const (
+	SheetSummary = "Resumo"
+	SheetDetail  = "Notas"
+)
+
+// statusFill is the background color of each status in the detail sheet.
+var statusFill = map[domain.StatusCode]string{
+	domain.StatusOK:                     "C6EFCE",
+	domain.StatusDiscrepanciaICMS:       "FFC7CE",
+	domain.StatusDiscrepanciaICMSST:     "FFC7CE",
+	domain.StatusDiscrepanciaPISCOFINS:  "FFC7CE",
+	domain.StatusDiscrepanciaValorTotal: "FFC7CE",
+	domain.StatusDiscrepanciaCST:        "FFC7CE",
+	domain.StatusDiscrepanciaIPIST:      "FFC7CE",
+	domain.StatusNaoEncontradaSPED:      "FFEB9C",
+	domain.StatusCFOPNaoPermitido:       "FFEB9C",
+	domain.StatusSemXML:                 "FFEB9C",
+	domain.StatusXMLInvalido:            "D9D9D9",
+	domain.StatusChaveInvalida:          "D9D9D9",
+	domain.StatusNotaCancelada:          "D9D9D9",
+}
+
+// ExportCSV writes one line per result with the note number, access key, XML and SPED ICMS,
+// SPED CFOPs and readable status, separated by ';' and with decimal commas, as Excel expects in
+// pt-BR. Values not known for a result (IPI/ST notes carry no ICMS) are left empty.
+func ExportCSV(results []domain.AnalysisResult) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+	if err := w.Write([]string{"Num Nota", "Chave", "ICMS XML", "ICMS SPED", "CFOPs", "Status"}); err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		row := []string{"", r.NFeKey, "", "", "", r.StatusCode.Descricao()}
+		if data, ok := r.Data.(domain.ICMSData); ok {
+			row[0] = data.DocNumber
+			row[2], row[3] = formatDecimalComma(data.IcmsXML), formatDecimalComma(data.IcmsSPED)
+			row[4] = strings.Join(data.CfopsSPED, ", ")
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("erro ao gerar CSV da análise: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// formatDecimalComma formats v with two decimals and a decimal comma.
+func formatDecimalComma(v float64) string {
+	return strings.Replace(strconv.FormatFloat(v, 'f', 2, 64), ".", ",", 1)
+}
+
+// ContaAjustePadrao is the placeholder account used in adjustment entries when the caller does
+// not provide one, so the accountant can still find and fix the rows before importing.
+const ContaAjustePadrao = "999999"
+
+// AjusteContas holds the accounts of the adjustment entries built by ExportAjustes. Debito
+// receives the difference when the XML ICMS is higher than the SPED one; the accounts swap
+// when the SPED is higher.
+type AjusteContas struct {
+	Debito  string
+	Credito string
+}
+
+// AjusteRows maps each ICMS discrepancy to a pair of lançamentos (a D and a C row) carrying the
+// difference, in the layout produced by the converter pipeline. Other statuses are skipped.
+func AjusteRows(results []domain.AnalysisResult, contas AjusteContas) []domain.OutputRow {
+	debito := firstNonBlank(strings.TrimSpace(contas.Debito), ContaAjustePadrao)
+	credito := firstNonBlank(strings.TrimSpace(contas.Credito), ContaAjustePadrao)
+
+	var rows []domain.OutputRow
+	for _, r := range results {
+		if r.StatusCode != domain.StatusDiscrepanciaICMS {
+			continue
+		}
+		data, ok := r.Data.(domain.ICMSData)
+		if !ok || data.IcmsDifference < EPSILON {
+			continue
+		}
+		d, c := debito, credito
+		if data.IcmsSPED > data.IcmsXML {
+			d, c = c, d
+		}
+		dataLanc := ""
+		if t, err := time.Parse("2006-01-02", data.IssueDate); err == nil {
+			dataLanc = t.Format("02/01/2006")
+		}
+		descricao := fmt.Sprintf("AJUSTE ICMS NF %s", data.DocNumber)
+		historico := fmt.Sprintf("AJUSTE ICMS NF %s CHAVE %s XML %s SPED %s",
+			data.DocNumber, r.NFeKey, formatDecimalComma(data.IcmsXML), formatDecimalComma(data.IcmsSPED))
+		valor := formatDecimalComma(data.IcmsDifference)
+		rows = append(rows,
+			domain.OutputRow{Operacao: "D", Data: dataLanc, DescricaoCredito: descricao, ContaCredito: d, Valor: valor, Historico: historico},
+			domain.OutputRow{Operacao: "C", Data: dataLanc, DescricaoCredito: descricao, ContaCredito: c, Valor: valor, Historico: historico},
+		)
+	}
+	return rows
+}
+
+// ExportAjustes writes the rows of AjusteRows with the header, ';' separator and Windows-1252
+// encoding of the converter output, so the file can be imported like a LançamentosFinal.csv.
+func ExportAjustes(results []domain.AnalysisResult, contas AjusteContas) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+	if err := w.Write([]string{"Operação", "Data", "Descrição Credito", "Conta Credito", "Valor", "Historico"}); err != nil {
+		return nil, err
+	}
+	for _, row := range AjusteRows(results, contas) {
+		if err := w.Write([]string{row.Operacao, row.Data, row.DescricaoCredito, row.ContaCredito, row.Valor, row.Historico}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("erro ao gerar CSV de ajustes: %w", err)
+	}
+	encoded, err := charmap.Windows1252.NewEncoder().Bytes(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("erro ao codificar CSV de ajustes: %w", err)
+	}
+	return encoded, nil
+}
+
+// ExportXLSX builds a workbook with the count of notes per status and the value totals in
+// SheetSummary, and one row per note in SheetDetail, color-coded by status.
+func ExportXLSX(results []domain.AnalysisResult) ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := f.SetSheetName(f.GetSheetName(0), SheetSummary); err != nil {
+		return nil, err
+	}
+	if _, err := f.NewSheet(SheetDetail); err != nil {
+		return nil, err
+	}
+
+	fills := make(map[domain.StatusCode]int, len(statusFill))
+	for status, color := range statusFill {
+		style, err := f.NewStyle(&excelize.Style{Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{color}}})
+		if err != nil {
+			return nil, err
+		}
+		fills[status] = style
+	}
+
+	detailHeader := []interface{}{"Chave NF-e", "Tipo", "Status", "Número", "ICMS XML", "ICMS SPED", "Diferença ICMS",
+		"ST XML", "ST SPED", "IPI XML", "IPI SPED", "CFOPs", "Alertas"}
+	if err := f.SetSheetRow(SheetDetail, "A1", &detailHeader); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[domain.StatusCode]int)
+	var icmsXML, icmsSPED, stXML, stSPED, ipiXML, ipiSPED float64
+	for i, r := range results {
+		counts[r.StatusCode]++
+		row := []interface{}{r.NFeKey, string(r.Type), r.StatusCode.Descricao(), "", nil, nil, nil, nil, nil, nil, nil, "", strings.Join(r.Alerts, "; ")}
+		switch data := r.Data.(type) {
+		case domain.ICMSData:
+			row[3], row[4], row[5], row[6] = data.DocNumber, data.IcmsXML, data.IcmsSPED, data.IcmsDifference
+			row[11] = strings.Join(data.CfopsSPED, ", ")
+			icmsXML += data.IcmsXML
+			icmsSPED += data.IcmsSPED
+			if data.IcmsStXML != nil && data.IcmsStSPED != nil {
+				row[7], row[8] = *data.IcmsStXML, *data.IcmsStSPED
+				stXML += *data.IcmsStXML
+				stSPED += *data.IcmsStSPED
+			}
+		case domain.IPISTData:
+			row[7], row[8], row[9], row[10] = data.STValueXML, data.STValueSPED, data.IPIValueXML, data.IPIValueSPED
+			stXML += data.STValueXML
+			stSPED += data.STValueSPED
+			ipiXML += data.IPIValueXML
+			ipiSPED += data.IPIValueSPED
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		if err := f.SetSheetRow(SheetDetail, cell, &row); err != nil {
+			return nil, err
+		}
+		if style, ok := fills[r.StatusCode]; ok {
+			last, _ := excelize.CoordinatesToCellName(len(row), i+2)
+			if err := f.SetCellStyle(SheetDetail, cell, last, style); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	summary := [][]interface{}{{"Status", "Notas"}}
+	statuses := make([]domain.StatusCode, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i] < statuses[j] })
+	for _, status := range statuses {
+		summary = append(summary, []interface{}{status.String(), counts[status]})
+	}
+	summary = append(summary,
+		[]interface{}{"total", len(results)},
+		nil,
+		[]interface{}{"Total", "Valor"},
+		[]interface{}{"ICMS XML", round(icmsXML, 2)},
+		[]interface{}{"ICMS SPED", round(icmsSPED, 2)},
+		[]interface{}{"ST XML", round(stXML, 2)},
+		[]interface{}{"ST SPED", round(stSPED, 2)},
+		[]interface{}{"IPI XML", round(ipiXML, 2)},
+		[]interface{}{"IPI SPED", round(ipiSPED, 2)},
+	)
+	for i, row := range summary {
+		if row == nil {
+			continue
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(SheetSummary, cell, &row); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar planilha da análise: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SemCompetencia names the file of ExportXLSXByCompetencia that holds the results without an
+// issue date, such as unreadable XMLs and IPI/ST notes.
+const SemCompetencia = "sem_competencia"
+
+// ExportXLSXByCompetencia splits the results by the month of their issue date and returns a ZIP
+// with one ExportXLSX workbook per competência, named Analise_YYYY-MM.xlsx.
+func ExportXLSXByCompetencia(results []domain.AnalysisResult) ([]byte, error) {
+	groups := make(map[string][]domain.AnalysisResult)
+	for _, r := range results {
+		competencia := SemCompetencia
+		if data, ok := r.Data.(domain.ICMSData); ok && len(data.IssueDate) >= 7 {
+			competencia = data.IssueDate[:7]
+		}
+		groups[competencia] = append(groups[competencia], r)
+	}
+	competencias := make([]string, 0, len(groups))
+	for competencia := range groups {
+		competencias = append(competencias, competencia)
+	}
+	sort.Strings(competencias)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, competencia := range competencias {
+		xlsx, err := ExportXLSX(groups[competencia])
+		if err != nil {
+			return nil, err
+		}
+		w, err := zw.Create("Analise_" + competencia + ".xlsx")
+		if err != nil {
+			return nil, fmt.Errorf("erro ao gerar ZIP da análise: %w", err)
+		}
+		if _, err := w.Write(xlsx); err != nil {
+			return nil, fmt.Errorf("erro ao gerar ZIP da análise: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("erro ao gerar ZIP da análise: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportSpedDraft builds draft C100/C190 lines for the ICMS discrepancies in results, carrying
+// the ICMS taken from the XML. Only the fields known from the analysis are filled (document
+// number, key, CFOP and ICMS); the rest stay empty for manual review before any SPED is
+// rectified. When the SPED had several CFOPs for the note, the C190 CFOP is left blank since
+// the XML total cannot be split between them. The output is ISO-8859-1 with CRLF line endings.
+func (s *service) ExportSpedDraft(results []domain.AnalysisResult) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range results {
+		if r.StatusCode != domain.StatusDiscrepanciaICMS {
+			continue
+		}
+		data, ok := r.Data.(domain.ICMSData)
+		if !ok {
+			continue
+		}
+		icms := formatNumberSped(data.IcmsXML)
+
+		buf.WriteString(spedDraftLine("C100", map[int]string{
+			campoC100NumDoc: data.DocNumber,
+			campoC100Chave:  r.NFeKey,
+			campoC100VlICMS: icms,
+		}, 29))
+
+		cfop := ""
+		if len(data.CfopsSPED) == 1 {
+			cfop = data.CfopsSPED[0]
+		}
+		buf.WriteString(spedDraftLine("C190", map[int]string{
+			campoC190CFOP:   cfop,
+			campoC190VlICMS: icms,
+		}, 12))
+	}
+
+	out, err := charmap.ISO8859_1.NewEncoder().Bytes(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("falha ao codificar rascunho do SPED em ISO-8859-1: %w", err)
+	}
+	return out, nil
+}
+
+// spedDraftLine writes a pipe-delimited record with lastField fields after REG; fields maps
+// positions (as in splitSpedLine, REG at 1) to their values.
+func spedDraftLine(reg string, fields map[int]string, lastField int) string {
+	parts := make([]string, lastField+1)
+	parts[1] = reg
+	for pos, val := range fields {
+		if pos > 1 && pos <= lastField {
+			parts[pos] = strings.ReplaceAll(val, "|", `\|`)
+		}
+	}
+	return strings.Join(parts, "|") + "|\r\n"
+}
+
+// formatNumberSped formats a value with two decimals and a comma, as SPED expects.
+func formatNumberSped(val float64) string {
+	return strings.Replace(strconv.FormatFloat(round(val, 2), 'f', 2, 64), ".", ",", 1)
+}
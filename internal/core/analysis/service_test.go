@@ -0,0 +1,1591 @@
+package analysis
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// TestParseXMLForICMSGruposConflitantes garante que, com mais de um grupo de ICMS preenchido
+// no mesmo item, o primeiro grupo da ordem de preferência é usado e um alerta é gerado.
+func TestParseXMLForICMSGruposConflitantes(t *testing.T) {
+	svc := &service{}
+
+	xmlNFe := `<nfeProc>
+  <NFe>
+    <infNFe Id="NFe35200114200166000187550010000000046271239906">
+      <ide><nNF>46</nNF></ide>
+      <det nItem="1">
+        <imposto>
+          <ICMS>
+            <ICMS00><vICMS>10.00</vICMS></ICMS00>
+            <ICMS90><vICMS>5.00</vICMS></ICMS90>
+          </ICMS>
+        </imposto>
+      </det>
+      <det nItem="2">
+        <imposto>
+          <ICMS>
+            <ICMS20><vICMS>2.50</vICMS></ICMS20>
+          </ICMS>
+        </imposto>
+      </det>
+    </infNFe>
+  </NFe>
+  <protNFe><infProt><chNFe>35200114200166000187550010000000046271239901</chNFe></infProt></protNFe>
+</nfeProc>`
+
+	result, err := svc.parseXMLForICMS(strings.NewReader(xmlNFe))
+	if err != nil {
+		t.Fatalf("Erro inesperado ao processar XML: %v", err)
+	}
+
+	if result.IcmsXML != 12.50 {
+		t.Errorf("Esperava ICMS 12.50 (ICMS00 + ICMS20), mas obteve %.2f", result.IcmsXML)
+	}
+	if len(result.Alerts) != 1 {
+		t.Fatalf("Esperava 1 alerta de grupos conflitantes, mas obteve %d: %v", len(result.Alerts), result.Alerts)
+	}
+	if !strings.Contains(result.Alerts[0], "ICMS00, ICMS90") || !strings.Contains(result.Alerts[0], "Item 1") {
+		t.Errorf("Alerta não identifica o item e os grupos conflitantes: %s", result.Alerts[0])
+	}
+}
+
+// nfeXMLTeste monta um nfeProc mínimo com um item ICMS00.
+func nfeXMLTeste(chave, nNF, vICMS string) string {
+	return `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>` + nNF + `</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>` + vICMS + `</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+}
+
+// TestValidateXMLFiles verifica o relatório por arquivo para XMLs válidos e inválidos.
+func TestValidateXMLFiles(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+
+	results := svc.ValidateXMLFiles([]io.Reader{
+		strings.NewReader(nfeXMLTeste(chave, "46", "10.00")),
+		strings.NewReader("<nfeProc><NFe>quebrado"),
+		strings.NewReader("<outroDocumento><valor>1</valor></outroDocumento>"),
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("Esperava 3 resultados, obteve %d", len(results))
+	}
+	if !results[0].Valid || results[0].NFeKey != chave || results[0].DocNumber != "46" {
+		t.Errorf("Primeiro XML deveria ser válido com chave e número: %+v", results[0])
+	}
+	for i, r := range results[1:] {
+		if r.Valid || r.Reason == "" {
+			t.Errorf("XML %d deveria ser inválido com motivo: %+v", i+2, r)
+		}
+	}
+}
+
+// TestParseSpedPosicoesEntreVersoes garante que a chave do C100 e o ICMS do C190 são lidos
+// das mesmas posições qualquer que seja o COD_VER do registro 0000.
+func TestParseSpedPosicoesEntreVersoes(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+
+	for _, codVer := range []string{"002", "014", "017", "018"} {
+		t.Run(codVer, func(t *testing.T) {
+			sped := "|0000|" + codVer + "|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+				"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+				"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+			spedData, err := svc.parseSpedFileForICMS(strings.NewReader(sped), nil)
+			if err != nil {
+				t.Fatalf("Erro inesperado ao processar SPED: %v", err)
+			}
+			notas := spedData[chave]
+			if len(notas) != 1 {
+				t.Fatalf("Chave não encontrada no resultado: %v", spedData)
+			}
+			if info := notas[0]; info.Icms != 18.00 {
+				t.Errorf("Esperava ICMS 18.00, obteve %.2f", info.Icms)
+			}
+		})
+	}
+}
+
+// TestAnalyzeICMSChaveComEspacos garante que uma chave com espaços no SPED ainda casa com o XML.
+func TestAnalyzeICMSChaveComEspacos(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|  " + chave + " |01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+
+	results, err := svc.AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "10.00"))}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Esperava 1 resultado, obteve %d: %+v", len(results), results)
+	}
+	if results[0].StatusCode != domain.StatusDiscrepanciaICMS || results[0].NFeKey != chave {
+		t.Errorf("Esperava discrepância de ICMS para a chave normalizada, obteve %+v", results[0])
+	}
+}
+
+// TestAnalyzeConcorrente dispara análises simultâneas no mesmo service; rodado com -race,
+// acusa qualquer estado compartilhado entre os parsers.
+func TestAnalyzeConcorrente(t *testing.T) {
+	svc := NewService()
+	chave := "35200114200166000187550010000000046271239901"
+	// C100 completo: a análise de IPI/ST lê até o campo VL_IPI.
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|01012024|100,00|0|0|0|100,00|0|0|0|0|100,00|18,00|0|0|0|0|0|0|0|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			results, err := svc.AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "10.00"))}, ICMSOptions{})
+			if err == nil && len(results) != 1 {
+				err = fmt.Errorf("esperava 1 resultado de ICMS, obteve %d", len(results))
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := svc.AnalyzeIPISTFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "10.00"))}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestSplitSpedLine confere o alinhamento dos campos: REG sempre em parts[1].
+func TestSplitSpedLine(t *testing.T) {
+	casos := []struct {
+		linha string
+		reg   string
+		campo string // parts[3]
+	}{
+		{"|C190|000|5102|18,00|", "C190", "5102"},
+		{"C190|000|5102|18,00|", "C190", "5102"},
+		{"  |C190|000|5102|18,00|\r", "C190", "5102"},
+		{`|0150|P1|NOME A\|B LTDA|1058|`, "0150", `NOME A|B LTDA`},
+	}
+	for _, tc := range casos {
+		parts := splitSpedLine(tc.linha)
+		if len(parts) < 4 || parts[1] != tc.reg || parts[3] != tc.campo {
+			t.Errorf("splitSpedLine(%q) = %q; esperava REG %s e campo %q", tc.linha, parts, tc.reg, tc.campo)
+		}
+	}
+}
+
+// TestExportSpedDraft confere as posições dos campos nas linhas C100/C190 geradas e a
+// codificação ISO-8859-1 da saída.
+func TestExportSpedDraft(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+	results := []domain.AnalysisResult{
+		{NFeKey: chave, StatusCode: domain.StatusDiscrepanciaICMS, Data: domain.ICMSData{
+			DocNumber: "46", IcmsXML: 10, IcmsSPED: 18, CfopsSPED: []string{"5102"},
+		}},
+		{NFeKey: "outra", StatusCode: domain.StatusNaoEncontradaSPED, Data: domain.ICMSData{DocNumber: "47"}},
+		{NFeKey: "multi", StatusCode: domain.StatusDiscrepanciaICMS, Data: domain.ICMSData{
+			DocNumber: "Nº 48", IcmsXML: 1234.5, CfopsSPED: []string{"5102", "5405"},
+		}},
+	}
+
+	out, err := svc.ExportSpedDraft(results)
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	texto, err := charmap.ISO8859_1.NewDecoder().String(string(out))
+	if err != nil {
+		t.Fatalf("Saída não é ISO-8859-1: %v", err)
+	}
+	if !strings.Contains(texto, "Nº 48") {
+		t.Errorf("Caractere acentuado não sobreviveu à codificação: %q", texto)
+	}
+
+	linhas := strings.Split(strings.TrimSuffix(texto, "\r\n"), "\r\n")
+	if len(linhas) != 4 {
+		t.Fatalf("Esperava 4 linhas (C100/C190 para 2 discrepâncias), obteve %d: %q", len(linhas), linhas)
+	}
+
+	c100 := splitSpedLine(linhas[0])
+	if len(c100) != 31 || c100[1] != "C100" || c100[8] != "46" || c100[9] != chave || c100[22] != "10,00" {
+		t.Errorf("C100 com campos fora de posição: %q", c100)
+	}
+	c190 := splitSpedLine(linhas[1])
+	if len(c190) != 14 || c190[1] != "C190" || c190[3] != "5102" || c190[7] != "10,00" {
+		t.Errorf("C190 com campos fora de posição: %q", c190)
+	}
+	if c190 := splitSpedLine(linhas[3]); c190[3] != "" || c190[7] != "1234,50" {
+		t.Errorf("C190 com vários CFOPs deveria deixar o CFOP em branco: %q", c190)
+	}
+}
+
+// TestAnalyzeXMLsConcatenados garante que um arquivo com dois nfeProc concatenados, soltos ou
+// dentro de um envelope do ERP, gera um resultado por nota.
+func TestAnalyzeXMLsConcatenados(t *testing.T) {
+	svc := &service{}
+	chave1 := "35200114200166000187550010000000046271239901"
+	chave2 := "35200114200166000187550010000000047271239900"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave1 + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + chave2 + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+
+	prolog := `<?xml version="1.0" encoding="UTF-8"?>`
+	casos := map[string]string{
+		"concatenados": prolog + nfeXMLTeste(chave1, "46", "10.00") + "\n" + prolog + nfeXMLTeste(chave2, "47", "11.00"),
+		"envelope":     prolog + "<lote>" + nfeXMLTeste(chave1, "46", "10.00") + nfeXMLTeste(chave2, "47", "11.00") + "</lote>",
+	}
+	for nome, arquivo := range casos {
+		t.Run(nome, func(t *testing.T) {
+			results, err := svc.AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(arquivo)}, ICMSOptions{})
+			if err != nil {
+				t.Fatalf("Erro inesperado: %v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("Esperava 2 resultados, obteve %d: %+v", len(results), results)
+			}
+			if results[0].NFeKey != chave1 || results[1].NFeKey != chave2 {
+				t.Errorf("Chaves inesperadas: %s, %s", results[0].NFeKey, results[1].NFeKey)
+			}
+		})
+	}
+}
+
+// TestSpedSemC100 garante que um arquivo que não é SPED (ou com outro delimitador) gera erro
+// descritivo em vez de uma análise vazia.
+func TestSpedSemC100(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+	naoSped := "Data;Documento;Valor\n01/01/2024;46;100,00\n" +
+		"C100;0;1;P1;55;00;1;46;" + chave + ";01012024\n"
+
+	xmls := []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "10.00"))}
+	if _, err := svc.AnalyzeICMSFiles(strings.NewReader(naoSped), xmls, ICMSOptions{}); !errors.Is(err, ErrNenhumC100) {
+		t.Errorf("ICMS: esperava ErrNenhumC100, obteve %v", err)
+	}
+	xmls = []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "10.00"))}
+	if _, err := svc.AnalyzeIPISTFiles(strings.NewReader(naoSped), xmls); !errors.Is(err, ErrNenhumC100) {
+		t.Errorf("IPI/ST: esperava ErrNenhumC100, obteve %v", err)
+	}
+}
+
+// TestParseXMLForICMSPartEST confere o total de ICMS com itens nos grupos ICMSPart e ICMSST:
+// a partilha soma o vICMS próprio e o repasse de ST não soma ICMS da operação.
+func TestParseXMLForICMSPartEST(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+	xmlNFe := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>
+	  <det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>
+	  <det nItem="2"><imposto><ICMS><ICMSPart><CST>10</CST><vICMS>7.50</vICMS><vICMSST>3.00</vICMSST></ICMSPart></ICMS></imposto></det>
+	  <det nItem="3"><imposto><ICMS><ICMSST><CST>60</CST><vICMSSTRet>4.00</vICMSSTRet><vICMSSTDest>0.00</vICMSSTDest></ICMSST></ICMS></imposto></det>
+	</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+
+	result, err := svc.parseXMLForICMS(strings.NewReader(xmlNFe))
+	if err != nil {
+		t.Fatalf("Erro inesperado ao processar XML: %v", err)
+	}
+	if result.IcmsXML != 17.50 {
+		t.Errorf("Esperava ICMS 17.50 (ICMS00 + ICMSPart), obteve %.2f", result.IcmsXML)
+	}
+	if len(result.Alerts) != 0 {
+		t.Errorf("Não esperava alertas, obteve %v", result.Alerts)
+	}
+}
+
+// TestParseXMLForICMSSimplesNacional garante que CSOSN 102 e 500 não somam ICMS (nem o ST
+// retido como crédito), que o ICMSSN900 entra pelo vICMS e que o grupo de cada item é informado.
+func TestParseXMLForICMSSimplesNacional(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+	xmlNFe := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>
+	  <det nItem="1"><imposto><ICMS><ICMSSN102><orig>0</orig><CSOSN>102</CSOSN></ICMSSN102></ICMS></imposto></det>
+	  <det nItem="2"><imposto><ICMS><ICMSSN500><orig>0</orig><CSOSN>500</CSOSN><vICMSSTRet>7.00</vICMSSTRet></ICMSSN500></ICMS></imposto></det>
+	  <det nItem="3"><imposto><ICMS><ICMSSN900><orig>0</orig><CSOSN>900</CSOSN><vICMS>3.00</vICMS><vCredICMSSN>1.00</vCredICMSSN></ICMSSN900></ICMS></imposto></det>
+	</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+
+	result, err := svc.parseXMLForICMS(strings.NewReader(xmlNFe))
+	if err != nil {
+		t.Fatalf("Erro inesperado ao processar XML: %v", err)
+	}
+	if result.IcmsXML != 3.00 {
+		t.Errorf("Esperava ICMS 3.00 (só o vICMS do ICMSSN900), obteve %.2f", result.IcmsXML)
+	}
+	if len(result.Alerts) != 0 {
+		t.Errorf("Não esperava alertas, obteve %v", result.Alerts)
+	}
+	esperado := []domain.ICMSItemGroup{{Item: 1, Group: "ICMSSN102"}, {Item: 2, Group: "ICMSSN500"}, {Item: 3, Group: "ICMSSN900"}}
+	if fmt.Sprint(result.ItemGroups) != fmt.Sprint(esperado) {
+		t.Errorf("Grupos por item esperados %v, obtidos %v", esperado, result.ItemGroups)
+	}
+
+	// uma nota só com CSOSN 102 bate com o SPED sem ICMS
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|102|5102|0|100,00|0|0|0|0|0|0||\n"
+	soSN102 := strings.Replace(xmlNFe, "<vICMS>3.00</vICMS>", "", 1)
+	soSN102 = strings.Replace(soSN102, "<vCredICMSSN>1.00</vCredICMSSN>", "", 1)
+	results, err := svc.AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(soSN102)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado na análise: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Nota do Simples sem ICMS não deveria gerar discrepância, obteve %+v", results)
+	}
+}
+
+// TestCheckCNPJ avisa quando nenhum XML tem o CNPJ do SPED como emitente ou destinatário e
+// fica em silêncio quando as notas são da empresa do SPED.
+func TestCheckCNPJ(t *testing.T) {
+	svc := NewService()
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|14200166000187||SP|\n"
+	nota := func(emit, dest string) string {
+		return `<nfeProc><NFe><infNFe Id="NFe35200114200166000187550010000000046271239906"><ide><nNF>46</nNF></ide>` +
+			`<emit><CNPJ>` + emit + `</CNPJ></emit><dest><CNPJ>` + dest + `</CNPJ></dest></infNFe></NFe></nfeProc>`
+	}
+
+	check, err := svc.CheckCNPJ(strings.NewReader(sped), []io.Reader{
+		strings.NewReader(nota("11111111000111", "22222222000122")),
+		strings.NewReader(nota("33333333000133", "22222222000122")),
+	})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if !strings.Contains(check.Warning, "Nenhum dos 2 XMLs") || !strings.Contains(check.Warning, "14200166000187") {
+		t.Errorf("Esperava aviso de CNPJ divergente, obteve %q", check.Warning)
+	}
+
+	check, err = svc.CheckCNPJ(strings.NewReader(sped), []io.Reader{
+		strings.NewReader(nota("11111111000111", "14200166000187")),
+		strings.NewReader(nota("14200166000187", "22222222000122")),
+	})
+	if err != nil || check.Warning != "" {
+		t.Errorf("Notas da empresa do SPED não deveriam gerar aviso: %q, %v", check.Warning, err)
+	}
+}
+
+// TestCheckCNPJInfereEmpresa garante que o CNPJ destinatário da maioria dos XMLs é inferido como
+// a empresa, com as notas separadas em entradas e saídas a partir dele.
+func TestCheckCNPJInfereEmpresa(t *testing.T) {
+	nota := func(emit, dest string) io.Reader {
+		return strings.NewReader(`<nfeProc><NFe><infNFe Id="NFe35200114200166000187550010000000046271239906"><ide><nNF>46</nNF></ide>` +
+			`<emit><CNPJ>` + emit + `</CNPJ></emit><dest><CNPJ>` + dest + `</CNPJ></dest></infNFe></NFe></nfeProc>`)
+	}
+	empresa := "14.200.166/0001-87"
+
+	check, err := NewService().CheckCNPJ(strings.NewReader("|0000|017|0|01012024|31012024|EMPRESA|||SP|\n"), []io.Reader{
+		nota("11111111000111", empresa),
+		nota("22222222000122", empresa),
+		nota("33333333000133", empresa),
+		nota("14200166000187", "44444444000144"),
+		nota("55555555000155", "44444444000144"),
+	})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if check.InferredCNPJ != "14200166000187" {
+		t.Errorf("Esperava inferir 14200166000187, obteve %q", check.InferredCNPJ)
+	}
+	if check.Incoming != 3 || check.Outgoing != 1 {
+		t.Errorf("Esperava 3 entradas e 1 saída, obteve %d e %d", check.Incoming, check.Outgoing)
+	}
+	if check.Warning != "" {
+		t.Errorf("Sem CNPJ no SPED não deveria haver aviso, obteve %q", check.Warning)
+	}
+
+	// só vendas: nenhum destinatário é maioria, vale o CNPJ presente em mais notas
+	check, _ = NewService().CheckCNPJ(strings.NewReader(""), []io.Reader{
+		nota("14200166000187", "11111111000111"),
+		nota("14200166000187", "22222222000122"),
+		nota("14200166000187", "33333333000133"),
+	})
+	if check.InferredCNPJ != "14200166000187" || check.Outgoing != 3 {
+		t.Errorf("Esperava emitente 14200166000187 com 3 saídas, obteve %+v", check)
+	}
+}
+
+// TestParseXMLProtNFeMalformado garante que um protNFe quebrado não impede a leitura da nota: a
+// chave vem do atributo Id do infNFe e a nota é conciliada com o SPED normalmente.
+func TestParseXMLProtNFeMalformado(t *testing.T) {
+	svc := &service{}
+	chave := "35200114200166000187550010000000046271239901"
+	xmlNFe := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</infProt></protNFe></nfeProc>`
+
+	result, err := svc.parseXMLForICMS(strings.NewReader(xmlNFe))
+	if err != nil {
+		t.Fatalf("Erro inesperado ao processar XML: %v", err)
+	}
+	if result.NFeKey != chave || result.IcmsXML != 18.00 {
+		t.Errorf("Esperava chave %s e ICMS 18.00, obteve %s e %.2f", chave, result.NFeKey, result.IcmsXML)
+	}
+	if len(result.Alerts) != 1 || !strings.Contains(result.Alerts[0], "protNFe") {
+		t.Errorf("Esperava alerta de protNFe malformado, obteve %v", result.Alerts)
+	}
+
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|01012024|100,00|0|0,00|0,00|100,00|0|0,00|0,00|0,00|100,00|18,00|0,00|0,00|0,00|0,00|0,00|0,00|0,00|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xmlNFe)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado na análise: %v", err)
+	}
+	for _, r := range results {
+		if r.StatusCode == domain.StatusNaoEncontradaSPED || r.StatusCode == domain.StatusXMLInvalido {
+			t.Errorf("Nota com protNFe malformado não deveria ficar como %s: %+v", r.StatusCode, r)
+		}
+	}
+
+	if _, err := svc.parseXMLForICMS(strings.NewReader(`<outro><NFe>` + chave + `</outro>`)); err == nil {
+		t.Error("Documento sem nfeProc deveria continuar falhando")
+	}
+}
+
+// TestAnalyzeICMSUsaPoolConfigurado garante que o parse dos XMLs da análise de ICMS roda no pool
+// com o tamanho passado ao serviço e que o resultado não depende desse tamanho.
+func TestAnalyzeICMSUsaPoolConfigurado(t *testing.T) {
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n"
+	var xmls []string
+	for i := 0; i < 12; i++ {
+		chave := fmt.Sprintf("352001142001660001875500100000%05d271239906", i)
+		sped += "|C100|0|1|P1|55|00|1|" + fmt.Sprint(i) + "|" + chave + "|01012024|\n" +
+			"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+		xmls = append(xmls, nfeXMLTeste(chave, fmt.Sprint(i), fmt.Sprintf("%d.00", i)))
+	}
+
+	original := runPool
+	defer func() { runPool = original }()
+
+	analisar := func(workers int) ([]domain.AnalysisResult, int, int64) {
+		var tamanho int
+		var ativos, maxAtivos atomic.Int64
+		runPool = func(size, n int, fn func(i int)) {
+			tamanho = size
+			original(size, n, func(i int) {
+				n := ativos.Add(1)
+				for {
+					m := maxAtivos.Load()
+					if n <= m || maxAtivos.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(2 * time.Millisecond)
+				fn(i)
+				ativos.Add(-1)
+			})
+		}
+		readers := make([]io.Reader, len(xmls))
+		for i, x := range xmls {
+			readers[i] = strings.NewReader(x)
+		}
+		results, err := NewServiceWithWorkers(workers).AnalyzeICMSFiles(strings.NewReader(sped), readers, ICMSOptions{})
+		if err != nil {
+			t.Fatalf("Erro inesperado na análise: %v", err)
+		}
+		return results, tamanho, maxAtivos.Load()
+	}
+
+	sequencial, tamanho, maximo := analisar(1)
+	if tamanho != 1 || maximo != 1 {
+		t.Errorf("Com 1 worker esperava pool 1 sem concorrência, obteve pool %d e %d simultâneos", tamanho, maximo)
+	}
+	paralelo, tamanho, maximo := analisar(4)
+	if tamanho != 4 || maximo > 4 || maximo < 2 {
+		t.Errorf("Com 4 workers esperava pool 4 e até 4 simultâneos, obteve pool %d e %d simultâneos", tamanho, maximo)
+	}
+
+	if len(sequencial) != len(paralelo) || len(paralelo) != 12 {
+		t.Fatalf("Esperava 12 discrepâncias nos dois modos, obteve %d e %d", len(sequencial), len(paralelo))
+	}
+	for i := range sequencial {
+		if sequencial[i].NFeKey != paralelo[i].NFeKey || sequencial[i].StatusCode != paralelo[i].StatusCode {
+			t.Errorf("Resultado %d difere entre os modos: %+v x %+v", i, sequencial[i], paralelo[i])
+		}
+	}
+}
+
+// TestAnalyzeICMSEmitentesIgnorados garante que as notas de um emitente ignorado não aparecem
+// como problema, enquanto as dos demais emitentes continuam sendo reportadas.
+func TestAnalyzeICMSEmitentesIgnorados(t *testing.T) {
+	chaveIgnorada := "35200111111111000111550010000000046271239904"
+	chaveOutra := "35200133333333000133550010000000047271239902"
+	nota := func(chave, nNF, emit string) string {
+		return `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>` + nNF + `</nNF></ide>` +
+			`<emit><CNPJ>` + emit + `</CNPJ></emit>` +
+			`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>` +
+			`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	}
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveIgnorada + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + chaveOutra + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+	analisar := func(emitentes []string) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{
+			strings.NewReader(nota(chaveIgnorada, "46", "11111111000111")),
+			strings.NewReader(nota(chaveOutra, "47", "33333333000133")),
+		}, ICMSOptions{EmittersToIgnore: emitentes})
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(nil); len(results) != 2 {
+		t.Fatalf("Sem emitentes ignorados esperava 2 discrepâncias, obteve %d: %+v", len(results), results)
+	}
+	// CNPJ com pontuação também deve ser reconhecido
+	results := analisar([]string{"11.111.111/0001-11"})
+	if len(results) != 1 || results[0].NFeKey != chaveOutra {
+		t.Errorf("Esperava só a nota de 33333333000133, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSTolerancia verifies that differences up to the tolerance are not reported and that
+// the absolute difference is exposed in the result.
+func TestAnalyzeICMSTolerancia(t *testing.T) {
+	chave := "35200111111111000111550010000000046271239904"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<emit><CNPJ>11111111000111</CNPJ></emit>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,01|0|0|0|0||\n"
+	analisar := func(tolerancia float64) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)},
+			ICMSOptions{Tolerance: tolerancia})
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	results := analisar(0)
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Fatalf("Sem tolerância esperava 1 discrepância, obteve %+v", results)
+	}
+	if data, ok := results[0].Data.(domain.ICMSData); !ok || data.IcmsDifference != 0.01 {
+		t.Errorf("Esperava diferença de 0.01, obteve %+v", results[0].Data)
+	}
+	if results := analisar(0.02); len(results) != 0 {
+		t.Errorf("Com tolerância 0,02 não esperava discrepâncias, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSCompareST verifies that the ICMS-ST comparison runs only when requested and
+// reports a note whose own ICMS matches the SPED but whose ICMS-ST does not.
+func TestAnalyzeICMSCompareST(t *testing.T) {
+	chave := "35200111111111000111550010000000046271239904"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`<det nItem="2"><imposto><ICMS><ICMS10><vICMS>5.00</vICMS><vICMSST>3.00</vICMSST></ICMS10></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|010|5401|18,00|100,00|100,00|15,00|20,00|2,00|0|0||\n"
+	analisar := func(opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(ICMSOptions{}); len(results) != 0 {
+		t.Fatalf("Sem CompareST o ICMS confere e não esperava resultados, obteve %+v", results)
+	}
+	results := analisar(ICMSOptions{CompareST: true})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMSST {
+		t.Fatalf("Esperava 1 discrepância de ICMS-ST, obteve %+v", results)
+	}
+	data, ok := results[0].Data.(domain.ICMSData)
+	if !ok || data.IcmsStXML == nil || data.IcmsStSPED == nil || *data.IcmsStXML != 3 || *data.IcmsStSPED != 2 {
+		t.Errorf("Esperava ICMS-ST XML=3 e SPED=2, obteve %+v", results[0].Data)
+	}
+	if results := analisar(ICMSOptions{CompareST: true, Tolerance: 1}); len(results) != 0 {
+		t.Errorf("Com tolerância 1 não esperava discrepâncias, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSComparePISCOFINS verifies the PIS/COFINS comparison against the C100 values and,
+// when they are zero, against the sum of the C170 items.
+func TestAnalyzeICMSComparePISCOFINS(t *testing.T) {
+	chave := "35200111111111000111550010000000046271239904"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>10.00</vICMS></ICMS00></ICMS>` +
+		`<PIS><PISAliq><vPIS>1.65</vPIS></PISAliq></PIS><COFINS><COFINSAliq><vCOFINS>7.60</vCOFINS></COFINSAliq></COFINS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	// c100 fills VL_PIS (26) and VL_COFINS (27); c170 fills VL_PIS (30) and VL_COFINS (36)
+	c100 := func(pis, cofins string) string {
+		f := make([]string, 30)
+		f[1], f[8], f[9], f[22], f[26], f[27] = "C100", "46", chave, "10,00", pis, cofins
+		return strings.Join(f, "|") + "\n"
+	}
+	c170 := func(pis, cofins string) string {
+		f := make([]string, 38)
+		f[1], f[2], f[30], f[36] = "C170", "1", pis, cofins
+		return strings.Join(f, "|") + "\n"
+	}
+	c190 := "|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+	analisar := func(sped string, opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	divergente := c100("1,65", "7,00") + c170("1,65", "7,60") + c190
+	if results := analisar(divergente, ICMSOptions{}); len(results) != 0 {
+		t.Fatalf("Sem ComparePISCOFINS não esperava resultados, obteve %+v", results)
+	}
+	results := analisar(divergente, ICMSOptions{ComparePISCOFINS: true})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaPISCOFINS {
+		t.Fatalf("Esperava 1 discrepância de PIS/COFINS, obteve %+v", results)
+	}
+	data := results[0].Data.(domain.ICMSData)
+	if *data.PisXML != 1.65 || *data.PisSPED != 1.65 || *data.CofinsXML != 7.6 || *data.CofinsSPED != 7 {
+		t.Errorf("Valores de PIS/COFINS inesperados: %+v", data)
+	}
+	if len(results[0].Alerts) != 1 || !strings.Contains(results[0].Alerts[0], "COFINS") {
+		t.Errorf("Esperava só o alerta de COFINS, obteve %v", results[0].Alerts)
+	}
+
+	// C100 zerado: vale a soma dos C170
+	if results := analisar(c100("0", "0")+c170("1,00", "4,00")+c170("0,65", "3,60")+c190, ICMSOptions{ComparePISCOFINS: true}); len(results) != 0 {
+		t.Errorf("Com os C170 somando o XML não esperava discrepâncias, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSCompareTotal garante que, com CompareTotal, um VL_DOC digitado errado no C100
+// é apontado mesmo com o ICMS conferindo, e que a tolerância também vale para o total.
+func TestAnalyzeICMSCompareTotal(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`<total><ICMSTot><vNF>1234.56</vNF></ICMSTot></total>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	sped := func(vlDoc string) string {
+		return "|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|01012024|" + vlDoc + "|\n" +
+			"|C190|000|1102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+	}
+	analisar := func(sped string, opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(sped("1243,56"), ICMSOptions{}); len(results) != 0 {
+		t.Fatalf("Sem CompareTotal o ICMS confere e não esperava resultados, obteve %+v", results)
+	}
+	results := analisar(sped("1243,56"), ICMSOptions{CompareTotal: true})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaValorTotal {
+		t.Fatalf("Esperava 1 discrepância de valor total, obteve %+v", results)
+	}
+	data := results[0].Data.(domain.ICMSData)
+	if *data.TotalXML != 1234.56 || *data.TotalSPED != 1243.56 {
+		t.Errorf("Totais inesperados: XML %v, SPED %v", *data.TotalXML, *data.TotalSPED)
+	}
+	if len(results[0].Alerts) != 1 || !strings.Contains(results[0].Alerts[0], "valor total") {
+		t.Errorf("Esperava só o alerta de valor total, obteve %v", results[0].Alerts)
+	}
+
+	if results := analisar(sped("1234,56"), ICMSOptions{CompareTotal: true}); len(results) != 0 {
+		t.Errorf("Com os totais iguais não esperava resultados, obteve %+v", results)
+	}
+	if results := analisar(sped("1234,57"), ICMSOptions{CompareTotal: true, Tolerance: 0.02}); len(results) != 0 {
+		t.Errorf("Diferença dentro da tolerância não deveria ser apontada, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSCompareCST verifica que, com o ICMS conferindo, um CST escriturado diferente do
+// XML gera StatusDiscrepanciaCST com os códigos dos dois lados, origem incluída.
+func TestAnalyzeICMSCompareCST(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><orig>0</orig><CST>00</CST><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`<det nItem="2"><imposto><ICMS><ICMS40><orig>0</orig><CST>40</CST></ICMS40></ICMS></imposto></det>` +
+		`<det nItem="3"><imposto><ICMS><ICMSSN102><orig>1</orig><CSOSN>102</CSOSN></ICMSSN102></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	sped := func(cst string) string {
+		return "|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+			"|C190|" + cst + "|1102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+			"|C190|040|1102|0|50,00|0|0|0|0|0|0||\n" +
+			"|C190|1102|1102|0|10,00|0|0|0|0|0|0||\n"
+	}
+	analisar := func(sped string, opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(sped("020"), ICMSOptions{}); len(results) != 0 {
+		t.Fatalf("Sem CompareCST o ICMS confere e não esperava resultados, obteve %+v", results)
+	}
+	results := analisar(sped("020"), ICMSOptions{CompareCST: true})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaCST {
+		t.Fatalf("Esperava 1 discrepância de CST, obteve %+v", results)
+	}
+	data := results[0].Data.(domain.ICMSData)
+	if !reflect.DeepEqual(data.CstXML, []string{"000", "040", "1102"}) || !reflect.DeepEqual(data.CstSPED, []string{"020", "040", "1102"}) {
+		t.Errorf("CSTs inesperados: XML %v, SPED %v", data.CstXML, data.CstSPED)
+	}
+	if len(results[0].Alerts) != 1 || !strings.Contains(results[0].Alerts[0], "CST XML=000, 040, 1102, SPED=020, 040, 1102") {
+		t.Errorf("Esperava só o alerta de CST, obteve %v", results[0].Alerts)
+	}
+
+	if results := analisar(sped("000"), ICMSOptions{CompareCST: true}); len(results) != 0 {
+		t.Errorf("Com os CSTs iguais não esperava resultados, obteve %+v", results)
+	}
+}
+
+// TestAnalyzeICMSIncludeMatched verifies that matching notes are only returned, with StatusOK,
+// when IncludeMatched is set.
+func TestAnalyzeICMSIncludeMatched(t *testing.T) {
+	chaveOK := "35200111111111000111550010000000046271239904"
+	chaveDivergente := "35200133333333000133550010000000047271239902"
+	nota := func(chave, nNF string) string {
+		return `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>` + nNF + `</nNF></ide>` +
+			`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+			`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	}
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveOK + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + chaveDivergente + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+	analisar := func(opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{
+			strings.NewReader(nota(chaveOK, "46")),
+			strings.NewReader(nota(chaveDivergente, "47")),
+		}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(ICMSOptions{}); len(results) != 1 || results[0].NFeKey != chaveDivergente {
+		t.Fatalf("Por padrão esperava só a nota divergente, obteve %+v", results)
+	}
+	results := analisar(ICMSOptions{IncludeMatched: true})
+	if len(results) != 2 {
+		t.Fatalf("Com IncludeMatched esperava as 2 notas, obteve %+v", results)
+	}
+	if results[0].NFeKey != chaveOK || results[0].StatusCode != domain.StatusOK || len(results[0].Alerts) != 0 {
+		t.Errorf("Esperava a nota conferida com StatusOK e sem alertas, obteve %+v", results[0])
+	}
+	if data, ok := results[0].Data.(domain.ICMSData); !ok || data.IcmsXML != 18 || data.IcmsSPED != 18 {
+		t.Errorf("Dados inesperados para a nota conferida: %+v", results[0].Data)
+	}
+	if results[1].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Errorf("A nota divergente deveria manter a discrepância, obteve %+v", results[1])
+	}
+}
+
+// TestExportXLSX opens the exported workbook and checks both sheets, their headers and the
+// status counts.
+func TestExportXLSX(t *testing.T) {
+	results := []domain.AnalysisResult{
+		{Type: domain.TypeICMS, NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS,
+			Alerts: []string{"Discrepância"}, Data: domain.ICMSData{DocNumber: "46", IcmsXML: 18, IcmsSPED: 10, IcmsDifference: 8,
+				CfopsSPED: []string{"5102", "5405"}}},
+		{Type: domain.TypeICMS, NFeKey: "2", StatusCode: domain.StatusOK, Data: domain.ICMSData{DocNumber: "47", IcmsXML: 5, IcmsSPED: 5}},
+		{Type: domain.TypeIPIST, NFeKey: "3", StatusCode: domain.StatusDiscrepanciaIPIST, Data: domain.IPISTData{STValueXML: 3, STValueSPED: 2}},
+	}
+	data, err := ExportXLSX(results)
+	if err != nil {
+		t.Fatalf("Erro ao exportar: %v", err)
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Planilha inválida: %v", err)
+	}
+	defer f.Close()
+
+	if sheets := f.GetSheetList(); len(sheets) != 2 || sheets[0] != SheetSummary || sheets[1] != SheetDetail {
+		t.Fatalf("Esperava as abas %s e %s, obteve %v", SheetSummary, SheetDetail, sheets)
+	}
+
+	summary, err := f.GetRows(SheetSummary)
+	if err != nil {
+		t.Fatalf("Erro ao ler %s: %v", SheetSummary, err)
+	}
+	if len(summary) == 0 || strings.Join(summary[0], "|") != "Status|Notas" {
+		t.Fatalf("Cabeçalho inesperado em %s: %v", SheetSummary, summary)
+	}
+	counts := make(map[string]string)
+	for _, row := range summary[1:] {
+		if len(row) == 2 {
+			counts[row[0]] = row[1]
+		}
+	}
+	if counts["ok"] != "1" || counts["discrepancia_icms"] != "1" || counts["discrepancia_ipi_st"] != "1" || counts["total"] != "3" {
+		t.Errorf("Contagens inesperadas: %v", counts)
+	}
+	if counts["ICMS XML"] != "23" || counts["ST XML"] != "3" {
+		t.Errorf("Totais inesperados: %v", counts)
+	}
+
+	detail, err := f.GetRows(SheetDetail)
+	if err != nil {
+		t.Fatalf("Erro ao ler %s: %v", SheetDetail, err)
+	}
+	if len(detail) != 4 || detail[0][0] != "Chave NF-e" || detail[0][len(detail[0])-1] != "Alertas" {
+		t.Fatalf("Esperava cabeçalho e 3 notas em %s, obteve %v", SheetDetail, detail)
+	}
+	if detail[1][2] != "Discrepância de ICMS" || detail[1][3] != "46" || detail[1][6] != "8" {
+		t.Errorf("Linha da nota divergente inesperada: %v", detail[1])
+	}
+	if detail[1][11] != "5102, 5405" {
+		t.Errorf("Esperava os CFOPs do SPED na linha da nota, obteve %v", detail[1])
+	}
+	okStyle, _ := f.GetCellStyle(SheetDetail, "A3")
+	divStyle, _ := f.GetCellStyle(SheetDetail, "A2")
+	if okStyle == divStyle {
+		t.Errorf("Notas com status diferentes deveriam ter cores diferentes")
+	}
+}
+
+// TestValidChaveNFe checks the modulo 11 check digit, including the remainders 0 and 1 that
+// give digit 0, and keys with the wrong length or non-digits.
+func TestValidChaveNFe(t *testing.T) {
+	cases := []struct {
+		chave string
+		want  bool
+	}{
+		{"35200111111111000111550010000000046271239963", true},
+		{"35200111111111000111550010000000046271239980", true},  // resto 1
+		{"35200111111111000111550010000000046271239920", true},  // resto 0
+		{"35200111111111000111550010000000046271239971", true},  // 11 - resto = 1
+		{"35200111111111000111550010000000046271239961", false}, // dígito trocado
+		{"35200111111111000111550010000000046271239963" + "0", false},
+		{"3520011111111100011155001000000004627123996", false},
+		{"3520011111111100011155001000000004627123996A", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := ValidChaveNFe(tc.chave); got != tc.want {
+			t.Errorf("ValidChaveNFe(%q) = %v, esperava %v", tc.chave, got, tc.want)
+		}
+	}
+}
+
+// TestAnalyzeICMSChaveInvalida verifies that an XML whose key fails the check digit is reported
+// with StatusChaveInvalida instead of being reconciled with the SPED.
+func TestAnalyzeICMSChaveInvalida(t *testing.T) {
+	chave := "35200111111111000111550010000000046271239961"
+	xml := `<nfeProc><NFe><infNFe Id="NFe` + chave + `"><ide><nNF>46</nNF></ide>` +
+		`<det nItem="1"><imposto><ICMS><ICMS00><vICMS>18.00</vICMS></ICMS00></ICMS></imposto></det>` +
+		`</infNFe></NFe><protNFe><infProt><chNFe>` + chave + `</chNFe></infProt></protNFe></nfeProc>`
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 1 || results[0].StatusCode != domain.StatusChaveInvalida || results[0].NFeKey != chave {
+		t.Fatalf("Esperava a nota com StatusChaveInvalida, obteve %+v", results)
+	}
+	if v := NewService().ValidateXMLFiles([]io.Reader{strings.NewReader(xml)}); len(v) != 1 || v[0].Valid {
+		t.Errorf("ValidateXMLFiles deveria rejeitar a chave, obteve %+v", v)
+	}
+}
+
+// TestAnalyzeICMSNotaCancelada verifica que uma nota com protocolo de cancelamento não é conferida com o SPED.
+func TestAnalyzeICMSNotaCancelada(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := strings.Replace(nfeXMLTeste(chave, "46", "10.00"), "</chNFe>",
+		"</chNFe><cStat>101</cStat><xMotivo>Cancelamento de NF-e homologado</xMotivo>", 1)
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 1 || results[0].StatusCode != domain.StatusNotaCancelada {
+		t.Fatalf("Esperava a nota com StatusNotaCancelada, obteve %+v", results)
+	}
+	if !strings.Contains(results[0].Alerts[0], "cStat 101") {
+		t.Errorf("Alerta não informa o cStat do protocolo: %v", results[0].Alerts)
+	}
+	if data := results[0].Data.(domain.ICMSData); data.IcmsSPED != 0 {
+		t.Errorf("Nota cancelada não deveria ser cruzada com o SPED, obteve %+v", data)
+	}
+
+	autorizada := strings.Replace(nfeXMLTeste(chave, "46", "18.00"), "</chNFe>", "</chNFe><cStat>100</cStat>", 1)
+	results, err = NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(autorizada)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Nota autorizada e conferida não deveria ser reportada, obteve %+v", results)
+	}
+}
+
+// TestExportXLSXByCompetencia verifica a divisão da exportação em um arquivo por mês de emissão.
+func TestExportXLSXByCompetencia(t *testing.T) {
+	chaveJan := "35200114200166000187550010000000046271239901"
+	chaveFev := "35200114200166000187550010000000471000000470"
+	xmlJan := strings.Replace(nfeXMLTeste(chaveJan, "46", "10.00"), "<nNF>46</nNF>",
+		"<nNF>46</nNF><dhEmi>2024-01-15T10:00:00-03:00</dhEmi>", 1)
+	xmlFev := strings.Replace(nfeXMLTeste(chaveFev, "47", "10.00"), "<nNF>47</nNF>",
+		"<nNF>47</nNF><dEmi>2024-02-03</dEmi>", 1)
+	sped := "|0000|017|0|01012024|29022024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveJan + "|15012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped),
+		[]io.Reader{strings.NewReader(xmlJan), strings.NewReader(xmlFev)}, ICMSOptions{IncludeMatched: true})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 2 || results[0].Data.(domain.ICMSData).IssueDate != "2024-01-15" || results[1].Data.(domain.ICMSData).IssueDate != "2024-02-03" {
+		t.Fatalf("Esperava as 2 notas com a data de emissão, obteve %+v", results)
+	}
+
+	zipped, err := ExportXLSXByCompetencia(results)
+	if err != nil {
+		t.Fatalf("Erro ao exportar: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if err != nil {
+		t.Fatalf("ZIP inválido: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "Analise_2024-01.xlsx" || zr.File[1].Name != "Analise_2024-02.xlsx" {
+		names := make([]string, len(zr.File))
+		for i, f := range zr.File {
+			names[i] = f.Name
+		}
+		t.Fatalf("Arquivos inesperados no ZIP: %v", names)
+	}
+	for i, chave := range []string{chaveJan, chaveFev} {
+		rc, err := zr.File[i].Open()
+		if err != nil {
+			t.Fatalf("Erro ao abrir %s: %v", zr.File[i].Name, err)
+		}
+		f, err := excelize.OpenReader(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Planilha %s inválida: %v", zr.File[i].Name, err)
+		}
+		rows, _ := f.GetRows(SheetDetail)
+		f.Close()
+		if len(rows) != 2 || rows[1][0] != chave {
+			t.Errorf("%s deveria conter apenas a nota %s, obteve %v", zr.File[i].Name, chave, rows)
+		}
+	}
+}
+
+// TestAnalyzeICMSDevolucaoAbsoluta verifies that a devolução note with negative ICMS in the SPED
+// reconciles with the positive XML value only when AbsoluteReturns is set.
+func TestAnalyzeICMSDevolucaoAbsoluta(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := nfeXMLTeste(chave, "46", "18.00")
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5202|18,00|100,00|100,00|-18,00|0|0|0|0||\n"
+	analisar := func(opts ICMSOptions) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	results := analisar(ICMSOptions{})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Fatalf("Sem a opção esperava 1 discrepância, obteve %+v", results)
+	}
+	results = analisar(ICMSOptions{AbsoluteReturns: true, IncludeMatched: true})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusOK {
+		t.Fatalf("Com a opção esperava a nota conferida, obteve %+v", results)
+	}
+	if data := results[0].Data.(domain.ICMSData); data.IcmsSPED != -18 || data.IcmsDifference != 0 {
+		t.Errorf("Esperava o ICMS do SPED com o sinal original e diferença zero, obteve %+v", data)
+	}
+
+	if !IsCFOPDevolucao("1202") || !IsCFOPDevolucao("6411") || IsCFOPDevolucao("5102") || IsCFOPDevolucao("520") {
+		t.Errorf("IsCFOPDevolucao não reconheceu os CFOPs de devolução corretamente")
+	}
+}
+
+// TestParseICMSFilesProgress verifica que o progresso é avisado a cada ProgressInterval XMLs e no
+// último, sempre crescente, mesmo com o parse em paralelo.
+func TestParseICMSFilesProgress(t *testing.T) {
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n"
+	var xmls []io.Reader
+	for i := 0; i < 2*ProgressInterval+20; i++ {
+		chave := fmt.Sprintf("352001142001660001875500100000%05d271239906", i)
+		sped += "|C100|0|1|P1|55|00|1|" + fmt.Sprint(i) + "|" + chave + "|01012024|\n"
+		xmls = append(xmls, strings.NewReader(nfeXMLTeste(chave, fmt.Sprint(i), "18.00")))
+	}
+
+	var avisos [][2]int
+	_, err := NewServiceWithWorkers(4).ParseICMSFilesProgress(strings.NewReader(sped), xmls, func(done, total int) {
+		avisos = append(avisos, [2]int{done, total})
+	})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	total := len(xmls)
+	want := [][2]int{{ProgressInterval, total}, {2 * ProgressInterval, total}, {total, total}}
+	if !reflect.DeepEqual(avisos, want) {
+		t.Errorf("Progresso inesperado: %v, esperado %v", avisos, want)
+	}
+}
+
+// BenchmarkAnalyzeICMSWorkers mede a análise de 2000 notas com parse sequencial e com pools
+// maiores; o ganho depende das CPUs disponíveis (GOMAXPROCS).
+func BenchmarkAnalyzeICMSWorkers(b *testing.B) {
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n"
+	var xmls []string
+	for i := 0; i < 2000; i++ {
+		chave := fmt.Sprintf("352001142001660001875500100000%05d271239906", i)
+		sped += "|C100|0|1|P1|55|00|1|" + fmt.Sprint(i) + "|" + chave + "|01012024|\n" +
+			"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n"
+		xmls = append(xmls, nfeXMLTeste(chave, fmt.Sprint(i), "18.00"))
+	}
+
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			svc := NewServiceWithWorkers(n)
+			for i := 0; i < b.N; i++ {
+				readers := make([]io.Reader, len(xmls))
+				for j, x := range xmls {
+					readers[j] = strings.NewReader(x)
+				}
+				if _, err := svc.AnalyzeICMSFiles(strings.NewReader(sped), readers, ICMSOptions{}); err != nil {
+					b.Fatalf("Erro inesperado na análise: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// spedTeste monta um SPED com n notas, cada uma com um C100, um C170 e três C190 (5 linhas por nota).
+func spedTeste(n int) string {
+	var sb strings.Builder
+	sb.WriteString("|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n")
+	for i := 0; i < n; i++ {
+		chave := fmt.Sprintf("352001142001660001875500100000%05d271239906", i)
+		fmt.Fprintf(&sb, "|C100|0|1|P1|55|00|1|%d|%s|01012024|01012024|100,00|\n", i, chave)
+		sb.WriteString("|C170|1|P1|ITEM|1|UN|100,00|0|0|000|5102|\n")
+		sb.WriteString("|C190|000|5102|18,00|60,00|60,00|10,80|0|0|0|0||\n")
+		sb.WriteString("|C190|020|5102|12,00|30,00|30,00|3,60|0|0|0|0||\n")
+		sb.WriteString("|C190|060|5405|0|10,00|0|0|0|0|0|0||\n")
+	}
+	return sb.String()
+}
+
+// TestParseSpedC190UltimoC100 fixa a associação feita em uma única passada: cada C190 soma no
+// último C100 lido, C190 antes de qualquer C100 é descartado e uma chave repetida acumula.
+func TestParseSpedC190UltimoC100(t *testing.T) {
+	svc := &service{}
+	chaveA := "35200114200166000187550010000000046271239901"
+	chaveB := "35200114200166000187550010000000471000000470"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|99,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveA + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + chaveB + "|01012024|\n" +
+		"|C190|000|5405|0|50,00|0|0|0|0|0|0||\n" +
+		"|C190|000|5102|12,00|20,00|20,00|2,40|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveA + "|01012024|\n" +
+		"|C190|000|6102|12,00|10,00|10,00|1,20|0|0|0|0||\n"
+
+	notes, err := svc.parseSpedFileForICMS(strings.NewReader(sped), nil)
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(notes) != 2 || len(notes[chaveA]) != 1 || len(notes[chaveB]) != 1 {
+		t.Fatalf("Esperava uma nota por chave, obteve %+v", notes)
+	}
+	a, b := notes[chaveA][0], notes[chaveB][0]
+	if a.Icms != 19.2 || !reflect.DeepEqual(a.Cfops, []string{"5102", "6102"}) {
+		t.Errorf("Nota A: esperava ICMS 19,20 com CFOPs 5102 e 6102, obteve %.2f %v", a.Icms, a.Cfops)
+	}
+	if b.Icms != 2.4 || !reflect.DeepEqual(b.Cfops, []string{"5405", "5102"}) {
+		t.Errorf("Nota B: esperava ICMS 2,40 com CFOPs 5405 e 5102, obteve %.2f %v", b.Icms, b.Cfops)
+	}
+
+	// o resultado de um SPED grande não depende do tamanho: toda nota fica igual à primeira
+	grande, err := svc.parseSpedFileForICMS(strings.NewReader(spedTeste(2000)), nil)
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(grande) != 2000 {
+		t.Fatalf("Esperava 2000 notas, obteve %d", len(grande))
+	}
+	for chave, infos := range grande {
+		if n := infos[0]; len(infos) != 1 || n.Icms != 14.4 || len(n.Cfops) != 2 || n.ValorTotal != 100 {
+			t.Fatalf("Nota %s com dados inesperados: %+v", chave, infos)
+		}
+	}
+}
+
+// TestParseSpedRegistrosFixture confere o resultado completo do parse para um SPED com todos os
+// registros lidos (0000, 0140, C010, C100, C170, C190) e outros que devem ser ignorados.
+func TestParseSpedRegistrosFixture(t *testing.T) {
+	svc := &service{}
+	chaveA := "35200114200166000187550010000000046271239901"
+	chaveB := "35200114200166000187550010000000471000000470"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|0001|0|\n" +
+		"|0140|01|FILIAL|00000000000200|SP|\n" +
+		"|C001|0|\n" +
+		"|C010|00000000000300|2|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveA + "|01012024|01012024|150,00|0|0|0|150,00|0|0|0|0|100,00|18,00|0|0|0|1,65|7,60|\n" +
+		"|C170|1|P1|ITEM|1|UN|100,00|0|0|000|1102|1|100,00|18|18,00|0|0|0|0|0||0|0|0|50|100,00|1,65|0|0|1,65|50|100,00|7,60|0|0|7,60|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C190|060|1403|0|50,00|0|0|0|5,00|0|0||\n" +
+		"|C195|1|OBS|\n" +
+		"|C010|00000000000400|2|\n" +
+		"|C100|1|0|P1|55|00|1|47|" + chaveB + "|01012024|01012024|80,00|\n" +
+		"|C170|1|P1|ITEM|1|UN|80,00|0|0|000|5102|1|80,00|12|9,60|0|0|0|0|0||0|0|0|50|80,00|1,65|0|0|1,32|50|80,00|7,60|0|0|6,08|\n" +
+		"|C190|000|5102|12,00|80,00|80,00|9,60|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveA + "|01012024|01012024|150,00|\n" +
+		"|C190|000|1102|18,00|50,00|50,00|9,00|0|0|0|0||\n" +
+		"|D100|0|1|P1|57|00|1|9|\n" +
+		"|9999|20|\n"
+
+	got, err := svc.parseSpedFileForICMS(strings.NewReader(sped), map[string]bool{"1403": true})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	want := map[string][]domain.SpedInfo{
+		chaveA: {
+			{CNPJ: "00000000000300", IndOper: "0", NumDoc: "46", ValorTotal: 150, Icms: 18, IcmsST: 5, Pis: 1.65, Cofins: 7.6,
+				Cfops: []string{"1102", "1403"}, IcmsPorCfop: map[string]float64{"1102": 18, "1403": 0},
+				Csts: []string{"000", "060"}, TemCfopIgnorado: true},
+			{CNPJ: "00000000000400", IndOper: "0", NumDoc: "46", ValorTotal: 150, Icms: 9,
+				Cfops: []string{"1102"}, IcmsPorCfop: map[string]float64{"1102": 9}, Csts: []string{"000"}},
+		},
+		chaveB: {
+			{CNPJ: "00000000000400", IndOper: "1", NumDoc: "47", ValorTotal: 80, Icms: 9.6, Pis: 1.32, Cofins: 6.08,
+				Cfops: []string{"5102"}, IcmsPorCfop: map[string]float64{"5102": 9.6}, Csts: []string{"000"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse inesperado:\n%+v\nesperado:\n%+v", got, want)
+	}
+}
+
+// TestSpedInfoForChave verifica que só a nota pedida é lida, sem herdar os C190 das vizinhas, e
+// os casos de chave ausente, inválida e de SPED sem C100.
+func TestSpedInfoForChave(t *testing.T) {
+	svc := &service{}
+	chaveA := "35200114200166000187550010000000046271239901"
+	chaveB := "35200114200166000187550010000000471000000470"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chaveA + "|01012024|01012024|150,00|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|1|0|P1|55|00|1|47|" + chaveB + "|01012024|01012024|80,00|\n" +
+		"|C190|020|5102|12,00|80,00|80,00|9,60|0|0|0|0||\n" +
+		"|C190|060|5405|0|20,00|0|0|0|2,00|0|0||\n"
+
+	got, err := svc.SpedInfoForChave(strings.NewReader(sped), "NFe "+chaveB)
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	want := []domain.SpedInfo{{CNPJ: "00000000000100", IndOper: "1", NumDoc: "47", ValorTotal: 80, Icms: 9.6, IcmsST: 2,
+		Cfops: []string{"5102", "5405"}, IcmsPorCfop: map[string]float64{"5102": 9.6, "5405": 0}, Csts: []string{"020", "060"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SpedInfo inesperado:\n%+v\nesperado:\n%+v", got, want)
+	}
+
+	if got, err := svc.SpedInfoForChave(strings.NewReader(sped), "35200114200166000187550010000000481000000485"); err != nil || len(got) != 0 {
+		t.Errorf("Chave ausente deveria voltar vazia e sem erro, obteve %+v, %v", got, err)
+	}
+	if _, err := svc.SpedInfoForChave(strings.NewReader(sped), "123"); !errors.Is(err, ErrChaveInvalida) {
+		t.Errorf("Esperava ErrChaveInvalida, obteve %v", err)
+	}
+	if _, err := svc.SpedInfoForChave(strings.NewReader("|0000|017|\n"), chaveA); !errors.Is(err, ErrNenhumC100) {
+		t.Errorf("Esperava ErrNenhumC100, obteve %v", err)
+	}
+}
+
+// BenchmarkParseSpedFileForICMS mede o parse de SPEDs de 10 mil e 50 mil linhas; o tempo por
+// operação deve crescer na mesma proporção das linhas, já que a leitura é de uma passada só.
+func BenchmarkParseSpedFileForICMS(b *testing.B) {
+	svc := &service{}
+	for _, linhas := range []int{10000, 50000} {
+		sped := spedTeste(linhas / 5)
+		b.Run(fmt.Sprintf("linhas=%d", linhas), func(b *testing.B) {
+			b.SetBytes(int64(len(sped)))
+			for i := 0; i < b.N; i++ {
+				if _, err := svc.parseSpedFileForICMS(strings.NewReader(sped), nil); err != nil {
+					b.Fatalf("Erro inesperado: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestAnalyzeICMSCfopsPermitidos verifies that a note with a C190 CFOP outside the allow-list is
+// flagged even when its ICMS matches, and that listed CFOPs pass.
+func TestAnalyzeICMSCfopsPermitidos(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := nfeXMLTeste(chave, "46", "18.00")
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C190|000|5949|0|10,00|0|0|0|0|0|0||\n"
+	analisar := func(permitidos []string) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)},
+			ICMSOptions{AllowedCfops: permitidos})
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	results := analisar([]string{"5102"})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusCFOPNaoPermitido {
+		t.Fatalf("Esperava a nota com StatusCFOPNaoPermitido, obteve %+v", results)
+	}
+	if !strings.Contains(results[0].Alerts[0], "5949") {
+		t.Errorf("Alerta não informa o CFOP fora da lista: %v", results[0].Alerts)
+	}
+	if results := analisar([]string{"5102", "5949"}); len(results) != 0 {
+		t.Errorf("Com os dois CFOPs permitidos não esperava resultados, obteve %+v", results)
+	}
+	if results := analisar(nil); len(results) != 0 {
+		t.Errorf("Sem lista de permitidos não esperava resultados, obteve %+v", results)
+	}
+}
+
+// TestExportCSV verifica as colunas, o separador e o status legível do CSV da análise.
+func TestExportCSV(t *testing.T) {
+	results := []domain.AnalysisResult{
+		{Type: domain.TypeICMS, NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS,
+			Data: domain.ICMSData{DocNumber: "46", IcmsXML: 18, IcmsSPED: 10.5, CfopsSPED: []string{"5102", "5405"}}},
+		{Type: domain.TypeIPIST, NFeKey: "3", StatusCode: domain.StatusDiscrepanciaIPIST, Data: domain.IPISTData{STValueXML: 3}},
+	}
+	data, err := ExportCSV(results)
+	if err != nil {
+		t.Fatalf("Erro ao exportar: %v", err)
+	}
+	want := "Num Nota;Chave;ICMS XML;ICMS SPED;CFOPs;Status\n" +
+		"46;1;18,00;10,50;5102, 5405;Discrepância de ICMS\n" +
+		";3;;;;Discrepância de IPI/ST\n"
+	if string(data) != want {
+		t.Errorf("CSV inesperado:\n%s\nesperado:\n%s", data, want)
+	}
+}
+
+// TestExportAjustes verifies that each ICMS discrepancy becomes a D/C pair carrying the
+// difference, with the accounts swapped when the SPED is higher, in the converter CSV layout.
+func TestExportAjustes(t *testing.T) {
+	results := []domain.AnalysisResult{
+		{Type: domain.TypeICMS, NFeKey: "1", StatusCode: domain.StatusDiscrepanciaICMS,
+			Data: domain.ICMSData{DocNumber: "46", IssueDate: "2024-01-15", IcmsXML: 18, IcmsSPED: 10.5, IcmsDifference: 7.5}},
+		{Type: domain.TypeICMS, NFeKey: "2", StatusCode: domain.StatusDiscrepanciaICMS,
+			Data: domain.ICMSData{DocNumber: "47", IssueDate: "2024-01-20", IcmsXML: 5, IcmsSPED: 6, IcmsDifference: 1}},
+		{Type: domain.TypeICMS, NFeKey: "3", StatusCode: domain.StatusOK,
+			Data: domain.ICMSData{DocNumber: "48", IcmsXML: 5, IcmsSPED: 5}},
+	}
+	data, err := ExportAjustes(results, AjusteContas{Debito: "1101", Credito: "2201"})
+	if err != nil {
+		t.Fatalf("Erro ao exportar: %v", err)
+	}
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		t.Fatalf("CSV não está em Windows-1252: %v", err)
+	}
+	want := "Operação;Data;Descrição Credito;Conta Credito;Valor;Historico\n" +
+		"D;15/01/2024;AJUSTE ICMS NF 46;1101;7,50;AJUSTE ICMS NF 46 CHAVE 1 XML 18,00 SPED 10,50\n" +
+		"C;15/01/2024;AJUSTE ICMS NF 46;2201;7,50;AJUSTE ICMS NF 46 CHAVE 1 XML 18,00 SPED 10,50\n" +
+		"D;20/01/2024;AJUSTE ICMS NF 47;2201;1,00;AJUSTE ICMS NF 47 CHAVE 2 XML 5,00 SPED 6,00\n" +
+		"C;20/01/2024;AJUSTE ICMS NF 47;1101;1,00;AJUSTE ICMS NF 47 CHAVE 2 XML 5,00 SPED 6,00\n"
+	if string(decoded) != want {
+		t.Errorf("CSV inesperado:\n%s\nesperado:\n%s", decoded, want)
+	}
+
+	rows := AjusteRows(results[:1], AjusteContas{})
+	if len(rows) != 2 || rows[0].ContaCredito != ContaAjustePadrao || rows[1].ContaCredito != ContaAjustePadrao {
+		t.Errorf("Esperava a conta padrão sem contas informadas, obteve %+v", rows)
+	}
+}
+
+// TestAnalyzeICMSPorCfop verifies that the SPED ICMS of a note is split by C190 CFOP, adding up
+// repeated CFOPs, next to the total.
+func TestAnalyzeICMSPorCfop(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	xml := nfeXMLTeste(chave, "46", "30.00")
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C190|020|5102|12,00|20,00|20,00|2,40|0|0|0|0||\n" +
+		"|C190|060|5405|0|50,00|0|0|0|0|0|0||\n"
+
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), []io.Reader{strings.NewReader(xml)}, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Fatalf("Esperava 1 discrepância, obteve %+v", results)
+	}
+	data := results[0].Data.(domain.ICMSData)
+	if data.IcmsSPED != 20.4 || len(data.IcmsByCfop) != 2 || data.IcmsByCfop["5102"] != 20.4 || data.IcmsByCfop["5405"] != 0 {
+		t.Errorf("ICMS por CFOP inesperado: total %.2f, %v", data.IcmsSPED, data.IcmsByCfop)
+	}
+}
+
+// TestAnalyzeICMSSourceFile verifies that each result names the file its note came from, also
+// when one file carries several concatenated NFe.
+func TestAnalyzeICMSSourceFile(t *testing.T) {
+	chave1 := "35200114200166000187550010000000046271239901"
+	chave2 := "35200114200166000187550010000000471000000470"
+	chave3 := "35200114200166000187550010000000481000000485"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave1 + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+	xmls := []io.Reader{
+		WithSourceName(strings.NewReader(nfeXMLTeste(chave1, "46", "18.00")), "nota46.xml"),
+		WithSourceName(strings.NewReader(nfeXMLTeste(chave2, "47", "1.00")+nfeXMLTeste(chave3, "48", "1.00")), "lote.xml"),
+	}
+
+	results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), xmls, ICMSOptions{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	origem := make(map[string]string)
+	for _, r := range results {
+		origem[r.NFeKey] = r.SourceFile
+	}
+	if len(origem) != 3 || origem[chave1] != "nota46.xml" || origem[chave2] != "lote.xml" || origem[chave3] != "lote.xml" {
+		t.Errorf("Arquivos de origem inesperados: %v", origem)
+	}
+}
+
+// TestAnalyzeICMSOperation verifies that only the notes whose C100 IND_OPER matches the
+// requested operation are analyzed.
+func TestAnalyzeICMSOperation(t *testing.T) {
+	entrada := "35200114200166000187550010000000046271239901"
+	saida := "35200114200166000187550010000000471000000470"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + entrada + "|01012024|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|10,00|0|0|0|0||\n" +
+		"|C100|1|0||55|00|1|47|" + saida + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+	analisar := func(operacao string) []string {
+		xmls := []io.Reader{strings.NewReader(nfeXMLTeste(entrada, "46", "18.00")), strings.NewReader(nfeXMLTeste(saida, "47", "18.00"))}
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), xmls, ICMSOptions{Operation: operacao})
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		var chaves []string
+		for _, r := range results {
+			chaves = append(chaves, r.NFeKey)
+		}
+		return chaves
+	}
+
+	if chaves := analisar(""); len(chaves) != 2 {
+		t.Errorf("Sem filtro esperava as 2 notas, obteve %v", chaves)
+	}
+	if chaves := analisar(OperacaoEntrada); len(chaves) != 1 || chaves[0] != entrada {
+		t.Errorf("Com entradas esperava só a nota %s, obteve %v", entrada, chaves)
+	}
+	if chaves := analisar(OperacaoSaida); len(chaves) != 1 || chaves[0] != saida {
+		t.Errorf("Com saídas esperava só a nota %s, obteve %v", saida, chaves)
+	}
+}
+
+// TestAnalyzeICMSSemXML garante que, com DetectMissingXML, as notas do SPED sem XML enviado são
+// listadas com o número e o ICMS do SPED, respeitando o filtro de operação.
+func TestAnalyzeICMSSemXML(t *testing.T) {
+	enviada := "35200114200166000187550010000000046271239901"
+	saida := "35200114200166000187550010000000471000000470"
+	entrada := "35200114200166000187550010000000481000000485"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|00000000000100||SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + enviada + "|01012024|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|C100|1|0||55|00|1|47|" + saida + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|48|" + entrada + "|01012024|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|12,50|0|0|0|0||\n"
+	analisar := func(opts ICMSOptions) []domain.AnalysisResult {
+		xmls := []io.Reader{strings.NewReader(nfeXMLTeste(enviada, "46", "18.00"))}
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), xmls, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	if results := analisar(ICMSOptions{}); len(results) != 0 {
+		t.Fatalf("Sem a opção esperava nenhum resultado, obteve %+v", results)
+	}
+
+	results := analisar(ICMSOptions{DetectMissingXML: true})
+	if len(results) != 2 {
+		t.Fatalf("Esperava 2 notas sem XML, obteve %+v", results)
+	}
+	esperadas := []struct {
+		chave, numero string
+		icms          float64
+	}{{saida, "47", 10}, {entrada, "48", 12.5}}
+	for i, e := range esperadas {
+		r := results[i]
+		data, ok := r.Data.(domain.ICMSData)
+		if r.NFeKey != e.chave || r.StatusCode != domain.StatusSemXML || !ok {
+			t.Fatalf("Resultado %d inesperado: %+v", i, r)
+		}
+		if data.DocNumber != e.numero || data.IcmsSPED != e.icms {
+			t.Errorf("Nota %s: esperava número %s e ICMS SPED %.2f, obteve %s e %.2f", e.chave, e.numero, e.icms, data.DocNumber, data.IcmsSPED)
+		}
+	}
+
+	results = analisar(ICMSOptions{DetectMissingXML: true, Operation: OperacaoEntrada})
+	if len(results) != 1 || results[0].NFeKey != entrada {
+		t.Errorf("Com entradas esperava só a nota %s, obteve %+v", entrada, results)
+	}
+}
+
+// TestAnalyzeICMSEstabelecimentos garante que a mesma chave escriturada por dois estabelecimentos
+// (0140) não colide e que o filtro por CNPJ escolhe a escrituração de cada um.
+func TestAnalyzeICMSEstabelecimentos(t *testing.T) {
+	chave := "35200114200166000187550010000000046271239901"
+	outra := "35200114200166000187550010000000471000000470"
+	const matriz, filialB, filialC = "00000000000100", "11111111000111", "22222222000122"
+	sped := "|0000|017|0|01012024|31012024|EMPRESA|" + matriz + "||SP|\n" +
+		"|0140|B|FILIAL B|11.111.111/0001-11|SP|\n" +
+		"|C100|0|1|P1|55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|1152|18,00|100,00|100,00|18,00|0|0|0|0||\n" +
+		"|0140|C|FILIAL C|" + filialC + "|SP|\n" +
+		"|C100|1|0||55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5152|18,00|100,00|100,00|10,00|0|0|0|0||\n" +
+		"|C100|0|1|P1|55|00|1|47|" + outra + "|01012024|\n" +
+		"|C190|000|1102|18,00|100,00|100,00|5,00|0|0|0|0||\n"
+
+	spedData, err := (&service{}).parseSpedFileForICMS(strings.NewReader(sped), nil)
+	if err != nil {
+		t.Fatalf("Erro inesperado ao processar SPED: %v", err)
+	}
+	if notas := spedData[chave]; len(notas) != 2 || notas[0].CNPJ != filialB || notas[1].CNPJ != filialC || notas[0].Icms != 18 || notas[1].Icms != 10 {
+		t.Fatalf("Escriturações da chave colidiram ou perderam o estabelecimento: %+v", notas)
+	}
+
+	analisar := func(opts ICMSOptions) []domain.AnalysisResult {
+		xmls := []io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "18.00"))}
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped), xmls, opts)
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+
+	// sem filtro confere com a primeira escrituração e avisa das demais
+	results := analisar(ICMSOptions{})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusOK {
+		t.Fatalf("Sem filtro esperava a nota conferida com alerta, obteve %+v", results)
+	}
+	if data := results[0].Data.(domain.ICMSData); data.EstablishmentCNPJ != filialB {
+		t.Errorf("Esperava a escrituração da filial B, obteve %q", data.EstablishmentCNPJ)
+	}
+	if len(results[0].Alerts) != 1 || !strings.Contains(results[0].Alerts[0], "2 estabelecimentos") {
+		t.Errorf("Esperava o alerta de escriturações múltiplas, obteve %v", results[0].Alerts)
+	}
+
+	results = analisar(ICMSOptions{Establishment: "22.222.222/0001-22"})
+	if len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMS || results[0].Data.(domain.ICMSData).EstablishmentCNPJ != filialC {
+		t.Errorf("Com a filial C esperava a discrepância da escrituração dela, obteve %+v", results)
+	}
+
+	if results := analisar(ICMSOptions{Establishment: matriz}); len(results) != 0 {
+		t.Errorf("A matriz não escriturou a nota e não esperava resultados, obteve %+v", results)
+	}
+
+	results = analisar(ICMSOptions{Establishment: filialC, DetectMissingXML: true})
+	if len(results) != 2 || results[1].NFeKey != outra || results[1].StatusCode != domain.StatusSemXML {
+		t.Errorf("Esperava a nota %s sem XML na filial C, obteve %+v", outra, results)
+	}
+}
+
+// TestParseCFOPPatterns cobre CFOPs exatos, curingas e faixas, os padrões inválidos e o uso em
+// CfopsToIgnore.
+func TestParseCFOPPatterns(t *testing.T) {
+	set, err := ParseCFOPPatterns([]string{"1.102", "5.*", "61*", "2100-2199", " "})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	cases := map[string]bool{
+		"1102": true, "1103": false,
+		"5000": true, "5102": true, "5999": true, "6102": true,
+		"6199": true, "6201": false,
+		"2100": true, "2150": true, "2199": true, "2200": false, "2099": false,
+		"510": false, "51020": false,
+	}
+	for cfop, want := range cases {
+		if got := set.Contains(cfop); got != want {
+			t.Errorf("Contains(%q) = %v, esperava %v", cfop, got, want)
+		}
+	}
+
+	for _, invalido := range []string{"5199-5100", "51-52", "5*1", "51029*", "A102", "5100-"} {
+		if _, err := ParseCFOPPatterns([]string{invalido}); err == nil {
+			t.Errorf("Esperava erro para o padrão %q", invalido)
+		}
+	}
+	// os válidos continuam no conjunto mesmo com um inválido na lista
+	if set, err := ParseCFOPPatterns([]string{"5102", "9-1"}); err == nil || !set.Contains("5102") {
+		t.Errorf("Esperava erro e o CFOP válido mantido, obteve %v %v", set, err)
+	}
+
+	chave := "35200114200166000187550010000000046271239901"
+	sped := "|C100|1|0||55|00|1|46|" + chave + "|01012024|\n" +
+		"|C190|000|5102|18,00|100,00|100,00|10,00|0|0|0|0||\n"
+	analisar := func(ignorados ...string) []domain.AnalysisResult {
+		results, err := NewService().AnalyzeICMSFiles(strings.NewReader(sped),
+			[]io.Reader{strings.NewReader(nfeXMLTeste(chave, "46", "18.00"))}, ICMSOptions{CfopsToIgnore: ignorados})
+		if err != nil {
+			t.Fatalf("Erro inesperado: %v", err)
+		}
+		return results
+	}
+	if results := analisar("6*"); len(results) != 1 || results[0].StatusCode != domain.StatusDiscrepanciaICMS {
+		t.Errorf("Fora do curinga esperava a discrepância, obteve %+v", results)
+	}
+	for _, padrao := range []string{"5*", "5100-5199"} {
+		if results := analisar(padrao); len(results) != 0 {
+			t.Errorf("Com %q a nota deveria ser ignorada, obteve %+v", padrao, results)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// package analysis/store.go
+package analysis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ICMSStore keeps parsed ICMS analyses in memory for a while, so they can be re-analyzed with a
+// new CFOP ignore list without uploading the files again. Entries expire after ttl, and the
+// oldest entry is dropped when the store is full.
+type ICMSStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]storedICMS
+	now        func() time.Time
+}
+
+type storedICMS struct {
+	parsed    *ParsedICMS
+	expiresAt time.Time
+}
+
+// NewICMSStore creates a store that keeps up to maxEntries analyses for ttl each.
+func NewICMSStore(ttl time.Duration, maxEntries int) *ICMSStore {
+	return &ICMSStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]storedICMS),
+		now:        time.Now,
+	}
+}
+
+// Put stores a parsed analysis and returns the token that identifies it.
+func (st *ICMSStore) Put(parsed *ParsedICMS) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.now()
+	st.evictExpired(now)
+	if len(st.entries) >= st.maxEntries {
+		st.evictOldest()
+	}
+	st.entries[token] = storedICMS{parsed: parsed, expiresAt: now.Add(st.ttl)}
+	return token, nil
+}
+
+// Get returns the parsed analysis for token, if it is still stored. Each hit renews the entry,
+// since the user is still iterating on it.
+func (st *ICMSStore) Get(token string) (*ParsedICMS, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.entries[token]
+	now := st.now()
+	if !ok || now.After(entry.expiresAt) {
+		delete(st.entries, token)
+		return nil, false
+	}
+	entry.expiresAt = now.Add(st.ttl)
+	st.entries[token] = entry
+	return entry.parsed, true
+}
+
+func (st *ICMSStore) evictExpired(now time.Time) {
+	for token, entry := range st.entries {
+		if now.After(entry.expiresAt) {
+			delete(st.entries, token)
+		}
+	}
+}
+
+func (st *ICMSStore) evictOldest() {
+	var oldest string
+	var oldestAt time.Time
+	for token, entry := range st.entries {
+		if oldest == "" || entry.expiresAt.Before(oldestAt) {
+			oldest, oldestAt = token, entry.expiresAt
+		}
+	}
+	delete(st.entries, oldest)
+}
@@ -0,0 +1,31 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+)
+
+// TestICMSStoreExpiraEDescartaMaisAntigo cobre a expiração por TTL e o limite de entradas.
+func TestICMSStoreExpiraEDescartaMaisAntigo(t *testing.T) {
+	agora := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	st := NewICMSStore(10*time.Minute, 2)
+	st.now = func() time.Time { return agora }
+
+	a, _ := st.Put(&ParsedICMS{})
+	agora = agora.Add(time.Minute)
+	b, _ := st.Put(&ParsedICMS{})
+	agora = agora.Add(time.Minute)
+	c, _ := st.Put(&ParsedICMS{})
+
+	if _, ok := st.Get(a); ok {
+		t.Error("A entrada mais antiga deveria ter sido descartada ao exceder o limite")
+	}
+	if _, ok := st.Get(b); !ok {
+		t.Error("Entrada b deveria continuar guardada")
+	}
+
+	agora = agora.Add(11 * time.Minute)
+	if _, ok := st.Get(c); ok {
+		t.Error("Entrada c deveria ter expirado")
+	}
+}
@@ -4,11 +4,12 @@ package auth
 import (
 	"context"
 	"errors"
-	"log"
 	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"github.com/LuisEduardoPedra/analiseSped/internal/logging"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/api/iterator"
@@ -21,6 +22,10 @@ type Service interface {
 type service struct {
 	db        *firestore.Client
 	jwtSecret []byte
+	// issuer e audience vão nos claims iss e aud do token quando configurados (JWT_ISSUER e
+	// JWT_AUDIENCE), para o AuthMiddleware de cada serviço validar a origem e o destino.
+	issuer   string
+	audience string
 }
 
 func NewService(db *firestore.Client, jwtSecret []byte) Service {
@@ -31,7 +36,12 @@ func NewService(db *firestore.Client, jwtSecret []byte) Service {
 		}
 	}
 
-	return &service{db: db, jwtSecret: jwtSecret}
+	return &service{
+		db:        db,
+		jwtSecret: jwtSecret,
+		issuer:    strings.TrimSpace(os.Getenv("JWT_ISSUER")),
+		audience:  strings.TrimSpace(os.Getenv("JWT_AUDIENCE")),
+	}
 }
 
 // User representa a estrutura de um usuário no Firestore.
@@ -51,7 +61,7 @@ func (s *service) Login(ctx context.Context, username, password string) (string,
 		return "", errors.New("usuário ou senha inválidos")
 	}
 	if err != nil {
-		log.Printf("Erro detalhado do Firestore: %v", err)
+		logging.Errorf("Erro detalhado do Firestore: %v", err)
 		return "", errors.New("erro ao consultar o banco de dados")
 	}
 
@@ -67,11 +77,23 @@ func (s *service) Login(ctx context.Context, username, password string) (string,
 	}
 
 	// 3. Gerar o Token JWT com as permissões (roles).
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return s.gerarToken(user)
+}
+
+// gerarToken assina o token do usuário, com iss e aud quando configurados.
+func (s *service) gerarToken(user User) (string, error) {
+	mapClaims := jwt.MapClaims{
 		"username": user.Username,
 		"roles":    user.Roles,                            // Adiciona as permissões ao token
 		"exp":      time.Now().Add(time.Hour * 24).Unix(), // Token expira em 24 horas
-	})
+	}
+	if s.issuer != "" {
+		mapClaims["iss"] = s.issuer
+	}
+	if s.audience != "" {
+		mapClaims["aud"] = s.audience
+	}
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, mapClaims)
 
 	tokenString, err := claims.SignedString(s.jwtSecret)
 
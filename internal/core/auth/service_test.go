@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestGerarTokenIssuerAudience verifica os claims iss e aud do token, presentes só quando configurados.
+func TestGerarTokenIssuerAudience(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "analise-sped")
+	t.Setenv("JWT_AUDIENCE", "conversor")
+	s := NewService(nil, []byte("segredo")).(*service)
+
+	tokenString, err := s.gerarToken(User{Username: "ana", Roles: []string{"admin"}})
+	if err != nil {
+		t.Fatalf("Erro ao gerar token: %v", err)
+	}
+	token, err := jwt.Parse(tokenString, func(*jwt.Token) (interface{}, error) { return []byte("segredo"), nil },
+		jwt.WithIssuer("analise-sped"), jwt.WithAudience("conversor"))
+	if err != nil || !token.Valid {
+		t.Fatalf("Token deveria ser válido para o iss/aud configurados: %v", err)
+	}
+
+	sem := &service{jwtSecret: []byte("segredo")}
+	tokenString, err = sem.gerarToken(User{Username: "ana"})
+	if err != nil {
+		t.Fatalf("Erro ao gerar token: %v", err)
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) { return []byte("segredo"), nil }); err != nil {
+		t.Fatalf("Erro ao ler token: %v", err)
+	}
+	if _, ok := claims["iss"]; ok {
+		t.Errorf("Sem JWT_ISSUER o token não deveria ter iss: %v", claims)
+	}
+	if _, ok := claims["aud"]; ok {
+		t.Errorf("Sem JWT_AUDIENCE o token não deveria ter aud: %v", claims)
+	}
+}
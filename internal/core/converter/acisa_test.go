@@ -0,0 +1,74 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCalcularPisAcisa cobre o PIS informado como percentual da mensalidade e como valor absoluto.
+func TestCalcularPisAcisa(t *testing.T) {
+	svc := &service{}
+	cases := []struct {
+		raw  string
+		modo string
+		want float64
+	}{
+		{"0,65%", "", 1.30},
+		{"0,65 %", PisModoAuto, 1.30},
+		{"1,30", "", 1.30},
+		{"0,65", PisModoPercentual, 1.30},
+		{"0,65%", PisModoValor, 0.65},
+		{"", "", 0},
+	}
+	for _, tc := range cases {
+		got, err := svc.calcularPisAcisa(tc.raw, 200.00, tc.modo, "")
+		if err != nil {
+			t.Errorf("calcularPisAcisa(%q, %q) retornou erro: %v", tc.raw, tc.modo, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("calcularPisAcisa(%q, %q) = %.2f; esperava %.2f", tc.raw, tc.modo, got, tc.want)
+		}
+	}
+
+	if _, err := svc.ProcessReceitasAcisaFiles(strings.NewReader(""), strings.NewReader(""), "x.xlsx", nil, Options{PisModo: "fracao"}); err == nil {
+		t.Error("Esperava erro para modo de PIS inválido")
+	}
+}
+
+// TestReceitasAcisaPisCombinado verifica a separação do PIS embutido na coluna de mensalidade
+// pela alíquota informada, e a rejeição do modo combinado sem alíquota.
+func TestReceitasAcisaPisCombinado(t *testing.T) {
+	if mensalidade, pis := separarPisCombinado(200.00, 0.65); mensalidade != 198.70 || pis != 1.30 {
+		t.Errorf("separarPisCombinado(200, 0,65) = %.2f + %.2f; esperava 198,70 + 1,30", mensalidade, pis)
+	}
+
+	rows := [][]string{
+		{"Empresa", "Ref. Mês", "Mensalidade (PIS incluído)"},
+		{"CLIENTE ALFA LTDA", "01/2026", "200,00"},
+		{"CLIENTE BETA SA", "01/2026", "99,99"},
+	}
+	contas := "100;1.1.2.01.001;CLIENTE ALFA LTDA\n101;1.1.2.01.002;CLIENTE BETA SA\n"
+
+	svc := NewService()
+	output, err := svc.ProcessReceitasAcisaFiles(buildXLSX(t, rows), strings.NewReader(contas), "receitas.xlsx", nil,
+		Options{PisModo: PisModoCombinado, AliquotaPis: 0.65})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	records := readCSVCP1252(t, output.Saida)
+	if len(records) != 3 {
+		t.Fatalf("Esperava cabeçalho + 2 linhas, obteve %v", records)
+	}
+	esperado := [][2]string{{"198,70", "1,30"}, {"99,34", "0,65"}}
+	for i, e := range esperado {
+		if got := [2]string{records[i+1][3], records[i+1][4]}; got != e {
+			t.Errorf("Linha %d: esperava mensalidade/PIS %v, obteve %v", i+1, e, got)
+		}
+	}
+
+	if _, err := svc.ProcessReceitasAcisaFiles(buildXLSX(t, rows), strings.NewReader(contas), "receitas.xlsx", nil,
+		Options{PisModo: PisModoCombinado}); err == nil {
+		t.Error("Esperava erro para o modo combinado sem alíquota")
+	}
+}
@@ -1,9 +1,19 @@
 package converter
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
 	"os"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+
+	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/xuri/excelize/v2"
 )
 
 // TestBuscarContaAtoliniComFiltros testa se os filtros de prefixo estão funcionando corretamente
@@ -109,3 +119,798 @@ func findEntryByCode(contasMap map[string][]accEntry, code string) (accEntry, bo
 	}
 	return accEntry{}, false
 }
+
+// contasAtoliniTeste é um plano de contas mínimo usado pelos testes que não dependem do error_case.
+const contasAtoliniTeste = `9473;2.1.1.01.001;FORNECEDOR ALFA LTDA
+9487;1.1.2.01.001;FORNECEDOR ALFA LTDA
+10;1.1.1.02.001;BANCO SICREDI
+`
+
+// buildXLSX monta em memória uma planilha .xlsx com as linhas informadas na primeira aba.
+func buildXLSX(t testing.TB, rows [][]string) *bytes.Buffer {
+	t.Helper()
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	for r, row := range rows {
+		for c, val := range row {
+			if val == "" {
+				continue
+			}
+			cell, err := excelize.CoordinatesToCellName(c+1, r+1)
+			if err != nil {
+				t.Fatalf("Erro ao montar célula: %v", err)
+			}
+			if err := f.SetCellStr(sheet, cell, val); err != nil {
+				t.Fatalf("Erro ao preencher célula %s: %v", cell, err)
+			}
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatalf("Erro ao gerar planilha: %v", err)
+	}
+	return buf
+}
+
+// pagamentoRow monta uma linha de lançamento no layout do relatório de pagamentos Atolini.
+func pagamentoRow(fornecedor, nf, valor, banco string) []string {
+	row := make([]string, 20)
+	row[0] = "1"
+	row[1] = fornecedor
+	row[3] = nf
+	row[7] = valor
+	row[8] = valor
+	row[19] = banco
+	return row
+}
+
+// readCSV interpreta a saída (UTF-8) de um conversor.
+func readCSV(t *testing.T, data []byte) [][]string {
+	t.Helper()
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = ';'
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("Erro ao ler CSV de saída: %v", err)
+	}
+	return records
+}
+
+// TestAtoliniPagamentosIncluirClassificacao verifica as colunas de classificação das contas resolvidas.
+func TestAtoliniPagamentosIncluirClassificacao(t *testing.T) {
+	svc := NewService()
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+
+	output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		[]string{"1.1.1"}, []string{"2.1.1"}, Options{IncluirClassificacao: true})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	records := readCSV(t, output.Saida)
+	if len(records) != 2 {
+		t.Fatalf("Esperava cabeçalho + 1 linha, obteve %d linhas", len(records))
+	}
+	header, line := records[0], records[1]
+	if len(header) != len(line) {
+		t.Fatalf("Cabeçalho (%d) e linha (%d) com número de colunas diferente", len(header), len(line))
+	}
+	if header[len(header)-2] != "Classif Debito" || header[len(header)-1] != "Classif Credito" {
+		t.Errorf("Colunas de classificação ausentes no cabeçalho: %v", header)
+	}
+	if line[1] != "9473" || line[len(line)-2] != "2.1.1.01.001" {
+		t.Errorf("Débito esperado 9473/2.1.1.01.001, obteve %s/%s", line[1], line[len(line)-2])
+	}
+	if line[3] != "10" || line[len(line)-1] != "1.1.1.02.001" {
+		t.Errorf("Crédito esperado 10/1.1.1.02.001, obteve %s/%s", line[3], line[len(line)-1])
+	}
+
+	// sem a opção, as colunas não aparecem
+	output, err = svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		[]string{"1.1.1"}, []string{"2.1.1"}, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if plain := readCSV(t, output.Saida); len(plain[0]) != len(header)-2 {
+		t.Errorf("Sem a opção esperava %d colunas, obteve %d", len(header)-2, len(plain[0]))
+	}
+}
+
+// TestFormatoSaidaXLSX confere a saída em planilha: cabeçalho em negrito, colunas de valor como
+// número e as de texto (contas, descrições) inalteradas.
+func TestFormatoSaidaXLSX(t *testing.T) {
+	svc := NewService()
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "1.150,50", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		[]string{"1.1.1"}, []string{"2.1.1"}, Options{FormatoSaida: FormatoSaidaXLSX})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(output.Saida))
+	if err != nil {
+		t.Fatalf("Saída não é XLSX: %v", err)
+	}
+	defer f.Close()
+
+	sheet := f.GetSheetName(0)
+	got, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("Esperava cabeçalho + 1 linha, obteve %v (%v)", got, err)
+	}
+	if got[0][5] != "Valor" || got[1][5] != "1150.5" {
+		t.Errorf("Valor deveria ser numérico: %s=%q", got[0][5], got[1][5])
+	}
+	if got[1][1] != "9473" || got[1][2] != "FORNECEDOR ALFA LTDA" {
+		t.Errorf("Débito esperado 9473/FORNECEDOR ALFA LTDA, obteve %v", got[1][:3])
+	}
+	styleID, err := f.GetCellStyle(sheet, "A1")
+	if err != nil {
+		t.Fatalf("Erro ao ler estilo do cabeçalho: %v", err)
+	}
+	if style, err := f.GetStyle(styleID); err != nil || style.Font == nil || !style.Font.Bold {
+		t.Errorf("Cabeçalho deveria estar em negrito: %+v (%v)", style, err)
+	}
+
+	if _, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		nil, nil, Options{FormatoSaida: "ods"}); err == nil || !strings.Contains(err.Error(), "formato de saída inválido") {
+		t.Errorf("Esperava erro de formato de saída inválido, obteve %v", err)
+	}
+}
+
+// BenchmarkAtoliniPagamentosLargoEsparso mede o loop de pagamentos numa planilha com milhares
+// de linhas curtas ou vazias intercaladas com poucos lançamentos largos.
+func BenchmarkAtoliniPagamentosLargoEsparso(b *testing.B) {
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+	}
+	for i := 0; i < 5000; i++ {
+		switch i % 50 {
+		case 0:
+			rows = append(rows, pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"))
+		case 1:
+			rows = append(rows, []string{"", "", ""})
+		default:
+			rows = append(rows, []string{"", "observação curta"})
+		}
+	}
+	rows = append(rows, []string{"Total do histórico"})
+	data := buildXLSX(b, rows).Bytes()
+
+	svc := NewService()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := svc.ProcessAtoliniPagamentos(bytes.NewReader(data), strings.NewReader(contasAtoliniTeste), nil, nil, Options{}); err != nil {
+			b.Fatalf("Erro ao processar: %v", err)
+		}
+	}
+}
+
+// TestAtoliniRecebimentosMultilinha garante uma linha por componente não zerado, com a conta
+// configurada para os juros e o documento compartilhado.
+func TestAtoliniRecebimentosMultilinha(t *testing.T) {
+	svc := &service{}
+	rows := []domain.AtoliniRecebimentosOutputRow{{
+		Data:           "05/01/2026",
+		ContaCredito:   "9487",
+		ContaDebito:    "10",
+		Historico:      "RECEBIMENTO CONFORME DOCUMENTO 1234",
+		ValorPrincipal: "100,00",
+		Juros:          "2,50",
+		Desconto:       "0,00",
+		DespBanco:      "0,00",
+		DespCartorio:   "0,00",
+		VlLiqPago:      "102,50",
+		Documento:      "1234",
+	}}
+
+	opts := Options{Modo: ModoMultilinha, ContaJuros: "3301"}
+	output, err := svc.gerarCSVAtoliniRecebimentosMultilinha(svc.expandirComponentesRecebimento(rows, opts), opts)
+	if err != nil {
+		t.Fatalf("Erro ao gerar CSV: %v", err)
+	}
+
+	records := readCSVCP1252(t, output)
+	if len(records) != 3 {
+		t.Fatalf("Esperava cabeçalho + principal + juros, obteve %v", records)
+	}
+	principal, juros := records[1], records[2]
+	if principal[2] != "PRINCIPAL" || principal[3] != "10" || principal[4] != "9487" || principal[5] != "100,00" {
+		t.Errorf("Linha de principal inesperada: %v", principal)
+	}
+	if juros[2] != "JUROS" || juros[3] != "10" || juros[4] != "3301" || juros[5] != "2,50" {
+		t.Errorf("Linha de juros inesperada: %v", juros)
+	}
+	if principal[1] != "1234" || juros[1] != "1234" {
+		t.Errorf("Documento deveria ser compartilhado: %v / %v", principal, juros)
+	}
+
+	if _, err := svc.ProcessAtoliniRecebimentos(strings.NewReader(""), strings.NewReader(""), nil, nil, Options{Modo: "largo"}); err == nil {
+		t.Error("Esperava erro para modo inválido")
+	}
+}
+
+// TestAtoliniRecebimentosColunasDeslocadas garante que as colunas de valor vêm do cabeçalho
+// (inclusive com acentos e abreviações) quando estão fora das posições fixas 12–17, sem que um
+// componente vazio seja preenchido com o valor da coluna vizinha.
+func TestAtoliniRecebimentosColunasDeslocadas(t *testing.T) {
+	cabecalho := make([]string, 20)
+	cabecalho[0], cabecalho[4], cabecalho[9] = "Lançamento", "Documento", "Histórico"
+	cabecalho[14], cabecalho[15], cabecalho[16] = "Vl. Principal", "Juros", "Desconto"
+	cabecalho[17], cabecalho[18], cabecalho[19] = "Desp. Bancária", "Desp. Cartório", "Vl. Líq. Pago"
+
+	linha := make([]string, 20)
+	linha[0], linha[4], linha[9] = "9487 - FORNECEDOR ALFA LTDA", "1234", "RECEBIMENTO"
+	linha[14], linha[15], linha[17], linha[19] = "100,00", "2,50", "1,00", "101,50"
+
+	rows := [][]string{
+		{"Data: 05/01/2026"},
+		{"Portador: 10 - BANCO SICREDI"},
+		cabecalho,
+		linha,
+	}
+
+	svc := NewService()
+	output, err := svc.ProcessAtoliniRecebimentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	records := readCSVCP1252(t, output.Saida)
+	if len(records) != 2 {
+		t.Fatalf("Esperava cabeçalho + 1 linha, obteve %v", records)
+	}
+	want := []string{"100,00", "2,50", "0,00", "1,00", "0,00", "101,50"}
+	if got := records[1][6:12]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Valores por componente: esperava %v, obteve %v", want, got)
+	}
+}
+
+// TestAtoliniPagamentosColunaDocumento garante que a coluna configurada vence o telefone que
+// a heurística pegaria antes da NF, tanto por índice quanto pelo nome do cabeçalho.
+func TestAtoliniPagamentosColunaDocumento(t *testing.T) {
+	linha := pagamentoRow("FORNECEDOR ALFA LTDA", "", "150,00", "BANCO SICREDI")
+	linha[2] = "(54) 3333-4444"
+	linha[5] = "98765"
+
+	cabecalho := make([]string, 20)
+	cabecalho[1], cabecalho[2], cabecalho[5] = "Fornecedor", "Telefone", "Nota Fiscal"
+
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		cabecalho,
+		{"Histórico: PAGAMENTOS"},
+		linha,
+		{"Total do histórico"},
+	}
+
+	svc := NewService()
+	for _, coluna := range []string{"5", "Nota Fiscal"} {
+		output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+			nil, nil, Options{ColunaDocumento: coluna})
+		if err != nil {
+			t.Fatalf("Erro ao processar (%s): %v", coluna, err)
+		}
+		records := readCSV(t, output.Saida)
+		if len(records) != 2 {
+			t.Fatalf("Esperava cabeçalho + 1 linha (%s), obteve %v", coluna, records)
+		}
+		if hist := records[1][6]; hist != "FORNECEDOR ALFA LTDA NF 98765" {
+			t.Errorf("Coluna %q: histórico esperado com NF 98765, obteve %q", coluna, hist)
+		}
+	}
+}
+
+// TestAtoliniPagamentosOrdenarPorData garante que blocos fora de ordem saem ordenados pela data,
+// mantendo a ordem da planilha dentro do mesmo dia, e que sem a opção a ordem de origem é mantida.
+func TestAtoliniPagamentosOrdenarPorData(t *testing.T) {
+	rows := [][]string{
+		{"Data de pagamento:", "10/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "3", "30,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1", "10,00", "BANCO SICREDI"),
+		pagamentoRow("FORNECEDOR ALFA LTDA", "2", "20,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+
+	svc := NewService()
+	casos := []struct {
+		opts     Options
+		esperado []string
+	}{
+		{Options{OrdenarPorData: true}, []string{"05/01/2026|10,00", "05/01/2026|20,00", "10/01/2026|30,00"}},
+		{Options{}, []string{"10/01/2026|30,00", "05/01/2026|10,00", "05/01/2026|20,00"}},
+	}
+	for _, tc := range casos {
+		output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, tc.opts)
+		if err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		records := readCSV(t, output.Saida)
+		var obtido []string
+		for _, r := range records[1:] {
+			obtido = append(obtido, r[0]+"|"+r[5])
+		}
+		if strings.Join(obtido, ",") != strings.Join(tc.esperado, ",") {
+			t.Errorf("OrdenarPorData=%v: esperava %v, obteve %v", tc.opts.OrdenarPorData, tc.esperado, obtido)
+		}
+	}
+}
+
+// TestPeekPlanilha confere as primeiras linhas e o nome da aba devolvidos para uma planilha.
+func TestPeekPlanilha(t *testing.T) {
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+
+	preview, err := NewService().PeekPlanilha(buildXLSX(t, rows), 2)
+	if err != nil {
+		t.Fatalf("Erro ao ler planilha: %v", err)
+	}
+	if preview.Planilha != "Sheet1" || preview.TotalLinhas != 4 {
+		t.Errorf("Esperava aba Sheet1 com 4 linhas, obteve %q com %d", preview.Planilha, preview.TotalLinhas)
+	}
+	if len(preview.Linhas) != 2 || preview.Linhas[0][1] != "05/01/2026" || preview.Linhas[1][0] != "Histórico: PAGAMENTOS" {
+		t.Errorf("Linhas inesperadas: %v", preview.Linhas)
+	}
+
+	if _, err := NewService().PeekPlanilha(strings.NewReader("não é planilha"), 20); err == nil {
+		t.Error("Esperava erro para arquivo que não é planilha")
+	}
+}
+
+// buildXLSXSemAbas monta um .xlsx válido cujo workbook.xml não lista nenhuma aba.
+func buildXLSXSemAbas(t testing.TB) []byte {
+	t.Helper()
+	f := excelize.NewFile()
+	defer f.Close()
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatalf("Erro ao gerar planilha: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Erro ao abrir planilha gerada: %v", err)
+	}
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatalf("Erro ao ler %s: %v", zf.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Erro ao ler %s: %v", zf.Name, err)
+		}
+		if zf.Name == "xl/workbook.xml" {
+			data = regexp.MustCompile(`<sheet [^>]*(/>|></sheet>)`).ReplaceAll(data, nil)
+		}
+		w, err := zw.Create(zf.Name)
+		if err != nil {
+			t.Fatalf("Erro ao gravar %s: %v", zf.Name, err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Erro ao fechar planilha: %v", err)
+	}
+	return out.Bytes()
+}
+
+// TestPlanilhaSemAbas garante que um .xlsx sem abas devolve ErrPlanilhaSemAbas em vez de panic.
+func TestPlanilhaSemAbas(t *testing.T) {
+	svc := &service{}
+	data := buildXLSXSemAbas(t)
+
+	if _, err := svc.loadGenericExcel(bytes.NewReader(data)); !errors.Is(err, ErrPlanilhaSemAbas) {
+		t.Errorf("loadGenericExcel: esperava ErrPlanilhaSemAbas, obteve %v", err)
+	}
+	if _, err := svc.convertXLSXtoCSV(bytes.NewReader(data)); !errors.Is(err, ErrPlanilhaSemAbas) {
+		t.Errorf("convertXLSXtoCSV: esperava ErrPlanilhaSemAbas, obteve %v", err)
+	}
+	if _, err := svc.loadAndPrepareExcelReceitas(bytes.NewReader(data)); !errors.Is(err, ErrPlanilhaSemAbas) {
+		t.Errorf("loadAndPrepareExcelReceitas: esperava ErrPlanilhaSemAbas, obteve %v", err)
+	}
+}
+
+// TestAtoliniPagamentosRelaxarFiltro garante que, com RelaxarFiltro, o fornecedor fora dos
+// prefixos de classificação é encontrado sem filtro e registrado como fuzzy_relaxed no relatório.
+func TestAtoliniPagamentosRelaxarFiltro(t *testing.T) {
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	svc := NewService()
+	process := func(opts Options) []byte {
+		output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+			[]string{"1.1.1"}, []string{"9.9"}, opts)
+		// sem RelaxarFiltro a única linha cai na conta coringa, o que gera só o aviso de fallback
+		if _, err := separarErrosLinhas(err); err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		return output.Saida
+	}
+
+	if line := readCSV(t, process(Options{}))[1]; line[1] != "999999" {
+		t.Errorf("Sem RelaxarFiltro esperava débito 999999, obteve %s", line[1])
+	}
+	line := readCSV(t, process(Options{RelaxarFiltro: true}))[1]
+	if line[1] != "9473" && line[1] != "9487" {
+		t.Errorf("Com RelaxarFiltro esperava débito do fornecedor, obteve %s", line[1])
+	}
+
+	f, err := excelize.OpenReader(bytes.NewReader(process(Options{RelaxarFiltro: true, RelatorioMatches: true})))
+	if err != nil {
+		t.Fatalf("Erro ao abrir relatório: %v", err)
+	}
+	defer f.Close()
+	fuzzy, err := f.GetRows("fuzzy")
+	if err != nil {
+		t.Fatalf("Erro ao ler aba fuzzy: %v", err)
+	}
+	var achou bool
+	for _, r := range fuzzy[1:] {
+		if len(r) >= 4 && r[0] == "FORNECEDOR ALFA LTDA" && r[3] == MatchFuzzyRelaxed {
+			achou = true
+		}
+	}
+	if !achou {
+		t.Errorf("Esperava FORNECEDOR ALFA LTDA como %s na aba fuzzy, obteve %v", MatchFuzzyRelaxed, fuzzy)
+	}
+}
+
+// TestAtoliniPagamentosBalancete confere os totais por conta do balancete gerado a partir dos
+// pagamentos convertidos.
+func TestAtoliniPagamentosBalancete(t *testing.T) {
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1235", "50,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	output, err := NewService().ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		[]string{"1.1.1"}, []string{"2.1.1"}, Options{Balancete: true})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	records := readCSVCP1252(t, output.Saida)
+	esperado := [][]string{
+		{"Conta", "Débito", "Crédito", "Saldo"},
+		{"10", "0,00", "200,00", "-200,00"},
+		{"9473", "200,00", "0,00", "200,00"},
+		{"TOTAL", "200,00", "200,00", "0,00"},
+	}
+	if len(records) != len(esperado) {
+		t.Fatalf("Esperava %d linhas no balancete, obteve %v", len(esperado), records)
+	}
+	for i := range esperado {
+		if strings.Join(records[i], ";") != strings.Join(esperado[i], ";") {
+			t.Errorf("Linha %d: esperava %v, obteve %v", i, esperado[i], records[i])
+		}
+	}
+}
+
+// TestAtoliniPagamentosBOMUTF8 garante que o BOM UTF-8 só antecede o cabeçalho quando pedido.
+func TestAtoliniPagamentosBOMUTF8(t *testing.T) {
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	svc := NewService()
+	for _, comBOM := range []bool{true, false} {
+		output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, Options{BOMUTF8: comBOM})
+		if err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		if got := bytes.HasPrefix(output.Saida, append(append([]byte{}, utf8BOM...), "Data;"...)); got != comBOM {
+			t.Errorf("BOMUTF8=%v: saída começa com %q", comBOM, output.Saida[:min(len(output.Saida), 8)])
+		}
+		if !comBOM && !bytes.HasPrefix(output.Saida, []byte("Data;")) {
+			t.Errorf("Sem BOM a saída deveria começar pelo cabeçalho, obteve %q", output.Saida[:min(len(output.Saida), 8)])
+		}
+	}
+}
+
+// TestAtoliniPagamentosFormatoColunas usa uma planilha com o valor original em formato US e o
+// valor pago em formato BR: sem indicação os dois são lidos errado; com o formato de cada coluna
+// ambos viram 1.234,00.
+func TestAtoliniPagamentosFormatoColunas(t *testing.T) {
+	row := pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "", "BANCO SICREDI")
+	row[7] = "1,234"
+	row[8] = "1.234"
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		row,
+		{"Total do histórico"},
+	}
+	svc := NewService()
+	converter := func(formatos map[string]string) ([]string, error) {
+		output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil,
+			Options{FormatoColunas: formatos})
+		if err != nil {
+			return nil, err
+		}
+		return readCSV(t, output.Saida)[1], nil
+	}
+
+	line, err := converter(nil)
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if line[7] != "1,23" || line[8] != "1,23" {
+		t.Errorf("Sem formato esperava a leitura ambígua 1,23/1,23, obteve %s/%s", line[7], line[8])
+	}
+
+	line, err = converter(map[string]string{"valor": FormatoNumeroBR, "valor_pago": FormatoNumeroBR, "valor_original": FormatoNumeroUS})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if line[5] != "1234,00" || line[7] != "1234,00" || line[8] != "1234,00" {
+		t.Errorf("Com formato por coluna esperava 1234,00 em Valor/Original/Pago, obteve %s/%s/%s", line[5], line[7], line[8])
+	}
+
+	if _, err := converter(map[string]string{"mensalidade": FormatoNumeroBR}); err == nil {
+		t.Error("Esperava erro para coluna que não existe no conversor de pagamentos")
+	}
+	if _, err := converter(map[string]string{"valor_pago": "eu"}); err == nil {
+		t.Error("Esperava erro para formato numérico desconhecido")
+	}
+}
+
+// TestAtoliniPagamentosContasComLinhasRuins garante que linhas ruins do plano de contas são
+// descartadas e relatadas, sem impedir a conversão com as contas válidas.
+func TestAtoliniPagamentosContasComLinhasRuins(t *testing.T) {
+	contas := "Código;Classificação;Descrição\n" +
+		contasAtoliniTeste +
+		"9500;2.1.1.01.002\n" +
+		"ABC;2.1.1.01.003;FORNECEDOR BETA LTDA\n"
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+
+	output, err := NewService().ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contas), []string{"1.1.1"}, []string{"2.1"}, Options{})
+	var linhas *ErrosLinhas
+	if !errors.As(err, &linhas) {
+		t.Fatalf("Esperava *ErrosLinhas com as linhas descartadas, obteve %v", err)
+	}
+	if len(linhas.Linhas) != 2 || linhas.Linhas[0].Linha != 5 || linhas.Linhas[1].Linha != 6 {
+		t.Errorf("Esperava as linhas 5 e 6 relatadas, obteve %+v", linhas.Linhas)
+	}
+	if !strings.Contains(linhas.Linhas[1].Motivo, "não numérico") {
+		t.Errorf("Motivo inesperado para o código inválido: %q", linhas.Linhas[1].Motivo)
+	}
+
+	records := readCSV(t, output.Saida)
+	if len(records) != 2 {
+		t.Fatalf("Esperava cabeçalho e 1 lançamento, obteve %d linhas", len(records))
+	}
+	if records[1][1] != "9473" || records[1][3] != "10" {
+		t.Errorf("Contas inesperadas com o plano parcialmente válido: débito %s, crédito %s", records[1][1], records[1][3])
+	}
+}
+
+// TestCodigoNaDescricao garante que o código de conta no início da descrição vale mais que a
+// busca pelo texto, desde que a conta passe pelo filtro de classificação.
+func TestCodigoNaDescricao(t *testing.T) {
+	svc := &service{}
+	contas := contasAtoliniTeste + "9500;2.1.1.01.002;FORNECEDOR BETA COMERCIO\n"
+	contasMap, descricaoIndex, err := svc.lerPlanoContasAtolini(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	ordemReceb, contasReceb, err := svc.lerContasRecebimentos(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+
+	cases := []struct {
+		descricao string
+		prefixes  []string
+		code      string
+		mtype     string
+	}{
+		{"9500 - FORNECEDOR ALFA LTDA", nil, "9500", "codigo_all"},
+		{"9500 - FORNECEDOR ALFA LTDA", []string{"2.1"}, "9500", "codigo_filtered"},
+		// a conta 9500 não passa no filtro: segue a busca pelo texto
+		{"9500 - FORNECEDOR ALFA LTDA", []string{"1.1"}, "9487", "exata_filtered"},
+		// número que não é código de conta também segue a busca pelo texto
+		{"1234 - FORNECEDOR ALFA LTDA", []string{"1.1"}, "9487", "exata_filtered"},
+	}
+	for _, tc := range cases {
+		code, _, _, mtype := svc.resolverContaAtolini(tc.descricao, contasMap, descricaoIndex, tc.prefixes, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+		if code != tc.code || mtype != tc.mtype {
+			t.Errorf("Pagamentos %q %v: esperava %s/%s, obteve %s/%s", tc.descricao, tc.prefixes, tc.code, tc.mtype, code, mtype)
+		}
+		code, _, _, mtype = svc.resolverContaRecebimentos(tc.descricao, ordemReceb, contasReceb, tc.prefixes, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+		if code != tc.code || mtype != tc.mtype {
+			t.Errorf("Recebimentos %q %v: esperava %s/%s, obteve %s/%s", tc.descricao, tc.prefixes, tc.code, tc.mtype, code, mtype)
+		}
+	}
+}
+
+// TestPlanoContasColunasTrocadas garante que o plano exportado como classificação;código;descrição
+// é lido como o layout normal, com os mesmos matches.
+func TestPlanoContasColunasTrocadas(t *testing.T) {
+	svc := &service{}
+	contas := "Classificacao;Codigo;Descricao\n" +
+		"2.1.1.01.001;9473;FORNECEDOR ALFA LTDA\n" +
+		"1.1.2.01.001;9487;FORNECEDOR ALFA LTDA\n" +
+		"1.1.1.02.001;10.0;BANCO SICREDI\n"
+	contasMap, descricaoIndex, err := svc.lerPlanoContasAtolini(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas invertidas: %v", err)
+	}
+	if len(descricaoIndex) != 2 {
+		t.Fatalf("Esperava 2 descrições, obteve %v", descricaoIndex)
+	}
+
+	cases := []struct {
+		descricao string
+		prefixes  []string
+		code      string
+		classif   string
+	}{
+		{"FORNECEDOR ALFA LTDA", []string{"2.1"}, "9473", "2.1.1.01.001"},
+		{"FORNECEDOR ALFA LTDA", []string{"1.1"}, "9487", "1.1.2.01.001"},
+		{"BANCO SICREDI", nil, "10", "1.1.1.02.001"},
+	}
+	for _, tc := range cases {
+		code, _, classif, _ := svc.resolverContaAtolini(tc.descricao, contasMap, descricaoIndex, tc.prefixes, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+		if code != tc.code || classif != tc.classif {
+			t.Errorf("%q %v: esperava %s/%s, obteve %s/%s", tc.descricao, tc.prefixes, tc.code, tc.classif, code, classif)
+		}
+	}
+
+	// o layout normal continua intacto
+	normalMap, _, err := svc.lerPlanoContasAtolini(strings.NewReader(contasAtoliniTeste))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	if got := normalMap[svc.normalizeText("BANCO SICREDI")]; len(got) != 1 || got[0].ID != "10" {
+		t.Errorf("Layout normal alterado: %+v", got)
+	}
+}
+
+// TestExplicarMatchFuzzy confere o passo a passo de uma descrição que só casa por aproximação,
+// com o filtro de prefixos deixando de fora a conta de mesma descrição em outro grupo.
+func TestExplicarMatchFuzzy(t *testing.T) {
+	svc := &service{}
+	contas := "201;1.1.2.01.006;CLIENTE 1234 A\n" +
+		"202;2.1.1.01.001;CLIENTE 1234 B\n" +
+		"301;1.1.2.01.007;FORNECEDOR 99\n"
+	got, err := svc.ExplicarMatch("Cliente 1234", strings.NewReader(contas), []string{"1.1"}, Options{})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	want := domain.ExplicacaoMatch{
+		Descricao:        "Cliente 1234",
+		TextoNormalizado: "CLIENTE 1234",
+		Prefixos:         []string{"1.1"},
+		ExataNoPlano:     false,
+		ChavesFiltradas:  2,
+		CandidatosFuzzy:  []string{"CLIENTE 1234 A"},
+		Similaridade:     similaridade("CLIENTE 1234", "CLIENTE 1234 A"),
+		ChaveEscolhida:   "CLIENTE 1234 A",
+		Classificacao:    "1.1.2.01.006",
+		TipoMatch:        "fuzzy_filtered",
+		Codigo:           "201",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Explicação inesperada:\n obtida:   %+v\n esperada: %+v", got, want)
+	}
+
+	// o rastreio não muda a decisão do matcher usado na conversão
+	contasMap, descricaoIndex, _ := svc.lerPlanoContasAtolini(strings.NewReader(contas))
+	if code, _, _, mtype := svc.resolverContaAtolini("Cliente 1234", contasMap, descricaoIndex, []string{"1.1"}, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao); code != got.Codigo || mtype != got.TipoMatch {
+		t.Errorf("Matcher da conversão divergiu da explicação: %s/%s", code, mtype)
+	}
+
+	// sem fuzzy, a explicação para na busca exata
+	got, err = svc.ExplicarMatch("Cliente 1234", strings.NewReader(contas), []string{"1.1"}, Options{SemFuzzy: true})
+	if err != nil {
+		t.Fatalf("Erro inesperado: %v", err)
+	}
+	if got.Codigo != "999999" || got.TipoMatch != "nao_encontrada" || got.ChavesFiltradas != 0 || got.CandidatosFuzzy != nil {
+		t.Errorf("Sem fuzzy esperava a conta coringa sem candidatos, obteve %+v", got)
+	}
+}
+
+// TestAtoliniPagamentosPrefixosTrocados garante o aviso quando debitPrefixes e creditPrefixes
+// são informados invertidos e a ausência dele com os prefixos corretos.
+func TestAtoliniPagamentosPrefixosTrocados(t *testing.T) {
+	// homônimos no grupo errado: com os filtros invertidos, o fornecedor cai numa conta de
+	// banco e o banco no empréstimo do Passivo
+	contas := contasAtoliniTeste + "11;1.1.1.09.001;FORNECEDOR ALFA LTDA\n" + "9480;2.1.1.09.001;BANCO SICREDI\n"
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1235", "50,00", "BANCO SICREDI"),
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1236", "20,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	svc := NewService()
+
+	output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contas),
+		[]string{"2.1.1"}, []string{"1.1.1"}, Options{IncluirClassificacao: true})
+	var avisos *ErrosLinhas
+	if !errors.As(err, &avisos) || len(avisos.Avisos) != 1 || !strings.Contains(avisos.Avisos[0], "inversão de prefixos") {
+		t.Fatalf("Esperava o aviso de prefixos trocados, obteve %v\n%s", err, output.Saida)
+	}
+	if len(avisos.Linhas) != 0 {
+		t.Errorf("Não esperava linhas descartadas, obteve %+v", avisos.Linhas)
+	}
+	if records := readCSV(t, output.Saida); len(records) != 4 {
+		t.Errorf("A conversão deveria continuar com o aviso, obteve %d linhas", len(records))
+	}
+
+	if _, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contas),
+		[]string{"1.1.1"}, []string{"2.1.1"}, Options{}); err != nil {
+		t.Errorf("Com os prefixos corretos não esperava aviso, obteve %v", err)
+	}
+}
+
+// TestAtoliniLimiteLinhasSaida simula a planilha malformada que repete o mesmo pagamento milhares
+// de vezes: acima do limite a conversão é abortada com ErrLimiteLinhasSaida, sem saída parcial.
+func TestAtoliniLimiteLinhasSaida(t *testing.T) {
+	SetMaxLinhasSaida(50)
+	defer SetMaxLinhasSaida(0)
+
+	rows := [][]string{{"Data de pagamento:", "05/01/2026"}, {"Histórico: PAGAMENTOS"}}
+	for i := 0; i < 200; i++ {
+		rows = append(rows, pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"))
+	}
+	svc := NewService()
+	output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, Options{})
+	if !errors.Is(err, ErrLimiteLinhasSaida) {
+		t.Fatalf("Esperava ErrLimiteLinhasSaida, obteve %v", err)
+	}
+	if output.Saida != nil || !strings.Contains(err.Error(), "malformada") {
+		t.Errorf("Esperava erro sem saída sugerindo planilha malformada, obteve %q (%d bytes)", err, len(output.Saida))
+	}
+
+	// dentro do limite a mesma planilha converte normalmente
+	SetMaxLinhasSaida(500)
+	if _, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, Options{}); err != nil {
+		if _, err := separarErrosLinhas(err); err != nil {
+			t.Fatalf("Dentro do limite não esperava erro, obteve %v", err)
+		}
+	}
+
+	// o limite em si é permitido
+	if err := checarLimiteLinhas(500); err != nil {
+		t.Errorf("Exatamente no limite não esperava erro, obteve %v", err)
+	}
+	if err := checarLimiteLinhas(501); !errors.Is(err, ErrLimiteLinhasSaida) {
+		t.Errorf("Acima do limite esperava ErrLimiteLinhasSaida, obteve %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+)
+
+// extratoConciliacaoTeste traz dois boletos com título correspondente e um avulso.
+const extratoConciliacaoTeste = `Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor
+SIMPLES;000101;B1;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;100,00
+SIMPLES;102;B2;;CLIENTE BETA SA;01/01/2026;05/01/2026;;30,00
+SIMPLES;777;B3;;CLIENTE GAMA ME;01/01/2026;06/01/2026;;12,34
+`
+
+// titulosConciliacaoTeste é a lista de títulos em aberto correspondente ao extrato acima.
+const titulosConciliacaoTeste = `Documento;Pagador;Vencimento;Valor
+101;CLIENTE ALFA LTDA;01/01/2026;100,00
+102;CLIENTE BETA SA;01/01/2026;50,00
+103;CLIENTE DELTA LTDA;10/01/2026;80,00
+`
+
+// TestConciliacaoTitulos cobre um título conciliado, um parcial, um não recebido e um recebimento sem título.
+func TestConciliacaoTitulos(t *testing.T) {
+	svc := NewService()
+	output, err := svc.ProcessConciliacaoTitulos(strings.NewReader(extratoConciliacaoTeste), strings.NewReader(titulosConciliacaoTeste))
+	if err != nil {
+		t.Fatalf("Erro ao conciliar: %v", err)
+	}
+
+	records := readCSVCP1252(t, output.Saida)
+	if len(records) != 5 {
+		t.Fatalf("Esperava cabeçalho + 4 linhas, obteve %d: %v", len(records), records)
+	}
+
+	expected := []struct {
+		situacao, documento, recebido, diferenca string
+	}{
+		{SituacaoConciliado, "101", "100,00", "0,00"},
+		{SituacaoParcial, "102", "30,00", "20,00"},
+		{SituacaoNaoRecebido, "103", "0,00", "80,00"},
+		{SituacaoRecebidoSemTitulo, "777", "12,34", "-12,34"},
+	}
+	for i, exp := range expected {
+		rec := records[i+1]
+		if rec[0] != exp.situacao || rec[1] != exp.documento || rec[6] != exp.recebido || rec[7] != exp.diferenca {
+			t.Errorf("Linha %d: esperava %+v, obteve %v", i+1, exp, rec)
+		}
+	}
+}
@@ -29,14 +29,14 @@ func TestAtoliniPagamentosIntegration(t *testing.T) {
 		lancamentosFile.Seek(0, 0)
 		contasFile.Seek(0, 0)
 
-		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile, contasFile, nil, nil)
+		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile, contasFile, nil, nil, Options{})
 		if err != nil {
 			t.Fatalf("Erro ao processar: %v", err)
 		}
 
-		t.Logf("Output sem filtros: %d bytes", len(output))
+		t.Logf("Output sem filtros: %d bytes", len(output.Saida))
 		// Salvar output para análise
-		os.WriteFile("../../../error_case/output_sem_filtros.csv", output, 0644)
+		os.WriteFile("../../../error_case/output_sem_filtros.csv", output.Saida, 0644)
 	})
 
 	// Teste 2: Com filtros corretos para pagamentos
@@ -53,15 +53,15 @@ func TestAtoliniPagamentosIntegration(t *testing.T) {
 		debitPrefixes := []string{"1.1.1"}   // Ativo - para bancos
 		creditPrefixes := []string{"2.1.1"}  // Passivo - para fornecedores
 
-		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile2, contasFile2, debitPrefixes, creditPrefixes)
+		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile2, contasFile2, debitPrefixes, creditPrefixes, Options{})
 		if err != nil {
 			t.Fatalf("Erro ao processar: %v", err)
 		}
 
-		t.Logf("Output com filtros: %d bytes", len(output))
+		t.Logf("Output com filtros: %d bytes", len(output.Saida))
 
 		// Verificar se há contas de fornecedor (2.1.1.01.001) nas colunas de débito
-		outputStr := string(output)
+		outputStr := string(output.Saida)
 
 		// Contar quantas vezes aparece código de cliente (Ativo) vs fornecedor (Passivo)
 		// Não podemos verificar códigos específicos sem conhecer os dados do Excel,
@@ -74,7 +74,7 @@ func TestAtoliniPagamentosIntegration(t *testing.T) {
 		}
 
 		// Salvar output para análise manual
-		err = os.WriteFile("../../../error_case/output_com_filtros.csv", output, 0644)
+		err = os.WriteFile("../../../error_case/output_com_filtros.csv", output.Saida, 0644)
 		if err != nil {
 			t.Logf("Aviso: não foi possível salvar output: %v", err)
 		} else {
@@ -93,15 +93,15 @@ func TestAtoliniPagamentosIntegration(t *testing.T) {
 		debitPrefixes := []string{"1.1.1", "2.1.1"}  // Ativo + Passivo - para bancos em ambos
 		creditPrefixes := []string{"2.1.1"}          // Passivo - para fornecedores
 
-		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile3, contasFile3, debitPrefixes, creditPrefixes)
+		output, err := svc.ProcessAtoliniPagamentos(lancamentosFile3, contasFile3, debitPrefixes, creditPrefixes, Options{})
 		if err != nil {
 			t.Fatalf("Erro ao processar: %v", err)
 		}
 
-		t.Logf("Output com filtros múltiplos: %d bytes", len(output))
+		t.Logf("Output com filtros múltiplos: %d bytes", len(output.Saida))
 
 		// Salvar output para análise
-		err = os.WriteFile("../../../error_case/output_filtros_multiplos.csv", output, 0644)
+		err = os.WriteFile("../../../error_case/output_filtros_multiplos.csv", output.Saida, 0644)
 		if err != nil {
 			t.Logf("Aviso: não foi possível salvar output: %v", err)
 		} else {
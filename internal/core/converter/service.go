@@ -1,20 +1,29 @@
 package converter
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/LuisEduardoPedra/analiseSped/internal/domain"
+	"github.com/LuisEduardoPedra/analiseSped/internal/workers"
 	"github.com/schollz/closestmatch"
 	"github.com/shakinm/xlsReader/xls"
 	"github.com/xuri/excelize/v2"
@@ -25,17 +34,332 @@ import (
 
 // Service define a interface para os serviços de conversão de arquivos.
 type Service interface {
-	ProcessSicrediFiles(lancamentosFile io.Reader, contasFile io.Reader, lancamentosFilename string, classPrefixes []string) ([]byte, error)
-	ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io.Reader, excelFilename string, classPrefixes []string) ([]byte, error)
-	ProcessAtoliniPagamentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string) ([]byte, error)
-	ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string) ([]byte, error)
+	ProcessSicrediFiles(lancamentosFile io.Reader, contasFile io.Reader, lancamentosFilename string, classPrefixes []string, opts Options) (Resultado, error)
+	ProcessCNAB240(cnabFile io.Reader, contasFile io.Reader, classPrefixes []string, opts Options) (Resultado, error)
+	ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io.Reader, excelFilename string, classPrefixes []string, opts Options) (Resultado, error)
+	ProcessAtoliniPagamentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string, opts Options) (Resultado, error)
+	ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string, opts Options) (Resultado, error)
+	ProcessConciliacaoTitulos(extrato io.Reader, titulos io.Reader) (Resultado, error)
+	Warmup(contasFile io.Reader) error
+	PeekPlanilha(excelFile io.Reader, n int) (domain.PreviewPlanilha, error)
+	ExplicarMatch(descricao string, contasFile io.Reader, classPrefixes []string, opts Options) (domain.ExplicacaoMatch, error)
 }
 
-type service struct{}
+// ErroLinha descreve uma linha do arquivo de contas descartada durante a conversão.
+type ErroLinha struct {
+	Linha  int    `json:"linha"`
+	Motivo string `json:"motivo"`
+}
+
+// ErrosLinhas reúne os problemas não fatais de uma conversão: as linhas ruins são descartadas e
+// a conversão continua. Os métodos Process* o devolvem como erro junto com a saída, que continua
+// válida; só erros de outro tipo (arquivo ilegível, formato errado) indicam falha.
+type ErrosLinhas struct {
+	Linhas []ErroLinha
+	// Avisos são suspeitas sobre o resultado como um todo (ex.: prefixos de débito e crédito
+	// trocados), que não impedem a conversão.
+	Avisos []string
+}
+
+func (e *ErrosLinhas) Error() string {
+	var msgs []string
+	if len(e.Linhas) > 0 {
+		partes := make([]string, len(e.Linhas))
+		for i, l := range e.Linhas {
+			partes[i] = fmt.Sprintf("linha %d: %s", l.Linha, l.Motivo)
+		}
+		msgs = append(msgs, fmt.Sprintf("%d linha(s) do arquivo de contas ignorada(s): %s", len(e.Linhas), strings.Join(partes, "; ")))
+	}
+	return strings.Join(append(msgs, e.Avisos...), "; ")
+}
+
+func (e *ErrosLinhas) add(linha int, format string, args ...interface{}) {
+	e.Linhas = append(e.Linhas, ErroLinha{Linha: linha, Motivo: fmt.Sprintf(format, args...)})
+}
+
+// err devolve e como error, ou nil quando não há linhas descartadas nem avisos.
+func (e *ErrosLinhas) err() error {
+	if e == nil || len(e.Linhas)+len(e.Avisos) == 0 {
+		return nil
+	}
+	return e
+}
+
+// avisar acrescenta um aviso a e, criando-o quando a conversão ainda não tem erros de linha.
+func (e *ErrosLinhas) avisar(aviso string) *ErrosLinhas {
+	if aviso == "" {
+		return e
+	}
+	if e == nil {
+		e = &ErrosLinhas{}
+	}
+	e.Avisos = append(e.Avisos, aviso)
+	return e
+}
+
+// anexar devolve a saída de uma conversão acompanhada dos erros de linha acumulados, salvo se a
+// própria conversão falhou.
+func (e *ErrosLinhas) anexar(output []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return output, e.err()
+}
+
+// separarErrosLinhas separa os erros de linha de um erro fatal: devolve (linhas, nil) quando err
+// é *ErrosLinhas e (nil, err) caso contrário.
+func separarErrosLinhas(err error) (*ErrosLinhas, error) {
+	var linhas *ErrosLinhas
+	if errors.As(err, &linhas) {
+		return linhas, nil
+	}
+	return nil, err
+}
+
+// Resultado é o arquivo gerado por uma conversão e a contagem dos lançamentos que o originaram.
+type Resultado struct {
+	Saida []byte
+	// Linhas é o total de lançamentos gerados e Fallbacks quantos deles ficaram na conta
+	// coringa por falta de correspondência no plano de contas. A contagem é feita sobre os
+	// lançamentos, não sobre o arquivo, e vale para qualquer saída (CSV, XLSX, balancete,
+	// relatório de matches ou ZIP).
+	Linhas    int
+	Fallbacks int
+}
+
+// contagemLancamentos recebe de cada conversor, onde as linhas são montadas, o total de
+// lançamentos e quantos caíram na conta coringa. Um coletor nil ignora as chamadas.
+type contagemLancamentos struct {
+	linhas, fallbacks int
+}
+
+func (c *contagemLancamentos) registrar(linhas, fallbacks int) {
+	if c == nil {
+		return
+	}
+	c.linhas, c.fallbacks = linhas, fallbacks
+}
+
+// comContagem roda conversao com o coletor de contagem ligado e devolve a saída junto com os
+// totais registrados pelo conversor.
+func comContagem(opts Options, conversao func(opts Options) ([]byte, error)) (Resultado, error) {
+	opts.contagem = &contagemLancamentos{}
+	saida, err := conversao(opts)
+	return Resultado{Saida: saida, Linhas: opts.contagem.linhas, Fallbacks: opts.contagem.fallbacks}, err
+}
+
+// Options reúne os parâmetros opcionais de uma conversão. O valor zero mantém o
+// comportamento padrão de cada conversor.
+type Options struct {
+	// IncluirClassificacao adiciona ao CSV as classificações das contas de débito e crédito
+	// resolvidas pelo matcher (conversores Atolini).
+	IncluirClassificacao bool
+	// Agrupamento define como o débito diário do Sicredi é consolidado (AgrupamentoData por padrão).
+	Agrupamento string
+	// DebitoPorTitulo faz o Sicredi lançar um débito para cada crédito, no mesmo valor e data,
+	// em vez do débito consolidado do grupo.
+	DebitoPorTitulo bool
+	// Modo define o layout do CSV de Atolini recebimentos (ModoPadrao ou ModoMultilinha).
+	Modo string
+	// Contas usadas no ModoMultilinha para os componentes além do principal. Vazias
+	// resultam na conta coringa (ContaFallback).
+	ContaJuros        string
+	ContaDesconto     string
+	ContaDespBanco    string
+	ContaDespCartorio string
+	// ColunaDocumento indica de onde o Atolini pagamentos lê o número da NF: um índice de
+	// coluna (0 = A) ou o nome do cabeçalho. Vazia mantém a heurística (coluna D e depois a
+	// primeira célula com 3+ dígitos), que também é o último recurso quando a coluna está vazia.
+	ColunaDocumento string
+	// MarcarNaoEncontradas acrescenta a coluna "Conta Não Encontrada" (S/N), marcando as linhas
+	// em que o matcher caiu na conta coringa (ContaFallback).
+	MarcarNaoEncontradas bool
+	// IncluirDiagnostico acrescenta a coluna "Diagnóstico Match" com o tipo de match da conta
+	// (exata, fuzzy ou nao_encontrada; veja diagnosticoMatch), para revisar os matches fuzzy.
+	IncluirDiagnostico bool
+	// CreditPrefixes filtra as contas de despesa usadas nos pagamentos do extrato Sicredi.
+	CreditPrefixes []string
+	// SufixoSinal define como interpretar valores com sufixo C/D ou CR/DB no extrato Sicredi
+	// (SufixoSinalDebitoNegativo ou SufixoSinalCreditoNegativo). Vazio ignora o sufixo.
+	SufixoSinal string
+	// OrdenarPorData ordena as linhas dos conversores Atolini pela data (DD/MM/AAAA) antes de
+	// gerar o CSV, mantendo a ordem de origem entre linhas do mesmo dia. Falso mantém a ordem
+	// em que os blocos aparecem na planilha.
+	OrdenarPorData bool
+	// PisModo define como a coluna Pis das receitas ACISA é lida (PisModoAuto por padrão).
+	PisModo string
+	// AliquotaPis é o percentual de PIS ("0,65" = 0,65%) usado por PisModoCombinado para separar
+	// o PIS embutido na coluna de mensalidade.
+	AliquotaPis float64
+	// RelatorioMatches troca o CSV da conversão por um relatório XLSX das contas resolvidas pelo
+	// matcher, com uma aba para cada resultado (exata, fuzzy e não encontrada).
+	RelatorioMatches bool
+	// RelaxarFiltro faz os conversores Atolini repetirem a busca da conta sem os prefixos de
+	// classificação quando a busca filtrada cai na conta coringa. O resultado vem marcado como
+	// MatchFuzzyRelaxed, para o contador saber que o filtro foi ignorado.
+	RelaxarFiltro bool
+	// Balancete troca o CSV dos conversores Sicredi e Atolini por um balancete com o total a
+	// débito e a crédito de cada conta usada nos lançamentos gerados. RelatorioMatches, quando
+	// também informado, tem precedência.
+	Balancete bool
+	// BOMUTF8 grava o BOM UTF-8 no início das saídas CSV em UTF-8, para o Excel reconhecer a
+	// codificação ao abrir o arquivo. Desligado por padrão para não afetar leitores automáticos;
+	// não se aplica às saídas em cp1252.
+	BOMUTF8 bool
+	// Encoding é a codificação das saídas CSV: EncodingCP1252 ou EncodingUTF8. Vazio mantém a
+	// de cada conversor: cp1252 no Sicredi, Receitas ACISA, Atolini recebimentos e balancete,
+	// UTF-8 no Atolini pagamentos.
+	Encoding string
+	// FormatoColunas fixa o formato numérico (FormatoNumeroBR, FormatoNumeroUS ou
+	// FormatoNumeroAuto) de colunas de valor específicas, pelo nome lógico da coluna no conversor
+	// (ex.: "valor_pago", "juros", "mensalidade"). Colunas ausentes seguem a heurística.
+	FormatoColunas map[string]string
+	// FormatoData é o layout Go das datas gravadas no CSV (ex.: "2006-01-02" ou "02012006").
+	// Vazio mantém FormatoDataPadrao. As datas continuam em DD/MM/AAAA durante a conversão
+	// (agrupamento, ordenação) e só são reformatadas na saída.
+	FormatoData string
+	// SemFuzzy limita os matchers às correspondências exatas (e por código da conta): sem o
+	// closestmatch, descrições sem correspondência exata vão para a conta coringa,
+	// para tratamento manual em conciliações estritas.
+	SemFuzzy bool
+	// NormalizarSaida remove os acentos das descrições e históricos gravados no CSV (ex.: "João"
+	// vira "Joao"), para sistemas de importação que não os aceitam. Maiúsculas e pontuação são
+	// mantidas; desligado por padrão, preservando o texto original.
+	NormalizarSaida bool
+	// LimiteFallback é o percentual de linhas na conta coringa acima do qual a conversão
+	// avisa que os prefixos ou o arquivo de contas provavelmente estão errados. Zero usa
+	// LimiteFallbackPadrao; 100 desliga o aviso.
+	LimiteFallback float64
+	// ContaFallback é a conta coringa dos lançamentos sem conta identificada (matchers sem
+	// correspondência e contrapartidas bancárias). Vazia usa ContaFallbackPadrao.
+	ContaFallback string
+	// LayoutCNAB ajusta as posições lidas nos detalhes do CNAB240, no formato
+	// "segmento=E;data=143-150;valor=151-168;natureza=169;historico=177-201;documento=202-240;decimais=2".
+	// Campos omitidos mantêm o layout padrão (segmento E, extrato para conciliação FEBRABAN).
+	LayoutCNAB string
+	// RelatorioNaoEncontradas devolve um ZIP com a saída da conversão e NaoEncontradas.csv,
+	// que lista as descrições que caíram na conta coringa e quantas vezes cada uma apareceu,
+	// para completar o plano de contas. Sem efeito com RelatorioMatches, cuja aba unmatched
+	// já traz essas descrições.
+	RelatorioNaoEncontradas bool
+	// SimilaridadeMinima é o percentual de similaridade (Levenshtein normalizada) que o match
+	// fuzzy precisa atingir para ser aceito; abaixo dele a descrição vai para a conta coringa.
+	// Zero usa SimilaridadeMinimaPadrao.
+	SimilaridadeMinima float64
+	// FormatoSaida escolhe o arquivo gerado pelos conversores: FormatoSaidaCSV (padrão, ";") ou
+	// FormatoSaidaXLSX, com cabeçalho em negrito e as colunas de valor gravadas como número.
+	// Vale também para o balancete; o relatório de matches é sempre XLSX.
+	FormatoSaida string
+
+	relatorio      *relatorioMatches
+	naoEncontradas *contagemNaoEncontradas
+	contagem       *contagemLancamentos
+}
+
+// ContaFallbackPadrao é a conta coringa usada quando Options.ContaFallback não é informada.
+const ContaFallbackPadrao = "999999"
+
+// ContaCoringa devolve a conta coringa da conversão: ContaFallback ou, se vazia, ContaFallbackPadrao.
+func (o Options) ContaCoringa() string {
+	if conta := strings.TrimSpace(o.ContaFallback); conta != "" {
+		return conta
+	}
+	return ContaFallbackPadrao
+}
+
+// SimilaridadeMinimaPadrao é o Options.SimilaridadeMinima usado quando nenhuma é informada.
+// Escolhida com as descrições dos testes: os matches fuzzy esperados (mesmo nome com ou sem
+// "LTDA", "SA", "ME") ficam acima de 50% e os fuzzy espúrios, que só compartilham números ou
+// pedaços de palavras, abaixo de 20%. Nomes curtos contra razões sociais longas ("CEMIG" e
+// "CEMIG DISTRIBUICAO SA") também ficam abaixo e vão para a conta coringa.
+const SimilaridadeMinimaPadrao = 40.0
+
+// LimiarSimilaridade devolve a similaridade mínima do match fuzzy, em percentual:
+// SimilaridadeMinima ou, se não informada, SimilaridadeMinimaPadrao.
+func (o Options) LimiarSimilaridade() float64 {
+	if o.SimilaridadeMinima <= 0 {
+		return SimilaridadeMinimaPadrao
+	}
+	return o.SimilaridadeMinima
+}
+
+// MatchFuzzyRelaxed identifica contas encontradas fora do filtro de classificação (RelaxarFiltro).
+const MatchFuzzyRelaxed = "fuzzy_relaxed"
+
+// resolverComRelaxamento chama resolver com os prefixos informados e, com opts.RelaxarFiltro,
+// tenta de novo sem filtro quando a busca filtrada não encontra a conta.
+func resolverComRelaxamento(prefixes []string, opts Options, resolver func(prefixes []string) (code, matchedKey, matchedClass, mtype string)) (code, matchedKey, matchedClass, mtype string) {
+	code, matchedKey, matchedClass, mtype = resolver(prefixes)
+	if !opts.RelaxarFiltro || len(prefixes) == 0 || !(code == "" || isContaFallback(mtype)) {
+		return code, matchedKey, matchedClass, mtype
+	}
+	if c, k, cls, mt := resolver(nil); c != "" && !isContaFallback(mt) {
+		return c, k, cls, MatchFuzzyRelaxed
+	}
+	return code, matchedKey, matchedClass, mtype
+}
+
+// comRelatorio prepara o coletor do relatório de matches quando RelatorioMatches está ativo
+// e o das descrições não encontradas quando só RelatorioNaoEncontradas está.
+func (o Options) comRelatorio() Options {
+	if o.RelatorioMatches && o.relatorio == nil {
+		o.relatorio = &relatorioMatches{vistos: make(map[string]bool)}
+	}
+	if o.RelatorioNaoEncontradas && !o.RelatorioMatches && o.naoEncontradas == nil {
+		o.naoEncontradas = &contagemNaoEncontradas{
+			indice: make(map[string]int),
+			saida:  ArquivoSaidaZIP + "." + o.extensaoSaida(),
+			opts:   Options{Encoding: o.Encoding, BOMUTF8: o.BOMUTF8},
+		}
+	}
+	return o
+}
+
+// Interpretações da coluna Pis das receitas ACISA. No modo automático, valores terminados em
+// "%" são percentuais da mensalidade e os demais são valores absolutos. No modo combinado não
+// há coluna Pis: a mensalidade vem com o PIS incluído e é separada com Options.AliquotaPis.
+const (
+	PisModoAuto       = "auto"
+	PisModoPercentual = "percentual"
+	PisModoValor      = "valor"
+	PisModoCombinado  = "combinado"
+)
+
+// Interpretações do sufixo de sinal dos valores ("1.234,56 D").
+const (
+	SufixoSinalDebitoNegativo  = "debito_negativo"
+	SufixoSinalCreditoNegativo = "credito_negativo"
+)
+
+// Layouts de saída do conversor Atolini recebimentos.
+const (
+	ModoPadrao     = "padrao"
+	ModoMultilinha = "multilinha"
+)
+
+// Modos de agrupamento do lançamento de débito no conversor Sicredi.
+const (
+	AgrupamentoData          = "data"
+	AgrupamentoDataDescricao = "data_descricao"
+	AgrupamentoNenhum        = "nenhum"
+)
+
+// service guarda só o tamanho do pool de goroutines; os caches de índices são do pacote.
+type service struct {
+	workers int
+}
 
-// NewService cria uma nova instância do serviço de conversão.
+// NewService cria uma nova instância do serviço de conversão com o pool de tamanho padrão.
 func NewService() Service {
-	return &service{}
+	return NewServiceWithWorkers(workers.DefaultSize())
+}
+
+// NewServiceWithWorkers cria o serviço de conversão usando até n goroutines nas etapas paralelas.
+func NewServiceWithWorkers(n int) Service {
+	if n < 1 {
+		n = 1
+	}
+	return &service{workers: n}
 }
 
 // ---------------------- utilitários comuns ----------------------
@@ -43,6 +367,249 @@ func NewService() Service {
 var nonAlphanumericRegex = regexp.MustCompile(`[^A-Z0-9 ]+`)
 var whitespaceRegex = regexp.MustCompile(`\s+`)
 
+// maxFuzzyMatchers limita quantos índices do closestmatch ficam em memória.
+const maxFuzzyMatchers = 64
+
+// fuzzyMatchers guarda os índices do closestmatch já construídos, identificados pelas chaves
+// candidatas e tamanhos de n-grama, para não reconstruí-los a cada linha convertida.
+var fuzzyMatchers = struct {
+	mu    sync.Mutex
+	items map[uint64]*closestmatch.ClosestMatch
+}{items: make(map[uint64]*closestmatch.ClosestMatch)}
+
+// closestMatcher devolve o índice do closestmatch para as chaves informadas, construindo-o
+// apenas na primeira vez em que o mesmo conjunto de chaves é pedido.
+func closestMatcher(keys []string, subsetSizes []int) *closestmatch.ClosestMatch {
+	h := fnv.New64a()
+	for _, n := range subsetSizes {
+		fmt.Fprintf(h, "%d,", n)
+	}
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+	}
+	id := h.Sum64()
+
+	fuzzyMatchers.mu.Lock()
+	cm, ok := fuzzyMatchers.items[id]
+	fuzzyMatchers.mu.Unlock()
+	if ok {
+		return cm
+	}
+
+	// o índice é construído fora do lock para que planos diferentes não esperem uns pelos outros;
+	// se duas chamadas construírem o mesmo índice, fica o primeiro guardado
+	cm = closestmatch.New(keys, subsetSizes)
+
+	fuzzyMatchers.mu.Lock()
+	defer fuzzyMatchers.mu.Unlock()
+	if existing, ok := fuzzyMatchers.items[id]; ok {
+		return existing
+	}
+	if len(fuzzyMatchers.items) >= maxFuzzyMatchers {
+		fuzzyMatchers.items = make(map[uint64]*closestmatch.ClosestMatch)
+	}
+	fuzzyMatchers.items[id] = cm
+	return cm
+}
+
+// preFiltroFuzzy ativa o pré-filtro por palavras em comum antes do closestmatch.
+var preFiltroFuzzy atomic.Bool
+
+// minPreFiltroKeys é o tamanho a partir do qual o pré-filtro compensa; abaixo disso o índice
+// completo (em cache) já é barato.
+const minPreFiltroKeys = 200
+
+// maxFreqPalavraPreFiltro define quando uma palavra é rara o bastante para selecionar
+// candidatas: palavras presentes em mais chaves que isso ("LTDA", "COMERCIO") são ignoradas.
+const maxFreqPalavraPreFiltro = 50
+
+// SetPreFiltroFuzzy liga ou desliga o pré-filtro de candidatos do matcher fuzzy. Com ele, só as
+// chaves que compartilham alguma palavra rara (3+ caracteres) com a descrição buscada entram no
+// índice de n-gramas, que fica bem menor que o do plano de contas inteiro. Compensa quando o
+// índice completo raramente está em cache (planos grandes, filtros de prefixo variados); com o
+// índice já em cache, a busca direta é mais rápida.
+func SetPreFiltroFuzzy(ativo bool) {
+	preFiltroFuzzy.Store(ativo)
+}
+
+// closestEmpatados devolve, em ordem alfabética, as chaves de cm com a maior pontuação para
+// query. Closest escolhe arbitrariamente entre chaves igualmente próximas (o ranking vem de um
+// map), então a pontuação do closestmatch é refeita aqui: quantos substrings da query, com os
+// mesmos tamanhos e sem alterar a caixa, aparecem em cada chave.
+func closestEmpatados(cm *closestmatch.ClosestMatch, query string) []string {
+	pontos := make(map[uint32]int)
+	vistos := make(map[string]bool)
+	for _, n := range cm.SubstringSizes {
+		for i := 0; i < len(query)-n; i++ {
+			sub := query[i : i+n]
+			if vistos[sub] || strings.TrimSpace(sub) == "" {
+				continue
+			}
+			vistos[sub] = true
+			for id := range cm.SubstringToID[sub] {
+				pontos[id]++
+			}
+		}
+	}
+
+	melhor := 0
+	var empatados []string
+	for id, p := range pontos {
+		switch {
+		case p > melhor:
+			melhor = p
+			empatados = append(empatados[:0], cm.ID[id].Key)
+		case p == melhor:
+			empatados = append(empatados, cm.ID[id].Key)
+		}
+	}
+	sort.Strings(empatados)
+	return empatados
+}
+
+// similaridade devolve a similaridade entre a e b, de 0 a 100: a distância de Levenshtein
+// (em runas) normalizada pelo tamanho do texto mais longo. Textos iguais valem 100.
+func similaridade(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	maior := max(len(ra), len(rb))
+	if maior == 0 {
+		return 100
+	}
+	anterior := make([]int, len(rb)+1)
+	atual := make([]int, len(rb)+1)
+	for j := range anterior {
+		anterior[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		atual[0] = i
+		for j := 1; j <= len(rb); j++ {
+			custo := 1
+			if ra[i-1] == rb[j-1] {
+				custo = 0
+			}
+			atual[j] = min(anterior[j]+1, atual[j-1]+1, anterior[j-1]+custo)
+		}
+		anterior, atual = atual, anterior
+	}
+	return 100 * (1 - float64(anterior[len(rb)])/float64(maior))
+}
+
+// escolherPorClassif percorre as entradas das chaves na ordem dada e devolve a de classificação
+// mais longa (mais específica), ficando com a primeira em caso de empate. É o desempate comum às
+// buscas exata (uma chave) e fuzzy (as chaves empatadas de closestEmpatados).
+func escolherPorClassif[T any](keys []string, entries map[string][]T, classif func(T) string) (key string, chosen T, ok bool) {
+	for _, k := range keys {
+		for _, e := range entries[k] {
+			if !ok || len(classif(e)) > len(classif(chosen)) {
+				key, chosen, ok = k, e, true
+			}
+		}
+	}
+	return key, chosen, ok
+}
+
+// fuzzyMatcher devolve o índice usado para buscar queries entre keys. Com o pré-filtro ativo e
+// muitas chaves, monta um índice pequeno só com as candidatas; se as queries não tiverem
+// nenhuma palavra rara em comum com as chaves, usa o índice completo para não perder
+// correspondências.
+func fuzzyMatcher(keys []string, subsetSizes []int, queries ...string) *closestmatch.ClosestMatch {
+	if preFiltroFuzzy.Load() && len(keys) >= minPreFiltroKeys {
+		if candidatas := filtrarPorPalavras(keys, queries); len(candidatas) > 0 {
+			return closestmatch.New(candidatas, subsetSizes)
+		}
+	}
+	return closestMatcher(keys, subsetSizes)
+}
+
+// filtrarPorPalavras mantém as chaves que têm alguma palavra de 3+ caracteres em comum com as
+// queries (já normalizadas), considerando só palavras que aparecem em até
+// maxFreqPalavraPreFiltro chaves.
+func filtrarPorPalavras(keys []string, queries []string) []string {
+	palavras := make(map[string][]int)
+	for _, q := range queries {
+		for _, w := range strings.Fields(q) {
+			if len(w) >= 3 {
+				palavras[w] = nil
+			}
+		}
+	}
+	if len(palavras) == 0 {
+		return nil
+	}
+
+	for i, k := range keys {
+		for _, w := range strings.Fields(k) {
+			if idx, ok := palavras[w]; ok && len(idx) <= maxFreqPalavraPreFiltro {
+				if len(idx) == 0 || idx[len(idx)-1] != i {
+					palavras[w] = append(idx, i)
+				}
+			}
+		}
+	}
+
+	selecionadas := make(map[int]bool)
+	for _, idx := range palavras {
+		if len(idx) > maxFreqPalavraPreFiltro {
+			continue
+		}
+		for _, i := range idx {
+			selecionadas[i] = true
+		}
+	}
+
+	var candidatas []string
+	for i, k := range keys {
+		if selecionadas[i] {
+			candidatas = append(candidatas, k)
+		}
+	}
+	return candidatas
+}
+
+// Warmup antecipa o custo da primeira conversão. As expressões regulares do pacote já são
+// compiladas na inicialização; se contasFile for informado, os índices fuzzy do plano de contas
+// completo são construídos para os conversores Sicredi e Atolini. Linhas ruins do arquivo de
+// contas são apenas descartadas, como na conversão.
+func (svc *service) Warmup(contasFile io.Reader) error {
+	if contasFile == nil {
+		return nil
+	}
+	data, err := io.ReadAll(contasFile)
+	if err != nil {
+		return fmt.Errorf("erro ao ler arquivo de contas: %w", err)
+	}
+
+	_, sicrediKeys, err := svc.loadContasSicredi(bytes.NewReader(data))
+	if _, err = separarErrosLinhas(err); err != nil {
+		return fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+	_, atoliniKeys, err := svc.lerPlanoContasAtolini(bytes.NewReader(data))
+	if _, err = separarErrosLinhas(err); err != nil {
+		return fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+	recebimentosKeys, _, err := svc.lerContasRecebimentos(bytes.NewReader(data))
+	if _, err = separarErrosLinhas(err); err != nil {
+		return fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+
+	// cada índice é independente; construí-los no pool encurta o warmup de planos grandes
+	indices := []struct {
+		keys  []string
+		sizes []int
+	}{
+		{sicrediKeys, []int{3, 4}},
+		{atoliniKeys, []int{3, 4, 5}},
+		{recebimentosKeys, []int{3, 4, 5}},
+	}
+	workers.Each(svc.workers, len(indices), func(i int) {
+		if len(indices[i].keys) > 0 {
+			closestMatcher(indices[i].keys, indices[i].sizes)
+		}
+	})
+	return nil
+}
+
 func (svc *service) normalizeText(str string) string {
 	t := transform.Chain(norm.NFD, transform.RemoveFunc(func(r rune) bool {
 		return unicode.Is(unicode.Mn, r)
@@ -102,15 +669,176 @@ func sanitizeForCSV(s string) string {
 	return b.String()
 }
 
+// Formatos numéricos aceitos por coluna (Options.FormatoColunas). No automático, o último
+// separador da célula decide qual é o decimal, o que erra valores como "1,234" (milhar US)
+// ou "1.234" (milhar BR) quando a planilha mistura os dois formatos.
+const (
+	FormatoNumeroAuto = "auto"
+	FormatoNumeroBR   = "br"
+	FormatoNumeroUS   = "us"
+)
+
 // parseBRLNumber: heurística robusta para entradas brasileiras/anglo
 func (svc *service) parseBRLNumber(val string) (float64, error) {
+	return svc.parseNumero(val, FormatoNumeroAuto)
+}
+
+// Colunas de valor de cada conversor que aceitam formato numérico em Options.FormatoColunas.
+var (
+	colunasNumericasPagamentos = []string{"valor", "valor_original", "valor_pago", "valor_juros", "valor_multa",
+		"valor_desconto", "valor_despesas", "var_cam", "valor_liq_pago_banco"}
+	colunasNumericasRecebimentos = []string{"valor_principal", "juros", "desconto", "desp_banco", "desp_cartorio", "vl_liq_pago"}
+	colunasNumericasReceitas     = []string{"mensalidade", "pis"}
+)
+
+// FormatoDataPadrao é o layout das datas de saída quando Options.FormatoData está vazio.
+const FormatoDataPadrao = "02/01/2006"
+
+// validarFormatoData confere se Options.FormatoData tem dia, mês e ano: a data de referência
+// precisa sobreviver à formatação e ao parse com o layout. O separador do CSV não é aceito.
+func validarFormatoData(opts Options) error {
+	if opts.FormatoData == "" {
+		return nil
+	}
+	ref := time.Date(2009, time.November, 23, 0, 0, 0, 0, time.UTC)
+	t, err := time.Parse(opts.FormatoData, ref.Format(opts.FormatoData))
+	if err != nil || !t.Equal(ref) || strings.Contains(opts.FormatoData, ";") {
+		return fmt.Errorf("formato de data inválido: %s (use um layout com dia, mês e ano, como 02/01/2006, 2006-01-02 ou 02012006)", opts.FormatoData)
+	}
+	return nil
+}
+
+// formatarData reescreve uma data DD/MM/AAAA no layout de Options.FormatoData. Valores que não
+// são datas completas (ex.: competência "01/2024") saem inalterados.
+func (o Options) formatarData(data string) string {
+	if o.FormatoData == "" || o.FormatoData == FormatoDataPadrao {
+		return data
+	}
+	t, err := time.Parse(FormatoDataPadrao, strings.TrimSpace(data))
+	if err != nil {
+		return data
+	}
+	return t.Format(o.FormatoData)
+}
+
+// formatarTexto aplica NormalizarSaida a um campo de texto do CSV de saída.
+func (o Options) formatarTexto(s string) string {
+	if !o.NormalizarSaida {
+		return s
+	}
+	t := transform.Chain(norm.NFD, transform.RemoveFunc(func(r rune) bool {
+		return unicode.Is(unicode.Mn, r)
+	}), norm.NFC)
+	result, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return result
+}
+
+// parseNumeroColuna lê o valor de uma coluna lógica com o formato configurado para ela.
+func (svc *service) parseNumeroColuna(val, coluna string, opts Options) (float64, error) {
+	return svc.parseNumero(val, opts.FormatoColunas[coluna])
+}
+
+// validarFormatoColunas confere os formatos de Options.FormatoColunas e se as colunas
+// informadas existem no conversor.
+func validarFormatoColunas(opts Options, colunas ...string) error {
+	for coluna, formato := range opts.FormatoColunas {
+		if !slices.Contains(colunas, coluna) {
+			return fmt.Errorf("coluna desconhecida para formato numérico: %s (use %s)", coluna, strings.Join(colunas, ", "))
+		}
+		switch formato {
+		case "", FormatoNumeroAuto, FormatoNumeroBR, FormatoNumeroUS:
+		default:
+			return fmt.Errorf("formato numérico inválido para a coluna %s: %s (use %s, %s ou %s)", coluna, formato, FormatoNumeroAuto, FormatoNumeroBR, FormatoNumeroUS)
+		}
+	}
+	return nil
+}
+
+// SimbolosMoedaPadrao são os marcadores de moeda removidos dos valores antes do parse, inclusive
+// as variantes Unicode do cifrão (largura total e "pequeno").
+var SimbolosMoedaPadrao = []string{"R$", "US$", "BRL", "USD", "R\uff04", "R\ufe69", "$", "\uff04", "\ufe69"}
+
+// simbolosMoeda guarda a lista em uso, do símbolo mais longo para o mais curto.
+var simbolosMoeda atomic.Pointer[[]string]
+
+func init() {
+	SetSimbolosMoeda(SimbolosMoedaPadrao)
+}
+
+// SetSimbolosMoeda troca a lista de marcadores de moeda removidos pelo parse numérico (sem
+// diferenciar maiúsculas). Os mais longos são removidos primeiro, para "US$" não sobrar "US"
+// ao remover "$"; símbolos vazios são ignorados.
+func SetSimbolosMoeda(simbolos []string) {
+	lista := make([]string, 0, len(simbolos))
+	for _, s := range simbolos {
+		if s = strings.ToUpper(strings.TrimSpace(s)); s != "" {
+			lista = append(lista, s)
+		}
+	}
+	sort.SliceStable(lista, func(i, j int) bool { return len(lista[i]) > len(lista[j]) })
+	simbolosMoeda.Store(&lista)
+}
+
+// MaxLinhasSaidaPadrao é o limite de linhas de saída dos conversores Atolini quando
+// SetMaxLinhasSaida não foi chamado.
+const MaxLinhasSaidaPadrao = 200000
+
+// ErrLimiteLinhasSaida indica que a conversão passaria do limite de SetMaxLinhasSaida, o que
+// quase sempre é planilha malformada (milhares de linhas vazias formatadas, colunas deslocadas).
+var ErrLimiteLinhasSaida = errors.New("limite de linhas de saída excedido")
+
+// ErrPlanilhaSemAbas indica um .xlsx válido mas sem nenhuma aba, que não tem o que converter.
+var ErrPlanilhaSemAbas = errors.New("planilha sem abas")
+
+// maxLinhasSaida guarda o limite de SetMaxLinhasSaida; zero vale MaxLinhasSaidaPadrao.
+var maxLinhasSaida atomic.Int64
+
+// SetMaxLinhasSaida define quantas linhas uma conversão Atolini pode gerar antes de ser
+// abortada com ErrLimiteLinhasSaida, para uma planilha malformada não esgotar a memória.
+// Valores menores que 1 voltam ao padrão.
+func SetMaxLinhasSaida(n int) {
+	if n < 1 {
+		n = 0
+	}
+	maxLinhasSaida.Store(int64(n))
+}
+
+// checarLimiteLinhas falha com ErrLimiteLinhasSaida quando n passa do limite em vigor.
+func checarLimiteLinhas(n int) error {
+	limite := maxLinhasSaida.Load()
+	if limite == 0 {
+		limite = MaxLinhasSaidaPadrao
+	}
+	if int64(n) > limite {
+		return fmt.Errorf("%w: a conversão passou de %d linhas; a planilha de entrada provavelmente está malformada", ErrLimiteLinhasSaida, limite)
+	}
+	return nil
+}
+
+// removerSimbolosMoeda tira de s os marcadores de SetSimbolosMoeda, em qualquer posição, para
+// que o sinal depois do símbolo ("BRL-10,00") seja reconhecido.
+func removerSimbolosMoeda(s string) string {
+	s = strings.ToUpper(s)
+	for _, simbolo := range *simbolosMoeda.Load() {
+		s = strings.ReplaceAll(s, simbolo, "")
+	}
+	return s
+}
+
+// parseNumero interpreta um valor monetário no formato indicado: FormatoNumeroBR ("1.234,56"),
+// FormatoNumeroUS ("1,234.56") ou, vazio/FormatoNumeroAuto, pela heurística do último separador.
+func (svc *service) parseNumero(val string, formato string) (float64, error) {
 	s := strings.TrimSpace(val)
 	if s == "" {
 		return 0.0, nil
 	}
-	s = strings.ReplaceAll(s, "R$", "")
 	s = strings.ReplaceAll(s, " ", "")
 	s = strings.ReplaceAll(s, "\u00a0", "")
+	s = strings.ReplaceAll(s, "\u202f", "")
+	s = removerSimbolosMoeda(s)
 	s = strings.TrimSpace(s)
 	if s == "" {
 		return 0.0, nil
@@ -131,17 +859,23 @@ func (svc *service) parseBRLNumber(val string) (float64, error) {
 	lastDot := strings.LastIndex(s, ".")
 	lastComma := strings.LastIndex(s, ",")
 
-	if lastComma > lastDot {
+	switch {
+	case formato == FormatoNumeroBR:
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.ReplaceAll(s, ",", ".")
+	case formato == FormatoNumeroUS:
+		s = strings.ReplaceAll(s, ",", "")
+	case lastComma > lastDot:
 		s = strings.ReplaceAll(s, ".", "")
 		s = strings.ReplaceAll(s, ",", ".")
-	} else if lastDot > lastComma {
+	case lastDot > lastComma:
 		if strings.Count(s, ".") > 1 {
 			parts := strings.Split(s, ".")
 			decimalPart := parts[len(parts)-1]
 			intPart := strings.Join(parts[:len(parts)-1], "")
 			s = intPart + "." + decimalPart
 		}
-	} else {
+	default:
 		s = strings.ReplaceAll(s, ".", "")
 		s = strings.ReplaceAll(s, ",", ".")
 	}
@@ -169,6 +903,33 @@ func (svc *service) parseBRLNumber(val string) (float64, error) {
 	return mathRound(f, 2), nil
 }
 
+// sufixoSinalRegex separa o valor de um sufixo C/D/CR/DB no fim da célula.
+var sufixoSinalRegex = regexp.MustCompile(`(?i)^(.*?[0-9)])\s*(CR|DB|C|D)\.?$`)
+
+// parseBRLNumberComSufixo interpreta valores como "1.234,56 D" conforme o modo de sufixo:
+// em SufixoSinalDebitoNegativo o "D"/"DB" torna o valor negativo e "C"/"CR" o mantém positivo;
+// SufixoSinalCreditoNegativo faz o inverso. Com modo vazio equivale a parseBRLNumber.
+func (svc *service) parseBRLNumberComSufixo(val string, modo string) (float64, error) {
+	if modo == "" {
+		return svc.parseBRLNumber(val)
+	}
+	m := sufixoSinalRegex.FindStringSubmatch(strings.TrimSpace(val))
+	if m == nil {
+		return svc.parseBRLNumber(val)
+	}
+	f, err := svc.parseBRLNumber(m[1])
+	if err != nil {
+		return 0.0, err
+	}
+	debito := strings.HasPrefix(strings.ToUpper(m[2]), "D")
+	negativo := debito == (modo == SufixoSinalDebitoNegativo)
+	f = math.Abs(f)
+	if negativo {
+		f = -f
+	}
+	return f, nil
+}
+
 func mathRound(val float64, precision int) float64 {
 	pow := 1.0
 	for i := 0; i < precision; i++ {
@@ -184,6 +945,136 @@ func (svc *service) formatTwoDecimalsComma(val float64) string {
 	return strings.Replace(fmt.Sprintf("%.2f", val), ".", ",", 1)
 }
 
+// utf8BOM é a marca de ordem de bytes que o Excel grava no início de CSVs "UTF-8".
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM descarta um BOM UTF-8 no início do arquivo. Sem isso, num arquivo decodificado como
+// ISO-8859-1 os bytes viram "ï»¿" e contaminam a primeira célula.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if head, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(head, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
+
+// decodeInput detecta a codificação de cada arquivo de entrada de forma independente: conteúdo
+// UTF-8 válido (inclusive o CSV gerado a partir de .xlsx/.xls) é usado como está, e o restante
+// é decodificado como ISO-8859-1. O BOM UTF-8 é descartado.
+func decodeInput(r io.Reader) io.Reader {
+	data, err := io.ReadAll(skipBOM(r))
+	if err != nil {
+		return &errReader{err: err}
+	}
+	if utf8.Valid(data) {
+		return bytes.NewReader(data)
+	}
+	return transform.NewReader(bytes.NewReader(data), charmap.ISO8859_1.NewDecoder())
+}
+
+// amostraDelimitador é quanto do início do arquivo detectarDelimitador examina.
+const amostraDelimitador = 8 << 10
+
+// novoLeitorCSV abre um CSV de entrada (contas, lançamentos, títulos) já decodificado (veja
+// decodeInput), com o delimitador detectado nas primeiras linhas e tolerante a aspas soltas e
+// linhas de tamanhos diferentes.
+func novoLeitorCSV(r io.Reader) *csv.Reader {
+	br := bufio.NewReaderSize(decodeInput(r), amostraDelimitador)
+	// um erro de leitura aqui volta a aparecer na primeira leitura do csv.Reader
+	amostra, _ := br.Peek(amostraDelimitador)
+	reader := csv.NewReader(br)
+	reader.Comma = detectarDelimitador(amostra)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// detectarDelimitador escolhe entre ';' (o padrão dos sistemas contábeis), tab e ',' contando
+// cada um, fora de aspas, nas primeiras linhas da amostra. Tab e ',' só vencem quando aparecem
+// mais que ';', porque a vírgula decimal é comum em arquivos separados por ';'; várias linhas
+// evitam que um título sem colunas decida sozinho.
+func detectarDelimitador(amostra []byte) rune {
+	const maxLinhas = 10
+	contagem := map[rune]int{}
+	linhas, entreAspas := 0, false
+	for _, r := range string(amostra) {
+		switch {
+		case r == '"':
+			entreAspas = !entreAspas
+		case entreAspas:
+		case r == '\n':
+			linhas++
+		case r == ';' || r == '\t' || r == ',':
+			contagem[r]++
+		}
+		if linhas == maxLinhas {
+			break
+		}
+	}
+	melhor := ';'
+	for _, r := range []rune{'\t', ','} {
+		if contagem[r] > contagem[melhor] {
+			melhor = r
+		}
+	}
+	return melhor
+}
+
+// errReader devolve sempre o erro de leitura original, repassando-o ao csv.Reader.
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// isContaFallback indica se o tipo de match devolvido pelos matchers corresponde à conta coringa.
+func isContaFallback(mtype string) bool {
+	return mtype == "nao_encontrada" || mtype == "nao_aplicavel"
+}
+
+// Valores da coluna "Diagnóstico Match" (Options.IncluirDiagnostico).
+const (
+	DiagnosticoExata         = "exata"
+	DiagnosticoFuzzy         = "fuzzy"
+	DiagnosticoNaoEncontrada = "nao_encontrada"
+)
+
+// diagnosticoMatch resume os tipos de match de uma linha ("exata_all", "fuzzy_filtered", ...) no
+// pior deles: uma conta na coringa vence um match fuzzy, que vence um exato. Contas achadas pelo
+// código na descrição contam como exatas, como no relatório de matches.
+func diagnosticoMatch(tipos ...string) string {
+	diag := DiagnosticoExata
+	for _, tipo := range tipos {
+		switch abaRelatorioMatch(tipo) {
+		case abaMatchNaoEncontrada:
+			return DiagnosticoNaoEncontrada
+		case abaMatchFuzzy:
+			diag = DiagnosticoFuzzy
+		}
+	}
+	return diag
+}
+
+// flagSN formata a coluna de marcação "Conta Não Encontrada".
+func flagSN(v bool) string {
+	if v {
+		return "S"
+	}
+	return "N"
+}
+
+// isBlankRow indica se todas as células da linha estão vazias (ou só com espaços).
+func isBlankRow(row []string) bool {
+	for _, c := range row {
+		if strings.TrimSpace(c) != "" {
+			return false
+		}
+	}
+	return true
+}
+
 // ---------------------- conversores Excel/CSV ----------------------
 
 func (svc *service) convertXLSXtoCSV(file io.Reader) (io.Reader, error) {
@@ -193,6 +1084,10 @@ func (svc *service) convertXLSXtoCSV(file io.Reader) (io.Reader, error) {
 	}
 	defer f.Close()
 
+	if len(f.GetSheetList()) == 0 {
+		return nil, ErrPlanilhaSemAbas
+	}
+
 	var buffer bytes.Buffer
 	writer := csv.NewWriter(&buffer)
 	writer.Comma = ';'
@@ -249,10 +1144,25 @@ func (svc *service) convertXLStoCSV(file io.Reader) (io.Reader, error) {
 	return &buffer, writer.Error()
 }
 
+// primeiraAba devolve o nome da primeira aba do .xlsx, ou ErrPlanilhaSemAbas quando não há nenhuma.
+func primeiraAba(f *excelize.File) (string, error) {
+	abas := f.GetSheetList()
+	if len(abas) == 0 {
+		return "", ErrPlanilhaSemAbas
+	}
+	return abas[0], nil
+}
+
 func (svc *service) loadGenericExcel(file io.Reader) ([][]string, error) {
+	_, rows, err := svc.loadGenericExcelSheet(file)
+	return rows, err
+}
+
+// loadGenericExcelSheet lê a primeira aba de um .xlsx ou .xls e devolve também o nome dela.
+func (svc *service) loadGenericExcelSheet(file io.Reader) (string, [][]string, error) {
 	data, err := io.ReadAll(file)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	reader := bytes.NewReader(data)
 
@@ -260,8 +1170,12 @@ func (svc *service) loadGenericExcel(file io.Reader) ([][]string, error) {
 	f, err := excelize.OpenReader(reader)
 	if err == nil {
 		defer f.Close()
-		sheetName := f.GetSheetList()[0]
-		return f.GetRows(sheetName)
+		sheetName, err := primeiraAba(f)
+		if err != nil {
+			return "", nil, err
+		}
+		rows, err := f.GetRows(sheetName)
+		return sheetName, rows, err
 	}
 
 	// tenta xls
@@ -271,7 +1185,7 @@ func (svc *service) loadGenericExcel(file io.Reader) ([][]string, error) {
 		if len(workbook.GetSheets()) > 0 {
 			sheet, err := workbook.GetSheet(0)
 			if err != nil {
-				return nil, fmt.Errorf("erro ao obter planilha do arquivo .xls: %w", err)
+				return "", nil, fmt.Errorf("erro ao obter planilha do arquivo .xls: %w", err)
 			}
 			var allRows [][]string
 			for _, row := range sheet.GetRows() {
@@ -281,17 +1195,463 @@ func (svc *service) loadGenericExcel(file io.Reader) ([][]string, error) {
 				}
 				allRows = append(allRows, csvRow)
 			}
-			return allRows, nil
+			return sheet.GetName(), allRows, nil
+		}
+		return "", nil, fmt.Errorf("o arquivo .xls não contém planilhas")
+	}
+
+	return "", nil, fmt.Errorf("unsupported workbook file format")
+}
+
+// PeekPlanilha devolve as n primeiras linhas da planilha exatamente como os conversores as
+// enxergam (após loadGenericExcel), para conferir colunas e cabeçalhos antes de converter.
+func (svc *service) PeekPlanilha(excelFile io.Reader, n int) (domain.PreviewPlanilha, error) {
+	sheetName, rows, err := svc.loadGenericExcelSheet(excelFile)
+	if err != nil {
+		return domain.PreviewPlanilha{}, err
+	}
+	preview := domain.PreviewPlanilha{Planilha: sheetName, TotalLinhas: len(rows), Linhas: rows}
+	if n > 0 && len(rows) > n {
+		preview.Linhas = rows[:n]
+	}
+	if preview.Linhas == nil {
+		preview.Linhas = [][]string{}
+	}
+	return preview, nil
+}
+
+// ---------------------- relatório de matches ----------------------
+
+// Abas do relatório XLSX de matches.
+const (
+	abaMatchExata         = "matched"
+	abaMatchFuzzy         = "fuzzy"
+	abaMatchNaoEncontrada = "unmatched"
+)
+
+// relatorioMatches acumula as contas resolvidas pelo matcher, uma linha por descrição e conta.
+// Um coletor nil ignora as chamadas, então os conversores podem registrar sem checar a opção.
+type relatorioMatches struct {
+	vistos map[string]bool
+	linhas []linhaRelatorioMatch
+}
+
+type linhaRelatorioMatch struct {
+	Descricao string
+	Codigo    string
+	Classif   string
+	Tipo      string
+}
+
+func (r *relatorioMatches) add(descricao, codigo, classif, tipo string) {
+	if r == nil {
+		return
+	}
+	key := descricao + "\x00" + codigo
+	if r.vistos[key] {
+		return
+	}
+	r.vistos[key] = true
+	r.linhas = append(r.linhas, linhaRelatorioMatch{Descricao: descricao, Codigo: codigo, Classif: classif, Tipo: tipo})
+}
+
+// abaRelatorioMatch escolhe a aba conforme o tipo de match ("exata_all", "fuzzy_filtered", ...).
+// Contas achadas pelo código na descrição ("codigo_all") contam como exatas.
+func abaRelatorioMatch(tipo string) string {
+	switch {
+	case strings.HasPrefix(tipo, "exata"), strings.HasPrefix(tipo, "codigo"):
+		return abaMatchExata
+	case strings.HasPrefix(tipo, "fuzzy"):
+		return abaMatchFuzzy
+	default:
+		return abaMatchNaoEncontrada
+	}
+}
+
+// gerarXLSX monta a planilha com as abas de matches exatos, fuzzy e não encontrados.
+func (r *relatorioMatches) gerarXLSX() ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	abas := []string{abaMatchExata, abaMatchFuzzy, abaMatchNaoEncontrada}
+	if err := f.SetSheetName(f.GetSheetName(0), abas[0]); err != nil {
+		return nil, err
+	}
+	proximaLinha := make(map[string]int, len(abas))
+	for i, aba := range abas {
+		if i > 0 {
+			if _, err := f.NewSheet(aba); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.SetSheetRow(aba, "A1", &[]interface{}{"Descrição", "Código", "Classificação", "Tipo de Match"}); err != nil {
+			return nil, err
+		}
+		proximaLinha[aba] = 2
+	}
+
+	for _, l := range r.linhas {
+		aba := abaRelatorioMatch(l.Tipo)
+		cell, _ := excelize.CoordinatesToCellName(1, proximaLinha[aba])
+		if err := f.SetSheetRow(aba, cell, &[]interface{}{l.Descricao, l.Codigo, l.Classif, l.Tipo}); err != nil {
+			return nil, err
+		}
+		proximaLinha[aba]++
+	}
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar relatório XLSX: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ---------------------- saída tabular (CSV ou XLSX) ----------------------
+
+// Formatos de arquivo das saídas dos conversores (Options.FormatoSaida).
+const (
+	FormatoSaidaCSV  = "csv"
+	FormatoSaidaXLSX = "xlsx"
+)
+
+// Codificações das saídas CSV (Options.Encoding).
+const (
+	EncodingCP1252 = "cp1252"
+	EncodingUTF8   = "utf8"
+)
+
+// validarFormatoSaida confere Options.FormatoSaida e Options.Encoding antes da conversão.
+func validarFormatoSaida(opts Options) error {
+	switch opts.FormatoSaida {
+	case "", FormatoSaidaCSV, FormatoSaidaXLSX:
+	default:
+		return fmt.Errorf("formato de saída inválido: %s (use %s ou %s)", opts.FormatoSaida, FormatoSaidaCSV, FormatoSaidaXLSX)
+	}
+	switch opts.Encoding {
+	case "", EncodingCP1252, EncodingUTF8:
+	default:
+		return fmt.Errorf("encoding de saída inválido: %s (use %s ou %s)", opts.Encoding, EncodingUTF8, EncodingCP1252)
+	}
+	return nil
+}
+
+// extensaoSaida devolve a extensão do arquivo gerado conforme Options.FormatoSaida.
+func (o Options) extensaoSaida() string {
+	if o.FormatoSaida == FormatoSaidaXLSX {
+		return FormatoSaidaXLSX
+	}
+	return FormatoSaidaCSV
+}
+
+// saidaTabular recebe as linhas de uma saída, a primeira sendo o cabeçalho, e devolve o
+// arquivo pronto em gerar. Os gerarCSV* escrevem nela sem saber o formato escolhido.
+type saidaTabular interface {
+	Write(record []string) error
+	gerar() ([]byte, error)
+}
+
+// novaSaida cria a saída conforme opts.FormatoSaida. O CSV é gravado em opts.Encoding ou, se
+// vazio, em encodingPadrao, a codificação histórica do conversor; em UTF-8 leva o BOM de
+// Options.BOMUTF8. No XLSX, colunasValor são os cabeçalhos das colunas gravadas como número.
+func novaSaida(opts Options, encodingPadrao string, colunasValor ...string) saidaTabular {
+	if opts.FormatoSaida == FormatoSaidaXLSX {
+		return &saidaXLSX{colunasValor: colunasValor}
+	}
+	encoding := opts.Encoding
+	if encoding == "" {
+		encoding = encodingPadrao
+	}
+	out := &saidaCSV{}
+	var w io.Writer = &out.buffer
+	if encoding == EncodingCP1252 {
+		w = transform.NewWriter(&out.buffer, charmap.Windows1252.NewEncoder())
+	} else if opts.BOMUTF8 {
+		out.buffer.Write(utf8BOM)
+	}
+	out.writer = csv.NewWriter(w)
+	out.writer.Comma = ';'
+	return out
+}
+
+type saidaCSV struct {
+	buffer bytes.Buffer
+	writer *csv.Writer
+}
+
+func (s *saidaCSV) Write(record []string) error {
+	return s.writer.Write(record)
+}
+
+func (s *saidaCSV) gerar() ([]byte, error) {
+	s.writer.Flush()
+	return s.buffer.Bytes(), s.writer.Error()
+}
+
+// saidaXLSX grava as linhas numa planilha única pelo stream writer do excelize, para aguentar
+// saídas grandes. O arquivo é criado na primeira linha (o cabeçalho).
+type saidaXLSX struct {
+	colunasValor []string
+
+	f       *excelize.File
+	sw      *excelize.StreamWriter
+	linha   int
+	negrito int
+	numero  int
+	ehValor []bool
+}
+
+// abaSaidaXLSX é o nome da planilha das saídas em XLSX.
+const abaSaidaXLSX = "Lancamentos"
+
+func (s *saidaXLSX) iniciar(header []string) error {
+	s.f = excelize.NewFile()
+	if err := s.f.SetSheetName(s.f.GetSheetName(0), abaSaidaXLSX); err != nil {
+		return err
+	}
+	var err error
+	if s.negrito, err = s.f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err != nil {
+		return err
+	}
+	// 4 é o formato embutido "#,##0.00"; o Excel o exibe com os separadores do usuário
+	if s.numero, err = s.f.NewStyle(&excelize.Style{NumFmt: 4}); err != nil {
+		return err
+	}
+	if s.sw, err = s.f.NewStreamWriter(abaSaidaXLSX); err != nil {
+		return err
+	}
+	s.ehValor = make([]bool, len(header))
+	for i, h := range header {
+		s.ehValor[i] = slices.Contains(s.colunasValor, h)
+	}
+	return nil
+}
+
+func (s *saidaXLSX) Write(record []string) error {
+	if s.sw == nil {
+		if err := s.iniciar(record); err != nil {
+			return fmt.Errorf("erro ao criar planilha de saída: %w", err)
+		}
+	}
+	s.linha++
+	cells := make([]interface{}, len(record))
+	for i, v := range record {
+		switch {
+		case s.linha == 1:
+			cells[i] = excelize.Cell{StyleID: s.negrito, Value: v}
+		case i < len(s.ehValor) && s.ehValor[i] && v != "":
+			// as saídas formatam os valores com vírgula decimal ("1234,56")
+			if n, err := strconv.ParseFloat(strings.Replace(v, ",", ".", 1), 64); err == nil {
+				cells[i] = excelize.Cell{StyleID: s.numero, Value: n}
+				continue
+			}
+			cells[i] = v
+		default:
+			cells[i] = v
 		}
-		return nil, fmt.Errorf("o arquivo .xls não contém planilhas")
 	}
+	cell, _ := excelize.CoordinatesToCellName(1, s.linha)
+	return s.sw.SetRow(cell, cells)
+}
 
-	return nil, fmt.Errorf("unsupported workbook file format")
+func (s *saidaXLSX) gerar() ([]byte, error) {
+	if s.sw == nil {
+		return nil, fmt.Errorf("erro ao gerar XLSX: saída sem cabeçalho")
+	}
+	defer s.f.Close()
+	if err := s.sw.Flush(); err != nil {
+		return nil, fmt.Errorf("erro ao gerar XLSX: %w", err)
+	}
+	buf, err := s.f.WriteToBuffer()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar XLSX: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ---------------------- descrições não encontradas ----------------------
+
+// contagemNaoEncontradas conta, linha a linha, as descrições resolvidas para a conta coringa.
+// Como em relatorioMatches, um coletor nil ignora as chamadas.
+type contagemNaoEncontradas struct {
+	indice map[string]int
+	itens  []domain.DescricaoNaoEncontrada
+	// saida é o nome da saída da conversão dentro do ZIP.
+	saida string
+	// opts leva a codificação de NaoEncontradas.csv, sempre gravado em CSV.
+	opts Options
+}
+
+// add conta uma ocorrência de descricao quando o tipo de match é o da conta coringa.
+func (c *contagemNaoEncontradas) add(descricao, tipo string) {
+	descricao = strings.TrimSpace(descricao)
+	if c == nil || descricao == "" || !isContaFallback(tipo) {
+		return
+	}
+	i, ok := c.indice[descricao]
+	if !ok {
+		i = len(c.itens)
+		c.indice[descricao] = i
+		c.itens = append(c.itens, domain.DescricaoNaoEncontrada{Descricao: descricao})
+	}
+	c.itens[i].Ocorrencias++
+}
+
+// listar devolve as descrições da mais frequente para a menos frequente; empates em ordem alfabética.
+func (c *contagemNaoEncontradas) listar() []domain.DescricaoNaoEncontrada {
+	itens := slices.Clone(c.itens)
+	sort.SliceStable(itens, func(i, j int) bool {
+		if itens[i].Ocorrencias != itens[j].Ocorrencias {
+			return itens[i].Ocorrencias > itens[j].Ocorrencias
+		}
+		return itens[i].Descricao < itens[j].Descricao
+	})
+	return itens
+}
+
+// gerarCSV monta NaoEncontradas.csv (Descrição;Ocorrências), em cp1252 salvo Options.Encoding.
+func (c *contagemNaoEncontradas) gerarCSV() ([]byte, error) {
+	out := novaSaida(c.opts, EncodingCP1252)
+	if err := out.Write([]string{"Descrição", "Ocorrências"}); err != nil {
+		return nil, err
+	}
+	for _, item := range c.listar() {
+		if err := out.Write([]string{sanitizeForCSV(item.Descricao), strconv.Itoa(item.Ocorrencias)}); err != nil {
+			return nil, err
+		}
+	}
+	return out.gerar()
+}
+
+// Arquivos do ZIP devolvido com Options.RelatorioNaoEncontradas. A saída da conversão leva a
+// extensão do formato escolhido (Conversao.csv ou Conversao.xlsx).
+const (
+	ArquivoSaidaZIP          = "Conversao"
+	ArquivoNaoEncontradasZIP = "NaoEncontradas.csv"
+)
+
+// empacotar junta a saída da conversão e NaoEncontradas.csv num ZIP. Com o coletor nil (opção
+// desligada) ou se a conversão falhou, devolve output e err sem alteração.
+func (c *contagemNaoEncontradas) empacotar(output []byte, err error) ([]byte, error) {
+	if c == nil || err != nil {
+		return output, err
+	}
+	naoEncontradas, err := c.gerarCSV()
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar CSV de descrições não encontradas: %w", err)
+	}
+
+	var buffer bytes.Buffer
+	zw := zip.NewWriter(&buffer)
+	for _, arq := range []struct {
+		nome  string
+		dados []byte
+	}{{c.saida, output}, {ArquivoNaoEncontradasZIP, naoEncontradas}} {
+		w, err := zw.Create(arq.nome)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(arq.dados); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("erro ao gerar ZIP: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// ---------------------- balancete ----------------------
+
+// balancete soma os valores lançados a débito e a crédito em cada conta, na forma de um
+// balancete de verificação simplificado das linhas geradas pela conversão.
+type balancete struct {
+	contas map[string]*saldoConta
+}
+
+type saldoConta struct {
+	Debito  float64
+	Credito float64
+}
+
+func novoBalancete() *balancete {
+	return &balancete{contas: make(map[string]*saldoConta)}
+}
+
+// lancar soma valor à conta de débito e à de crédito; contas vazias são ignoradas, o que
+// permite lançar linhas de partida simples (Sicredi) informando só um dos lados.
+func (b *balancete) lancar(debito, credito string, valor float64) {
+	if debito = strings.TrimSpace(debito); debito != "" {
+		b.saldo(debito).Debito += valor
+	}
+	if credito = strings.TrimSpace(credito); credito != "" {
+		b.saldo(credito).Credito += valor
+	}
+}
+
+func (b *balancete) saldo(conta string) *saldoConta {
+	s, ok := b.contas[conta]
+	if !ok {
+		s = &saldoConta{}
+		b.contas[conta] = s
+	}
+	return s
+}
+
+// gerar escreve Conta;Débito;Crédito;Saldo (débito - crédito) no formato de opts.FormatoSaida
+// (CSV em cp1252 por padrão), com as contas em ordem numérica e uma linha final de totais.
+func (b *balancete) gerar(opts Options) ([]byte, error) {
+	contas := make([]string, 0, len(b.contas))
+	for conta := range b.contas {
+		contas = append(contas, conta)
+	}
+	sort.Slice(contas, func(i, j int) bool {
+		if len(contas[i]) != len(contas[j]) {
+			return len(contas[i]) < len(contas[j])
+		}
+		return contas[i] < contas[j]
+	})
+
+	formatar := func(v float64) string {
+		return strings.Replace(fmt.Sprintf("%.2f", v), ".", ",", 1)
+	}
+
+	out := novaSaida(opts, EncodingCP1252, "Débito", "Crédito", "Saldo")
+	if err := out.Write([]string{"Conta", "Débito", "Crédito", "Saldo"}); err != nil {
+		return nil, err
+	}
+	var totalDebito, totalCredito float64
+	for _, conta := range contas {
+		s := b.contas[conta]
+		totalDebito += s.Debito
+		totalCredito += s.Credito
+		if err := out.Write([]string{sanitizeForCSV(conta), formatar(s.Debito), formatar(s.Credito), formatar(s.Debito - s.Credito)}); err != nil {
+			return nil, err
+		}
+	}
+	if err := out.Write([]string{"TOTAL", formatar(totalDebito), formatar(totalCredito), formatar(totalDebito - totalCredito)}); err != nil {
+		return nil, err
+	}
+	return out.gerar()
 }
 
 // ---------------------- SICREDI (mantido) ----------------------
 
-func (svc *service) ProcessSicrediFiles(lancamentosFile io.Reader, contasFile io.Reader, lancamentosFilename string, classPrefixes []string) ([]byte, error) {
+func (svc *service) ProcessSicrediFiles(lancamentosFile io.Reader, contasFile io.Reader, lancamentosFilename string, classPrefixes []string, opts Options) (Resultado, error) {
+	return comContagem(opts, func(opts Options) ([]byte, error) {
+		return svc.processarSicredi(lancamentosFile, contasFile, lancamentosFilename, classPrefixes, opts)
+	})
+}
+
+func (svc *service) processarSicredi(lancamentosFile io.Reader, contasFile io.Reader, lancamentosFilename string, classPrefixes []string, opts Options) ([]byte, error) {
+	if err := validarOpcoesSicredi(opts); err != nil {
+		return nil, err
+	}
+	switch opts.SufixoSinal {
+	case "", SufixoSinalDebitoNegativo, SufixoSinalCreditoNegativo:
+	default:
+		return nil, fmt.Errorf("sufixo de sinal inválido: %s (use %s ou %s)", opts.SufixoSinal, SufixoSinalDebitoNegativo, SufixoSinalCreditoNegativo)
+	}
+
 	var lancamentosCSVReader io.Reader
 	ext := strings.ToLower(filepath.Ext(lancamentosFilename))
 
@@ -310,178 +1670,712 @@ func (svc *service) ProcessSicrediFiles(lancamentosFile io.Reader, contasFile io
 		lancamentosCSVReader = csvData
 	case ".csv":
 		lancamentosCSVReader = lancamentosFile
+	case ".ofx":
+		// extrato OFX: as transações viram lançamentos direto, sem passar pelo CSV
 	default:
 		return nil, fmt.Errorf("formato de arquivo de lançamentos não suportado: %s", ext)
 	}
 
 	contasEntries, allKeys, err := svc.loadContasSicredi(contasFile)
+	errosLinhas, err := separarErrosLinhas(err)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+
+	var lancamentos []domain.Lancamento
+	if ext == ".ofx" {
+		lancamentos, err = svc.carregarLancamentosOFX(lancamentosFile)
+	} else {
+		lancamentos, err = svc.carregarLancamentos(lancamentosCSVReader, opts.SufixoSinal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao carregar arquivo de lançamentos: %w", err)
+	}
+
+	return svc.gerarSaidaSicredi(lancamentos, contasEntries, allKeys, classPrefixes, errosLinhas, opts)
+}
+
+// validarOpcoesSicredi confere as opções comuns aos extratos convertidos pelo fluxo do Sicredi.
+func validarOpcoesSicredi(opts Options) error {
+	switch opts.Agrupamento {
+	case "", AgrupamentoData, AgrupamentoDataDescricao, AgrupamentoNenhum:
+	default:
+		return fmt.Errorf("agrupamento inválido: %s (use %s, %s ou %s)", opts.Agrupamento, AgrupamentoData, AgrupamentoDataDescricao, AgrupamentoNenhum)
+	}
+	if err := validarFormatoSaida(opts); err != nil {
+		return err
+	}
+	return validarFormatoData(opts)
+}
+
+// gerarSaidaSicredi ordena os lançamentos já carregados (CSV, OFX ou CNAB240), resolve as contas
+// e gera a saída pedida: CSV, relatório de matches ou balancete.
+func (svc *service) gerarSaidaSicredi(lancamentos []domain.Lancamento, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, errosLinhas *ErrosLinhas, opts Options) ([]byte, error) {
+	if opts.Agrupamento == AgrupamentoDataDescricao {
+		sort.SliceStable(lancamentos, func(i, j int) bool {
+			if !lancamentos[i].DataLiquidacao.Equal(lancamentos[j].DataLiquidacao) {
+				return lancamentos[i].DataLiquidacao.Before(lancamentos[j].DataLiquidacao)
+			}
+			return svc.normalizeText(lancamentos[i].Descricao) < svc.normalizeText(lancamentos[j].Descricao)
+		})
+	} else {
+		sort.Slice(lancamentos, func(i, j int) bool {
+			return lancamentos[i].DataLiquidacao.Before(lancamentos[j].DataLiquidacao)
+		})
+	}
+
+	opts = opts.comRelatorio()
+	finalRows := svc.montarOutputSicredi(lancamentos, contasEntries, allKeys, classPrefixes, opts)
+	// só as linhas com descrição passaram pelo matcher; os débitos consolidados não entram na conta
+	resolvidas, naoEncontradas := 0, 0
+	for _, row := range finalRows {
+		if row.DescricaoCredito == "" {
+			continue
+		}
+		resolvidas++
+		if row.ContaNaoEncontrada {
+			naoEncontradas++
+		}
+	}
+	errosLinhas = errosLinhas.avisar(avisoFallback(naoEncontradas, resolvidas, opts.LimiteFallback, opts.ContaCoringa()))
+	opts.contagem.registrar(len(finalRows), naoEncontradas)
+	if opts.relatorio != nil {
+		return errosLinhas.anexar(opts.relatorio.gerarXLSX())
+	}
+	if opts.Balancete {
+		b := novoBalancete()
+		for _, row := range finalRows {
+			valor, _ := svc.parseBRLNumber(row.Valor)
+			if row.Operacao == "D" {
+				b.lancar(row.ContaCredito, "", valor)
+			} else {
+				b.lancar("", row.ContaCredito, valor)
+			}
+		}
+		return errosLinhas.anexar(opts.naoEncontradas.empacotar(b.gerar(opts)))
+	}
+
+	outputCSV, err := svc.gerarCSVSicredi(finalRows, opts)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao gerar CSV final: %w", err)
+	}
+
+	return errosLinhas.anexar(opts.naoEncontradas.empacotar(outputCSV, nil))
+}
+
+// registroConta é uma linha do arquivo de contas (código;classificação;descrição).
+// Cabecalho marca a primeira linha não vazia, que pode ser o cabeçalho do arquivo.
+type registroConta struct {
+	Linha     int
+	Cabecalho bool
+	Code      string
+	Classif   string
+	Desc      string
+}
+
+// lerRegistrosContas lê o CSV de contas linha a linha. Linhas incompletas ou malformadas são
+// descartadas e relatadas em ErrosLinhas, exceto a primeira, que pode ser o cabeçalho; cada
+// loader relata as que ele próprio descarta. Planos com código e classificação invertidos são
+// detectados e desinvertidos (veja colunasContasTrocadas). O erro só é não nulo quando o arquivo
+// não pode ser lido.
+func lerRegistrosContas(contasFile io.Reader) ([]registroConta, *ErrosLinhas, error) {
+	reader := novoLeitorCSV(contasFile)
+
+	var registros []registroConta
+	erros := &ErrosLinhas{}
+	primeira := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		linha, _ := reader.FieldPos(0)
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return nil, nil, err
+			}
+			erros.add(perr.StartLine, "%v", perr.Err)
+			continue
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		cabecalho := primeira
+		primeira = false
+
+		if slices.ContainsFunc(record, func(f string) bool { return strings.Contains(f, "\n") }) {
+			// com LazyQuotes, uma aspa sem par engole as linhas seguintes num único campo
+			erros.add(linha, "aspas sem fechamento; as linhas seguintes foram lidas como parte desta")
+			continue
+		}
+		if len(record) < 3 {
+			if !cabecalho {
+				erros.add(linha, "esperadas 3 colunas (código;classificação;descrição), encontradas %d", len(record))
+			}
+			continue
+		}
+		registros = append(registros, registroConta{
+			Linha:     linha,
+			Cabecalho: cabecalho,
+			Code:      strings.TrimSpace(record[0]),
+			Classif:   strings.TrimSpace(record[1]),
+			Desc:      strings.TrimSpace(record[2]),
+		})
+	}
+	if colunasContasTrocadas(registros) {
+		for i := range registros {
+			registros[i].Code, registros[i].Classif = registros[i].Classif, registros[i].Code
+		}
+	}
+	return registros, erros, nil
+}
+
+// colunasContasTrocadas detecta o plano exportado como classificação;código;descrição: conta as
+// linhas em que só a primeira coluna tem cara de classificação (com pontos) e a segunda de código
+// (só dígitos), e o contrário. Linhas ambíguas, como classificações de um nível só, não votam.
+func colunasContasTrocadas(registros []registroConta) bool {
+	trocadas, normais := 0, 0
+	for _, reg := range registros {
+		switch {
+		case pareceClassifConta(reg.Code) && pareceCodigoConta(reg.Classif):
+			trocadas++
+		case pareceCodigoConta(reg.Code) && pareceClassifConta(reg.Classif):
+			normais++
+		}
+	}
+	return trocadas > normais
+}
+
+// pareceCodigoConta indica um código reduzido de conta: só dígitos, aceitando o ".0" que o Excel
+// acrescenta ao salvar números.
+func pareceCodigoConta(s string) bool {
+	s = strings.TrimSuffix(s, ".0")
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// pareceClassifConta indica uma classificação hierárquica, como 2.1.1.01.001.
+func pareceClassifConta(s string) bool {
+	return strings.Contains(strings.TrimSuffix(s, ".0"), ".") && strings.Trim(s, "0123456789.") == ""
+}
+
+// descartar relata reg como ignorado por motivo, salvo se for a primeira linha (cabeçalho).
+func (e *ErrosLinhas) descartar(reg registroConta, motivo string) {
+	if !reg.Cabecalho {
+		e.add(reg.Linha, "%s", motivo)
+	}
+}
+
+func (svc *service) loadContasSicredi(contasFile io.Reader) (map[string][]domain.ContaSicredi, []string, error) {
+	registros, erros, err := lerRegistrosContas(contasFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contasEntries := make(map[string][]domain.ContaSicredi)
+	var allKeys []string
+	keysMap := make(map[string]bool)
+
+	for _, reg := range registros {
+		key := svc.normalizeText(reg.Desc)
+
+		if key == "" {
+			erros.descartar(reg, "descrição da conta vazia")
+			continue
+		}
+
+		entry := domain.ContaSicredi{Code: reg.Code, Classif: reg.Classif, Desc: reg.Desc}
+		contasEntries[key] = append(contasEntries[key], entry)
+
+		if !keysMap[key] {
+			keysMap[key] = true
+			allKeys = append(allKeys, key)
+		}
+	}
+	return contasEntries, allKeys, erros.err()
+}
+
+func (svc *service) carregarLancamentos(lancamentosFile io.Reader, sufixoSinal string) ([]domain.Lancamento, error) {
+	reader := novoLeitorCSV(lancamentosFile)
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var lancamentos []domain.Lancamento
+	for _, record := range records {
+		if len(record) < 9 {
+			continue
+		}
+		tipo := strings.ToUpper(strings.TrimSpace(record[0]))
+		tipoPagamento := isTipoPagamentoSicredi(tipo)
+		if !strings.HasPrefix(tipo, "SIMPLES") && !tipoPagamento {
+			continue
+		}
+
+		dataLiq, err := time.Parse("02/01/2006", record[6])
+		if err != nil {
+			continue
+		}
+
+		valor, err := svc.parseBRLNumberComSufixo(record[8], sufixoSinal)
+		if err != nil {
+			valor = 0.0
+		}
+
+		descricaoCredito := strings.TrimSpace(record[4])
+
+		if tipoPagamento || valor < 0 {
+			lancamentos = append(lancamentos, domain.Lancamento{
+				DataLiquidacao: dataLiq,
+				Documento:      strings.TrimSpace(record[1]),
+				Descricao:      descricaoCredito,
+				Valor:          math.Abs(valor),
+				Historico: fmt.Sprintf("PAGAMENTO A %s CONFORME DOCUMENTO %s COM VENCIMENTO EM %s",
+					descricaoCredito, record[1], record[5]),
+				Pagamento: true,
+			})
+			continue
+		}
+
+		historico := fmt.Sprintf("RECEBIMENTO DE %s CONFORME BOLETO %s COM VENCIMENTO EM %s REFERENTE DOCUMENTO %s",
+			descricaoCredito, record[2], record[5], record[1])
+
+		lancamentos = append(lancamentos, domain.Lancamento{
+			DataLiquidacao: dataLiq,
+			Documento:      strings.TrimSpace(record[1]),
+			Descricao:      descricaoCredito,
+			Valor:          valor,
+			Historico:      historico,
+		})
+	}
+	return lancamentos, nil
+}
+
+var ofxTransacaoRegex = regexp.MustCompile(`(?is)<STMTTRN>(.*?)(?:</STMTTRN>|<STMTTRN>|</BANKTRANLIST>|$)`)
+var ofxCampoRegex = regexp.MustCompile(`(?i)<([A-Z0-9.]+)>([^<\r\n]*)`)
+
+// carregarLancamentosOFX lê as transações (STMTTRN) de um extrato OFX, tanto no formato SGML
+// (OFX 1.x, sem tags de fechamento) quanto XML (OFX 2.x). Valores negativos viram pagamentos;
+// transações sem data ou valor legíveis são ignoradas, como no CSV.
+func (svc *service) carregarLancamentosOFX(ofxFile io.Reader) ([]domain.Lancamento, error) {
+	data, err := io.ReadAll(decodeInput(ofxFile))
 	if err != nil {
-		return nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+		return nil, err
 	}
 
-	lancamentos, err := svc.carregarLancamentos(lancamentosCSVReader)
-	if err != nil {
-		return nil, fmt.Errorf("erro ao carregar arquivo de lançamentos: %w", err)
+	blocos := ofxTransacaoRegex.FindAllStringSubmatch(string(data), -1)
+	if len(blocos) == 0 {
+		return nil, errors.New("nenhuma transação (STMTTRN) encontrada no arquivo OFX")
 	}
 
-	sort.Slice(lancamentos, func(i, j int) bool {
-		return lancamentos[i].DataLiquidacao.Before(lancamentos[j].DataLiquidacao)
-	})
+	var lancamentos []domain.Lancamento
+	for _, bloco := range blocos {
+		campos := make(map[string]string)
+		for _, m := range ofxCampoRegex.FindAllStringSubmatch(bloco[1], -1) {
+			campos[strings.ToUpper(m[1])] = strings.TrimSpace(m[2])
+		}
 
-	finalRows := svc.montarOutputSicredi(lancamentos, contasEntries, allKeys, classPrefixes)
+		dataLiq, err := parseDataOFX(campos["DTPOSTED"])
+		if err != nil {
+			continue
+		}
+		valor, err := strconv.ParseFloat(strings.Replace(campos["TRNAMT"], ",", ".", 1), 64)
+		if err != nil {
+			continue
+		}
 
-	outputCSV, err := svc.gerarCSVSicredi(finalRows)
-	if err != nil {
-		return nil, fmt.Errorf("erro ao gerar CSV final: %w", err)
+		descricao := campos["MEMO"]
+		if descricao == "" {
+			descricao = campos["NAME"]
+		}
+		documento := campos["CHECKNUM"]
+		if documento == "" {
+			documento = campos["FITID"]
+		}
+
+		if valor < 0 {
+			lancamentos = append(lancamentos, domain.Lancamento{
+				DataLiquidacao: dataLiq,
+				Documento:      documento,
+				Descricao:      descricao,
+				Valor:          math.Abs(valor),
+				Historico:      fmt.Sprintf("PAGAMENTO A %s CONFORME DOCUMENTO %s", descricao, documento),
+				Pagamento:      true,
+			})
+			continue
+		}
+		lancamentos = append(lancamentos, domain.Lancamento{
+			DataLiquidacao: dataLiq,
+			Documento:      documento,
+			Descricao:      descricao,
+			Valor:          valor,
+			Historico:      fmt.Sprintf("RECEBIMENTO DE %s CONFORME DOCUMENTO %s", descricao, documento),
+		})
 	}
+	return lancamentos, nil
+}
 
-	return outputCSV, nil
+// parseDataOFX interpreta as datas do OFX (YYYYMMDD, YYYYMMDDHHMM ou YYYYMMDDHHMMSS, com
+// milissegundos e fuso opcionais, ex: "20260105120000.000[-3:BRT]") e devolve só o dia, para
+// que o agrupamento diário trate a transação como as do CSV.
+func parseDataOFX(s string) (time.Time, error) {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "[")
+	s, _, _ = strings.Cut(s, ".")
+
+	var layout string
+	switch len(s) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("data OFX inválida: %q", s)
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("data OFX inválida: %q", s)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
 }
 
-func (svc *service) loadContasSicredi(contasFile io.Reader) (map[string][]domain.ContaSicredi, []string, error) {
-	decoder := charmap.ISO8859_1.NewDecoder()
-	reader := csv.NewReader(transform.NewReader(contasFile, decoder))
-	reader.Comma = ';'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
+// campoCNAB é a posição de um campo no registro CNAB, de Inicio a Fim (base 1, inclusivas), como
+// nos manuais FEBRABAN.
+type campoCNAB struct{ Inicio, Fim int }
 
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, nil, err
+// valor devolve o conteúdo do campo, sem os espaços de preenchimento; registros mais curtos que
+// 240 posições (espaços finais cortados por editores) são aceitos.
+func (c campoCNAB) valor(registro []rune) string {
+	if c.Inicio < 1 || c.Inicio > len(registro) {
+		return ""
 	}
+	return strings.TrimSpace(string(registro[c.Inicio-1 : min(c.Fim, len(registro))]))
+}
 
-	contasEntries := make(map[string][]domain.ContaSicredi)
-	var allKeys []string
-	keysMap := make(map[string]bool)
+// layoutCNAB240 indica onde estão os campos dos registros de detalhe (tipo 3) de um segmento.
+type layoutCNAB240 struct {
+	Segmento      string    // código do segmento (posição 14); os demais detalhes são ignorados
+	Data          campoCNAB // DDMMAAAA
+	Valor         campoCNAB // só dígitos, com CasasDecimais implícitas
+	Natureza      campoCNAB // "D" para débito; os demais valores são créditos
+	Historico     campoCNAB
+	Documento     campoCNAB
+	CasasDecimais int
+}
 
-	for _, record := range records {
-		if len(record) < 3 {
+// layoutCNAB240Extrato é o segmento E do extrato para conciliação bancária FEBRABAN.
+var layoutCNAB240Extrato = layoutCNAB240{
+	Segmento:      "E",
+	Data:          campoCNAB{143, 150},
+	Valor:         campoCNAB{151, 168},
+	Natureza:      campoCNAB{169, 169},
+	Historico:     campoCNAB{177, 201},
+	Documento:     campoCNAB{202, 240},
+	CasasDecimais: 2,
+}
+
+// parseLayoutCNAB240 aplica sobre o layout padrão as posições de Options.LayoutCNAB, pares
+// campo=inicio-fim (ou campo=posição, para campos de um caractere) separados por ";".
+func parseLayoutCNAB240(cfg string) (layoutCNAB240, error) {
+	layout := layoutCNAB240Extrato
+	for _, item := range strings.Split(cfg, ";") {
+		if strings.TrimSpace(item) == "" {
 			continue
 		}
-		code := strings.TrimSpace(record[0])
-		classif := strings.TrimSpace(record[1])
-		desc := strings.TrimSpace(record[2])
-		key := svc.normalizeText(desc)
-
-		if key == "" {
+		nome, valor, ok := strings.Cut(item, "=")
+		nome, valor = strings.ToLower(strings.TrimSpace(nome)), strings.TrimSpace(valor)
+		if !ok || valor == "" {
+			return layoutCNAB240{}, fmt.Errorf("layout CNAB inválido: %q (use campo=inicio-fim)", item)
+		}
+		switch nome {
+		case "segmento":
+			if utf8.RuneCountInString(valor) != 1 {
+				return layoutCNAB240{}, fmt.Errorf("layout CNAB inválido: segmento %q (use uma letra, ex: E)", valor)
+			}
+			layout.Segmento = strings.ToUpper(valor)
+			continue
+		case "decimais":
+			n, err := strconv.Atoi(valor)
+			if err != nil || n < 0 || n > 6 {
+				return layoutCNAB240{}, fmt.Errorf("layout CNAB inválido: decimais %q", valor)
+			}
+			layout.CasasDecimais = n
 			continue
 		}
 
-		entry := domain.ContaSicredi{Code: code, Classif: classif, Desc: desc}
-		contasEntries[key] = append(contasEntries[key], entry)
-
-		if !keysMap[key] {
-			keysMap[key] = true
-			allKeys = append(allKeys, key)
-		}
-	}
-	return contasEntries, allKeys, nil
+		ini, fim, intervalo := strings.Cut(valor, "-")
+		if !intervalo {
+			fim = ini
+		}
+		campo := campoCNAB{}
+		var errIni, errFim error
+		campo.Inicio, errIni = strconv.Atoi(strings.TrimSpace(ini))
+		campo.Fim, errFim = strconv.Atoi(strings.TrimSpace(fim))
+		if errIni != nil || errFim != nil || campo.Inicio < 1 || campo.Fim < campo.Inicio || campo.Fim > 240 {
+			return layoutCNAB240{}, fmt.Errorf("layout CNAB inválido: posição %q do campo %s", valor, nome)
+		}
+		switch nome {
+		case "data":
+			layout.Data = campo
+		case "valor":
+			layout.Valor = campo
+		case "natureza":
+			layout.Natureza = campo
+		case "historico":
+			layout.Historico = campo
+		case "documento":
+			layout.Documento = campo
+		default:
+			return layoutCNAB240{}, fmt.Errorf("layout CNAB inválido: campo desconhecido %q (use segmento, data, valor, natureza, historico, documento ou decimais)", nome)
+		}
+	}
+	return layout, nil
 }
 
-func (svc *service) carregarLancamentos(lancamentosFile io.Reader) ([]domain.Lancamento, error) {
-	decoder := charmap.ISO8859_1.NewDecoder()
-	reader := csv.NewReader(transform.NewReader(lancamentosFile, decoder))
-	reader.Comma = ';'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
+// ProcessCNAB240 converte um retorno/extrato CNAB240 pelo mesmo fluxo do Sicredi: cada detalhe do
+// segmento configurado vira um lançamento (débitos como pagamentos) e o histórico é usado para
+// encontrar a conta com matchContaSicredi.
+func (svc *service) ProcessCNAB240(cnabFile io.Reader, contasFile io.Reader, classPrefixes []string, opts Options) (Resultado, error) {
+	return comContagem(opts, func(opts Options) ([]byte, error) {
+		return svc.processarCNAB240(cnabFile, contasFile, classPrefixes, opts)
+	})
+}
 
-	records, err := reader.ReadAll()
+func (svc *service) processarCNAB240(cnabFile io.Reader, contasFile io.Reader, classPrefixes []string, opts Options) ([]byte, error) {
+	if err := validarOpcoesSicredi(opts); err != nil {
+		return nil, err
+	}
+	layout, err := parseLayoutCNAB240(opts.LayoutCNAB)
 	if err != nil {
 		return nil, err
 	}
 
+	contasEntries, allKeys, err := svc.loadContasSicredi(contasFile)
+	errosLinhas, err := separarErrosLinhas(err)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+
+	lancamentos, err := svc.carregarLancamentosCNAB240(cnabFile, layout)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao carregar arquivo CNAB240: %w", err)
+	}
+
+	return svc.gerarSaidaSicredi(lancamentos, contasEntries, allKeys, classPrefixes, errosLinhas, opts)
+}
+
+// carregarLancamentosCNAB240 lê os registros de detalhe (tipo 3, posição 8) do segmento do layout.
+// As posições contam caracteres, não bytes, para que acentos em arquivos UTF-8 não desloquem os
+// campos; detalhes com data ou valor ilegíveis são ignorados, como no CSV.
+func (svc *service) carregarLancamentosCNAB240(cnabFile io.Reader, layout layoutCNAB240) ([]domain.Lancamento, error) {
+	scanner := bufio.NewScanner(decodeInput(cnabFile))
+	escala := math.Pow10(layout.CasasDecimais)
+
 	var lancamentos []domain.Lancamento
-	for _, record := range records {
-		if len(record) < 9 || !strings.HasPrefix(strings.ToUpper(record[0]), "SIMPLES") {
+	detalhes := 0
+	for scanner.Scan() {
+		registro := []rune(strings.TrimRight(scanner.Text(), "\r"))
+		if len(registro) < 14 || registro[7] != '3' || !strings.EqualFold(string(registro[13]), layout.Segmento) {
 			continue
 		}
+		detalhes++
 
-		dataLiq, err := time.Parse("02/01/2006", record[6])
+		dataLiq, err := time.Parse("02012006", layout.Data.valor(registro))
 		if err != nil {
 			continue
 		}
-
-		valor, err := svc.parseBRLNumber(record[8])
+		centavos, err := strconv.ParseInt(layout.Valor.valor(registro), 10, 64)
 		if err != nil {
-			valor = 0.0
+			continue
+		}
+		valor := float64(centavos) / escala
+		descricao := layout.Historico.valor(registro)
+		documento := layout.Documento.valor(registro)
+
+		if strings.EqualFold(layout.Natureza.valor(registro), "D") {
+			lancamentos = append(lancamentos, domain.Lancamento{
+				DataLiquidacao: dataLiq,
+				Documento:      documento,
+				Descricao:      descricao,
+				Valor:          valor,
+				Historico:      fmt.Sprintf("PAGAMENTO A %s CONFORME DOCUMENTO %s", descricao, documento),
+				Pagamento:      true,
+			})
+			continue
 		}
-
-		descricaoCredito := strings.TrimSpace(record[4])
-
-		historico := fmt.Sprintf("RECEBIMENTO DE %s CONFORME BOLETO %s COM VENCIMENTO EM %s REFERENTE DOCUMENTO %s",
-			descricaoCredito, record[2], record[5], record[1])
-
 		lancamentos = append(lancamentos, domain.Lancamento{
 			DataLiquidacao: dataLiq,
-			Descricao:      descricaoCredito,
+			Documento:      documento,
+			Descricao:      descricao,
 			Valor:          valor,
-			Historico:      historico,
+			Historico:      fmt.Sprintf("RECEBIMENTO DE %s CONFORME DOCUMENTO %s", descricao, documento),
 		})
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if detalhes == 0 {
+		return nil, fmt.Errorf("nenhum registro de detalhe do segmento %s encontrado", layout.Segmento)
+	}
 	return lancamentos, nil
 }
 
-func (svc *service) montarOutputSicredi(lancamentos []domain.Lancamento, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string) []domain.OutputRow {
+// isTipoPagamentoSicredi indica se o tipo da linha do extrato é uma saída (pagamento/débito).
+func isTipoPagamentoSicredi(tipo string) bool {
+	return strings.HasPrefix(tipo, "PAGAMENTO") || strings.HasPrefix(tipo, "DEBITO") || strings.HasPrefix(tipo, "DÉBITO")
+}
+
+func (svc *service) montarOutputSicredi(lancamentos []domain.Lancamento, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, opts Options) []domain.OutputRow {
+	var recebimentos, pagamentos []domain.Lancamento
+	for _, l := range lancamentos {
+		if l.Pagamento {
+			pagamentos = append(pagamentos, l)
+		} else {
+			recebimentos = append(recebimentos, l)
+		}
+	}
+
+	finalRows := svc.montarRecebimentosSicredi(recebimentos, contasEntries, allKeys, classPrefixes, opts)
+	for _, l := range pagamentos {
+		svc.appendPagamentoSicredi(l, &finalRows, contasEntries, allKeys, opts)
+	}
+	return finalRows
+}
+
+// appendPagamentoSicredi lança a saída do extrato: débito na conta de despesa do favorecido
+// (filtrada por CreditPrefixes) e crédito no banco, na própria data do pagamento.
+func (svc *service) appendPagamentoSicredi(l domain.Lancamento, finalRows *[]domain.OutputRow, contasEntries map[string][]domain.ContaSicredi, allKeys []string, opts Options) {
+	dataLancamento := l.DataLiquidacao.Format("02/01/2006")
+	valor := strings.Replace(fmt.Sprintf("%.2f", l.Valor), ".", ",", 1)
+	codigoConta, _, classif, mtype := svc.matchContaSicredi(l.Descricao, contasEntries, allKeys, opts.CreditPrefixes, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+	opts.relatorio.add(l.Descricao, codigoConta, classif, mtype)
+	opts.naoEncontradas.add(l.Descricao, mtype)
+
+	*finalRows = append(*finalRows, domain.OutputRow{
+		Operacao:           "D",
+		Data:               dataLancamento,
+		DescricaoCredito:   l.Descricao,
+		ContaCredito:       codigoConta,
+		Valor:              valor,
+		Historico:          l.Historico,
+		ContaNaoEncontrada: isContaFallback(mtype),
+		TipoMatch:          diagnosticoMatch(mtype),
+	}, domain.OutputRow{
+		Operacao:     "C",
+		Data:         dataLancamento,
+		ContaCredito: opts.ContaCoringa(),
+		Valor:        valor,
+		Historico:    l.Historico,
+	})
+}
+
+func (svc *service) montarRecebimentosSicredi(lancamentos []domain.Lancamento, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, opts Options) []domain.OutputRow {
 	if len(lancamentos) == 0 {
 		return nil
 	}
+	agrupamento := opts.Agrupamento
+
+	// chave de agrupamento: lançamentos consecutivos com a mesma chave formam um único débito
+	groupKey := func(l domain.Lancamento) string {
+		if agrupamento == AgrupamentoDataDescricao {
+			return l.DataLiquidacao.Format("20060102") + "|" + svc.normalizeText(l.Descricao)
+		}
+		return l.DataLiquidacao.Format("20060102")
+	}
 
 	var finalRows []domain.OutputRow
 	var group []domain.Lancamento
-	currentDate := lancamentos[0].DataLiquidacao
+	currentKey := groupKey(lancamentos[0])
 
 	for _, l := range lancamentos {
-		if l.DataLiquidacao.Equal(currentDate) {
+		key := groupKey(l)
+		if key == currentKey && agrupamento != AgrupamentoNenhum {
 			group = append(group, l)
 		} else {
-			svc.processarGrupoSicredi(group, &finalRows, contasEntries, allKeys, classPrefixes)
+			svc.processarGrupoSicredi(group, &finalRows, contasEntries, allKeys, classPrefixes, opts)
 			group = []domain.Lancamento{l}
-			currentDate = l.DataLiquidacao
+			currentKey = key
 		}
 	}
-	svc.processarGrupoSicredi(group, &finalRows, contasEntries, allKeys, classPrefixes)
+	svc.processarGrupoSicredi(group, &finalRows, contasEntries, allKeys, classPrefixes, opts)
 
 	return finalRows
 }
 
-func (svc *service) processarGrupoSicredi(grupo []domain.Lancamento, finalRows *[]domain.OutputRow, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string) {
+func (svc *service) processarGrupoSicredi(grupo []domain.Lancamento, finalRows *[]domain.OutputRow, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, opts Options) {
 	if len(grupo) == 0 {
 		return
 	}
 
+	dataLancamento := grupo[0].DataLiquidacao.AddDate(0, 0, 1).Format("02/01/2006")
+
+	if opts.DebitoPorTitulo {
+		// um débito do banco para cada título, logo antes do crédito correspondente
+		for _, l := range grupo {
+			valor := strings.Replace(fmt.Sprintf("%.2f", l.Valor), ".", ",", 1)
+			*finalRows = append(*finalRows, domain.OutputRow{
+				Operacao:     "D",
+				Data:         dataLancamento,
+				ContaCredito: opts.ContaCoringa(),
+				Valor:        valor,
+				Historico:    l.Historico,
+			})
+			svc.appendCreditoSicredi(l, dataLancamento, finalRows, contasEntries, allKeys, classPrefixes, opts)
+		}
+		return
+	}
+
 	var totalDiario float64
 	for _, l := range grupo {
 		totalDiario += l.Valor
 	}
 
-	dataLancamento := grupo[0].DataLiquidacao.AddDate(0, 0, 1).Format("02/01/2006")
+	historicoDebito := "TÍTULOS RECEBIDOS NA DATA"
+	switch opts.Agrupamento {
+	case AgrupamentoDataDescricao:
+		historicoDebito = "TÍTULOS RECEBIDOS NA DATA DE " + grupo[0].Descricao
+	case AgrupamentoNenhum:
+		historicoDebito = grupo[0].Historico
+	}
 
 	*finalRows = append(*finalRows, domain.OutputRow{
 		Operacao:     "D",
 		Data:         dataLancamento,
-		ContaCredito: "999999",
+		ContaCredito: opts.ContaCoringa(),
 		Valor:        strings.Replace(fmt.Sprintf("%.2f", totalDiario), ".", ",", 1),
-		Historico:    "TÍTULOS RECEBIDOS NA DATA",
+		Historico:    historicoDebito,
 	})
 
 	for _, l := range grupo {
-		codigoConta, _, _, _ := svc.matchContaSicredi(l.Descricao, contasEntries, allKeys, classPrefixes)
-
-		*finalRows = append(*finalRows, domain.OutputRow{
-			Operacao:         "C",
-			Data:             dataLancamento,
-			DescricaoCredito: l.Descricao,
-			ContaCredito:     codigoConta,
-			Valor:            strings.Replace(fmt.Sprintf("%.2f", l.Valor), ".", ",", 1),
-			Historico:        l.Historico,
-		})
+		svc.appendCreditoSicredi(l, dataLancamento, finalRows, contasEntries, allKeys, classPrefixes, opts)
 	}
 }
 
-func (svc *service) matchContaSicredi(descricao string, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string) (code, matchedKey, matchedClass, mtype string) {
+// appendCreditoSicredi adiciona a linha de crédito do título na conta do pagador.
+func (svc *service) appendCreditoSicredi(l domain.Lancamento, dataLancamento string, finalRows *[]domain.OutputRow, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, opts Options) {
+	codigoConta, _, classif, mtype := svc.matchContaSicredi(l.Descricao, contasEntries, allKeys, classPrefixes, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+	opts.relatorio.add(l.Descricao, codigoConta, classif, mtype)
+	opts.naoEncontradas.add(l.Descricao, mtype)
+
+	*finalRows = append(*finalRows, domain.OutputRow{
+		Operacao:           "C",
+		Data:               dataLancamento,
+		DescricaoCredito:   l.Descricao,
+		ContaCredito:       codigoConta,
+		Valor:              strings.Replace(fmt.Sprintf("%.2f", l.Valor), ".", ",", 1),
+		Historico:          l.Historico,
+		ContaNaoEncontrada: isContaFallback(mtype),
+		TipoMatch:          diagnosticoMatch(mtype),
+	})
+}
+
+func (svc *service) matchContaSicredi(descricao string, contasEntries map[string][]domain.ContaSicredi, allKeys []string, classPrefixes []string, fuzzy bool, minSimilaridade float64, fallback string) (code, matchedKey, matchedClass, mtype string) {
 	key := svc.normalizeText(descricao)
 	if key == "" {
-		return "999999", "", "", "nao_aplicavel"
+		return fallback, "", "", "nao_aplicavel"
 	}
 
 	searchEntries := contasEntries
@@ -515,50 +2409,253 @@ func (svc *service) matchContaSicredi(descricao string, contasEntries map[string
 		mtypeSuffix = "_filtered"
 	}
 
-	if entries, ok := searchEntries[key]; ok && len(entries) > 0 {
-		sort.Slice(entries, func(i, j int) bool { return len(entries[i].Classif) > len(entries[j].Classif) })
-		chosen := entries[0]
+	classif := func(e domain.ContaSicredi) string { return e.Classif }
+	if _, chosen, ok := escolherPorClassif([]string{key}, searchEntries, classif); ok {
 		return chosen.Code, key, chosen.Classif, "exata" + mtypeSuffix
 	}
 
-	if len(searchKeys) > 0 {
-		cm := closestmatch.New(searchKeys, []int{3, 4})
-		match := cm.Closest(key)
-		if match != "" {
-			entries := searchEntries[match]
-			if len(entries) > 0 {
-				sort.Slice(entries, func(i, j int) bool { return len(entries[i].Classif) > len(entries[j].Classif) })
-				chosen := entries[0]
-				return chosen.Code, match, chosen.Classif, "fuzzy" + mtypeSuffix
-			}
+	if fuzzy && len(searchKeys) > 0 {
+		cm := fuzzyMatcher(searchKeys, []int{3, 4}, key)
+		if match, chosen, ok := escolherPorClassif(closestEmpatados(cm, key), searchEntries, classif); ok && similaridade(key, match) >= minSimilaridade {
+			return chosen.Code, match, chosen.Classif, "fuzzy" + mtypeSuffix
 		}
 	}
 
-	return "999999", "", "", "nao_encontrada"
+	return fallback, "", "", "nao_encontrada"
 }
 
-func (svc *service) gerarCSVSicredi(rows []domain.OutputRow) ([]byte, error) {
-	var buffer bytes.Buffer
-	encoder := charmap.Windows1252.NewEncoder() // manter cp1252 para compatibilidade com LançamentosFinal.csv
-	writer := csv.NewWriter(transform.NewWriter(&buffer, encoder))
-	writer.Comma = ';'
+func (svc *service) gerarCSVSicredi(rows []domain.OutputRow, opts Options) ([]byte, error) {
+	out := novaSaida(opts, EncodingCP1252, "Valor") // manter cp1252 para compatibilidade com LançamentosFinal.csv
 
 	header := []string{"Operação", "Data", "Descrição Credito", "Conta Credito", "Valor", "Historico"}
+	if opts.MarcarNaoEncontradas {
+		header = append(header, "Conta Não Encontrada")
+	}
+	if opts.IncluirDiagnostico {
+		header = append(header, "Diagnóstico Match")
+	}
 	for i := range header {
 		header[i] = sanitizeForCSV(header[i])
 	}
-	if err := writer.Write(header); err != nil {
+	if err := out.Write(header); err != nil {
 		return nil, err
 	}
 
 	for _, row := range rows {
 		record := []string{
 			sanitizeForCSV(row.Operacao),
-			sanitizeForCSV(row.Data),
-			sanitizeForCSV(row.DescricaoCredito),
+			sanitizeForCSV(opts.formatarData(row.Data)),
+			sanitizeForCSV(opts.formatarTexto(row.DescricaoCredito)),
 			sanitizeForCSV(row.ContaCredito),
 			sanitizeForCSV(row.Valor),
-			sanitizeForCSV(row.Historico),
+			sanitizeForCSV(opts.formatarTexto(row.Historico)),
+		}
+		if opts.MarcarNaoEncontradas {
+			record = append(record, flagSN(row.ContaNaoEncontrada))
+		}
+		if opts.IncluirDiagnostico {
+			record = append(record, row.TipoMatch)
+		}
+		if err := out.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	return out.gerar()
+}
+
+// ---------------------- CONCILIAÇÃO DE TÍTULOS ----------------------
+
+// Situações possíveis de uma linha da conciliação de títulos.
+const (
+	SituacaoConciliado         = "CONCILIADO"
+	SituacaoParcial            = "PARCIAL"
+	SituacaoNaoRecebido        = "NAO RECEBIDO"
+	SituacaoRecebidoSemTitulo  = "RECEBIDO SEM TITULO"
+	toleranciaConciliacaoValor = 0.005
+)
+
+// ProcessConciliacaoTitulos cruza os boletos liquidados do extrato Sicredi (.csv) com a
+// lista de títulos em aberto (Documento;Pagador;Vencimento;Valor). O casamento é feito pelo
+// número do documento e, na falta dele, por um recebimento ainda livre com o mesmo valor.
+func (svc *service) ProcessConciliacaoTitulos(extrato io.Reader, titulos io.Reader) (Resultado, error) {
+	lancamentos, err := svc.carregarLancamentos(extrato, "")
+	if err != nil {
+		return Resultado{}, fmt.Errorf("erro ao carregar extrato: %w", err)
+	}
+	var recebimentos []domain.Lancamento
+	for _, l := range lancamentos {
+		if !l.Pagamento {
+			recebimentos = append(recebimentos, l)
+		}
+	}
+
+	listaTitulos, err := svc.carregarTitulos(titulos)
+	if err != nil {
+		return Resultado{}, fmt.Errorf("erro ao carregar arquivo de títulos: %w", err)
+	}
+
+	rows := svc.conciliarTitulos(recebimentos, listaTitulos)
+
+	outputCSV, err := svc.gerarCSVConciliacao(rows)
+	if err != nil {
+		return Resultado{}, fmt.Errorf("erro ao gerar CSV final: %w", err)
+	}
+	return Resultado{Saida: outputCSV, Linhas: len(rows)}, nil
+}
+
+func (svc *service) carregarTitulos(titulosFile io.Reader) ([]domain.Titulo, error) {
+	reader := novoLeitorCSV(titulosFile)
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var titulos []domain.Titulo
+	for _, record := range records {
+		if len(record) < 4 {
+			continue
+		}
+		documento := strings.TrimSpace(record[0])
+		if documento == "" {
+			continue
+		}
+		valor, err := svc.parseBRLNumber(record[3])
+		if err != nil || valor == 0 {
+			// cabeçalho ou linha sem valor
+			continue
+		}
+		vencimento, ok := svc.parseDateDayFirst(record[2])
+		if !ok {
+			vencimento = strings.TrimSpace(record[2])
+		}
+		titulos = append(titulos, domain.Titulo{
+			Documento:  documento,
+			Pagador:    strings.TrimSpace(record[1]),
+			Vencimento: vencimento,
+			Valor:      valor,
+		})
+	}
+	return titulos, nil
+}
+
+// normalizeDocumento reduz o número do documento aos dígitos sem zeros à esquerda,
+// para que "000123" no extrato case com "123" na lista de títulos.
+func normalizeDocumento(doc string) string {
+	var b strings.Builder
+	for _, r := range doc {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := strings.TrimLeft(b.String(), "0")
+	if digits == "" {
+		return strings.ToUpper(strings.TrimSpace(doc))
+	}
+	return digits
+}
+
+func (svc *service) conciliarTitulos(recebimentos []domain.Lancamento, titulos []domain.Titulo) []domain.ConciliacaoTituloRow {
+	usados := make([]bool, len(recebimentos))
+	porDocumento := make(map[string][]int)
+	for i, r := range recebimentos {
+		if doc := normalizeDocumento(r.Documento); doc != "" {
+			porDocumento[doc] = append(porDocumento[doc], i)
+		}
+	}
+
+	var rows []domain.ConciliacaoTituloRow
+	for _, t := range titulos {
+		var idxs []int
+		for _, i := range porDocumento[normalizeDocumento(t.Documento)] {
+			if !usados[i] {
+				idxs = append(idxs, i)
+			}
+		}
+		if len(idxs) == 0 {
+			for i, r := range recebimentos {
+				if !usados[i] && math.Abs(r.Valor-t.Valor) < toleranciaConciliacaoValor {
+					idxs = []int{i}
+					break
+				}
+			}
+		}
+
+		row := domain.ConciliacaoTituloRow{
+			Documento:   t.Documento,
+			Pagador:     t.Pagador,
+			Vencimento:  t.Vencimento,
+			ValorTitulo: svc.formatTwoDecimalsComma(t.Valor),
+		}
+		if len(idxs) == 0 {
+			row.Situacao = SituacaoNaoRecebido
+			row.ValorRecebido = svc.formatTwoDecimalsComma(0)
+			row.Diferenca = svc.formatTwoDecimalsComma(t.Valor)
+			rows = append(rows, row)
+			continue
+		}
+
+		recebido := 0.0
+		var datas []string
+		for _, i := range idxs {
+			usados[i] = true
+			recebido += recebimentos[i].Valor
+			data := recebimentos[i].DataLiquidacao.Format("02/01/2006")
+			if len(datas) == 0 || datas[len(datas)-1] != data {
+				datas = append(datas, data)
+			}
+		}
+		recebido = mathRound(recebido, 2)
+		diferenca := mathRound(t.Valor-recebido, 2)
+
+		row.Situacao = SituacaoConciliado
+		if math.Abs(diferenca) >= toleranciaConciliacaoValor {
+			row.Situacao = SituacaoParcial
+		}
+		row.DataRecebimento = strings.Join(datas, ", ")
+		row.ValorRecebido = svc.formatTwoDecimalsComma(recebido)
+		row.Diferenca = svc.formatTwoDecimalsComma(diferenca)
+		rows = append(rows, row)
+	}
+
+	for i, r := range recebimentos {
+		if usados[i] {
+			continue
+		}
+		rows = append(rows, domain.ConciliacaoTituloRow{
+			Situacao:        SituacaoRecebidoSemTitulo,
+			Documento:       r.Documento,
+			Pagador:         r.Descricao,
+			DataRecebimento: r.DataLiquidacao.Format("02/01/2006"),
+			ValorRecebido:   svc.formatTwoDecimalsComma(r.Valor),
+			Diferenca:       svc.formatTwoDecimalsComma(-r.Valor),
+		})
+	}
+	return rows
+}
+
+func (svc *service) gerarCSVConciliacao(rows []domain.ConciliacaoTituloRow) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := charmap.Windows1252.NewEncoder()
+	writer := csv.NewWriter(transform.NewWriter(&buffer, encoder))
+	writer.Comma = ';'
+
+	header := []string{"Situação", "Documento", "Pagador", "Vencimento", "Valor Título", "Data Recebimento", "Valor Recebido", "Diferença"}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		record := []string{
+			sanitizeForCSV(row.Situacao),
+			sanitizeForCSV(row.Documento),
+			sanitizeForCSV(row.Pagador),
+			sanitizeForCSV(row.Vencimento),
+			sanitizeForCSV(row.ValorTitulo),
+			sanitizeForCSV(row.DataRecebimento),
+			sanitizeForCSV(row.ValorRecebido),
+			sanitizeForCSV(row.Diferenca),
 		}
 		if err := writer.Write(record); err != nil {
 			return nil, err
@@ -571,8 +2668,34 @@ func (svc *service) gerarCSVSicredi(rows []domain.OutputRow) ([]byte, error) {
 
 // ---------------------- RECEITAS ACISA (mantido) ----------------------
 
-func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io.Reader, excelFilename string, classPrefixes []string) ([]byte, error) {
+func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io.Reader, excelFilename string, classPrefixes []string, opts Options) (Resultado, error) {
+	return comContagem(opts, func(opts Options) ([]byte, error) {
+		return svc.processarReceitasAcisa(excelFile, contasFile, excelFilename, classPrefixes, opts)
+	})
+}
+
+func (svc *service) processarReceitasAcisa(excelFile io.Reader, contasFile io.Reader, excelFilename string, classPrefixes []string, opts Options) ([]byte, error) {
+	switch opts.PisModo {
+	case "", PisModoAuto, PisModoPercentual, PisModoValor:
+	case PisModoCombinado:
+		if opts.AliquotaPis <= 0 || opts.AliquotaPis >= 100 {
+			return nil, fmt.Errorf("alíquota de PIS inválida para o modo %s: %.2f (informe o percentual, ex.: 0,65)", PisModoCombinado, opts.AliquotaPis)
+		}
+	default:
+		return nil, fmt.Errorf("modo de PIS inválido: %s (use %s, %s, %s ou %s)", opts.PisModo, PisModoAuto, PisModoPercentual, PisModoValor, PisModoCombinado)
+	}
+	if err := validarFormatoColunas(opts, colunasNumericasReceitas...); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoSaida(opts); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoData(opts); err != nil {
+		return nil, err
+	}
+
 	contasEntries, allKeys, err := svc.loadContasReceitasAcisa(contasFile)
+	errosLinhas, err := separarErrosLinhas(err)
 	if err != nil {
 		return nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
 	}
@@ -582,6 +2705,7 @@ func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io
 		return nil, fmt.Errorf("erro ao carregar e preparar arquivo excel: %w", err)
 	}
 
+	opts = opts.comRelatorio()
 	var finalRows []domain.ReceitasAcisaOutputRow
 	for _, row := range excelData {
 		empresa := row["Empresa"]
@@ -589,7 +2713,9 @@ func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io
 		mensalidadeRaw := row["Mensalidade"]
 		pisRaw := row["Pis"]
 
-		code, matchedKey, _, _ := svc.matchContaReceitas(empresa, contasEntries, allKeys, classPrefixes)
+		code, matchedKey, matchedClass, mtype := svc.matchContaReceitas(empresa, contasEntries, allKeys, classPrefixes, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+		opts.relatorio.add(empresa, code, matchedClass, mtype)
+		opts.naoEncontradas.add(empresa, mtype)
 
 		var descricao string
 		if entries, ok := contasEntries[matchedKey]; ok {
@@ -626,8 +2752,13 @@ func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io
 			descricao = empresa
 		}
 
-		mensalVal, _ := svc.parseBRLNumber(mensalidadeRaw)
-		pisVal, _ := svc.parseBRLNumber(pisRaw)
+		mensalVal, _ := svc.parseNumeroColuna(mensalidadeRaw, "mensalidade", opts)
+		var pisVal float64
+		if opts.PisModo == PisModoCombinado {
+			mensalVal, pisVal = separarPisCombinado(mensalVal, opts.AliquotaPis)
+		} else {
+			pisVal, _ = svc.calcularPisAcisa(pisRaw, mensalVal, opts.PisModo, opts.FormatoColunas["pis"])
+		}
 
 		finalRows = append(finalRows, domain.ReceitasAcisaOutputRow{
 			Data:        refMes,
@@ -636,20 +2767,61 @@ func (svc *service) ProcessReceitasAcisaFiles(excelFile io.Reader, contasFile io
 			Mensalidade: svc.formatTwoDecimalsComma(mensalVal),
 			Pis:         svc.formatTwoDecimalsComma(pisVal),
 			Historico:   fmt.Sprintf("%s da competencia %s", descricao, refMes),
+
+			ContaNaoEncontrada: isContaFallback(mtype),
+			TipoMatch:          diagnosticoMatch(mtype),
 		})
 	}
 
-	return svc.gerarCSVReceitasAcisa(finalRows)
+	naoEncontradas := 0
+	for _, row := range finalRows {
+		if row.ContaNaoEncontrada {
+			naoEncontradas++
+		}
+	}
+	errosLinhas = errosLinhas.avisar(avisoFallback(naoEncontradas, len(finalRows), opts.LimiteFallback, opts.ContaCoringa()))
+	opts.contagem.registrar(len(finalRows), naoEncontradas)
+
+	if opts.relatorio != nil {
+		return errosLinhas.anexar(opts.relatorio.gerarXLSX())
+	}
+	return errosLinhas.anexar(opts.naoEncontradas.empacotar(svc.gerarCSVReceitasAcisa(finalRows, opts)))
 }
 
-func (svc *service) loadContasReceitasAcisa(contasFile io.Reader) (map[string][]domain.ContaReceitasAcisa, []string, error) {
-	decoder := charmap.ISO8859_1.NewDecoder()
-	reader := csv.NewReader(transform.NewReader(contasFile, decoder))
-	reader.Comma = ';'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
+// calcularPisAcisa interpreta a célula Pis conforme o modo: como percentual ("0,65%") aplicado
+// sobre a mensalidade ou como valor já calculado. formato é o formato numérico da coluna.
+func (svc *service) calcularPisAcisa(pisRaw string, mensalidade float64, modo, formato string) (float64, error) {
+	raw := strings.TrimSpace(pisRaw)
+	percentual := strings.HasSuffix(raw, "%")
+	raw = strings.TrimSpace(strings.TrimSuffix(raw, "%"))
+
+	switch modo {
+	case PisModoPercentual:
+		percentual = true
+	case PisModoValor:
+		percentual = false
+	}
+
+	v, err := svc.parseNumero(raw, formato)
+	if err != nil {
+		return 0.0, err
+	}
+	if percentual {
+		return mathRound(mensalidade*v/100, 2), nil
+	}
+	return v, nil
+}
+
+// separarPisCombinado divide o valor da coluna de mensalidade com PIS incluído: o PIS é a alíquota
+// (em percentual) aplicada sobre o valor cheio e a mensalidade líquida é o restante, de modo que
+// mensalidade + PIS sempre reproduz o valor original.
+func separarPisCombinado(valor, aliquota float64) (mensalidade, pis float64) {
+	pis = mathRound(valor*aliquota/100, 2)
+	return mathRound(valor-pis, 2), pis
+}
 
-	records, err := reader.ReadAll()
+func (svc *service) loadContasReceitasAcisa(contasFile io.Reader) (map[string][]domain.ContaReceitasAcisa, []string, error) {
+	registros, erros, err := lerRegistrosContas(contasFile)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -658,20 +2830,15 @@ func (svc *service) loadContasReceitasAcisa(contasFile io.Reader) (map[string][]
 	var allKeys []string
 	keysMap := make(map[string]bool)
 
-	for _, record := range records {
-		if len(record) < 3 {
-			continue
-		}
-		code := strings.TrimSpace(record[0])
-		classif := strings.TrimSpace(record[1])
-		desc := strings.TrimSpace(record[2])
-		key := svc.normalizeText(desc)
+	for _, reg := range registros {
+		key := svc.normalizeText(reg.Desc)
 
 		if key == "" {
+			erros.descartar(reg, "descrição da conta vazia")
 			continue
 		}
 
-		entry := domain.ContaReceitasAcisa{Code: code, Classif: classif, Desc: desc}
+		entry := domain.ContaReceitasAcisa{Code: reg.Code, Classif: reg.Classif, Desc: reg.Desc}
 		contasEntries[key] = append(contasEntries[key], entry)
 
 		if !keysMap[key] {
@@ -679,7 +2846,7 @@ func (svc *service) loadContasReceitasAcisa(contasFile io.Reader) (map[string][]
 			allKeys = append(allKeys, key)
 		}
 	}
-	return contasEntries, allKeys, nil
+	return contasEntries, allKeys, erros.err()
 }
 
 func (svc *service) findHeaderRowReceitas(rows [][]string) int {
@@ -720,7 +2887,10 @@ func (svc *service) loadAndPrepareExcelReceitas(excelFile io.Reader) ([]map[stri
 	}
 	defer f.Close()
 
-	sheetName := f.GetSheetList()[0]
+	sheetName, err := primeiraAba(f)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := f.GetRows(sheetName)
 	if err != nil {
 		return nil, err
@@ -772,10 +2942,10 @@ func (svc *service) loadAndPrepareExcelReceitas(excelFile io.Reader) ([]map[stri
 	return data, nil
 }
 
-func (svc *service) matchContaReceitas(descricao string, contasEntries map[string][]domain.ContaReceitasAcisa, allKeys []string, classPrefixes []string) (code, matchedKey, matchedClass, mtype string) {
+func (svc *service) matchContaReceitas(descricao string, contasEntries map[string][]domain.ContaReceitasAcisa, allKeys []string, classPrefixes []string, fuzzy bool, minSimilaridade float64, fallback string) (code, matchedKey, matchedClass, mtype string) {
 	key := svc.normalizeText(descricao)
 	if key == "" {
-		return "999999", "", "", "nao_aplicavel"
+		return fallback, "", "", "nao_aplicavel"
 	}
 
 	searchEntries := contasEntries
@@ -809,62 +2979,70 @@ func (svc *service) matchContaReceitas(descricao string, contasEntries map[strin
 		mtypeSuffix = "_filtered"
 	}
 
-	if entries, ok := searchEntries[key]; ok && len(entries) > 0 {
-		sort.Slice(entries, func(i, j int) bool { return len(entries[i].Classif) > len(entries[j].Classif) })
-		chosen := entries[0]
+	classif := func(e domain.ContaReceitasAcisa) string { return e.Classif }
+	if _, chosen, ok := escolherPorClassif([]string{key}, searchEntries, classif); ok {
 		return chosen.Code, key, chosen.Classif, "exata" + mtypeSuffix
 	}
 
-	if len(searchKeys) > 0 {
-		cm := closestmatch.New(searchKeys, []int{4, 5, 6})
-		match := cm.Closest(key)
-		if match != "" {
-			entries := searchEntries[match]
-			if len(entries) > 0 {
-				sort.Slice(entries, func(i, j int) bool { return len(entries[i].Classif) > len(entries[j].Classif) })
-				chosen := entries[0]
-				return chosen.Code, match, chosen.Classif, "fuzzy" + mtypeSuffix
-			}
+	if fuzzy && len(searchKeys) > 0 {
+		cm := fuzzyMatcher(searchKeys, []int{4, 5, 6}, key)
+		if match, chosen, ok := escolherPorClassif(closestEmpatados(cm, key), searchEntries, classif); ok && similaridade(key, match) >= minSimilaridade {
+			return chosen.Code, match, chosen.Classif, "fuzzy" + mtypeSuffix
 		}
 	}
 
-	return "999999", "", "", "nao_encontrada"
+	return fallback, "", "", "nao_encontrada"
 }
 
-func (svc *service) gerarCSVReceitasAcisa(rows []domain.ReceitasAcisaOutputRow) ([]byte, error) {
-	var buffer bytes.Buffer
-	encoder := charmap.Windows1252.NewEncoder()
-	writer := csv.NewWriter(transform.NewWriter(&buffer, encoder))
-	writer.Comma = ';'
+func (svc *service) gerarCSVReceitasAcisa(rows []domain.ReceitasAcisaOutputRow, opts Options) ([]byte, error) {
+	out := novaSaida(opts, EncodingCP1252, "Mensalidade", "Pis")
 
 	header := []string{"Data", "Descrição", "Conta", "Mensalidade", "Pis", "Histórico"}
+	if opts.MarcarNaoEncontradas {
+		header = append(header, "Conta Não Encontrada")
+	}
+	if opts.IncluirDiagnostico {
+		header = append(header, "Diagnóstico Match")
+	}
 	for i := range header {
 		header[i] = sanitizeForCSV(header[i])
 	}
-	if err := writer.Write(header); err != nil {
+	if err := out.Write(header); err != nil {
 		return nil, err
 	}
 
 	for _, row := range rows {
 		record := []string{
-			sanitizeForCSV(row.Data),
-			sanitizeForCSV(row.Descricao),
+			sanitizeForCSV(opts.formatarData(row.Data)),
+			sanitizeForCSV(opts.formatarTexto(row.Descricao)),
 			sanitizeForCSV(row.Conta),
 			sanitizeForCSV(row.Mensalidade),
 			sanitizeForCSV(row.Pis),
-			sanitizeForCSV(row.Historico),
+			sanitizeForCSV(opts.formatarTexto(row.Historico)),
 		}
-		if err := writer.Write(record); err != nil {
+		if opts.MarcarNaoEncontradas {
+			record = append(record, flagSN(row.ContaNaoEncontrada))
+		}
+		if opts.IncluirDiagnostico {
+			record = append(record, row.TipoMatch)
+		}
+		if err := out.Write(record); err != nil {
 			return nil, err
 		}
 	}
 
-	writer.Flush()
-	return buffer.Bytes(), writer.Error()
+	return out.gerar()
 }
 
 // ---------------------- ATOLINI - PAGAMENTOS (corrigido) ----------------------
 
+// contaMatch guarda o resultado de um match de conta para reaproveitamento nos caches.
+type contaMatch struct {
+	Code    string
+	Classif string
+	MType   string
+}
+
 // accEntry para plano de contas Atolini
 type accEntry struct {
 	ID      string
@@ -875,13 +3053,7 @@ type accEntry struct {
 // lerPlanoContasAtolini agora mantém todas as entradas por descrição (descNorm -> []accEntry)
 // e retorna a ordem das chaves (descricaoIndex) para fuzzy.
 func (svc *service) lerPlanoContasAtolini(contasFile io.Reader) (map[string][]accEntry, []string, error) {
-	decoder := charmap.ISO8859_1.NewDecoder()
-	reader := csv.NewReader(transform.NewReader(contasFile, decoder))
-	reader.Comma = ';'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
-
-	records, err := reader.ReadAll()
+	registros, erros, err := lerRegistrosContas(contasFile)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -890,15 +3062,17 @@ func (svc *service) lerPlanoContasAtolini(contasFile io.Reader) (map[string][]ac
 	order := []string{}
 	seen := map[string]bool{}
 
-	for _, rec := range records {
-		if len(rec) < 3 {
+	for _, reg := range registros {
+		rawID := reg.Code
+		classif := reg.Classif
+		desc := reg.Desc
+
+		if rawID == "" {
+			erros.descartar(reg, "código da conta vazio")
 			continue
 		}
-		rawID := strings.TrimSpace(rec[0])
-		classif := strings.TrimSpace(rec[1])
-		desc := strings.TrimSpace(rec[2])
-
-		if desc == "" || rawID == "" {
+		if desc == "" {
+			erros.descartar(reg, "descrição da conta vazia")
 			continue
 		}
 
@@ -906,17 +3080,20 @@ func (svc *service) lerPlanoContasAtolini(contasFile io.Reader) (map[string][]ac
 		idForParse := strings.ReplaceAll(rawID, ".", "")
 		idForParse = strings.ReplaceAll(idForParse, ",", ".")
 		if idForParse == "" {
+			erros.descartar(reg, "código da conta vazio")
 			continue
 		}
 		if _, perr := strconv.ParseFloat(idForParse, 64); perr != nil {
 			// se o ID não for numérico, ainda podemos aceitar, mas normalmente pulamos
 			// mantemos o continue para evitar lixo
+			erros.descartar(reg, fmt.Sprintf("código da conta não numérico: %q", rawID))
 			continue
 		}
 
 		id := strings.TrimSuffix(rawID, ".0")
 		key := svc.normalizeText(desc)
 		if key == "" {
+			erros.descartar(reg, "descrição da conta vazia")
 			continue
 		}
 		byDesc[key] = append(byDesc[key], accEntry{
@@ -939,21 +3116,64 @@ func (svc *service) lerPlanoContasAtolini(contasFile io.Reader) (map[string][]ac
 		byDesc[k] = list
 	}
 
-	return byDesc, order, nil
+	return byDesc, order, erros.err()
 }
 
 // buscarContaAtolini agora aceita filtros de classPrefixes.
-// retorna o código da conta ou "999999".
+// retorna o código da conta ou ContaFallbackPadrao.
 func (svc *service) buscarContaAtolini(texto string, contasMap map[string][]accEntry, descricaoIndex []string, classPrefixes []string) string {
+	code, _, _, _ := svc.resolverContaAtolini(texto, contasMap, descricaoIndex, classPrefixes, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+	return code
+}
+
+// resolverContaAtolini segue a mesma lógica de buscarContaAtolini, mas também devolve a chave
+// casada, a classificação da conta escolhida e o tipo de match (como em matchContaSicredi).
+// Com fuzzy falso (Options.SemFuzzy), o que não casar exatamente vai para a conta coringa.
+func (svc *service) resolverContaAtolini(texto string, contasMap map[string][]accEntry, descricaoIndex []string, classPrefixes []string, fuzzy bool, minSimilaridade float64, fallback string) (code, matchedKey, matchedClass, mtype string) {
+	return svc.rastrearContaAtolini(texto, contasMap, descricaoIndex, classPrefixes, fuzzy, minSimilaridade, fallback, nil)
+}
+
+// maxCandidatosExplicacao limita os candidatos fuzzy listados em ExplicarMatch.
+const maxCandidatosExplicacao = 5
+
+// ExplicarMatch carrega o plano de contas e resolve uma única descrição com o matcher dos
+// conversores Atolini, devolvendo cada etapa da decisão. Linhas ruins do plano são apenas
+// descartadas, como na conversão.
+func (svc *service) ExplicarMatch(descricao string, contasFile io.Reader, classPrefixes []string, opts Options) (domain.ExplicacaoMatch, error) {
+	contasMap, descricaoIndex, err := svc.lerPlanoContasAtolini(contasFile)
+	if _, err = separarErrosLinhas(err); err != nil {
+		return domain.ExplicacaoMatch{}, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+	}
+	trace := domain.ExplicacaoMatch{Descricao: descricao, Prefixos: classPrefixes}
+	trace.Codigo, trace.ChaveEscolhida, trace.Classificacao, trace.TipoMatch = svc.rastrearContaAtolini(descricao, contasMap, descricaoIndex, classPrefixes, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa(), &trace)
+	return trace, nil
+}
+
+// rastrearContaAtolini é o matcher de resolverContaAtolini; com trace não nulo, registra nele as
+// etapas intermediárias (ExplicarMatch). O resultado não depende de trace.
+func (svc *service) rastrearContaAtolini(texto string, contasMap map[string][]accEntry, descricaoIndex []string, classPrefixes []string, fuzzy bool, minSimilaridade float64, fallback string, trace *domain.ExplicacaoMatch) (code, matchedKey, matchedClass, mtype string) {
 	t := strings.TrimSpace(texto)
 	if t == "" {
-		return "999999"
+		return fallback, "", "", "nao_aplicavel"
 	}
 	descNorm := svc.normalizeText(t)
 	if descNorm == "" {
-		return "999999"
+		return fallback, "", "", "nao_aplicavel"
 	}
 	altNorm := stripLeadingNumberPrefix(descNorm)
+	if trace != nil {
+		trace.TextoNormalizado = descNorm
+		if altNorm != descNorm {
+			trace.TextoAlternativo = altNorm
+		}
+		trace.CodigoInicial = codigoInicial(descNorm)
+		trace.ExataNoPlano = len(contasMap[descNorm]) > 0 || len(contasMap[altNorm]) > 0
+	}
+
+	mtypeSuffix := "_all"
+	if len(classPrefixes) > 0 {
+		mtypeSuffix = "_filtered"
+	}
 
 	// helper: pick best entry from slice applying classPrefixes filter (prefers longest classif)
 	pickBest := func(entries []accEntry, prefixes []string) (accEntry, bool) {
@@ -984,28 +3204,47 @@ func (svc *service) buscarContaAtolini(texto string, contasMap map[string][]accE
 		return candidates[0], true
 	}
 
-	tryKey := func(key string) (string, bool) {
+	tryKey := func(key string) (accEntry, bool) {
 		if key == "" {
-			return "", false
+			return accEntry{}, false
 		}
 		if entries, ok := contasMap[key]; ok && len(entries) > 0 {
 			if be, ok2 := pickBest(entries, classPrefixes); ok2 {
-				return strings.TrimSpace(be.ID), true
+				return be, true
 			}
 		}
-		return "", false
+		return accEntry{}, false
+	}
+
+	// 0) código da conta no início da descrição ("9473 - FORNECEDOR X"), respeitando o filtro
+	if cod := codigoInicial(descNorm); cod != "" {
+		var porCodigo []accEntry
+		for _, k := range descricaoIndex {
+			for _, e := range contasMap[k] {
+				if strings.TrimSpace(e.ID) == cod {
+					porCodigo = append(porCodigo, e)
+				}
+			}
+		}
+		if be, ok := pickBest(porCodigo, classPrefixes); ok {
+			return strings.TrimSpace(be.ID), svc.normalizeText(be.Desc), be.Classif, "codigo" + mtypeSuffix
+		}
 	}
 
 	// 1) exato
-	if code, ok := tryKey(descNorm); ok {
-		return code
+	if be, ok := tryKey(descNorm); ok {
+		return strings.TrimSpace(be.ID), descNorm, be.Classif, "exata" + mtypeSuffix
 	}
 	if altNorm != descNorm {
-		if code, ok := tryKey(altNorm); ok {
-			return code
+		if be, ok := tryKey(altNorm); ok {
+			return strings.TrimSpace(be.ID), altNorm, be.Classif, "exata" + mtypeSuffix
 		}
 	}
 
+	if !fuzzy {
+		return fallback, "", "", "nao_encontrada"
+	}
+
 	// 2) fuzzy: construir candidateKeys aplicando filtro por classPrefixes (se houver)
 	candidateKeys := descricaoIndex
 	if len(classPrefixes) > 0 {
@@ -1027,37 +3266,58 @@ func (svc *service) buscarContaAtolini(texto string, contasMap map[string][]accE
 		} else {
 			// se nenhum chave passou pelo filtro, não fazemos fuzzy entre todos para evitar escolhas fora do filtro
 			// portanto retornamos fallback
-			return "999999"
+			return fallback, "", "", "nao_encontrada"
 		}
 	}
+	if trace != nil {
+		trace.ChavesFiltradas = len(candidateKeys)
+	}
 
 	if len(candidateKeys) > 0 {
-		cm := closestmatch.New(candidateKeys, []int{3, 4, 5})
-		if match := cm.Closest(descNorm); match != "" {
-			if code, ok := tryKey(match); ok {
-				return code
+		cm := fuzzyMatcher(candidateKeys, []int{3, 4, 5}, descNorm, altNorm)
+		if trace != nil {
+			for _, q := range []string{descNorm, altNorm} {
+				for _, k := range cm.ClosestN(q, maxCandidatosExplicacao) {
+					// ClosestN devolve [""] quando nada casa
+					if k != "" && !slices.Contains(trace.CandidatosFuzzy, k) {
+						trace.CandidatosFuzzy = append(trace.CandidatosFuzzy, k)
+					}
+				}
+			}
+		}
+		aceitar := func(query, match string) bool {
+			sim := similaridade(query, match)
+			if trace != nil && sim > trace.Similaridade {
+				trace.Similaridade = sim
+			}
+			return sim >= minSimilaridade
+		}
+		if match := cm.Closest(descNorm); match != "" && aceitar(descNorm, match) {
+			if be, ok := tryKey(match); ok {
+				return strings.TrimSpace(be.ID), match, be.Classif, "fuzzy" + mtypeSuffix
 			}
 		}
 		if altNorm != descNorm {
-			if matchAlt := cm.Closest(altNorm); matchAlt != "" {
-				if code, ok := tryKey(matchAlt); ok {
-					return code
+			if matchAlt := cm.Closest(altNorm); matchAlt != "" && aceitar(altNorm, matchAlt) {
+				if be, ok := tryKey(matchAlt); ok {
+					return strings.TrimSpace(be.ID), matchAlt, be.Classif, "fuzzy" + mtypeSuffix
 				}
 			}
 		}
 	}
 
-	return "999999"
+	return fallback, "", "", "nao_encontrada"
 }
 
 // ---------------------- ATOLINI - UTILITÁRIOS DE DATA E NF ----------------------
 
+var dateRegex1 = regexp.MustCompile(`\b\d{2}/\d{2}/\d{4}\b`)
+var dateRegex2 = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+
 // findDateInRow: tenta reconhecer datas na linha. Para evitar interpretações erradas de números
 // como datas do Excel, restringimos o intervalo de serial aceito.
 // Aceitamos serial Excel entre 35000 (≈1995) e 47000 (≈2028) — evita anos estranhos.
 func (svc *service) findDateInRow(row []string) (string, bool) {
-	dateRegex1 := regexp.MustCompile(`\b\d{2}/\d{2}/\d{4}\b`)
-	dateRegex2 := regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
 	for _, c := range row {
 		clean := strings.TrimSpace(c)
 		if clean == "" {
@@ -1137,6 +3397,35 @@ func (svc *service) findDateInPreviousRows(sheet [][]string, idx int, lookback i
 	return "", false
 }
 
+// ordenarPorData ordena as linhas pela data DD/MM/AAAA de forma estável, preservando a ordem de
+// origem dentro do mesmo dia. Datas que não puderem ser interpretadas vão para o fim.
+func ordenarPorData[T any](rows []T, data func(T) string) {
+	chaves := make([]time.Time, len(rows))
+	validas := make([]bool, len(rows))
+	for i, r := range rows {
+		t, err := time.Parse("02/01/2006", strings.TrimSpace(data(r)))
+		chaves[i], validas[i] = t, err == nil
+	}
+
+	idx := make([]int, len(rows))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ia, ib := idx[a], idx[b]
+		if validas[ia] != validas[ib] {
+			return validas[ia]
+		}
+		return chaves[ia].Before(chaves[ib])
+	})
+
+	ordenadas := make([]T, len(rows))
+	for i, k := range idx {
+		ordenadas[i] = rows[k]
+	}
+	copy(rows, ordenadas)
+}
+
 // loadAtoliniData encapsula a lógica comum de leitura do plano de contas e do
 // arquivo Excel de lançamentos. O carregador de contas é passado como função
 // para permitir reutilização tanto em pagamentos quanto em recebimentos.
@@ -1145,21 +3434,22 @@ func loadAtoliniData[T1 any, T2 any](
 	excelFile io.Reader,
 	contasFile io.Reader,
 	contasLoader func(io.Reader) (T1, T2, error),
-) (T1, T2, [][]string, error) {
+) (T1, T2, [][]string, *ErrosLinhas, error) {
 	var zeroT1 T1
 	var zeroT2 T2
 
 	contasMap, descricaoIndex, err := contasLoader(contasFile)
+	errosLinhas, err := separarErrosLinhas(err)
 	if err != nil {
-		return zeroT1, zeroT2, nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
+		return zeroT1, zeroT2, nil, nil, fmt.Errorf("erro ao carregar arquivo de contas: %w", err)
 	}
 
 	rows, err := svc.loadGenericExcel(excelFile)
 	if err != nil {
-		return zeroT1, zeroT2, nil, fmt.Errorf("erro ao carregar arquivo de lançamentos: %w", err)
+		return zeroT1, zeroT2, nil, nil, fmt.Errorf("erro ao carregar arquivo de lançamentos: %w", err)
 	}
 
-	return contasMap, descricaoIndex, rows, nil
+	return contasMap, descricaoIndex, rows, errosLinhas, nil
 }
 
 // ---------------------- ATOLINI - PAGAMENTOS (processamento) ----------------------
@@ -1177,12 +3467,29 @@ func (svc *service) ProcessAtoliniPagamentos(
 	contasFile io.Reader,
 	debitPrefixes []string,
 	creditPrefixes []string,
-) ([]byte, error) {
-	contasMap, descricaoIndex, rows, err := loadAtoliniData(svc, excelFile, contasFile, svc.lerPlanoContasAtolini)
+	opts Options,
+) (Resultado, error) {
+	return comContagem(opts, func(opts Options) ([]byte, error) {
+		return svc.processarAtoliniPagamentos(excelFile, contasFile, debitPrefixes, creditPrefixes, opts)
+	})
+}
+
+func (svc *service) processarAtoliniPagamentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string, opts Options) ([]byte, error) {
+	if err := validarFormatoColunas(opts, colunasNumericasPagamentos...); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoSaida(opts); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoData(opts); err != nil {
+		return nil, err
+	}
+	contasMap, descricaoIndex, rows, errosLinhas, err := loadAtoliniData(svc, excelFile, contasFile, svc.lerPlanoContasAtolini)
 	if err != nil {
 		return nil, err
 	}
 
+	opts = opts.comRelatorio()
 	out := make([]domain.AtoliniPagamentosOutputRow, 0, len(rows))
 	var blockDate string
 	var blockDateSanitized string
@@ -1190,8 +3497,8 @@ func (svc *service) ProcessAtoliniPagamentos(
 
 	// ---------- caches p/ evitar fuzzy match repetido ----------
 	// chave = UPPER(desc) + "|" + strings.Join(prefixos, ",")
-	debCache := make(map[string]string, 256)
-	credCache := make(map[string]string, 64)
+	debCache := make(map[string]contaMatch, 256)
+	credCache := make(map[string]contaMatch, 64)
 
 	debitKeySuffix := strings.Join(debitPrefixes, ",")
 	creditKeySuffix := strings.Join(creditPrefixes, ",")
@@ -1331,6 +3638,15 @@ func (svc *service) ProcessAtoliniPagamentos(
 
 	valueColumns := [...]int{8, 10, 11, 12, 9}
 
+	// largura mínima para uma linha conter algum valor: linhas mais curtas não passam
+	// por pickValor/pickBanco, evitando sondar colunas que não existem.
+	minValueWidth := valueColumns[0] + 1
+	for _, ci := range valueColumns {
+		if ci+1 < minValueWidth {
+			minValueWidth = ci + 1
+		}
+	}
+
 	// Valor: prioridade coluna I(8); depois vizinhas e J(9) como último recurso.
 	pickValor := func(row []string) (float64, bool) {
 		for _, ci := range valueColumns {
@@ -1338,19 +3654,19 @@ func (svc *service) ProcessAtoliniPagamentos(
 			if v == "" || v == "0,00" {
 				continue
 			}
-			if parsed, err := svc.parseBRLNumber(v); err == nil {
+			if parsed, err := svc.parseNumeroColuna(v, "valor", opts); err == nil {
 				return parsed, true
 			}
 		}
 		return 0, false
 	}
 
-	formatMoney := func(row []string, idx int) string {
+	formatMoney := func(row []string, idx int, coluna string) string {
 		raw := trimmedCell(row, idx)
 		if raw == "" {
 			return ""
 		}
-		if parsed, err := svc.parseBRLNumber(raw); err == nil {
+		if parsed, err := svc.parseNumeroColuna(raw, coluna, opts); err == nil {
 			return svc.formatTwoDecimalsComma(parsed)
 		}
 		return raw
@@ -1368,6 +3684,27 @@ func (svc *service) ProcessAtoliniPagamentos(
 		return "", ""
 	}
 
+	// coluna do documento configurada: índice direto ou aprendida no cabeçalho
+	docCol := -1
+	docHeader := ""
+	if cfg := strings.TrimSpace(opts.ColunaDocumento); cfg != "" {
+		if idx, err := strconv.Atoi(cfg); err == nil && idx >= 0 {
+			docCol = idx
+		} else {
+			docHeader = svc.normalizeText(cfg)
+		}
+	}
+
+	learnDocHeader := func(row []string) bool {
+		for i := range row {
+			if svc.normalizeText(trimmedCell(row, i)) == docHeader {
+				docCol = i
+				return true
+			}
+		}
+		return false
+	}
+
 	extractDoc := func(row []string) string {
 		// célula com 3+ dígitos (barato e suficiente p/ fallback)
 		for i := range row {
@@ -1390,11 +3727,18 @@ func (svc *service) ProcessAtoliniPagamentos(
 
 	// ----------------------- único loop O(n) -----------------------
 	for _, row := range rows {
-		advanceRow(len(row))
+		rowLen := len(row)
+		if isBlankRow(row) {
+			continue
+		}
+		advanceRow(rowLen)
 		// 1) data do bloco (cabeçalho)
 		if updateBlockDateIfHeader(row) {
 			continue
 		}
+		if docHeader != "" && docCol == -1 && learnDocHeader(row) {
+			continue
+		}
 
 		// 2) começo/fim do bloco "Histórico:"
 		if rowHasPrefixN(row, 3, "histórico", "historico") {
@@ -1405,7 +3749,7 @@ func (svc *service) ProcessAtoliniPagamentos(
 			inHistorico = false
 			continue
 		}
-		if !inHistorico || blockDate == "" {
+		if !inHistorico || blockDate == "" || rowLen < minValueWidth {
 			continue
 		}
 
@@ -1418,7 +3762,13 @@ func (svc *service) ProcessAtoliniPagamentos(
 		// 4) descrição (B) + histórico (B + " NF " + D / doc)
 		descDeb := trimmedCell(row, 1) // B
 		hist := descDeb
-		if dcol := trimmedCell(row, 3); dcol != "" { // D
+		if doc := trimmedCell(row, docCol); doc != "" { // coluna configurada
+			if descDeb != "" {
+				hist = descDeb + " NF " + doc
+			} else {
+				hist = " NF " + doc
+			}
+		} else if dcol := trimmedCell(row, 3); dcol != "" { // D
 			if descDeb != "" {
 				hist = descDeb + " NF " + dcol
 			} else {
@@ -1434,75 +3784,180 @@ func (svc *service) ProcessAtoliniPagamentos(
 		// 6) matching com CACHE
 		// NOTA: creditPrefixes = Passivo (2.x.x), debitPrefixes = Ativo (1.x.x)
 		// Para PAGAMENTOS: débito contábil = fornecedor (Passivo), crédito contábil = banco (Ativo)
-		var debID, credID string
+		var deb, cred contaMatch
 
 		if descDeb != "" {
 			debKey := buildCacheKey(upperCell(row, 1), debitKeySuffix)
-			if id, ok := debCache[debKey]; ok {
-				debID = id
+			if m, ok := debCache[debKey]; ok {
+				deb = m
 			} else {
 				// Fornecedor (débito contábil) está no Passivo → usa creditPrefixes
-				debID = svc.buscarContaAtolini(descDeb, contasMap, descricaoIndex, creditPrefixes)
-				debCache[debKey] = debID
+				code, _, classif, mtype := resolverComRelaxamento(creditPrefixes, opts, func(p []string) (string, string, string, string) {
+					return svc.resolverContaAtolini(descDeb, contasMap, descricaoIndex, p, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+				})
+				deb = contaMatch{Code: code, Classif: classif, MType: mtype}
+				opts.relatorio.add(descDeb, code, classif, mtype)
+				debCache[debKey] = deb
 			}
 		}
 
 		if descCred != "" {
 			credKey := buildCacheKey(descCredUpper, creditKeySuffix)
-			if id, ok := credCache[credKey]; ok {
-				credID = id
+			if m, ok := credCache[credKey]; ok {
+				cred = m
 			} else {
 				// Banco (crédito contábil) está no Ativo → usa debitPrefixes
-				credID = svc.buscarContaAtolini(descCred, contasMap, descricaoIndex, debitPrefixes)
-				credCache[credKey] = credID
+				code, _, classif, mtype := resolverComRelaxamento(debitPrefixes, opts, func(p []string) (string, string, string, string) {
+					return svc.resolverContaAtolini(descCred, contasMap, descricaoIndex, p, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+				})
+				cred = contaMatch{Code: code, Classif: classif, MType: mtype}
+				opts.relatorio.add(descCred, code, classif, mtype)
+				credCache[credKey] = cred
 			}
 		}
 
+		opts.naoEncontradas.add(descDeb, deb.MType)
+		opts.naoEncontradas.add(descCred, cred.MType)
 		out = append(out, domain.AtoliniPagamentosOutputRow{
 			Data:              blockDateSanitized,
-			Debito:            sanitizeForCSV(debID),
+			Debito:            sanitizeForCSV(deb.Code),
 			DescricaoConta:    sanitizeForCSV(descDeb),
-			Credito:           sanitizeForCSV(credID),
+			Credito:           sanitizeForCSV(cred.Code),
 			DescricaoCredito:  sanitizeForCSV(descCred),
 			Valor:             sanitizeForCSV(svc.formatTwoDecimalsComma(val)),
 			Historico:         sanitizeForCSV(hist),
-			ValorOriginal:     sanitizeForCSV(formatMoney(row, 7)),
-			ValorPago:         sanitizeForCSV(formatMoney(row, 8)),
-			ValorJuros:        sanitizeForCSV(formatMoney(row, 9)),
-			ValorMulta:        sanitizeForCSV(formatMoney(row, 11)),
-			ValorDesconto:     sanitizeForCSV(formatMoney(row, 12)),
-			ValorDespesas:     sanitizeForCSV(formatMoney(row, 13)),
-			VarCam:            sanitizeForCSV(formatMoney(row, 15)),
-			ValorLiqPagoBanco: sanitizeForCSV(formatMoney(row, 17)),
+			ValorOriginal:     sanitizeForCSV(formatMoney(row, 7, "valor_original")),
+			ValorPago:         sanitizeForCSV(formatMoney(row, 8, "valor_pago")),
+			ValorJuros:        sanitizeForCSV(formatMoney(row, 9, "valor_juros")),
+			ValorMulta:        sanitizeForCSV(formatMoney(row, 11, "valor_multa")),
+			ValorDesconto:     sanitizeForCSV(formatMoney(row, 12, "valor_desconto")),
+			ValorDespesas:     sanitizeForCSV(formatMoney(row, 13, "valor_despesas")),
+			VarCam:            sanitizeForCSV(formatMoney(row, 15, "var_cam")),
+			ValorLiqPagoBanco: sanitizeForCSV(formatMoney(row, 17, "valor_liq_pago_banco")),
+			ClassifDebito:     sanitizeForCSV(deb.Classif),
+			ClassifCredito:    sanitizeForCSV(cred.Classif),
+
+			ContaNaoEncontrada: deb.Code == "" || cred.Code == "" || isContaFallback(deb.MType) || isContaFallback(cred.MType),
+			TipoMatch:          diagnosticoMatch(deb.MType, cred.MType),
 		})
+		if err := checarLimiteLinhas(len(out)); err != nil {
+			return nil, err
+		}
+	}
+
+	errosLinhas = errosLinhas.avisar(avisoPrefixosTrocados(out))
+	naoEncontradas := 0
+	for _, r := range out {
+		if r.ContaNaoEncontrada {
+			naoEncontradas++
+		}
+	}
+	errosLinhas = errosLinhas.avisar(avisoFallback(naoEncontradas, len(out), opts.LimiteFallback, opts.ContaCoringa()))
+	opts.contagem.registrar(len(out), naoEncontradas)
+
+	if opts.OrdenarPorData {
+		ordenarPorData(out, func(r domain.AtoliniPagamentosOutputRow) string { return r.Data })
 	}
 
-	return svc.gerarCSVAtoliniPagamentos(out)
+	if opts.relatorio != nil {
+		return errosLinhas.anexar(opts.relatorio.gerarXLSX())
+	}
+	if opts.Balancete {
+		b := novoBalancete()
+		for _, row := range out {
+			valor, _ := svc.parseBRLNumber(row.Valor)
+			b.lancar(row.Debito, row.Credito, valor)
+		}
+		return errosLinhas.anexar(opts.naoEncontradas.empacotar(b.gerar(opts)))
+	}
+	return errosLinhas.anexar(opts.naoEncontradas.empacotar(svc.gerarCSVAtoliniPagamentos(out, opts)))
 }
 
-func (svc *service) gerarCSVAtoliniPagamentos(rows []domain.AtoliniPagamentosOutputRow) ([]byte, error) {
-	var buffer bytes.Buffer
-	writer := csv.NewWriter(&buffer)
-	writer.Comma = ';'
+// LimiteFallbackPadrao é o Options.LimiteFallback usado quando nenhum é informado.
+const LimiteFallbackPadrao = 30.0
+
+// avisoFallback devolve o aviso de excesso de conta coringa quando naoEncontradas passa de limite
+// por cento das linhas resolvidas pelo matcher, ou "" caso contrário.
+func avisoFallback(naoEncontradas, linhas int, limite float64, conta string) string {
+	if limite <= 0 {
+		limite = LimiteFallbackPadrao
+	}
+	if linhas == 0 || float64(naoEncontradas)*100 <= limite*float64(linhas) {
+		return ""
+	}
+	return fmt.Sprintf("%d de %d linhas (%.0f%%) caíram na conta coringa %s, acima do limite de %.0f%%; "+
+		"confira os prefixos de classificação e se o arquivo de contas é o da empresa",
+		naoEncontradas, linhas, float64(naoEncontradas)*100/float64(linhas), conta, limite)
+}
+
+// Heurística de prefixos trocados no Atolini pagamentos: com pelo menos minLinhasInversao linhas
+// resolvidas, se a fração fracaoInversao ou mais dos débitos cai em bancos (Ativo 1.1.1) e dos
+// créditos em fornecedores (Passivo 2), os filtros debitPrefixes/creditPrefixes provavelmente
+// foram informados invertidos (ver a semântica em ProcessAtoliniPagamentos).
+const (
+	minLinhasInversao = 3
+	fracaoInversao    = 0.8
+)
+
+// avisoPrefixosTrocados devolve o aviso de prefixos trocados, ou "" quando as contas resolvidas
+// têm a natureza esperada. Linhas sem classificação (conta coringa) não entram na conta.
+func avisoPrefixosTrocados(rows []domain.AtoliniPagamentosOutputRow) string {
+	var debitos, debitosBanco, creditos, creditosFornecedor int
+	for _, r := range rows {
+		if r.ClassifDebito != "" {
+			debitos++
+			if strings.HasPrefix(r.ClassifDebito, "1.1.1") {
+				debitosBanco++
+			}
+		}
+		if r.ClassifCredito != "" {
+			creditos++
+			if strings.HasPrefix(r.ClassifCredito, "2") {
+				creditosFornecedor++
+			}
+		}
+	}
+	if debitos < minLinhasInversao || creditos < minLinhasInversao ||
+		float64(debitosBanco) < fracaoInversao*float64(debitos) ||
+		float64(creditosFornecedor) < fracaoInversao*float64(creditos) {
+		return ""
+	}
+	return fmt.Sprintf("possível inversão de prefixos: %d de %d débitos caíram em contas de banco (1.1.1) e %d de %d créditos em fornecedores (2); "+
+		"confira se debitPrefixes (bancos, Ativo) e creditPrefixes (fornecedores, Passivo) não foram trocados",
+		debitosBanco, debitos, creditosFornecedor, creditos)
+}
+
+func (svc *service) gerarCSVAtoliniPagamentos(rows []domain.AtoliniPagamentosOutputRow, opts Options) ([]byte, error) {
+	out := novaSaida(opts, EncodingUTF8, "Valor", "Valor Original", "Valor Pago", "Valor Juros", "Valor Multa",
+		"Valor Desconto", "Valor Despesas", "Var Cam", "Valor Liq Pago Banco")
 
 	header := []string{"Data", "Debito", "Descição conta", "Credito", "Descrição Crédito", "Valor", "histórico", "Valor Original",
-		"Valor Juros", "Valor Multa", "Valor Desconto", "Valor Despesas", "Var Cam", "Valor Liq Pago Banco"}
+		"Valor Pago", "Valor Juros", "Valor Multa", "Valor Desconto", "Valor Despesas", "Var Cam", "Valor Liq Pago Banco"}
+	if opts.IncluirClassificacao {
+		header = append(header, "Classif Debito", "Classif Credito")
+	}
+	if opts.MarcarNaoEncontradas {
+		header = append(header, "Conta Não Encontrada")
+	}
+	if opts.IncluirDiagnostico {
+		header = append(header, "Diagnóstico Match")
+	}
 	for i := range header {
 		header[i] = sanitizeForCSV(header[i])
 	}
-	if err := writer.Write(header); err != nil {
+	if err := out.Write(header); err != nil {
 		return nil, err
 	}
 
 	for _, row := range rows {
 		record := []string{
-			row.Data,
+			opts.formatarData(row.Data),
 			row.Debito,
-			row.DescricaoConta,
+			opts.formatarTexto(row.DescricaoConta),
 			row.Credito,
-			row.DescricaoCredito,
+			opts.formatarTexto(row.DescricaoCredito),
 			row.Valor,
-			row.Historico,
+			opts.formatarTexto(row.Historico),
 			row.ValorOriginal,
 			row.ValorPago,
 			row.ValorJuros,
@@ -1512,13 +3967,21 @@ func (svc *service) gerarCSVAtoliniPagamentos(rows []domain.AtoliniPagamentosOut
 			row.VarCam,
 			row.ValorLiqPagoBanco,
 		}
-		if err := writer.Write(record); err != nil {
+		if opts.IncluirClassificacao {
+			record = append(record, row.ClassifDebito, row.ClassifCredito)
+		}
+		if opts.MarcarNaoEncontradas {
+			record = append(record, flagSN(row.ContaNaoEncontrada))
+		}
+		if opts.IncluirDiagnostico {
+			record = append(record, row.TipoMatch)
+		}
+		if err := out.Write(record); err != nil {
 			return nil, err
 		}
 	}
 
-	writer.Flush()
-	return buffer.Bytes(), writer.Error()
+	return out.gerar()
 }
 
 // ---------------------- ATOLINI - RECEBIMENTOS (mantido/refinado) ----------------------
@@ -1534,35 +3997,28 @@ type ContaEntry struct {
 // - uma lista ordenada de descrições normalizadas (descricaoIndex),
 // - um mapa de descrição normalizada -> lista de entradas (contasMap)
 func (svc *service) lerContasRecebimentos(contasFile io.Reader) ([]string, map[string][]ContaEntry, error) {
-	decoder := charmap.ISO8859_1.NewDecoder()
-	reader := csv.NewReader(transform.NewReader(contasFile, decoder))
-	reader.Comma = ';'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
-
-	records, err := reader.ReadAll()
+	registros, erros, err := lerRegistrosContas(contasFile)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	contasMap := make(map[string][]ContaEntry)
-	order := make([]string, 0, len(records))
+	order := make([]string, 0, len(registros))
 	seen := make(map[string]bool)
 
-	for _, rec := range records {
-		if len(rec) < 3 {
-			continue
-		}
-		code := strings.TrimSpace(rec[0])
-		classif := strings.TrimSpace(rec[1])
-		desc := strings.TrimSpace(rec[2])
+	for _, reg := range registros {
+		code := reg.Code
+		classif := reg.Classif
+		desc := reg.Desc
 
-		if code == "" || desc == "" {
+		if code == "" {
+			erros.descartar(reg, "código da conta vazio")
 			continue
 		}
 
 		descNorm := svc.normalizeText(desc)
 		if descNorm == "" {
+			erros.descartar(reg, "descrição da conta vazia")
 			continue
 		}
 
@@ -1577,19 +4033,32 @@ func (svc *service) lerContasRecebimentos(contasFile io.Reader) ([]string, map[s
 		}
 	}
 
-	return order, contasMap, nil
+	return order, contasMap, erros.err()
 }
 
 // findContaCodigoByDescricao: encontra o código da conta dado uma descrição (texto),
 // usando correspondência exata ou fuzzy, aplicando filtro por classif (prefixos) quando fornecido.
 //
-// Retorna o código encontrado ou "999999" como fallback.
+// Retorna o código encontrado ou ContaFallbackPadrao como fallback.
 func (svc *service) findContaCodigoByDescricao(descricao string, descricaoIndex []string, contasMap map[string][]ContaEntry, classPrefixes []string) string {
+	code, _, _, _ := svc.resolverContaRecebimentos(descricao, descricaoIndex, contasMap, classPrefixes, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+	return code
+}
+
+// resolverContaRecebimentos segue a mesma lógica de findContaCodigoByDescricao, devolvendo também
+// a chave casada, a classificação da conta escolhida e o tipo de match. Com fuzzy falso
+// (Options.SemFuzzy), o que não casar exatamente vai para a conta coringa.
+func (svc *service) resolverContaRecebimentos(descricao string, descricaoIndex []string, contasMap map[string][]ContaEntry, classPrefixes []string, fuzzy bool, minSimilaridade float64, fallback string) (code, matchedKey, matchedClass, mtype string) {
 	if strings.TrimSpace(descricao) == "" {
-		return "999999"
+		return fallback, "", "", "nao_aplicavel"
 	}
 	descNorm := svc.normalizeText(descricao)
 
+	mtypeSuffix := "_all"
+	if len(classPrefixes) > 0 {
+		mtypeSuffix = "_filtered"
+	}
+
 	// Helper: seleciona melhor entry da lista, preferindo classif mais longa (mais específica)
 	pickBestEntry := func(entries []ContaEntry, prefixes []string) (ContaEntry, bool) {
 		// se houver prefixes, filtrar pelas entradas que começam com algum prefixo
@@ -1620,10 +4089,25 @@ func (svc *service) findContaCodigoByDescricao(descricao string, descricaoIndex
 		return candidates[0], true
 	}
 
+	// 0) código da conta no início da descrição ("9473 - FORNECEDOR X"), respeitando o filtro
+	if cod := codigoInicial(descNorm); cod != "" {
+		var porCodigo []ContaEntry
+		for _, k := range descricaoIndex {
+			for _, e := range contasMap[k] {
+				if strings.TrimSpace(e.Code) == cod {
+					porCodigo = append(porCodigo, e)
+				}
+			}
+		}
+		if be, ok := pickBestEntry(porCodigo, classPrefixes); ok {
+			return strings.TrimSpace(be.Code), svc.normalizeText(be.Desc), be.Classf, "codigo" + mtypeSuffix
+		}
+	}
+
 	// 1) tentar match exato
 	if entries, ok := contasMap[descNorm]; ok && len(entries) > 0 {
 		if be, ok2 := pickBestEntry(entries, classPrefixes); ok2 {
-			return strings.TrimSpace(be.Code)
+			return strings.TrimSpace(be.Code), descNorm, be.Classf, "exata" + mtypeSuffix
 		}
 	}
 
@@ -1632,11 +4116,15 @@ func (svc *service) findContaCodigoByDescricao(descricao string, descricaoIndex
 	if alt != descNorm {
 		if entries, ok := contasMap[alt]; ok && len(entries) > 0 {
 			if be, ok2 := pickBestEntry(entries, classPrefixes); ok2 {
-				return strings.TrimSpace(be.Code)
+				return strings.TrimSpace(be.Code), alt, be.Classf, "exata" + mtypeSuffix
 			}
 		}
 	}
 
+	if !fuzzy {
+		return fallback, "", "", "nao_encontrada"
+	}
+
 	// 2) se não encontrou exato, fazer fuzzy entre as chaves candidatas
 	// construir lista de chaves candidato: se houver classPrefixes, filtrar chaves que têm pelo menos uma entry com classif correspondente
 	candidateKeys := descricaoIndex
@@ -1657,27 +4145,27 @@ func (svc *service) findContaCodigoByDescricao(descricao string, descricaoIndex
 		if len(filteredKeys) > 0 {
 			candidateKeys = filteredKeys
 		} else {
-			return "999999"
+			return fallback, "", "", "nao_encontrada"
 		}
 	}
 
 	if len(candidateKeys) > 0 {
-		cm := closestmatch.New(candidateKeys, []int{3, 4, 5})
+		cm := fuzzyMatcher(candidateKeys, []int{3, 4, 5}, descNorm, alt)
 		match := cm.Closest(descNorm)
-		if match != "" {
+		if match != "" && similaridade(descNorm, match) >= minSimilaridade {
 			if entries, ok := contasMap[match]; ok && len(entries) > 0 {
 				if be, ok2 := pickBestEntry(entries, classPrefixes); ok2 {
-					return strings.TrimSpace(be.Code)
+					return strings.TrimSpace(be.Code), match, be.Classf, "fuzzy" + mtypeSuffix
 				}
 			}
 		}
 		// tentativa fuzzy no alt (sem prefixo numérico)
 		if alt != descNorm {
 			match2 := cm.Closest(alt)
-			if match2 != "" {
+			if match2 != "" && similaridade(alt, match2) >= minSimilaridade {
 				if entries, ok := contasMap[match2]; ok && len(entries) > 0 {
 					if be, ok2 := pickBestEntry(entries, classPrefixes); ok2 {
-						return strings.TrimSpace(be.Code)
+						return strings.TrimSpace(be.Code), match2, be.Classf, "fuzzy" + mtypeSuffix
 					}
 				}
 			}
@@ -1685,7 +4173,7 @@ func (svc *service) findContaCodigoByDescricao(descricao string, descricaoIndex
 	}
 
 	// fallback
-	return "999999"
+	return fallback, "", "", "nao_encontrada"
 }
 
 func (svc *service) parseDateDayFirst(s string) (string, bool) {
@@ -1709,6 +4197,7 @@ func (svc *service) parseDateDayFirst(s string) (string, bool) {
 	return "", false
 }
 
+var portadorCodigoRegex = regexp.MustCompile(`^\s*\d+\s*-\s*.+`)
 var recebimentoLancamentoRegex = regexp.MustCompile(`^\s*\d+\s*-\s+.+$`)
 var extractAfterHyphenRegex = regexp.MustCompile(`^\s*\d+\s*-\s*(.*)$`)
 
@@ -1792,19 +4281,30 @@ func cleanPortadorText(s string) string {
 	return strings.TrimSpace(s)
 }
 
+var prefixRegex = regexp.MustCompile(`^\s*\d+\s*[-:]\s*(.*)$`)
+var prefixOnlyNum = regexp.MustCompile(`^\s*\d+\s+(.*)$`)
+
 // stripLeadingNumberPrefix remove prefixos como "123 - " ou "123- " no início da string normalizada
 // Recebe tanto string normal quanto a versao normalizada (por precaucao), e retorna string normalizada se possível.
+// codigoInicial devolve o primeiro token da descrição normalizada quando ele só tem dígitos
+// ("9473 FORNECEDOR X" -> "9473"), para ser comparado aos códigos do plano de contas.
+func codigoInicial(descNorm string) string {
+	token, _, _ := strings.Cut(descNorm, " ")
+	if token == "" || strings.TrimFunc(token, unicode.IsDigit) != "" {
+		return ""
+	}
+	return token
+}
+
 func stripLeadingNumberPrefix(s string) string {
 	if s == "" {
 		return s
 	}
-	// regex para prefixo numérico seguido de - ou :
-	prefixRegex := regexp.MustCompile(`^\s*\d+\s*[-:]\s*(.*)$`)
+	// prefixo numérico seguido de - ou :
 	if m := prefixRegex.FindStringSubmatch(s); len(m) > 1 {
 		return strings.TrimSpace(m[1])
 	}
 	// caso somente número e espaço: "123 RESTANTE..."
-	prefixOnlyNum := regexp.MustCompile(`^\s*\d+\s+(.*)$`)
 	if m := prefixOnlyNum.FindStringSubmatch(s); len(m) > 1 {
 		return strings.TrimSpace(m[1])
 	}
@@ -1892,7 +4392,7 @@ func findLastPortadorBefore(sheet [][]string, idx int, lookback int) (string, bo
 		}
 		// caso a própria linha contenha um "NNN - NOME DO PORTADOR" sem marcador
 		for _, c := range row {
-			if m := regexp.MustCompile(`^\s*\d+\s*-\s*.+`).FindString(c); m != "" {
+			if m := portadorCodigoRegex.FindString(c); m != "" {
 				// interpretar como possível portador (cuidado: pode ser um lançamento)
 				// heurística: se a linha tem poucas colunas não vazias (provável header de portador), aceitar
 				nonEmpty := 0
@@ -1917,11 +4417,33 @@ func findLastPortadorBefore(sheet [][]string, idx int, lookback int) (string, bo
 //   - creditPrefixes: Filtro para contas do PASSIVO (2.x.x) - usado se houver receitas no Passivo
 //
 // Nota: Para recebimentos, tanto débito (banco) quanto crédito (cliente) geralmente estão no Ativo.
-func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string) ([]byte, error) {
-	descricaoIndex, contasMap, rows, err := loadAtoliniData(svc, excelFile, contasFile, svc.lerContasRecebimentos)
+func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string, opts Options) (Resultado, error) {
+	return comContagem(opts, func(opts Options) ([]byte, error) {
+		return svc.processarAtoliniRecebimentos(excelFile, contasFile, debitPrefixes, creditPrefixes, opts)
+	})
+}
+
+func (svc *service) processarAtoliniRecebimentos(excelFile io.Reader, contasFile io.Reader, debitPrefixes []string, creditPrefixes []string, opts Options) ([]byte, error) {
+	switch opts.Modo {
+	case "", ModoPadrao, ModoMultilinha:
+	default:
+		return nil, fmt.Errorf("modo inválido: %s (use %s ou %s)", opts.Modo, ModoPadrao, ModoMultilinha)
+	}
+	if err := validarFormatoColunas(opts, colunasNumericasRecebimentos...); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoSaida(opts); err != nil {
+		return nil, err
+	}
+	if err := validarFormatoData(opts); err != nil {
+		return nil, err
+	}
+
+	descricaoIndex, contasMap, rows, errosLinhas, err := loadAtoliniData(svc, excelFile, contasFile, svc.lerContasRecebimentos)
 	if err != nil {
 		return nil, err
 	}
+	opts = opts.comRelatorio()
 
 	finalRows := make([]domain.AtoliniRecebimentosOutputRow, 0, len(rows))
 
@@ -1929,11 +4451,13 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		blockDate          string
 		blockDateSanitized string
 		currentDescDebito  string
-		currentCodDebito   = "999999"
+		currentCodDebito   = opts.ContaCoringa()
+		currentClsDebito   string
+		currentDebMType    = "nao_aplicavel"
 	)
 
-	debCache := make(map[string]string, 256)
-	credCache := make(map[string]string, 256)
+	debCache := make(map[string]contaMatch, 256)
+	credCache := make(map[string]contaMatch, 256)
 	debitKeySuffix := strings.Join(debitPrefixes, ",")
 	creditKeySuffix := strings.Join(creditPrefixes, ",")
 
@@ -1953,22 +4477,31 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		desc = strings.TrimSpace(desc)
 		if desc == "" {
 			currentDescDebito = ""
-			currentCodDebito = "999999"
+			currentCodDebito = opts.ContaCoringa()
+			currentClsDebito = ""
+			currentDebMType = "nao_aplicavel"
 			return
 		}
 		currentDescDebito = desc
 		upper := strings.ToUpper(desc)
 		key := buildCacheKey(upper, debitKeySuffix)
-		if code, ok := debCache[key]; ok {
-			currentCodDebito = code
+		if m, ok := debCache[key]; ok {
+			currentCodDebito = m.Code
+			currentClsDebito = m.Classif
+			currentDebMType = m.MType
 			return
 		}
-		code := svc.findContaCodigoByDescricao(desc, descricaoIndex, contasMap, debitPrefixes)
+		code, _, classif, mtype := resolverComRelaxamento(debitPrefixes, opts, func(p []string) (string, string, string, string) {
+			return svc.resolverContaRecebimentos(desc, descricaoIndex, contasMap, p, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+		})
 		if code == "" {
-			code = "999999"
+			code = opts.ContaCoringa()
 		}
-		debCache[key] = code
+		opts.relatorio.add(desc, code, classif, mtype)
+		debCache[key] = contaMatch{Code: code, Classif: classif, MType: mtype}
 		currentCodDebito = code
+		currentClsDebito = classif
+		currentDebMType = mtype
 	}
 
 	var (
@@ -2086,37 +4619,43 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 					hints.historico = idx
 				}
 			}
-			if strings.Contains(upper, "VALOR PRINC") || strings.Contains(upper, "VL PRINC") || strings.Contains(upper, "VLR PRINC") {
+			// Colunas de valor: compara o texto normalizado (sem acentos/pontuação), para aceitar
+			// variações como "Vl. Líq. Pago" ou "Desp. Cartório".
+			norm := ""
+			if strings.ContainsFunc(upper, unicode.IsLetter) {
+				norm = svc.normalizeText(upper)
+			}
+			if strings.Contains(norm, "VALOR PRINC") || strings.Contains(norm, "VL PRINC") || strings.Contains(norm, "VLR PRINC") {
 				principalHit = true
 				if hints.valorPrincipal == -1 {
 					hints.valorPrincipal = idx
 				}
 			}
-			if strings.Contains(upper, "JUROS") {
+			if strings.Contains(norm, "JUROS") {
 				jurosHit = true
 				if hints.juros == -1 {
 					hints.juros = idx
 				}
 			}
-			if strings.Contains(upper, "DESCONTO") || strings.Contains(upper, "DESC.") {
+			if strings.Contains(norm, "DESCONTO") || slices.Contains(strings.Fields(norm), "DESC") {
 				descHit = true
 				if hints.desconto == -1 {
 					hints.desconto = idx
 				}
 			}
-			if strings.Contains(upper, "DESP") && strings.Contains(upper, "BANC") {
+			if strings.Contains(norm, "DESP") && strings.Contains(norm, "BANC") {
 				despBcoHit = true
 				if hints.despBanco == -1 {
 					hints.despBanco = idx
 				}
 			}
-			if strings.Contains(upper, "DESP") && strings.Contains(upper, "CART") {
+			if strings.Contains(norm, "DESP") && strings.Contains(norm, "CART") {
 				despCartHit = true
 				if hints.despCartorio == -1 {
 					hints.despCartorio = idx
 				}
 			}
-			if strings.Contains(upper, "VL") && strings.Contains(upper, "LIQ") {
+			if (strings.Contains(norm, "VL") || strings.Contains(norm, "VALOR")) && strings.Contains(norm, "LIQ") {
 				vlLiqHit = true
 				if hints.vlLiqPago == -1 {
 					hints.vlLiqPago = idx
@@ -2193,7 +4732,7 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		return ""
 	}
 
-	parseValueFrom := func(row []string, indices []int) (float64, bool) {
+	parseValueFrom := func(row []string, indices []int, coluna string) (float64, bool) {
 		seen := make(map[int]struct{}, len(indices))
 		for _, idx := range indices {
 			if idx < 0 || idx >= len(row) {
@@ -2207,7 +4746,7 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 			if val == "" {
 				continue
 			}
-			if parsed, err := svc.parseBRLNumber(val); err == nil {
+			if parsed, err := svc.parseNumeroColuna(val, coluna, opts); err == nil {
 				return parsed, true
 			}
 		}
@@ -2245,6 +4784,15 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		return indices
 	}
 
+	// valueCandidates usa somente a coluna detectada pelo cabeçalho; as posições fixas só valem
+	// sem cabeçalho, pois com colunas deslocadas um valor vazio cairia na coluna vizinha.
+	valueCandidates := func(lancIdx, hint int, abs []int, rel []int) []int {
+		if hint >= 0 {
+			return []int{hint}
+		}
+		return buildCandidates(lancIdx, abs, rel)
+	}
+
 	pickDescricaoCredito := func(row []string, lancIdx int) (string, string) {
 		base := stripLeadingNumberPrefix(extractAfterHyphen(trimmedCell(row, lancIdx)))
 		if base == "" {
@@ -2424,7 +4972,9 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 			}
 			if strings.TrimSpace(descDeb) == "" {
 				currentDescDebito = ""
-				currentCodDebito = "999999"
+				currentCodDebito = opts.ContaCoringa()
+				currentClsDebito = ""
+				currentDebMType = "nao_aplicavel"
 			} else {
 				setCurrentDebit(descDeb)
 			}
@@ -2457,20 +5007,29 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		}
 
 		descCredito, descCreditoUpper := pickDescricaoCredito(row, lancIdx)
-		codCredito := "999999"
+		codCredito := opts.ContaCoringa()
+		var clsCredito string
+		credMType := "nao_aplicavel"
 		if descCredito != "" {
 			key := buildCacheKey(descCreditoUpper, creditKeySuffix)
 			if cached, ok := credCache[key]; ok {
-				codCredito = cached
+				codCredito = cached.Code
+				clsCredito = cached.Classif
+				credMType = cached.MType
 			} else {
 				// Cliente (crédito contábil em recebimentos) está no Ativo → usa debitPrefixes
 				// NOTA: Se houver receitas no Passivo, pode precisar usar creditPrefixes
-				code := svc.findContaCodigoByDescricao(descCredito, descricaoIndex, contasMap, debitPrefixes)
+				code, _, classif, mtype := resolverComRelaxamento(debitPrefixes, opts, func(p []string) (string, string, string, string) {
+					return svc.resolverContaRecebimentos(descCredito, descricaoIndex, contasMap, p, !opts.SemFuzzy, opts.LimiarSimilaridade(), opts.ContaCoringa())
+				})
 				if code == "" {
-					code = "999999"
+					code = opts.ContaCoringa()
 				}
-				credCache[key] = code
+				opts.relatorio.add(descCredito, code, classif, mtype)
+				credCache[key] = contaMatch{Code: code, Classif: classif, MType: mtype}
 				codCredito = code
+				clsCredito = classif
+				credMType = mtype
 			}
 		}
 
@@ -2490,20 +5049,22 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 		}
 		historico = sanitizeForCSV(strings.TrimSpace(historico))
 
-		principalCandidates := buildCandidates(lancIdx, []int{hints.valorPrincipal, 12, 11, 13}, []int{12, 11, 13, 10})
-		jurosCandidates := buildCandidates(lancIdx, []int{hints.juros, 13, 12, 14}, []int{13, 12, 14})
-		descontoCandidates := buildCandidates(lancIdx, []int{hints.desconto, 14, 13, 15}, []int{14, 13, 15})
-		despBancoCandidates := buildCandidates(lancIdx, []int{hints.despBanco, 15, 14, 16}, []int{15, 14, 16})
-		despCartCandidates := buildCandidates(lancIdx, []int{hints.despCartorio, 16, 15, 17}, []int{16, 15, 17})
-		liquidoCandidates := buildCandidates(lancIdx, []int{hints.vlLiqPago, 17, 16, 18, 19}, []int{17, 16, 18})
-
-		vPrincipal, _ := parseValueFrom(row, principalCandidates)
-		vJuros, _ := parseValueFrom(row, jurosCandidates)
-		vDesc, _ := parseValueFrom(row, descontoCandidates)
-		vDespBco, _ := parseValueFrom(row, despBancoCandidates)
-		vDespCart, _ := parseValueFrom(row, despCartCandidates)
-		vVlliq, _ := parseValueFrom(row, liquidoCandidates)
-
+		principalCandidates := valueCandidates(lancIdx, hints.valorPrincipal, []int{12, 11, 13}, []int{12, 11, 13, 10})
+		jurosCandidates := valueCandidates(lancIdx, hints.juros, []int{13, 12, 14}, []int{13, 12, 14})
+		descontoCandidates := valueCandidates(lancIdx, hints.desconto, []int{14, 13, 15}, []int{14, 13, 15})
+		despBancoCandidates := valueCandidates(lancIdx, hints.despBanco, []int{15, 14, 16}, []int{15, 14, 16})
+		despCartCandidates := valueCandidates(lancIdx, hints.despCartorio, []int{16, 15, 17}, []int{16, 15, 17})
+		liquidoCandidates := valueCandidates(lancIdx, hints.vlLiqPago, []int{17, 16, 18, 19}, []int{17, 16, 18})
+
+		vPrincipal, _ := parseValueFrom(row, principalCandidates, "valor_principal")
+		vJuros, _ := parseValueFrom(row, jurosCandidates, "juros")
+		vDesc, _ := parseValueFrom(row, descontoCandidates, "desconto")
+		vDespBco, _ := parseValueFrom(row, despBancoCandidates, "desp_banco")
+		vDespCart, _ := parseValueFrom(row, despCartCandidates, "desp_cartorio")
+		vVlliq, _ := parseValueFrom(row, liquidoCandidates, "vl_liq_pago")
+
+		opts.naoEncontradas.add(descCredito, credMType)
+		opts.naoEncontradas.add(currentDescDebito, currentDebMType)
 		finalRows = append(finalRows, domain.AtoliniRecebimentosOutputRow{
 			Data:             sanitizeForCSV(effectiveDateSanitized),
 			DescricaoCredito: sanitizeForCSV(descCredito),
@@ -2517,33 +5078,166 @@ func (svc *service) ProcessAtoliniRecebimentos(excelFile io.Reader, contasFile i
 			DespBanco:        sanitizeForCSV(svc.formatTwoDecimalsComma(vDespBco)),
 			DespCartorio:     sanitizeForCSV(svc.formatTwoDecimalsComma(vDespCart)),
 			VlLiqPago:        sanitizeForCSV(svc.formatTwoDecimalsComma(vVlliq)),
+			ClassifCredito:   sanitizeForCSV(clsCredito),
+			ClassifDebito:    sanitizeForCSV(currentClsDebito),
+			Documento:        sanitizeForCSV(strings.TrimSpace(doc)),
+
+			ContaNaoEncontrada: isContaFallback(credMType) || isContaFallback(currentDebMType),
+			TipoMatch:          diagnosticoMatch(credMType, currentDebMType),
 		})
+		if err := checarLimiteLinhas(len(finalRows)); err != nil {
+			return nil, err
+		}
+	}
+
+	naoEncontradas := 0
+	for _, row := range finalRows {
+		if row.ContaNaoEncontrada {
+			naoEncontradas++
+		}
+	}
+	errosLinhas = errosLinhas.avisar(avisoFallback(naoEncontradas, len(finalRows), opts.LimiteFallback, opts.ContaCoringa()))
+	opts.contagem.registrar(len(finalRows), naoEncontradas)
+
+	if opts.OrdenarPorData {
+		ordenarPorData(finalRows, func(r domain.AtoliniRecebimentosOutputRow) string { return r.Data })
 	}
 
-	return svc.gerarCSVAtoliniRecebimentos(finalRows)
+	if opts.relatorio != nil {
+		return errosLinhas.anexar(opts.relatorio.gerarXLSX())
+	}
+	if opts.Balancete {
+		// os componentes já trazem a partida dobrada de cada valor (principal, juros, ...)
+		b := novoBalancete()
+		for _, row := range svc.expandirComponentesRecebimento(finalRows, opts) {
+			valor, _ := svc.parseBRLNumber(row.Valor)
+			b.lancar(row.ContaDebito, row.ContaCredito, valor)
+		}
+		return errosLinhas.anexar(opts.naoEncontradas.empacotar(b.gerar(opts)))
+	}
+	if opts.Modo == ModoMultilinha {
+		// cada recebimento vira até cinco linhas, uma por componente
+		componentes := svc.expandirComponentesRecebimento(finalRows, opts)
+		if err := checarLimiteLinhas(len(componentes)); err != nil {
+			return nil, err
+		}
+		return errosLinhas.anexar(opts.naoEncontradas.empacotar(svc.gerarCSVAtoliniRecebimentosMultilinha(componentes, opts)))
+	}
+	return errosLinhas.anexar(opts.naoEncontradas.empacotar(svc.gerarCSVAtoliniRecebimentos(finalRows, opts)))
 }
-func (svc *service) gerarCSVAtoliniRecebimentos(rows []domain.AtoliniRecebimentosOutputRow) ([]byte, error) {
-	var buffer bytes.Buffer
-	encoder := charmap.Windows1252.NewEncoder()
-	writer := csv.NewWriter(transform.NewWriter(&buffer, encoder))
-	writer.Comma = ';'
+
+// expandirComponentesRecebimento quebra cada recebimento em uma linha por componente não zerado.
+// Principal e juros entram a débito do portador; desconto baixa o cliente contra a conta de
+// desconto; as despesas saem do portador para as respectivas contas de despesa.
+func (svc *service) expandirComponentesRecebimento(rows []domain.AtoliniRecebimentosOutputRow, opts Options) []domain.AtoliniRecebimentoComponenteRow {
+	contaOuCoringa := func(conta string) string {
+		if c := strings.TrimSpace(conta); c != "" {
+			return c
+		}
+		return opts.ContaCoringa()
+	}
+
+	var out []domain.AtoliniRecebimentoComponenteRow
+	for _, row := range rows {
+		componentes := []struct {
+			nome         string
+			valor        string
+			debito, cred string
+		}{
+			{"PRINCIPAL", row.ValorPrincipal, row.ContaDebito, row.ContaCredito},
+			{"JUROS", row.Juros, row.ContaDebito, contaOuCoringa(opts.ContaJuros)},
+			{"DESCONTO", row.Desconto, contaOuCoringa(opts.ContaDesconto), row.ContaCredito},
+			{"DESP BANCO", row.DespBanco, contaOuCoringa(opts.ContaDespBanco), row.ContaDebito},
+			{"DESP CARTORIO", row.DespCartorio, contaOuCoringa(opts.ContaDespCartorio), row.ContaDebito},
+		}
+		for _, c := range componentes {
+			v, err := svc.parseBRLNumber(c.valor)
+			if err != nil || v == 0 {
+				continue
+			}
+			out = append(out, domain.AtoliniRecebimentoComponenteRow{
+				Data:         row.Data,
+				Documento:    row.Documento,
+				Componente:   c.nome,
+				ContaDebito:  c.debito,
+				ContaCredito: c.cred,
+				Valor:        svc.formatTwoDecimalsComma(math.Abs(v)),
+				Historico:    c.nome + " " + row.Historico,
+
+				ContaNaoEncontrada: row.ContaNaoEncontrada,
+				TipoMatch:          row.TipoMatch,
+			})
+		}
+	}
+	return out
+}
+
+func (svc *service) gerarCSVAtoliniRecebimentosMultilinha(rows []domain.AtoliniRecebimentoComponenteRow, opts Options) ([]byte, error) {
+	out := novaSaida(opts, EncodingCP1252, "Valor")
+
+	header := []string{"Data", "Documento", "Componente", "conta Debito", "conta crédito", "Valor", "Histórico"}
+	if opts.MarcarNaoEncontradas {
+		header = append(header, "Conta Não Encontrada")
+	}
+	if opts.IncluirDiagnostico {
+		header = append(header, "Diagnóstico Match")
+	}
+	if err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		record := []string{
+			sanitizeForCSV(opts.formatarData(row.Data)),
+			sanitizeForCSV(row.Documento),
+			sanitizeForCSV(opts.formatarTexto(row.Componente)),
+			sanitizeForCSV(row.ContaDebito),
+			sanitizeForCSV(row.ContaCredito),
+			sanitizeForCSV(row.Valor),
+			sanitizeForCSV(opts.formatarTexto(row.Historico)),
+		}
+		if opts.MarcarNaoEncontradas {
+			record = append(record, flagSN(row.ContaNaoEncontrada))
+		}
+		if opts.IncluirDiagnostico {
+			record = append(record, row.TipoMatch)
+		}
+		if err := out.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	return out.gerar()
+}
+
+func (svc *service) gerarCSVAtoliniRecebimentos(rows []domain.AtoliniRecebimentosOutputRow, opts Options) ([]byte, error) {
+	out := novaSaida(opts, EncodingCP1252, "valor Principal", "Juros", "Desconto", "Desp Banco", "Desp Cartório", "VlLiq Pago")
 
 	header := []string{"Data", "Descrição Credito", "conta crédito", "Descrição Débito", "conta Debito", "Histórico", "valor Principal", "Juros", "Desconto", "Desp Banco", "Desp Cartório", "VlLiq Pago"}
+	if opts.IncluirClassificacao {
+		header = append(header, "Classif Credito", "Classif Debito")
+	}
+	if opts.MarcarNaoEncontradas {
+		header = append(header, "Conta Não Encontrada")
+	}
+	if opts.IncluirDiagnostico {
+		header = append(header, "Diagnóstico Match")
+	}
 	for i := range header {
 		header[i] = sanitizeForCSV(header[i])
 	}
-	if err := writer.Write(header); err != nil {
+	if err := out.Write(header); err != nil {
 		return nil, err
 	}
 
 	for _, row := range rows {
 		record := []string{
-			sanitizeForCSV(row.Data),
-			sanitizeForCSV(row.DescricaoCredito),
+			sanitizeForCSV(opts.formatarData(row.Data)),
+			sanitizeForCSV(opts.formatarTexto(row.DescricaoCredito)),
 			sanitizeForCSV(row.ContaCredito),
-			sanitizeForCSV(row.DescricaoDebito),
+			sanitizeForCSV(opts.formatarTexto(row.DescricaoDebito)),
 			sanitizeForCSV(row.ContaDebito),
-			sanitizeForCSV(row.Historico),
+			sanitizeForCSV(opts.formatarTexto(row.Historico)),
 			sanitizeForCSV(row.ValorPrincipal),
 			sanitizeForCSV(row.Juros),
 			sanitizeForCSV(row.Desconto),
@@ -2551,11 +5245,19 @@ func (svc *service) gerarCSVAtoliniRecebimentos(rows []domain.AtoliniRecebimento
 			sanitizeForCSV(row.DespCartorio),
 			sanitizeForCSV(row.VlLiqPago),
 		}
-		if err := writer.Write(record); err != nil {
+		if opts.IncluirClassificacao {
+			record = append(record, sanitizeForCSV(row.ClassifCredito), sanitizeForCSV(row.ClassifDebito))
+		}
+		if opts.MarcarNaoEncontradas {
+			record = append(record, flagSN(row.ContaNaoEncontrada))
+		}
+		if opts.IncluirDiagnostico {
+			record = append(record, row.TipoMatch)
+		}
+		if err := out.Write(record); err != nil {
 			return nil, err
 		}
 	}
 
-	writer.Flush()
-	return buffer.Bytes(), writer.Error()
+	return out.gerar()
 }
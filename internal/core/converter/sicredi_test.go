@@ -0,0 +1,1098 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/schollz/closestmatch"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// contasSicrediTeste é um plano de contas mínimo para os testes do conversor Sicredi.
+const contasSicrediTeste = `101;1.1.2.01.001;CLIENTE ALFA LTDA
+102;1.1.2.01.002;CLIENTE BETA SA
+`
+
+// lancamentosSicrediTeste tem dois títulos no dia 05 (clientes diferentes) e um no dia 06.
+const lancamentosSicrediTeste = `Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor
+SIMPLES;D1;B1;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;100,00
+SIMPLES;D2;B2;;CLIENTE BETA SA;01/01/2026;05/01/2026;;50,00
+SIMPLES;D3;B3;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;25,00
+SIMPLES;D4;B4;;CLIENTE BETA SA;02/01/2026;06/01/2026;;10,00
+`
+
+// readCSVCP1252 interpreta a saída em Windows-1252 de um conversor.
+func readCSVCP1252(t *testing.T, data []byte) [][]string {
+	t.Helper()
+	r := csv.NewReader(transform.NewReader(bytes.NewReader(data), charmap.Windows1252.NewDecoder()))
+	r.Comma = ';'
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("Erro ao ler CSV de saída: %v", err)
+	}
+	return records
+}
+
+// TestSicrediAgrupamento verifica a estrutura de débitos/créditos em cada modo de agrupamento.
+func TestSicrediAgrupamento(t *testing.T) {
+	cases := []struct {
+		agrupamento string
+		debitos     []string // valores das linhas D, na ordem
+	}{
+		{"", []string{"175,00", "10,00"}},
+		{AgrupamentoData, []string{"175,00", "10,00"}},
+		{AgrupamentoDataDescricao, []string{"125,00", "50,00", "10,00"}},
+		{AgrupamentoNenhum, []string{"100,00", "50,00", "25,00", "10,00"}},
+	}
+
+	svc := NewService()
+	for _, tc := range cases {
+		t.Run("agrupamento="+tc.agrupamento, func(t *testing.T) {
+			output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+				"lancamentos.csv", nil, Options{Agrupamento: tc.agrupamento})
+			if err != nil {
+				t.Fatalf("Erro ao processar: %v", err)
+			}
+
+			var debitos []string
+			creditos := 0
+			for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+				switch rec[0] {
+				case "D":
+					debitos = append(debitos, rec[4])
+				case "C":
+					creditos++
+				}
+			}
+			if strings.Join(debitos, "|") != strings.Join(tc.debitos, "|") {
+				t.Errorf("Débitos esperados %v, obtidos %v", tc.debitos, debitos)
+			}
+			if creditos != 4 {
+				t.Errorf("Esperava 4 créditos, obteve %d", creditos)
+			}
+		})
+	}
+
+	if _, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, Options{Agrupamento: "semanal"}); err == nil {
+		t.Error("Esperava erro para agrupamento inválido")
+	}
+}
+
+// TestSicrediDebitoPorTitulo garante um débito por crédito, com mesmo valor e data, quando a opção está ativa.
+func TestSicrediDebitoPorTitulo(t *testing.T) {
+	svc := NewService()
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, Options{DebitoPorTitulo: true})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	records := readCSVCP1252(t, output.Saida)[1:]
+	if len(records) != 8 {
+		t.Fatalf("Esperava 4 pares D/C, obteve %d linhas: %v", len(records), records)
+	}
+	for i := 0; i < len(records); i += 2 {
+		deb, cred := records[i], records[i+1]
+		if deb[0] != "D" || cred[0] != "C" {
+			t.Fatalf("Linhas %d/%d deveriam ser D/C: %v / %v", i, i+1, deb, cred)
+		}
+		if deb[1] != cred[1] || deb[4] != cred[4] {
+			t.Errorf("Débito %v não corresponde ao crédito %v (data/valor)", deb, cred)
+		}
+		if strings.Contains(deb[5], "TÍTULOS RECEBIDOS NA DATA") {
+			t.Errorf("Débito não deveria ser consolidado: %v", deb)
+		}
+	}
+}
+
+// TestSicrediFormatoData verifica o layout das datas de saída e a validação de FormatoData.
+func TestSicrediFormatoData(t *testing.T) {
+	cases := []struct {
+		formato string
+		datas   []string // datas das linhas D, na ordem
+	}{
+		{"", []string{"06/01/2026", "07/01/2026"}},
+		{"2006-01-02", []string{"2026-01-06", "2026-01-07"}},
+		{"02012006", []string{"06012026", "07012026"}},
+	}
+
+	svc := NewService()
+	for _, tc := range cases {
+		t.Run("formato="+tc.formato, func(t *testing.T) {
+			output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+				"lancamentos.csv", nil, Options{FormatoData: tc.formato})
+			if err != nil {
+				t.Fatalf("Erro ao processar: %v", err)
+			}
+			var datas []string
+			for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+				if rec[0] == "D" {
+					datas = append(datas, rec[1])
+				}
+			}
+			if strings.Join(datas, "|") != strings.Join(tc.datas, "|") {
+				t.Errorf("Datas esperadas %v, obtidas %v", tc.datas, datas)
+			}
+		})
+	}
+
+	for _, formato := range []string{"2006-01", "DD/MM/AAAA", "02;01;2006"} {
+		if _, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+			"lancamentos.csv", nil, Options{FormatoData: formato}); err == nil {
+			t.Errorf("Esperava erro para o formato de data %q", formato)
+		}
+	}
+}
+
+// TestWarmup garante que o warmup termina sem erro e não altera o resultado da primeira conversão.
+func TestWarmup(t *testing.T) {
+	svc := NewService()
+	if err := svc.Warmup(nil); err != nil {
+		t.Fatalf("Warmup sem contas retornou erro: %v", err)
+	}
+	if err := svc.Warmup(strings.NewReader(contasSicrediTeste)); err != nil {
+		t.Fatalf("Warmup com contas retornou erro: %v", err)
+	}
+
+	lancamentos := "SIMPLES;D1;B1;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;100,00\n"
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contasSicrediTeste), "lancamentos.csv", nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar após warmup: %v", err)
+	}
+	records := readCSVCP1252(t, output.Saida)
+	if len(records) != 3 || records[2][3] != "101" {
+		t.Errorf("Esperava crédito na conta 101, obteve %v", records)
+	}
+}
+
+// TestContasComBOM garante que o BOM de um CSV salvo pelo Excel não contamina a primeira conta.
+func TestContasComBOM(t *testing.T) {
+	svc := &service{}
+	contas := "\xEF\xBB\xBF" + contasSicrediTeste
+
+	entries, keys, err := svc.loadContasSicredi(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "CLIENTE ALFA LTDA" {
+		t.Fatalf("Chaves inesperadas: %v", keys)
+	}
+	if code := entries["CLIENTE ALFA LTDA"][0].Code; code != "101" {
+		t.Errorf("Esperava código 101 na primeira conta, obteve %q", code)
+	}
+}
+
+// TestContasTabulado garante que contas e lançamentos separados por tab (ou vírgula) são lidos
+// como os separados por ';' e geram a mesma conversão.
+func TestContasTabulado(t *testing.T) {
+	svc := NewService().(*service)
+	tsv := func(s string) string { return strings.ReplaceAll(s, ";", "\t") }
+
+	entries, keys, err := svc.loadContasSicredi(strings.NewReader(tsv(contasSicrediTeste)))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas tabuladas: %v", err)
+	}
+	if len(keys) != 2 || entries["CLIENTE BETA SA"][0].Code != "102" || entries["CLIENTE BETA SA"][0].Classif != "1.1.2.01.002" {
+		t.Fatalf("Contas tabuladas lidas errado: %v %+v", keys, entries)
+	}
+
+	esperado, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste), "lancamentos.csv", nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	obtido, err := svc.ProcessSicrediFiles(strings.NewReader(tsv(lancamentosSicrediTeste)), strings.NewReader(tsv(contasSicrediTeste)), "lancamentos.csv", nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar arquivos tabulados: %v", err)
+	}
+	if !bytes.Equal(obtido.Saida, esperado.Saida) {
+		t.Errorf("Conversão tabulada difere da separada por ';':\n%s\n%s", obtido.Saida, esperado.Saida)
+	}
+
+	cases := []struct {
+		nome    string
+		amostra string
+		want    rune
+	}{
+		{"ponto e vírgula com vírgula decimal", "01/01/2026;PIX;1.234,56;C\n", ';'},
+		{"tab com vírgula decimal", "01/01/2026\tPIX\t1.234,56\tC\n", '\t'},
+		{"vírgula", "101,1.1.2.01.001,CLIENTE ALFA\n", ','},
+		{"vírgula entre aspas não conta", "101;1.1.2;\"ALFA, BETA, GAMA\"\n", ';'},
+		{"título sem colunas antes do cabeçalho", "Extrato, janeiro\nA;B;C\n1;2;3\n", ';'},
+		{"vazio", "", ';'},
+	}
+	for _, tc := range cases {
+		if got := detectarDelimitador([]byte(tc.amostra)); got != tc.want {
+			t.Errorf("%s: esperava %q, obteve %q", tc.nome, tc.want, got)
+		}
+	}
+}
+
+// TestMarcarNaoEncontradas garante que a coluna de marcação só vale "S" nas linhas que caíram na conta coringa.
+func TestMarcarNaoEncontradas(t *testing.T) {
+	lancamentos := lancamentosSicrediTeste + "SIMPLES;D5;B5;;CLIENTE SEM CADASTRO;02/01/2026;06/01/2026;;7,00\n"
+
+	svc := NewService()
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, Options{MarcarNaoEncontradas: true})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	records := readCSVCP1252(t, output.Saida)
+	if got := records[0][len(records[0])-1]; got != "Conta Não Encontrada" {
+		t.Fatalf("Coluna de marcação ausente no cabeçalho: %v", records[0])
+	}
+	marcadas := 0
+	for _, rec := range records[1:] {
+		flag := rec[len(rec)-1]
+		naoEncontrada := rec[0] == "C" && rec[2] == "CLIENTE SEM CADASTRO"
+		if naoEncontrada != (flag == "S") {
+			t.Errorf("Marcação incorreta na linha %v", rec)
+		}
+		if flag == "S" {
+			marcadas++
+		}
+	}
+	if marcadas != 1 {
+		t.Errorf("Esperava 1 linha marcada, obteve %d", marcadas)
+	}
+}
+
+// TestSicrediPagamentos verifica que uma saída do extrato vira débito na conta de despesa
+// (filtrada por CreditPrefixes) e crédito no banco, sem afetar o recebimento.
+func TestSicrediPagamentos(t *testing.T) {
+	contas := contasSicrediTeste + "201;3.1.1.01.001;ENERGIA ELETRICA SA\n" + "202;1.1.9.01.001;ENERGIA ELETRICA SA\n"
+	lancamentos := `Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor
+SIMPLES;D1;B1;;CLIENTE ALFA LTDA;01/01/2026;05/01/2026;;100,00
+PAGAMENTO;F1;;;ENERGIA ELETRICA SA;04/01/2026;05/01/2026;;-80,00
+`
+
+	svc := NewService()
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contas),
+		"lancamentos.csv", nil, Options{CreditPrefixes: []string{"3.1"}})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	records := readCSVCP1252(t, output.Saida)[1:]
+	if len(records) != 4 {
+		t.Fatalf("Esperava 2 linhas do recebimento e 2 do pagamento, obteve %v", records)
+	}
+	if records[1][0] != "C" || records[1][3] != "101" || !strings.HasPrefix(records[1][5], "RECEBIMENTO DE") {
+		t.Errorf("Recebimento inesperado: %v", records[1])
+	}
+	deb, cred := records[2], records[3]
+	if deb[0] != "D" || deb[3] != "201" || deb[4] != "80,00" || !strings.HasPrefix(deb[5], "PAGAMENTO A ENERGIA ELETRICA SA") {
+		t.Errorf("Débito do pagamento inesperado: %v", deb)
+	}
+	if cred[0] != "C" || cred[3] != "999999" || cred[4] != "80,00" || cred[1] != "05/01/2026" {
+		t.Errorf("Crédito do pagamento inesperado: %v", cred)
+	}
+}
+
+// TestParseBRLNumberComSufixo cobre as variações de sufixo C/D/CR/DB nos dois modos.
+func TestParseBRLNumberComSufixo(t *testing.T) {
+	svc := &service{}
+	cases := []struct {
+		val  string
+		modo string
+		want float64
+	}{
+		{"1.234,56 D", SufixoSinalDebitoNegativo, -1234.56},
+		{"1.234,56 C", SufixoSinalDebitoNegativo, 1234.56},
+		{"1.234,56DB", SufixoSinalDebitoNegativo, -1234.56},
+		{"1.234,56 cr", SufixoSinalDebitoNegativo, 1234.56},
+		{"R$ 10,00 D.", SufixoSinalDebitoNegativo, -10.00},
+		{"1.234,56 D", SufixoSinalCreditoNegativo, 1234.56},
+		{"1.234,56 C", SufixoSinalCreditoNegativo, -1234.56},
+		{"1.234,56 CR", SufixoSinalCreditoNegativo, -1234.56},
+		{"-5,00 C", SufixoSinalDebitoNegativo, 5.00},
+		{"1.234,56", SufixoSinalDebitoNegativo, 1234.56},
+		{"1.234,56 D", "", 1234.56},
+	}
+	for _, tc := range cases {
+		got, err := svc.parseBRLNumberComSufixo(tc.val, tc.modo)
+		if err != nil {
+			t.Errorf("parseBRLNumberComSufixo(%q, %q) retornou erro: %v", tc.val, tc.modo, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseBRLNumberComSufixo(%q, %q) = %.2f; esperava %.2f", tc.val, tc.modo, got, tc.want)
+		}
+	}
+}
+
+// TestParseBRLNumberSimbolosMoeda cobre valores com marcadores de moeda antes ou depois do
+// número, inclusive com o sinal depois do símbolo, e a troca da lista de símbolos.
+func TestParseBRLNumberSimbolosMoeda(t *testing.T) {
+	svc := &service{}
+	cases := []struct {
+		val  string
+		want float64
+	}{
+		{"R$ 1.234,56", 1234.56},
+		{"R$-10,00", -10.00},
+		{"BRL -1.234,56", -1234.56},
+		{"brl 7,50", 7.50},
+		{"1.234,56 BRL", 1234.56},
+		{"US$ 1,234.56", 1234.56},
+		{"USD -2.50", -2.50},
+		{"R\uff04 99,90", 99.90},
+		{"(R$ 5,00)", -5.00},
+		{"R$\u00a010,00", 10.00},
+	}
+	for _, tc := range cases {
+		got, err := svc.parseBRLNumber(tc.val)
+		if err != nil {
+			t.Errorf("parseBRLNumber(%q) retornou erro: %v", tc.val, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseBRLNumber(%q) = %.2f; esperava %.2f", tc.val, got, tc.want)
+		}
+	}
+
+	SetSimbolosMoeda([]string{"EUR"})
+	defer SetSimbolosMoeda(SimbolosMoedaPadrao)
+	if got, err := svc.parseBRLNumber("EUR -3,00"); err != nil || got != -3.00 {
+		t.Errorf("Com a lista customizada esperava -3,00, obteve %.2f (%v)", got, err)
+	}
+}
+
+// TestSicrediCodificacoesMistas combina lançamentos em UTF-8 com um plano de contas em
+// ISO-8859-1: cada arquivo deve ser decodificado pela própria codificação.
+func TestSicrediCodificacoesMistas(t *testing.T) {
+	contas := "301;1.1.2.01.003;CLIENTE AÇÚCAR E CIA\n"
+	lancamentos := "SIMPLES;D1;B1;;CLIENTE AÇÚCAR E CIA;01/01/2026;05/01/2026;;100,00\n"
+
+	for _, tc := range []struct {
+		nome        string
+		lancamentos string
+		contas      string
+	}{
+		{"lançamentos UTF-8, contas ISO-8859-1", lancamentos, mustLatin1(t, contas)},
+		{"lançamentos ISO-8859-1, contas UTF-8", mustLatin1(t, lancamentos), contas},
+	} {
+		t.Run(tc.nome, func(t *testing.T) {
+			output, err := NewService().ProcessSicrediFiles(strings.NewReader(tc.lancamentos), strings.NewReader(tc.contas),
+				"lancamentos.csv", nil, Options{})
+			if err != nil {
+				t.Fatalf("Erro ao processar: %v", err)
+			}
+			records := readCSVCP1252(t, output.Saida)
+			if len(records) != 3 || records[2][3] != "301" || records[2][2] != "CLIENTE AÇÚCAR E CIA" {
+				t.Errorf("Esperava crédito na conta 301 com descrição acentuada, obteve %v", records)
+			}
+		})
+	}
+}
+
+// mustLatin1 converte um texto UTF-8 para ISO-8859-1.
+func mustLatin1(t *testing.T, s string) string {
+	t.Helper()
+	out, err := charmap.ISO8859_1.NewEncoder().String(s)
+	if err != nil {
+		t.Fatalf("Erro ao codificar: %v", err)
+	}
+	return out
+}
+
+// planoContasSintetico gera n descrições de contas distintas, no formato já normalizado.
+func planoContasSintetico(n int) []string {
+	ramos := []string{"COMERCIO", "INDUSTRIA", "SERVICOS", "TRANSPORTES", "ALIMENTOS", "CONSTRUCOES"}
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("EMPRESA%04d %s LTDA", i, ramos[i%len(ramos)]))
+	}
+	return keys
+}
+
+// TestPreFiltroFuzzyMantemResultado compara o matcher com e sem pré-filtro. Quando o plano de
+// contas do error_case está disponível, ele também é usado.
+func TestPreFiltroFuzzyMantemResultado(t *testing.T) {
+	defer SetPreFiltroFuzzy(false)
+
+	svc := &service{}
+	keys := planoContasSintetico(1000)
+	queries := []string{"EMPRESA0042 COMERCIO LTDA", "EMPRESA0042 COMERCIO", "EMPRESA 0777 SERVICOS", "SEM RELACAO ALGUMA", ""}
+
+	if contasFile, err := os.Open("../../../error_case/contas.csv"); err == nil {
+		_, descricaoIndex, err := svc.lerPlanoContasAtolini(contasFile)
+		contasFile.Close()
+		if err != nil {
+			t.Fatalf("Erro ao ler plano de contas: %v", err)
+		}
+		keys = append(keys, descricaoIndex...)
+		queries = append(queries, svc.normalizeText("INDALTEX COMERCIO E SERVICOS LTDA"), svc.normalizeText("BANCO SICREDI"))
+	}
+
+	for _, q := range queries {
+		SetPreFiltroFuzzy(false)
+		sem := fuzzyMatcher(keys, []int{3, 4, 5}, q).Closest(q)
+		SetPreFiltroFuzzy(true)
+		com := fuzzyMatcher(keys, []int{3, 4, 5}, q).Closest(q)
+		if com != sem {
+			t.Errorf("Query %q: com pré-filtro %q, sem pré-filtro %q", q, com, sem)
+		}
+	}
+
+	if got := filtrarPorPalavras(keys, []string{"EMPRESA0003 TRANSPORTES"}); len(got) != 1 || got[0] != keys[3] {
+		t.Errorf("Pré-filtro deveria manter só %q (TRANSPORTES é comum demais), obteve %v", keys[3], got)
+	}
+}
+
+// BenchmarkFuzzyPreFiltro mede a busca fuzzy num plano de contas grande com e sem pré-filtro,
+// com o índice completo já em cache e com o cache vazio a cada busca (primeira conversão ou
+// conjuntos de chaves sempre diferentes).
+func BenchmarkFuzzyPreFiltro(b *testing.B) {
+	defer SetPreFiltroFuzzy(false)
+	keys := planoContasSintetico(5000)
+	for _, frio := range []bool{false, true} {
+		for _, ativo := range []bool{false, true} {
+			b.Run(fmt.Sprintf("cacheFrio=%v/prefiltro=%v", frio, ativo), func(b *testing.B) {
+				SetPreFiltroFuzzy(ativo)
+				for i := 0; i < b.N; i++ {
+					if frio {
+						fuzzyMatchers.mu.Lock()
+						fuzzyMatchers.items = make(map[uint64]*closestmatch.ClosestMatch)
+						fuzzyMatchers.mu.Unlock()
+					}
+					q := fmt.Sprintf("EMPRESA%04d COMERCIO", i%5000)
+					fuzzyMatcher(keys, []int{3, 4, 5}, q).Closest(q)
+				}
+			})
+		}
+	}
+}
+
+// TestRelatorioMatchesXLSX abre o relatório gerado e confere as abas e uma linha em cada.
+func TestRelatorioMatchesXLSX(t *testing.T) {
+	rel := Options{RelatorioMatches: true}.comRelatorio().relatorio
+	rel.add("CLIENTE ALFA LTDA", "101", "1.1.2.01.001", "exata_all")
+	rel.add("CLIENTE ALFA LTDA", "101", "1.1.2.01.001", "exata_all")
+	rel.add("CLIENTE BETA S A", "102", "1.1.2.01.002", "fuzzy_filtered")
+	rel.add("XPTO QWERTY", "999999", "", "nao_encontrada")
+
+	output, err := rel.gerarXLSX()
+	if err != nil {
+		t.Fatalf("Erro ao gerar relatório: %v", err)
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("Relatório não é um XLSX válido: %v", err)
+	}
+	defer f.Close()
+
+	if abas := strings.Join(f.GetSheetList(), ","); abas != "matched,fuzzy,unmatched" {
+		t.Fatalf("Abas inesperadas: %s", abas)
+	}
+	esperado := map[string]string{
+		"matched":   "CLIENTE ALFA LTDA|101|1.1.2.01.001|exata_all",
+		"fuzzy":     "CLIENTE BETA S A|102|1.1.2.01.002|fuzzy_filtered",
+		"unmatched": "XPTO QWERTY|999999||nao_encontrada",
+	}
+	for aba, linha := range esperado {
+		rows, err := f.GetRows(aba)
+		if err != nil {
+			t.Fatalf("Erro ao ler aba %s: %v", aba, err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("Aba %s: esperava cabeçalho + 1 linha (repetidas entram uma vez), obteve %v", aba, rows)
+		}
+		if got := strings.Join(rows[1], "|"); got != linha {
+			t.Errorf("Aba %s: esperava %q, obteve %q", aba, linha, got)
+		}
+	}
+
+	// pela conversão, a opção troca o CSV pelo relatório
+	output, err = NewService().ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, Options{RelatorioMatches: true})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	f2, err := excelize.OpenReader(bytes.NewReader(output.Saida))
+	if err != nil {
+		t.Fatalf("Saída com RelatorioMatches não é XLSX: %v", err)
+	}
+	defer f2.Close()
+	if rows, _ := f2.GetRows("matched"); len(rows) != 3 {
+		t.Errorf("Esperava os dois clientes na aba matched, obteve %v", rows)
+	}
+}
+
+// TestFuzzyEmpateClassifMaisEspecifica monta duas chaves igualmente próximas da busca e garante
+// que a de classificação mais específica vence sempre, como na busca exata. Closest sozinho
+// escolheria uma delas ao acaso, por isso a busca é repetida.
+func TestFuzzyEmpateClassifMaisEspecifica(t *testing.T) {
+	svc := &service{}
+	contas := "201;1.1.2;CLIENTE 1234 A\n" +
+		"202;1.1.2.01.007;CLIENTE 1234 B\n"
+	sicrediEntries, sicrediKeys, err := svc.loadContasSicredi(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	acisaEntries, acisaKeys, err := svc.loadContasReceitasAcisa(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+
+	query := "CLIENTE 1234"
+	cm := closestmatch.New(sicrediKeys, []int{3, 4})
+	if empatados := closestEmpatados(cm, query); len(empatados) != 2 {
+		t.Fatalf("Esperava as 2 chaves empatadas, obteve %v", empatados)
+	}
+
+	for i := 0; i < 20; i++ {
+		code, key, classif, mtype := svc.matchContaSicredi(query, sicrediEntries, sicrediKeys, nil, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+		if code != "202" || key != "CLIENTE 1234 B" || classif != "1.1.2.01.007" || mtype != "fuzzy_all" {
+			t.Fatalf("Sicredi: esperava 202 (classificação mais específica), obteve %s %q %s %s", code, key, classif, mtype)
+		}
+		code, _, _, mtype = svc.matchContaReceitas(query, acisaEntries, acisaKeys, nil, true, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+		if code != "202" || mtype != "fuzzy_all" {
+			t.Fatalf("ACISA: esperava 202 (classificação mais específica), obteve %s %s", code, mtype)
+		}
+	}
+}
+
+// TestSemFuzzy garante que, com o fuzzy desligado, uma descrição que hoje só casa por
+// aproximação vai para a conta coringa em todos os matchers.
+func TestSemFuzzy(t *testing.T) {
+	svc := &service{}
+	contas := "201;1.1.2.01.006;CLIENTE 1234 A\n"
+	query := "CLIENTE 1234"
+
+	sicrediEntries, sicrediKeys, err := svc.loadContasSicredi(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	acisaEntries, acisaKeys, err := svc.loadContasReceitasAcisa(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	contasMap, descricaoIndex, err := svc.lerPlanoContasAtolini(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	ordemReceb, contasReceb, err := svc.lerContasRecebimentos(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+
+	matchers := map[string]func(fuzzy bool) (string, string){
+		"sicredi": func(fuzzy bool) (string, string) {
+			code, _, _, mtype := svc.matchContaSicredi(query, sicrediEntries, sicrediKeys, nil, fuzzy, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"acisa": func(fuzzy bool) (string, string) {
+			code, _, _, mtype := svc.matchContaReceitas(query, acisaEntries, acisaKeys, nil, fuzzy, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"atolini": func(fuzzy bool) (string, string) {
+			code, _, _, mtype := svc.resolverContaAtolini(query, contasMap, descricaoIndex, nil, fuzzy, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"recebimentos": func(fuzzy bool) (string, string) {
+			code, _, _, mtype := svc.resolverContaRecebimentos(query, ordemReceb, contasReceb, nil, fuzzy, SimilaridadeMinimaPadrao, ContaFallbackPadrao)
+			return code, mtype
+		},
+	}
+	for nome, match := range matchers {
+		if code, mtype := match(true); code != "201" || mtype != "fuzzy_all" {
+			t.Errorf("%s: com fuzzy esperava 201/fuzzy_all, obteve %s/%s", nome, code, mtype)
+		}
+		if code, mtype := match(false); code != "999999" || mtype != "nao_encontrada" {
+			t.Errorf("%s: sem fuzzy esperava a conta coringa, obteve %s/%s", nome, code, mtype)
+		}
+	}
+}
+
+// TestSimilaridadeMinima garante que todos os matchers recusam o candidato do fuzzy abaixo do
+// limiar: "TARIFA 1234" só compartilha o número com "CLIENTE 1234 A" e vai para a conta coringa.
+func TestSimilaridadeMinima(t *testing.T) {
+	svc := &service{}
+	contas := "201;1.1.2.01.006;CLIENTE 1234 A\n"
+
+	sicrediEntries, sicrediKeys, err := svc.loadContasSicredi(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	acisaEntries, acisaKeys, err := svc.loadContasReceitasAcisa(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	contasMap, descricaoIndex, err := svc.lerPlanoContasAtolini(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+	ordemReceb, contasReceb, err := svc.lerContasRecebimentos(strings.NewReader(contas))
+	if err != nil {
+		t.Fatalf("Erro ao carregar contas: %v", err)
+	}
+
+	matchers := map[string]func(query string, limiar float64) (string, string){
+		"sicredi": func(query string, limiar float64) (string, string) {
+			code, _, _, mtype := svc.matchContaSicredi(query, sicrediEntries, sicrediKeys, nil, true, limiar, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"acisa": func(query string, limiar float64) (string, string) {
+			code, _, _, mtype := svc.matchContaReceitas(query, acisaEntries, acisaKeys, nil, true, limiar, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"atolini": func(query string, limiar float64) (string, string) {
+			code, _, _, mtype := svc.resolverContaAtolini(query, contasMap, descricaoIndex, nil, true, limiar, ContaFallbackPadrao)
+			return code, mtype
+		},
+		"recebimentos": func(query string, limiar float64) (string, string) {
+			code, _, _, mtype := svc.resolverContaRecebimentos(query, ordemReceb, contasReceb, nil, true, limiar, ContaFallbackPadrao)
+			return code, mtype
+		},
+	}
+	cases := []struct {
+		query  string
+		limiar float64
+		code   string
+		mtype  string
+	}{
+		{"CLIENTE 1234", SimilaridadeMinimaPadrao, "201", "fuzzy_all"},
+		{"CLIENTE 1234", 90, "999999", "nao_encontrada"},
+		{"TARIFA 1234", SimilaridadeMinimaPadrao, "999999", "nao_encontrada"},
+		{"TARIFA 1234", 1, "201", "fuzzy_all"},
+	}
+	for nome, match := range matchers {
+		for _, tc := range cases {
+			if code, mtype := match(tc.query, tc.limiar); code != tc.code || mtype != tc.mtype {
+				t.Errorf("%s: %q com limiar %.0f%% esperava %s/%s, obteve %s/%s", nome, tc.query, tc.limiar, tc.code, tc.mtype, code, mtype)
+			}
+		}
+	}
+
+	if got := similaridade("CLIENTE 1234", "CLIENTE 1234 A"); math.Abs(got-85.71) > 0.01 {
+		t.Errorf("similaridade: esperava 85,71, obteve %.2f", got)
+	}
+	if got := (Options{}).LimiarSimilaridade(); got != SimilaridadeMinimaPadrao {
+		t.Errorf("LimiarSimilaridade padrão: esperava %.0f, obteve %.0f", SimilaridadeMinimaPadrao, got)
+	}
+}
+
+// TestSicrediNormalizarSaida compara a saída com as descrições acentuadas originais e com
+// NormalizarSaida, que remove só os acentos.
+func TestSicrediNormalizarSaida(t *testing.T) {
+	contas := "101;1.1.2.01.001;JOSÉ AÇÚCAR LTDA\n"
+	lancamentos := "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;JOSÉ AÇÚCAR LTDA;01/01/2026;05/01/2026;;100,00\n"
+
+	svc := NewService()
+	descricoes := func(opts Options) []string {
+		output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contas), "lancamentos.csv", nil, opts)
+		if err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		var textos []string
+		for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+			if rec[0] == "C" {
+				textos = append(textos, rec[2], rec[5])
+			}
+		}
+		return textos
+	}
+
+	original := descricoes(Options{})
+	normalizada := descricoes(Options{NormalizarSaida: true})
+	if len(original) == 0 || len(original) != len(normalizada) {
+		t.Fatalf("Esperava as mesmas linhas C nas duas saídas, obteve %v e %v", original, normalizada)
+	}
+	if !strings.Contains(original[0], "JOSÉ AÇÚCAR") {
+		t.Errorf("Sem a opção a descrição deveria manter os acentos, obteve %q", original[0])
+	}
+	for i := range original {
+		if strings.ContainsAny(normalizada[i], "ÉÇÚ") {
+			t.Errorf("Com a opção não esperava acentos, obteve %q", normalizada[i])
+		}
+	}
+	if !strings.Contains(normalizada[0], "JOSE ACUCAR") {
+		t.Errorf("Esperava a descrição sem acentos, obteve %q", normalizada[0])
+	}
+}
+
+// TestSicrediAvisoFallback garante o aviso quando muitas linhas caem na conta coringa, e só nesse
+// caso, respeitando o limite configurado.
+func TestSicrediAvisoFallback(t *testing.T) {
+	svc := NewService()
+	contasOutraEmpresa := "201;1.1.2.01.001;FORNECEDOR GAMA LTDA\n"
+	processar := func(contas string, opts Options) *ErrosLinhas {
+		opts.SemFuzzy = true
+		_, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentosSicrediTeste), strings.NewReader(contas), "lancamentos.csv", nil, opts)
+		linhas, err := separarErrosLinhas(err)
+		if err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		return linhas
+	}
+
+	if linhas := processar(contasSicrediTeste, Options{}); linhas != nil {
+		t.Errorf("Conversão sem conta coringa não deveria avisar, obteve %v", linhas)
+	}
+	linhas := processar(contasOutraEmpresa, Options{})
+	if linhas == nil || len(linhas.Avisos) != 1 || !strings.Contains(linhas.Avisos[0], "4 de 4 linhas (100%)") {
+		t.Fatalf("Esperava o aviso de conta coringa, obteve %v", linhas)
+	}
+	if linhas := processar(contasOutraEmpresa, Options{LimiteFallback: 100}); linhas != nil {
+		t.Errorf("Com limite de 100%% não esperava aviso, obteve %v", linhas)
+	}
+}
+
+// extratoOFXTeste é um extrato OFX 1.x (SGML, sem tags de fechamento nos campos) com dois
+// recebimentos no dia 05, em horários diferentes, e um pagamento no dia 06.
+const extratoOFXTeste = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+CHARSET:1252
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<BANKTRANLIST>
+<DTSTART>20260101000000[-3:BRT]
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20260105093000[-3:BRT]
+<TRNAMT>100.00
+<FITID>F1
+<MEMO>CLIENTE ALFA LTDA
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20260105174512.000[-3:BRT]
+<TRNAMT>50,00
+<FITID>F2
+<CHECKNUM>D2
+<MEMO>CLIENTE BETA SA
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20260106
+<TRNAMT>-30.00
+<FITID>F3
+<MEMO>CLIENTE ALFA LTDA
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+// TestSicrediOFX garante que o extrato OFX gera os mesmos lançamentos do CSV: recebimentos do
+// mesmo dia agrupados (e lançados no dia seguinte) apesar do horário em DTPOSTED, e valores
+// negativos como pagamentos na própria data.
+func TestSicrediOFX(t *testing.T) {
+	svc := NewService()
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(extratoOFXTeste), strings.NewReader(contasSicrediTeste),
+		"extrato.OFX", nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+
+	var linhas []string
+	for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+		linhas = append(linhas, strings.Join(rec[:5], "|"))
+	}
+	want := []string{
+		"D|06/01/2026||999999|150,00",
+		"C|06/01/2026|CLIENTE ALFA LTDA|101|100,00",
+		"C|06/01/2026|CLIENTE BETA SA|102|50,00",
+		"D|06/01/2026|CLIENTE ALFA LTDA|101|30,00",
+		"C|06/01/2026||999999|30,00",
+	}
+	if strings.Join(linhas, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Saída inesperada:\n%s\nesperava:\n%s", strings.Join(linhas, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := svc.ProcessSicrediFiles(strings.NewReader("<OFX></OFX>"), strings.NewReader(contasSicrediTeste),
+		"vazio.ofx", nil, Options{}); err == nil {
+		t.Error("Esperava erro para OFX sem transações")
+	}
+}
+
+// TestParseDataOFX cobre os tamanhos de data aceitos pelo OFX, com e sem fuso.
+func TestParseDataOFX(t *testing.T) {
+	for _, s := range []string{"20260105", "202601050930", "20260105093000", "20260105093000.123[-3:BRT]"} {
+		d, err := parseDataOFX(s)
+		if err != nil || d.Format("02/01/2006 15:04") != "05/01/2026 00:00" {
+			t.Errorf("parseDataOFX(%q) = %v, %v", s, d, err)
+		}
+	}
+	for _, s := range []string{"", "2026010", "20261305", "05/01/2026"} {
+		if _, err := parseDataOFX(s); err == nil {
+			t.Errorf("parseDataOFX(%q) deveria falhar", s)
+		}
+	}
+}
+
+// registroCNAB monta um registro CNAB240 com os textos informados a partir de cada posição
+// (base 1), preenchido com espaços.
+func registroCNAB(campos map[int]string) string {
+	r := []rune(strings.Repeat(" ", 240))
+	for pos, texto := range campos {
+		copy(r[pos-1:], []rune(texto))
+	}
+	return string(r)
+}
+
+// detalheCNAB monta um detalhe do segmento E com data, valor (em centavos), natureza e histórico.
+func detalheCNAB(data string, centavos int, natureza, historico, documento string) string {
+	return registroCNAB(map[int]string{1: "74800013", 14: "E", 143: data,
+		151: fmt.Sprintf("%018d", centavos), 169: natureza, 177: historico, 202: documento})
+}
+
+// TestCNAB240 garante que os detalhes do segmento E geram os mesmos lançamentos do extrato
+// Sicredi, ignorando os demais registros e segmentos, e que o layout pode ser reposicionado.
+func TestCNAB240(t *testing.T) {
+	cnab := strings.Join([]string{
+		registroCNAB(map[int]string{1: "74800000"}),
+		registroCNAB(map[int]string{1: "74800011"}),
+		detalheCNAB("05012026", 10000, "C", "CLIENTE ALFA LTDA", "D1"),
+		detalheCNAB("05012026", 5000, "C", "CLIENTE BETA SA", "D2"),
+		registroCNAB(map[int]string{1: "74800013", 14: "J", 143: "05012026", 151: "999"}),
+		detalheCNAB("06012026", 3000, "D", "CLIENTE ALFA LTDA", "D3"),
+		registroCNAB(map[int]string{1: "74800015"}),
+		registroCNAB(map[int]string{1: "74899999"}),
+	}, "\r\n")
+
+	svc := NewService()
+	output, err := svc.ProcessCNAB240(strings.NewReader(cnab), strings.NewReader(contasSicrediTeste), nil, Options{})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	var linhas []string
+	for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+		linhas = append(linhas, strings.Join(rec[:5], "|"))
+	}
+	want := []string{
+		"D|06/01/2026||999999|150,00",
+		"C|06/01/2026|CLIENTE ALFA LTDA|101|100,00",
+		"C|06/01/2026|CLIENTE BETA SA|102|50,00",
+		"D|06/01/2026|CLIENTE ALFA LTDA|101|30,00",
+		"C|06/01/2026||999999|30,00",
+	}
+	if strings.Join(linhas, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Saída inesperada:\n%s\nesperava:\n%s", strings.Join(linhas, "\n"), strings.Join(want, "\n"))
+	}
+
+	// layout de outro banco: segmento Z, data em 20-27, valor em 30-44 e histórico em 50-79
+	outro := registroCNAB(map[int]string{1: "00100013", 14: "Z", 20: "07012026", 30: fmt.Sprintf("%015d", 12345),
+		50: "CLIENTE BETA SA"})
+	output, err = svc.ProcessCNAB240(strings.NewReader(outro), strings.NewReader(contasSicrediTeste), nil,
+		Options{LayoutCNAB: "segmento=z; data=20-27; valor=30-44; historico=50-79; natureza=45; documento=80-90"})
+	if err != nil {
+		t.Fatalf("Erro ao processar com layout configurado: %v", err)
+	}
+	records := readCSVCP1252(t, output.Saida)
+	if len(records) != 3 || records[2][2] != "CLIENTE BETA SA" || records[2][3] != "102" || records[2][4] != "123,45" {
+		t.Errorf("Layout configurado: saída inesperada %v", records)
+	}
+
+	for _, layout := range []string{"data=150-140", "valor=1-300", "segmento=EE", "decimais=x", "cor=1-2", "data"} {
+		if _, err := svc.ProcessCNAB240(strings.NewReader(cnab), strings.NewReader(contasSicrediTeste), nil,
+			Options{LayoutCNAB: layout}); err == nil {
+			t.Errorf("Esperava erro para o layout %q", layout)
+		}
+	}
+	if _, err := svc.ProcessCNAB240(strings.NewReader(registroCNAB(map[int]string{1: "74800000"})),
+		strings.NewReader(contasSicrediTeste), nil, Options{}); err == nil {
+		t.Error("Esperava erro para arquivo sem detalhes do segmento")
+	}
+}
+
+// TestContaFallbackConfiguravel garante que a conta coringa informada substitui a "999999" nos
+// matchers, nas contrapartidas bancárias e no aviso de excesso de coringa.
+func TestContaFallbackConfiguravel(t *testing.T) {
+	lancamentos := "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;CLIENTE DESCONHECIDO;01/01/2026;05/01/2026;;100,00\n"
+	opts := Options{ContaFallback: "8888", SemFuzzy: true}
+
+	svc := NewService()
+	output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, opts)
+	var avisos *ErrosLinhas
+	if !errors.As(err, &avisos) || len(avisos.Avisos) != 1 || !strings.Contains(avisos.Avisos[0], "conta coringa 8888") {
+		t.Fatalf("Esperava aviso citando a conta 8888, obteve %v", err)
+	}
+	for _, rec := range readCSVCP1252(t, output.Saida)[1:] {
+		if rec[3] != "8888" {
+			t.Errorf("Sicredi: esperava a conta coringa 8888, obteve %v", rec)
+		}
+	}
+
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR DESCONHECIDO", "1", "30,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	output, err = svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste), nil, nil, opts)
+	if _, err := separarErrosLinhas(err); err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if records := readCSV(t, output.Saida); len(records) != 2 || records[1][1] != "8888" || records[1][3] != "10" {
+		t.Errorf("Atolini: esperava débito na conta 8888 e crédito no banco 10, obteve %v", records)
+	}
+}
+
+// TestIncluirDiagnostico verifica a coluna "Diagnóstico Match" do Sicredi (vazia nos débitos do
+// banco, que não passam pelo matcher) e a combinação dos tipos das linhas com duas contas.
+func TestIncluirDiagnostico(t *testing.T) {
+	contas := "201;1.1.2.01.006;CLIENTE 1234 A\n"
+	lancamentos := "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;CLIENTE 1234 A;01/01/2026;05/01/2026;;100,00\n" +
+		"SIMPLES;D2;B2;;CLIENTE 1234;01/01/2026;05/01/2026;;50,00\n" +
+		"SIMPLES;D3;B3;;ZZZZ QQQQ;01/01/2026;05/01/2026;;10,00\n"
+
+	output, err := NewService().ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contas),
+		"lancamentos.csv", nil, Options{IncluirDiagnostico: true, LimiteFallback: 100})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	records := readCSVCP1252(t, output.Saida)
+	if header := records[0]; header[len(header)-1] != "Diagnóstico Match" {
+		t.Fatalf("Cabeçalho sem a coluna de diagnóstico: %v", header)
+	}
+	var diags []string
+	for _, rec := range records[1:] {
+		diags = append(diags, rec[0]+":"+rec[len(rec)-1])
+	}
+	if got, want := strings.Join(diags, " "), "D: C:exata C:fuzzy C:nao_encontrada"; got != want {
+		t.Errorf("Diagnósticos: esperava %q, obteve %q", want, got)
+	}
+
+	cases := []struct {
+		tipos []string
+		want  string
+	}{
+		{[]string{"exata_filtered", "codigo_all"}, DiagnosticoExata},
+		{[]string{"exata_all", "fuzzy_filtered"}, DiagnosticoFuzzy},
+		{[]string{MatchFuzzyRelaxed}, DiagnosticoFuzzy},
+		{[]string{"fuzzy_all", "nao_aplicavel"}, DiagnosticoNaoEncontrada},
+		{[]string{"nao_encontrada", "exata_all"}, DiagnosticoNaoEncontrada},
+	}
+	for _, tc := range cases {
+		if got := diagnosticoMatch(tc.tipos...); got != tc.want {
+			t.Errorf("diagnosticoMatch(%v) = %q, esperava %q", tc.tipos, got, tc.want)
+		}
+	}
+}
+
+func TestRelatorioNaoEncontradasZIP(t *testing.T) {
+	contas := "201;1.1.2.01.006;CLIENTE 1234 A\n"
+	lancamentos := "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;CLIENTE 1234 A;01/01/2026;05/01/2026;;100,00\n" +
+		"SIMPLES;D2;B2;;ZZZZ QQQQ;01/01/2026;05/01/2026;;10,00\n" +
+		"SIMPLES;D3;B3;;WWWW KKKK;01/01/2026;06/01/2026;;20,00\n" +
+		"SIMPLES;D4;B4;;ZZZZ QQQQ;01/01/2026;06/01/2026;;30,00\n"
+
+	output, err := NewService().ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contas),
+		"lancamentos.csv", nil, Options{RelatorioNaoEncontradas: true, SemFuzzy: true, LimiteFallback: 100})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(output.Saida), int64(len(output.Saida)))
+	if err != nil {
+		t.Fatalf("Saída não é um ZIP: %v", err)
+	}
+	arquivos := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Erro ao abrir %s: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Erro ao ler %s: %v", f.Name, err)
+		}
+		arquivos[f.Name] = data
+	}
+
+	if saida, ok := arquivos[ArquivoSaidaZIP+".csv"]; !ok {
+		t.Fatalf("ZIP sem %s.csv: %v", ArquivoSaidaZIP, zr.File)
+	} else if records := readCSVCP1252(t, saida); len(records) < 5 {
+		t.Errorf("CSV da conversão incompleto: %v", records)
+	}
+	naoEncontradas, ok := arquivos[ArquivoNaoEncontradasZIP]
+	if !ok {
+		t.Fatalf("ZIP sem %s", ArquivoNaoEncontradasZIP)
+	}
+	want := [][]string{{"Descrição", "Ocorrências"}, {"ZZZZ QQQQ", "2"}, {"WWWW KKKK", "1"}}
+	if got := readCSVCP1252(t, naoEncontradas); !reflect.DeepEqual(got, want) {
+		t.Errorf("NaoEncontradas.csv: esperava %v, obteve %v", want, got)
+	}
+
+	// com o relatório de matches a opção é ignorada e a saída continua sendo o XLSX
+	output, err = NewService().ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contas),
+		"lancamentos.csv", nil, Options{RelatorioNaoEncontradas: true, RelatorioMatches: true, LimiteFallback: 100})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if _, err := excelize.OpenReader(bytes.NewReader(output.Saida)); err != nil {
+		t.Errorf("Esperava o relatório XLSX: %v", err)
+	}
+}
+
+// TestEncodingSaida confere a codificação das saídas: o padrão de cada conversor, UTF-8 com BOM
+// no Sicredi e cp1252 no Atolini pagamentos, além da recusa de encodings desconhecidos.
+func TestEncodingSaida(t *testing.T) {
+	svc := NewService()
+	lancamentos := "Tipo;Documento;Boleto;X;Pagador;Vencimento;Liquidacao;Y;Valor\n" +
+		"SIMPLES;D1;B1;;JOSÉ;01/01/2026;05/01/2026;;100,00\n"
+	sicredi := func(opts Options) []byte {
+		t.Helper()
+		opts.LimiteFallback = 100
+		output, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contasSicrediTeste), "lancamentos.csv", nil, opts)
+		if err != nil {
+			t.Fatalf("Erro ao processar: %v", err)
+		}
+		return output.Saida
+	}
+
+	if output.Saida := sicredi(Options{}); !bytes.Contains(output.Saida, []byte("JOS\xc9")) {
+		t.Errorf("Sicredi deveria sair em cp1252 por padrão: %q", output.Saida)
+	}
+	output.Saida := sicredi(Options{Encoding: EncodingUTF8, BOMUTF8: true})
+	if !bytes.HasPrefix(output.Saida, utf8BOM) || !bytes.Contains(output.Saida, []byte("JOSÉ")) {
+		t.Errorf("Esperava UTF-8 com BOM: %q", output.Saida)
+	}
+
+	rows := [][]string{
+		{"Data de pagamento:", "05/01/2026"},
+		{"Histórico: PAGAMENTOS"},
+		pagamentoRow("FORNECEDOR ALFA LTDA", "1234", "150,00", "BANCO SICREDI"),
+		{"Total do histórico"},
+	}
+	output, err := svc.ProcessAtoliniPagamentos(buildXLSX(t, rows), strings.NewReader(contasAtoliniTeste),
+		nil, nil, Options{Encoding: EncodingCP1252})
+	if err != nil {
+		t.Fatalf("Erro ao processar: %v", err)
+	}
+	if utf8.Valid(output.Saida) || !bytes.Contains(output.Saida, []byte("Descri\xe7\xe3o Cr\xe9dito")) {
+		t.Errorf("Atolini pagamentos deveria sair em cp1252: %q", output.Saida)
+	}
+	if records := readCSVCP1252(t, output.Saida); records[0][4] != "Descrição Crédito" {
+		t.Errorf("Cabeçalho em cp1252 mal decodificado: %v", records[0])
+	}
+
+	if _, err := svc.ProcessSicrediFiles(strings.NewReader(lancamentos), strings.NewReader(contasSicrediTeste),
+		"lancamentos.csv", nil, Options{Encoding: "latin1"}); err == nil || !strings.Contains(err.Error(), "encoding de saída inválido") {
+		t.Errorf("Esperava erro de encoding inválido, obteve %v", err)
+	}
+}
@@ -2,7 +2,9 @@
 package domain
 
 import (
+	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"time"
 )
 
@@ -25,8 +27,90 @@ const (
 	StatusNaoEncontradaSPED StatusCode = 2
 	StatusXMLInvalido       StatusCode = 3
 	StatusDiscrepanciaIPIST StatusCode = 4
+	// StatusDiscrepanciaICMSST is only produced by an ICMS analysis that also compares ICMS-ST.
+	StatusDiscrepanciaICMSST StatusCode = 5
+	// StatusDiscrepanciaPISCOFINS is only produced by an ICMS analysis that also compares PIS/COFINS.
+	StatusDiscrepanciaPISCOFINS StatusCode = 6
+	// StatusChaveInvalida marks an XML whose access key fails the check digit, so it is not
+	// reconciled with the SPED.
+	StatusChaveInvalida StatusCode = 7
+	// StatusNotaCancelada marks an XML whose authorization protocol reports a cancellation, so it
+	// is left out of the reconciliation.
+	StatusNotaCancelada StatusCode = 8
+	// StatusCFOPNaoPermitido marks a note whose SPED C190 records use a CFOP outside the
+	// allow-list given to the ICMS analysis.
+	StatusCFOPNaoPermitido StatusCode = 9
+	// StatusSemXML marks a note of the SPED (C100) for which no XML was sent; only produced when
+	// the ICMS analysis is asked to detect missing XMLs.
+	StatusSemXML StatusCode = 10
+	// StatusDiscrepanciaValorTotal is only produced by an ICMS analysis that also compares the
+	// note total (vNF x C100 VL_DOC).
+	StatusDiscrepanciaValorTotal StatusCode = 11
+	// StatusDiscrepanciaCST is only produced by an ICMS analysis that also compares the CST/CSOSN
+	// of the XML items with the C190 CST_ICMS of the SPED.
+	StatusDiscrepanciaCST StatusCode = 12
 )
 
+// String returns the readable name of the status, used as key when results are grouped.
+func (s StatusCode) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusDiscrepanciaICMS:
+		return "discrepancia_icms"
+	case StatusNaoEncontradaSPED:
+		return "nao_encontrada_sped"
+	case StatusXMLInvalido:
+		return "xml_invalido"
+	case StatusDiscrepanciaIPIST:
+		return "discrepancia_ipi_st"
+	case StatusDiscrepanciaICMSST:
+		return "discrepancia_icms_st"
+	case StatusDiscrepanciaPISCOFINS:
+		return "discrepancia_pis_cofins"
+	case StatusChaveInvalida:
+		return "chave_invalida"
+	case StatusNotaCancelada:
+		return "nota_cancelada"
+	case StatusCFOPNaoPermitido:
+		return "cfop_nao_permitido"
+	case StatusSemXML:
+		return "sem_xml"
+	case StatusDiscrepanciaValorTotal:
+		return "discrepancia_valor_total"
+	case StatusDiscrepanciaCST:
+		return "discrepancia_cst"
+	default:
+		return fmt.Sprintf("status_%d", int(s))
+	}
+}
+
+// statusDescricoes are the readable names of the statuses, for API clients and exported files.
+var statusDescricoes = map[StatusCode]string{
+	StatusOK:                     "Conferida",
+	StatusDiscrepanciaICMS:       "Discrepância de ICMS",
+	StatusNaoEncontradaSPED:      "Não encontrada no SPED",
+	StatusXMLInvalido:            "XML inválido",
+	StatusDiscrepanciaIPIST:      "Discrepância de IPI/ST",
+	StatusDiscrepanciaICMSST:     "Discrepância de ICMS-ST",
+	StatusDiscrepanciaPISCOFINS:  "Discrepância de PIS/COFINS",
+	StatusChaveInvalida:          "Chave de acesso inválida",
+	StatusNotaCancelada:          "Nota cancelada",
+	StatusCFOPNaoPermitido:       "CFOP não permitido",
+	StatusSemXML:                 "XML não enviado",
+	StatusDiscrepanciaValorTotal: "Discrepância de valor total",
+	StatusDiscrepanciaCST:        "Discrepância de CST/CSOSN",
+}
+
+// Descricao returns the readable description of the status (e.g. "Discrepância de ICMS"),
+// falling back to String for unknown codes. String stays the stable key used to group results.
+func (s StatusCode) Descricao() string {
+	if d, ok := statusDescricoes[s]; ok {
+		return d
+	}
+	return s.String()
+}
+
 // AnalysisResult is the generic structure for analysis results.
 type AnalysisResult struct {
 	Type       AnalysisType `json:"type"`
@@ -34,14 +118,61 @@ type AnalysisResult struct {
 	StatusCode StatusCode   `json:"status_code"`
 	Alerts     []string     `json:"alerts"`
 	Data       interface{}  `json:"data"`
+	// SourceFile names the uploaded file the note came from, when the caller informed it.
+	SourceFile string `json:"source_file,omitempty"`
+}
+
+// MarshalJSON adds status_descricao (see StatusCode.Descricao) next to status_code, so API
+// clients need no table of their own.
+func (r AnalysisResult) MarshalJSON() ([]byte, error) {
+	type result AnalysisResult // sem o método, para não recursar
+	return json.Marshal(struct {
+		result
+		StatusDescricao string `json:"status_descricao"`
+	}{result(r), r.StatusCode.Descricao()})
 }
 
 // ICMSData holds specific data for ICMS analysis.
 type ICMSData struct {
-	DocNumber string   `json:"doc_number"`
-	IcmsXML   float64  `json:"icms_xml"`
-	IcmsSPED  float64  `json:"icms_sped"`
-	CfopsSPED []string `json:"cfops_sped"`
+	DocNumber string `json:"doc_number"`
+	// IssueDate is the emission date of the XML (YYYY-MM-DD), empty when the XML could not be read.
+	IssueDate string  `json:"issue_date,omitempty"`
+	IcmsXML   float64 `json:"icms_xml"`
+	IcmsSPED  float64 `json:"icms_sped"`
+	// IcmsDifference is |IcmsXML - IcmsSPED|, zero when the note is not in the SPED.
+	IcmsDifference float64  `json:"icms_difference"`
+	CfopsSPED      []string `json:"cfops_sped"`
+	// IcmsByCfop is the SPED ICMS of the note split by C190 CFOP, to locate the source of a
+	// difference when the note has several CFOPs.
+	IcmsByCfop map[string]float64 `json:"icms_by_cfop,omitempty"`
+	// EstablishmentCNPJ is the SPED establishment the note was booked under.
+	EstablishmentCNPJ string `json:"establishment_cnpj,omitempty"`
+	// ItemGroups tells which ICMS group of each XML item was used in IcmsXML, for debugging.
+	ItemGroups []ICMSItemGroup `json:"item_groups,omitempty"`
+	// IcmsStXML (sum of the items' vICMSST) and IcmsStSPED (sum of the C190 VL_ICMS_ST) are
+	// only filled when the analysis also compares ICMS-ST.
+	IcmsStXML  *float64 `json:"icms_st_xml,omitempty"`
+	IcmsStSPED *float64 `json:"icms_st_sped,omitempty"`
+	// PisXML/CofinsXML (sum of the items' vPIS/vCOFINS) and PisSPED/CofinsSPED (C100, or the sum
+	// of the C170 when the C100 is zero) are only filled when the analysis also compares PIS/COFINS.
+	PisXML     *float64 `json:"pis_xml,omitempty"`
+	PisSPED    *float64 `json:"pis_sped,omitempty"`
+	CofinsXML  *float64 `json:"cofins_xml,omitempty"`
+	CofinsSPED *float64 `json:"cofins_sped,omitempty"`
+	// TotalXML (ICMSTot/vNF) and TotalSPED (C100 VL_DOC) are only filled when the analysis also
+	// compares the note total.
+	TotalXML  *float64 `json:"total_xml,omitempty"`
+	TotalSPED *float64 `json:"total_sped,omitempty"`
+	// CstXML (origin + CST/CSOSN of the items) and CstSPED (C190 CST_ICMS) are the distinct codes
+	// of the note, sorted; only filled when the analysis also compares the CST.
+	CstXML  []string `json:"cst_xml,omitempty"`
+	CstSPED []string `json:"cst_sped,omitempty"`
+}
+
+// ICMSItemGroup is the ICMS group used for one item (nItem order, starting at 1) of an NFe.
+type ICMSItemGroup struct {
+	Item  int    `json:"item"`
+	Group string `json:"group"`
 }
 
 // IPISTData holds specific data for IPI/ST analysis.
@@ -52,10 +183,38 @@ type IPISTData struct {
 	IPIValueSPED float64 `json:"ipi_value_sped"`
 }
 
+// XMLValidationResult holds the structural check of a single uploaded XML.
+type XMLValidationResult struct {
+	FileName  string   `json:"file_name"`
+	Valid     bool     `json:"valid"`
+	NFeKey    string   `json:"nfe_key,omitempty"`
+	DocNumber string   `json:"doc_number,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Alerts    []string `json:"alerts,omitempty"`
+}
+
+// CNPJCheck relates the company of the SPED to the issuers and recipients of the uploaded XMLs.
+type CNPJCheck struct {
+	SpedCNPJ     string `json:"sped_cnpj,omitempty"`
+	InferredCNPJ string `json:"inferred_cnpj,omitempty"`
+	Incoming     int    `json:"incoming"` // notes received by the inferred company (entradas)
+	Outgoing     int    `json:"outgoing"` // notes issued by the inferred company (saídas)
+	Warning      string `json:"-"`
+}
+
 // SpedInfo contains information extracted from the SPED file for a specific NFe.
 type SpedInfo struct {
+	CNPJ            string  // establishment (0000, 0140 or C010) the note is booked under
+	IndOper         string  // C100 IND_OPER: "0" entrada, "1" saída
+	NumDoc          string  // C100 NUM_DOC
+	ValorTotal      float64 // C100 VL_DOC
 	Icms            float64
+	IcmsST          float64
+	Pis             float64
+	Cofins          float64
 	Cfops           []string
+	IcmsPorCfop     map[string]float64
+	Csts            []string // distinct C190 CST_ICMS, in file order
 	TemCfopIgnorado bool
 }
 
@@ -70,8 +229,9 @@ type SpedTaxContext struct {
 
 // XMLTaxData stores tax values extracted from a single XML.
 type XMLTaxData struct {
-	STValue  float64
-	IPIValue float64
+	STValue    float64
+	IPIValue   float64
+	SourceFile string
 }
 
 // NFeProc represents the root structure of a processed NFe XML.
@@ -80,7 +240,9 @@ type NFeProc struct {
 	NFe     NFeXML   `xml:"NFe"`
 	ProtNFe struct {
 		InfProt struct {
-			ChNFe string `xml:"chNFe"`
+			ChNFe   string `xml:"chNFe"`
+			CStat   string `xml:"cStat"`
+			XMotivo string `xml:"xMotivo"`
 		} `xml:"infProt"`
 	} `xml:"protNFe"`
 }
@@ -90,6 +252,8 @@ type NFeXML struct {
 	InfNFe struct {
 		ID    string   `xml:"Id,attr"`
 		Ide   IdeXML   `xml:"ide"`
+		Emit  EmitXML  `xml:"emit"`
+		Dest  DestXML  `xml:"dest"`
 		Det   []DetXML `xml:"det"`
 		Total TotalXML `xml:"total"`
 	} `xml:"infNFe"`
@@ -97,7 +261,19 @@ type NFeXML struct {
 
 // IdeXML represents the <ide> node (NFe identification).
 type IdeXML struct {
-	NNF string `xml:"nNF"`
+	NNF   string `xml:"nNF"`
+	DhEmi string `xml:"dhEmi"` // layout 3.10 onwards
+	DEmi  string `xml:"dEmi"`  // layout 2.00
+}
+
+// EmitXML represents the <emit> node (issuer of the NFe).
+type EmitXML struct {
+	CNPJ string `xml:"CNPJ"`
+}
+
+// DestXML represents the <dest> node (recipient of the NFe).
+type DestXML struct {
+	CNPJ string `xml:"CNPJ"`
 }
 
 // TotalXML represents the <total> node with tax totals.
@@ -105,38 +281,139 @@ type TotalXML struct {
 	ICMSTot ICMSTotXML `xml:"ICMSTot"`
 }
 
-// ICMSTotXML represents the <ICMSTot> node with ICMS, ST, and IPI values.
+// ICMSTotXML represents the <ICMSTot> node with ICMS, ST, and IPI values and the note total.
 type ICMSTotXML struct {
 	VST  float64 `xml:"vST"`
 	VIPI float64 `xml:"vIPI"`
+	VNF  float64 `xml:"vNF"`
 }
 
 // DetXML represents the <det> node (product/service details).
 type DetXML struct {
 	Imposto struct {
-		ICMS struct {
-			ICMS00 struct {
-				VICMS string `xml:"vICMS"`
-			} `xml:"ICMS00"`
-			ICMS10 struct {
-				VICMS string `xml:"vICMS"`
-			} `xml:"ICMS10"`
-			ICMS20 struct {
-				VICMS string `xml:"vICMS"`
-			} `xml:"ICMS20"`
-			ICMS70 struct {
-				VICMS string `xml:"vICMS"`
-			} `xml:"ICMS70"`
-			ICMS90 struct {
-				VICMS string `xml:"vICMS"`
-			} `xml:"ICMS90"`
-			ICMSSN101 struct {
-				VCreditICMSSN string `xml:"vCredICMSSN"`
-			} `xml:"ICMSSN101"`
-		} `xml:"ICMS"`
+		ICMS   ICMSXML   `xml:"ICMS"`
+		PIS    PISXML    `xml:"PIS"`
+		COFINS COFINSXML `xml:"COFINS"`
 	} `xml:"imposto"`
 }
 
+// PISXML represents the <PIS> node of an item. PISNT (non-taxed) carries no value.
+type PISXML struct {
+	PISAliq struct {
+		VPIS string `xml:"vPIS"`
+	} `xml:"PISAliq"`
+	PISQtde struct {
+		VPIS string `xml:"vPIS"`
+	} `xml:"PISQtde"`
+	PISOutr struct {
+		VPIS string `xml:"vPIS"`
+	} `xml:"PISOutr"`
+}
+
+// COFINSXML represents the <COFINS> node of an item. COFINSNT (non-taxed) carries no value.
+type COFINSXML struct {
+	COFINSAliq struct {
+		VCOFINS string `xml:"vCOFINS"`
+	} `xml:"COFINSAliq"`
+	COFINSQtde struct {
+		VCOFINS string `xml:"vCOFINS"`
+	} `xml:"COFINSQtde"`
+	COFINSOutr struct {
+		VCOFINS string `xml:"vCOFINS"`
+	} `xml:"COFINSOutr"`
+}
+
+// ICMSXML represents the <ICMS> node of an item, holding one group per CST/CSOSN.
+type ICMSXML struct {
+	ICMS00 struct {
+		ICMSCSTXML
+		VICMS string `xml:"vICMS"`
+	} `xml:"ICMS00"`
+	ICMS10 struct {
+		ICMSCSTXML
+		VICMS   string `xml:"vICMS"`
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMS10"`
+	ICMS20 struct {
+		ICMSCSTXML
+		VICMS string `xml:"vICMS"`
+	} `xml:"ICMS20"`
+	// ICMS30 covers CST 30: exempt or non-taxed operation with ICMS-ST charged.
+	ICMS30 struct {
+		ICMSCSTXML
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMS30"`
+	// ICMS40, ICMS51 and ICMS60 (CST 40/41/50, 51 and 60) are only read for their CST: their
+	// items carry no own ICMS in the total.
+	ICMS40 struct {
+		ICMSCSTXML
+	} `xml:"ICMS40"`
+	ICMS51 struct {
+		ICMSCSTXML
+	} `xml:"ICMS51"`
+	ICMS60 struct {
+		ICMSCSTXML
+	} `xml:"ICMS60"`
+	ICMS70 struct {
+		ICMSCSTXML
+		VICMS   string `xml:"vICMS"`
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMS70"`
+	ICMS90 struct {
+		ICMSCSTXML
+		VICMS   string `xml:"vICMS"`
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMS90"`
+	ICMSSN101 struct {
+		ICMSCSTXML
+		VCreditICMSSN string `xml:"vCredICMSSN"`
+	} `xml:"ICMSSN101"`
+	// ICMSSN201 and ICMSSN202 cover CSOSN 201 and 202/203: Simples Nacional with ICMS-ST charged.
+	ICMSSN201 struct {
+		ICMSCSTXML
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMSSN201"`
+	ICMSSN202 struct {
+		ICMSCSTXML
+		VICMSST string `xml:"vICMSST"`
+	} `xml:"ICMSSN202"`
+	// ICMSSN102 covers CSOSN 102/103/300/400: Simples Nacional with no ICMS value or credit.
+	ICMSSN102 struct {
+		ICMSCSTXML
+	} `xml:"ICMSSN102"`
+	// ICMSSN500 covers CSOSN 500: ICMS-ST charged earlier (vICMSSTRet), with no own-operation ICMS.
+	ICMSSN500 struct {
+		ICMSCSTXML
+		VICMSSTRet string `xml:"vICMSSTRet"`
+	} `xml:"ICMSSN500"`
+	// ICMSSN900 covers CSOSN 900, which may carry own ICMS (vICMS) and/or a credit (vCredICMSSN).
+	ICMSSN900 struct {
+		ICMSCSTXML
+		VICMS         string `xml:"vICMS"`
+		VCreditICMSSN string `xml:"vCredICMSSN"`
+		VICMSST       string `xml:"vICMSST"`
+	} `xml:"ICMSSN900"`
+	// ICMSPart is the ICMS shared between origin and destination states (CST 10/90 with partilha).
+	ICMSPart struct {
+		ICMSCSTXML
+		VICMS string `xml:"vICMS"`
+	} `xml:"ICMSPart"`
+	// ICMSST carries ICMS-ST withheld earlier and passed on (CST 41/60); it has no own-operation ICMS.
+	ICMSST struct {
+		ICMSCSTXML
+		VICMSSTRet  string `xml:"vICMSSTRet"`
+		VICMSSTDest string `xml:"vICMSSTDest"`
+	} `xml:"ICMSST"`
+}
+
+// ICMSCSTXML holds the tax situation shared by every ICMS group: the origin of the goods and
+// the CST (regular regime) or CSOSN (Simples Nacional).
+type ICMSCSTXML struct {
+	Orig  string `xml:"orig"`
+	CST   string `xml:"CST"`
+	CSOSN string `xml:"CSOSN"`
+}
+
 // --- Modelos de Conversor Francesinha ---
 
 // ContaSicredi representa uma entrada do arquivo Contas.csv para o conversor Sicredi.
@@ -149,9 +426,11 @@ type ContaSicredi struct {
 // Lancamento representa uma linha de lançamento do arquivo de entrada.
 type Lancamento struct {
 	DataLiquidacao time.Time
+	Documento      string
 	Descricao      string
 	Valor          float64
 	Historico      string
+	Pagamento      bool // saída (despesa) em vez de recebimento de título
 }
 
 // OutputRow representa uma linha do arquivo CSV de saída.
@@ -162,6 +441,36 @@ type OutputRow struct {
 	ContaCredito     string
 	Valor            string
 	Historico        string
+
+	ContaNaoEncontrada bool
+	TipoMatch          string
+}
+
+// DescricaoNaoEncontrada é uma descrição que os conversores mandaram para a conta coringa,
+// com o número de linhas em que apareceu.
+type DescricaoNaoEncontrada struct {
+	Descricao   string
+	Ocorrencias int
+}
+
+// Titulo representa um título em aberto do arquivo de contas a receber.
+type Titulo struct {
+	Documento  string
+	Pagador    string
+	Vencimento string
+	Valor      float64
+}
+
+// ConciliacaoTituloRow representa uma linha do CSV de conciliação de títulos.
+type ConciliacaoTituloRow struct {
+	Situacao        string
+	Documento       string
+	Pagador         string
+	Vencimento      string
+	ValorTitulo     string
+	DataRecebimento string
+	ValorRecebido   string
+	Diferenca       string
 }
 
 // --- Modelos de Conversor Receitas ACISA ---
@@ -181,6 +490,43 @@ type ReceitasAcisaOutputRow struct {
 	Mensalidade string
 	Pis         string
 	Historico   string
+
+	ContaNaoEncontrada bool
+	TipoMatch          string
+}
+
+// PreviewPlanilha traz as primeiras linhas de uma planilha enviada, como o servidor as leu.
+type PreviewPlanilha struct {
+	Planilha    string     `json:"sheet_name"`
+	Linhas      [][]string `json:"rows"`
+	TotalLinhas int        `json:"total_rows"`
+}
+
+// ExplicacaoMatch é o passo a passo da escolha de conta para uma descrição, para responder
+// "por que X caiu na conta Y?". Os campos do fuzzy só são preenchidos quando a decisão chega
+// até ele.
+type ExplicacaoMatch struct {
+	Descricao        string `json:"description"`
+	TextoNormalizado string `json:"normalized_text"`
+	// TextoAlternativo é o texto normalizado sem o número inicial, tentado depois do original.
+	TextoAlternativo string   `json:"alt_text,omitempty"`
+	Prefixos         []string `json:"prefixes,omitempty"`
+	// CodigoInicial é o código de conta lido do início da descrição, se houver.
+	CodigoInicial string `json:"leading_code,omitempty"`
+	// ExataNoPlano indica que o texto (ou o alternativo) é descrição de alguma conta do plano,
+	// mesmo que nenhuma delas passe pelo filtro de prefixos.
+	ExataNoPlano bool `json:"exact_hit"`
+	// ChavesFiltradas é o número de descrições do plano que passaram pelo filtro de prefixos e
+	// entraram no fuzzy.
+	ChavesFiltradas int      `json:"filtered_candidates"`
+	CandidatosFuzzy []string `json:"fuzzy_candidates,omitempty"`
+	// Similaridade é a maior similaridade (0 a 100) entre o texto e a chave devolvida pelo
+	// fuzzy; abaixo do limiar da conversão o match é recusado.
+	Similaridade   float64 `json:"similarity,omitempty"`
+	ChaveEscolhida string  `json:"chosen_key,omitempty"`
+	Classificacao  string  `json:"classif,omitempty"`
+	TipoMatch      string  `json:"match_type"`
+	Codigo         string  `json:"code"`
 }
 
 // --- Modelos de Conversores Atolini ---
@@ -209,6 +555,11 @@ type AtoliniPagamentosOutputRow struct {
 	ValorDespesas     string
 	VarCam            string
 	ValorLiqPagoBanco string
+	ClassifDebito     string
+	ClassifCredito    string
+
+	ContaNaoEncontrada bool
+	TipoMatch          string
 }
 
 // AtoliniRecebimentosOutputRow representa uma linha do CSV de saída para Atolini Recebimentos.
@@ -225,4 +576,25 @@ type AtoliniRecebimentosOutputRow struct {
 	DespBanco        string
 	DespCartorio     string
 	VlLiqPago        string
+	ClassifCredito   string
+	ClassifDebito    string
+	Documento        string
+
+	ContaNaoEncontrada bool
+	TipoMatch          string
+}
+
+// AtoliniRecebimentoComponenteRow representa uma linha do CSV de recebimentos no modo
+// multilinha: um componente de valor (principal, juros, ...) com as próprias contas.
+type AtoliniRecebimentoComponenteRow struct {
+	Data         string
+	Documento    string
+	Componente   string
+	ContaDebito  string
+	ContaCredito string
+	Valor        string
+	Historico    string
+
+	ContaNaoEncontrada bool
+	TipoMatch          string
 }
@@ -0,0 +1,110 @@
+// internal/logging/logging.go
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Config defines the verbosity and output format of the application logger.
+type Config struct {
+	Level  string // debug, info, warn ou error
+	Format string // text ou json
+}
+
+var (
+	logger = zap.NewNop()
+	sugar  = logger.Sugar()
+)
+
+// ConfigFromEnv reads LOG_LEVEL and LOG_FORMAT, defaulting to info/json.
+func ConfigFromEnv() Config {
+	cfg := Config{Level: os.Getenv("LOG_LEVEL"), Format: os.Getenv("LOG_FORMAT")}
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+	if cfg.Format == "" {
+		cfg.Format = "json"
+	}
+	return cfg
+}
+
+// New builds a logger for the given configuration writing to out.
+func New(cfg Config, out io.Writer) (*zap.Logger, error) {
+	var level zapcore.Level
+	switch strings.ToLower(strings.TrimSpace(cfg.Level)) {
+	case "debug":
+		level = zapcore.DebugLevel
+	case "", "info":
+		level = zapcore.InfoLevel
+	case "warn", "warning":
+		level = zapcore.WarnLevel
+	case "error":
+		level = zapcore.ErrorLevel
+	default:
+		return nil, fmt.Errorf("LOG_LEVEL inválido: %s (use debug, info, warn ou error)", cfg.Level)
+	}
+
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	switch strings.ToLower(strings.TrimSpace(cfg.Format)) {
+	case "", "json":
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	case "text":
+		encoderCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderCfg)
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT inválido: %s (use text ou json)", cfg.Format)
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.AddSync(out), level)
+	return zap.New(core), nil
+}
+
+// Init configures the global logger used by the whole application.
+func Init(cfg Config) error {
+	l, err := New(cfg, os.Stdout)
+	if err != nil {
+		return err
+	}
+	logger = l
+	sugar = l.Sugar()
+	return nil
+}
+
+// L returns the global structured logger.
+func L() *zap.Logger {
+	return logger
+}
+
+// Debugf logs a formatted message at debug level.
+func Debugf(format string, args ...interface{}) {
+	sugar.Debugf(format, args...)
+}
+
+// Infof logs a formatted message at info level.
+func Infof(format string, args ...interface{}) {
+	sugar.Infof(format, args...)
+}
+
+// Warnf logs a formatted message at warn level.
+func Warnf(format string, args ...interface{}) {
+	sugar.Warnf(format, args...)
+}
+
+// Errorf logs a formatted message at error level.
+func Errorf(format string, args ...interface{}) {
+	sugar.Errorf(format, args...)
+}
+
+// Fatalf logs a formatted message and terminates the process.
+func Fatalf(format string, args ...interface{}) {
+	sugar.Fatalf(format, args...)
+}
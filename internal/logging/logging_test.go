@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestDebugSuprimidoEmNivelInfo garante que mensagens de debug não são emitidas no nível info.
+func TestDebugSuprimidoEmNivelInfo(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(Config{Level: "info", Format: "json"}, &buf)
+	if err != nil {
+		t.Fatalf("Erro ao criar logger: %v", err)
+	}
+
+	l.Sugar().Debugf("mensagem de debug %d", 1)
+	l.Sugar().Infof("mensagem de info %d", 2)
+	l.Sync()
+
+	out := buf.String()
+	if strings.Contains(out, "mensagem de debug") {
+		t.Errorf("Debug não deveria ser emitido em nível info: %s", out)
+	}
+	if !strings.Contains(out, "mensagem de info 2") {
+		t.Errorf("Info deveria ser emitido: %s", out)
+	}
+}
+
+// TestConfigInvalida garante que nível e formato desconhecidos são rejeitados.
+func TestConfigInvalida(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := New(Config{Level: "verbose", Format: "json"}, &buf); err == nil {
+		t.Error("Esperava erro para LOG_LEVEL inválido")
+	}
+	if _, err := New(Config{Level: "info", Format: "xml"}, &buf); err == nil {
+		t.Error("Esperava erro para LOG_FORMAT inválido")
+	}
+}
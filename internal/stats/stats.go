@@ -0,0 +1,68 @@
+// internal/stats/stats.go
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters keeps cumulative usage counts since the process started.
+type Counters interface {
+	IncAnalysis()
+	IncConversion(kind string)
+	AddDiscrepancies(n int)
+	Snapshot() Snapshot
+}
+
+// Snapshot is a point-in-time copy of the counters, as exposed by GET /stats.
+type Snapshot struct {
+	Analyses      int64            `json:"analyses"`
+	Conversions   map[string]int64 `json:"conversions"`
+	Discrepancies int64            `json:"discrepancies"`
+	StartedAt     time.Time        `json:"started_at"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+}
+
+type counters struct {
+	startedAt     time.Time
+	analyses      atomic.Int64
+	discrepancies atomic.Int64
+	conversions   sync.Map // kind -> *atomic.Int64
+}
+
+// New creates an in-memory, concurrency-safe set of counters.
+func New() Counters {
+	return &counters{startedAt: time.Now()}
+}
+
+func (c *counters) IncAnalysis() {
+	c.analyses.Add(1)
+}
+
+func (c *counters) IncConversion(kind string) {
+	v, _ := c.conversions.LoadOrStore(kind, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+}
+
+func (c *counters) AddDiscrepancies(n int) {
+	if n > 0 {
+		c.discrepancies.Add(int64(n))
+	}
+}
+
+func (c *counters) Snapshot() Snapshot {
+	conversions := make(map[string]int64)
+	c.conversions.Range(func(k, v interface{}) bool {
+		conversions[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+
+	return Snapshot{
+		Analyses:      c.analyses.Load(),
+		Conversions:   conversions,
+		Discrepancies: c.discrepancies.Load(),
+		StartedAt:     c.startedAt,
+		UptimeSeconds: int64(time.Since(c.startedAt).Seconds()),
+	}
+}
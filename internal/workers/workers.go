@@ -0,0 +1,61 @@
+// internal/workers/workers.go
+package workers
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EnvPoolSize is the environment variable that sizes the worker pools of the services.
+const EnvPoolSize = "WORKER_POOL_SIZE"
+
+// DefaultSize is the pool size used when WORKER_POOL_SIZE is not set: one worker per usable CPU.
+func DefaultSize() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// SizeFromEnv reads WORKER_POOL_SIZE, falling back to DefaultSize when it is empty.
+// Values that are not positive integers are rejected.
+func SizeFromEnv() (int, error) {
+	raw := strings.TrimSpace(os.Getenv(EnvPoolSize))
+	if raw == "" {
+		return DefaultSize(), nil
+	}
+	size, err := strconv.Atoi(raw)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("%s inválido: %s (use um inteiro positivo)", EnvPoolSize, raw)
+	}
+	return size, nil
+}
+
+// Each calls fn(i) for every i in [0, n) using at most size goroutines at a time, and returns
+// once all calls are done. A size below 1 runs the calls one at a time.
+func Each(size, n int, fn func(i int)) {
+	if size < 1 {
+		size = 1
+	}
+	if size > n {
+		size = n
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(size)
+	for w := 0; w < size; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
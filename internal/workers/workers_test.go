@@ -0,0 +1,64 @@
+package workers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSizeFromEnv cobre o valor padrão, um valor válido e valores rejeitados.
+func TestSizeFromEnv(t *testing.T) {
+	t.Setenv(EnvPoolSize, "")
+	if size, err := SizeFromEnv(); err != nil || size != DefaultSize() {
+		t.Errorf("Sem a variável esperava %d, obteve %d (%v)", DefaultSize(), size, err)
+	}
+
+	t.Setenv(EnvPoolSize, " 3 ")
+	if size, err := SizeFromEnv(); err != nil || size != 3 {
+		t.Errorf("Esperava 3, obteve %d (%v)", size, err)
+	}
+
+	for _, invalido := range []string{"0", "-2", "muitos"} {
+		t.Setenv(EnvPoolSize, invalido)
+		if _, err := SizeFromEnv(); err == nil {
+			t.Errorf("Esperava erro para %s=%q", EnvPoolSize, invalido)
+		}
+	}
+}
+
+// TestEachRespeitaTamanho garante que todos os índices são processados uma vez e que nunca há
+// mais chamadas simultâneas do que o tamanho do pool.
+func TestEachRespeitaTamanho(t *testing.T) {
+	var ativos, maxAtivos atomic.Int64
+	var mu sync.Mutex
+	vistos := make(map[int]int)
+
+	Each(3, 20, func(i int) {
+		n := ativos.Add(1)
+		for {
+			m := maxAtivos.Load()
+			if n <= m || maxAtivos.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		ativos.Add(-1)
+
+		mu.Lock()
+		vistos[i]++
+		mu.Unlock()
+	})
+
+	if len(vistos) != 20 {
+		t.Errorf("Esperava 20 índices processados, obteve %d", len(vistos))
+	}
+	for i, n := range vistos {
+		if n != 1 {
+			t.Errorf("Índice %d processado %d vezes", i, n)
+		}
+	}
+	if got := maxAtivos.Load(); got > 3 || got < 2 {
+		t.Errorf("Esperava até 3 chamadas simultâneas (e paralelismo real), obteve %d", got)
+	}
+}